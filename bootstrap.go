@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// ExecBootstrap runs p2p as a bootstrap node for private installations.
+// Connections are encrypted when certificate and key are specified
+func ExecBootstrap(listen, cert, key, clientCA, logLevel string) {
+	ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Initializing P2P Bootstrap")
+	if logLevel == "" {
+		ptp.SetMinLogLevelString(DefaultLog)
+	} else {
+		ptp.SetMinLogLevelString(logLevel)
+	}
+
+	server := ptp.NewBootstrapServer(AppVersion)
+	if cert != "" || key != "" {
+		config, err := ptp.ServerTLSConfig(cert, key, clientCA)
+		if err != nil {
+			ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Failed to configure TLS: %s", err)
+			os.Exit(1)
+		}
+		server.TLS = config
+	} else if clientCA != "" {
+		fmt.Println("Client certificates can't be verified without TLS: specify -cert and -key")
+		os.Exit(1)
+	} else {
+		ptp.LogWith(ptp.Warning, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Certificate is not specified: bootstrap traffic is not encrypted")
+	}
+	err := server.Listen(listen)
+	if err != nil {
+		ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Failed to start bootstrap node: %s", err)
+		os.Exit(1)
+	}
+	ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Bootstrap node is listening on %s", server.Addr())
+
+	SignalChannel = make(chan os.Signal, 1)
+	signal.Notify(SignalChannel, os.Interrupt)
+	go func() {
+		for sig := range SignalChannel {
+			fmt.Println("Received signal: ", sig)
+			server.Close()
+		}
+	}()
+	server.Run()
+}
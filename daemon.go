@@ -22,6 +22,7 @@ var (
 // p2p behaviour
 type DaemonArgs struct {
 	IP         string `json:"ip"`
+	IPv6       string `json:"ipv6"`
 	Mac        string `json:"mac"`
 	Dev        string `json:"dev"`
 	Hash       string `json:"hash"`
@@ -31,18 +32,29 @@ type DaemonArgs struct {
 	TTL        string `json:"ttl"`
 	Fwd        bool   `json:"fwd"`
 	Port       int    `json:"port"`
+	VLAN       int    `json:"vlan"`
+	Trunk      string `json:"trunk"`
+	Static     string `json:"static"`
+	Invite     string `json:"invite"`
+	SingleUse  bool   `json:"single_use"` // invite only
 	Interfaces bool   `json:"interfaces"` // show only
 	All        bool   `json:"all"`        // show only
 	Command    string `json:"command"`
 	Args       string `json:"args"`
 	Log        string `json:"log"`
+	Subsystem  string `json:"subsystem"` // set log only
 	Bind       bool   `json:"bind"`
 	MTU        bool   `json:"mtu"`
+	Keys       bool   `json:"keys"` // show only
+	ACL        bool   `json:"acl"`  // show only
 }
 
 var bootstrap DHTConnection
 var UsePMTU bool
 
+// daemonConf is a configuration loaded at daemon startup
+var daemonConf *ptp.Conf
+
 func processConfigFile(configFile string) (*ptp.Conf, error) {
 	if configFile == "" {
 		return nil, fmt.Errorf("no config file provided")
@@ -74,8 +86,24 @@ func configureMTU(conf *ptp.Conf, mtu int, pmtu bool) {
 	}
 }
 
+func configureMulticast(conf *ptp.Conf) {
+	if conf == nil {
+		return
+	}
+	ptp.MulticastRate = conf.GetMulticastRate()
+	ptp.UseIGMPSnooping = conf.GetIGMPSnooping()
+	if ptp.MulticastRate > 0 {
+		ptp.Log(ptp.Info, "Multicast rate is limited to %d frames per second", ptp.MulticastRate)
+	}
+	if ptp.UseIGMPSnooping {
+		ptp.Log(ptp.Info, "IGMP snooping enabled")
+	}
+	ptp.UseLANDiscovery = conf.GetLANDiscovery()
+	ptp.LANDiscoveryPort = conf.GetLANDiscoveryPort()
+}
+
 // ExecDaemon starts P2P daemon
-func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configFile string, mtu int, pmtu bool) {
+func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, logFormat, configFile string, mtu int, pmtu bool) {
 	ptp.Log(ptp.Info, "Initializing P2P Daemon")
 	if logLevel == "" {
 		ptp.SetMinLogLevelString(DefaultLog)
@@ -93,6 +121,13 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 	} else {
 		ptp.Log(ptp.Info, "Loaded configuration from %s", configFile)
 	}
+	daemonConf = config
+	if logFormat == "" && config != nil {
+		logFormat = config.LogFormat
+	}
+	if err := ptp.SetLogFormat(logFormat); err != nil {
+		ptp.Log(ptp.Error, "%s. Using text format", err)
+	}
 
 	if targetURL == "" {
 		targetURL = "subutai.io"
@@ -105,6 +140,7 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 	ptp.InitErrors()
 
 	configureMTU(config, mtu, pmtu)
+	configureMulticast(config)
 
 	if !ptp.HavePrivileges(ptp.GetPrivilegesLevel()) {
 		os.Exit(1)
@@ -113,22 +149,8 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 
 	ReadyToServe = false
 
-	bootstrapConnected := false
-	bootstrapLastConnection := time.Unix(0, 0)
-
-	for !bootstrapConnected {
-		if time.Since(bootstrapLastConnection) > time.Duration(time.Second*5) {
-			bootstrapLastConnection = time.Now()
-			err := bootstrap.init(targetURL)
-			if err == nil {
-				bootstrapConnected = true
-			} else {
-				ptp.Log(ptp.Error, "Failed to connect to %s", targetURL)
-			}
-		}
-		time.Sleep(time.Millisecond * 100)
-	}
-
+	configureBootstrapTLS(config)
+	connectBootstrap(ptp.NewBootstrapDiscovery(config, targetURL), haveStaticPeers())
 	go bootstrap.run()
 	go waitOutboundIP()
 
@@ -144,6 +166,7 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 	signal.Notify(SignalChannel, os.Interrupt)
 
 	go waitActiveBootstrap()
+	handleReloadSignal(proc)
 
 	go func() {
 		for sig := range SignalChannel {
@@ -154,7 +177,13 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 	}()
 
 	// main loop
+	lastPeersSave := time.Now()
 	for {
+		if time.Since(lastPeersSave) > ptp.PeerCacheInterval {
+			lastPeersSave = time.Now()
+			savePeers(proc)
+		}
+		markBootstrapLoss(proc)
 		for id, inst := range proc.Instances.get() {
 			if inst == nil || inst.PTP == nil {
 				continue
@@ -162,7 +191,7 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 			if inst.PTP.ReadyToStop {
 				err := proc.Stop(&DaemonArgs{Hash: id}, &Response{})
 				if err != nil {
-					ptp.Log(ptp.Error, "Failed to stop instance: %s", err)
+					ptp.LogWith(ptp.Error, ptp.Fields{Hash: id, Subsystem: ptp.SubsystemInstance}, "Failed to stop instance: %s", err)
 				}
 			}
 		}
@@ -170,16 +199,52 @@ func ExecDaemon(port int, targetURL, sFile, profiling, syslog, logLevel, configF
 	}
 }
 
+// configureBootstrapTLS applies TLS settings of bootstrap connections.
+// Daemon refuses to start when TLS was requested but can't be configured
+func configureBootstrapTLS(conf *ptp.Conf) {
+	if conf == nil {
+		return
+	}
+	err := bootstrap.setTLS(&conf.Bootstrap.TLS)
+	if err != nil {
+		ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Failed to configure TLS for bootstrap connections: %s", err)
+		os.Exit(1)
+	}
+}
+
+// connectBootstrap blocks until list of bootstrap nodes is received.
+// When swarms have static peers daemon doesn't wait for bootstrap nodes:
+// they are added later, once discovery succeeds
+func connectBootstrap(discovery *ptp.BootstrapDiscovery, optional bool) {
+	lastAttempt := time.Unix(0, 0)
+	for {
+		if time.Since(lastAttempt) > time.Duration(time.Second*5) {
+			lastAttempt = time.Now()
+			err := bootstrap.init(discovery)
+			if err == nil {
+				return
+			}
+			ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Failed to discover bootstrap nodes: %s", err)
+			if optional {
+				ptp.LogWith(ptp.Warning, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Starting without bootstrap nodes: static peers are configured")
+				return
+			}
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
 func waitOutboundIP() {
-	for _, r := range bootstrap.routers {
+	for _, r := range bootstrap.getRouters() {
 		if r != nil {
 			go r.run()
 			go r.keepAlive()
 		}
 	}
+	go bootstrap.watch()
 	for !bootstrap.isActive {
-		for _, r := range bootstrap.routers {
-			if r.running && r.handshaked {
+		for _, r := range bootstrap.getRouters() {
+			if r.isRunning() && r.handshaked {
 				bootstrap.isActive = true
 				break
 			}
@@ -195,21 +260,73 @@ func waitOutboundIP() {
 func waitActiveBootstrap() {
 	for {
 		active := 0
-		for _, r := range bootstrap.routers {
-			if !r.stop {
+		for _, r := range bootstrap.getRouters() {
+			if !r.stopped() {
 				active++
 			}
 		}
-		if active == 0 {
-			ptp.Log(ptp.Info, "No active bootstrap nodes")
+		if active == 0 && !haveStaticPeers() {
+			ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "No active bootstrap nodes")
 			os.Exit(0)
 		}
 		time.Sleep(time.Millisecond * 100)
 	}
 }
 
+// savePeers writes peers of running instances next to the save file
+func savePeers(daemon *Daemon) {
+	if daemon.Restore == nil || !daemon.Restore.isActive() {
+		return
+	}
+	for hash, inst := range daemon.Instances.get() {
+		if inst == nil || inst.PTP == nil || inst.PTP.Shutdown {
+			continue
+		}
+		daemon.Restore.updatePeers(hash, inst.PTP.SnapshotPeers())
+	}
+	err := daemon.Restore.savePeers()
+	if err != nil {
+		ptp.Log(ptp.Error, "Failed to save cached peers: %s", err)
+	}
+}
+
+// markBootstrapLoss tells instances that bootstrap nodes are unreachable,
+// so peers losing connection are reconnected on known endpoints. Flag is
+// restored when bootstrap confirms instance registration again
+func markBootstrapLoss(daemon *Daemon) {
+	if bootstrap.handshaked() > 0 {
+		return
+	}
+	for _, inst := range daemon.Instances.get() {
+		if inst != nil && inst.PTP != nil && inst.PTP.Dht != nil {
+			inst.PTP.Dht.SetConnected(false)
+		}
+	}
+}
+
+// haveStaticPeers returns true if configuration file lists static peers
+func haveStaticPeers() bool {
+	return daemonConf != nil && len(daemonConf.Static) > 0
+}
+
 func restoreInstances(daemon *Daemon) {
+	if daemon.Restore != nil && daemon.Restore.isActive() {
+		err := daemon.Restore.loadPeers()
+		if err != nil {
+			ptp.Log(ptp.Warning, "Failed to load cached peers: %s", err)
+		}
+	}
+	// Instances with cached peers can reconnect without bootstrap
+	started := time.Now()
 	for !bootstrap.isActive {
+		if haveStaticPeers() {
+			ptp.Log(ptp.Warning, "Bootstrap nodes are unreachable. Restoring instances with static peers")
+			break
+		}
+		if daemon.Restore != nil && daemon.Restore.hasPeers() && time.Since(started) > ptp.PeerCacheWait {
+			ptp.Log(ptp.Warning, "Bootstrap nodes are unreachable. Restoring instances with cached peers")
+			break
+		}
 		time.Sleep(100 * time.Millisecond)
 	}
 	if daemon.Restore != nil && daemon.Restore.isActive() {
@@ -222,7 +339,7 @@ func restoreInstances(daemon *Daemon) {
 			return
 		}
 
-		entries := daemon.Restore.get()
+		entries := trunksFirst(daemon.Restore.get())
 		if len(entries) == 0 {
 			return
 		}
@@ -233,20 +350,30 @@ func restoreInstances(daemon *Daemon) {
 
 		for _, e := range entries {
 			err := daemon.run(&RunArgs{
-				IP:      e.IP,
-				Mac:     e.Mac,
-				Dev:     e.Dev,
-				Hash:    e.Hash,
-				Keyfile: e.Keyfile,
-				Key:     e.Key,
-				TTL:     e.TTL,
+				IP:       e.IP,
+				IPv6:     e.IPv6,
+				Mac:      e.Mac,
+				Dev:      e.Dev,
+				Hash:     e.Hash,
+				Keyfile:  e.Keyfile,
+				Key:      e.Key,
+				TTL:      e.TTL,
+				VLAN:     e.VLAN,
+				Trunk:    e.Trunk,
+				Static:   e.Static,
+				Invite:   e.Invite,
+				Peers:    daemon.Restore.getPeers(e.Hash),
+				Identity: e.Identity,
+				Allow:    e.Allow,
+				Deny:     e.Deny,
 			}, new(Response))
 			if err != nil {
-				ptp.Log(ptp.Error, "Failed to start instance %s during restore: %s", e.Hash, err.Error())
+				ptp.LogWith(ptp.Error, ptp.Fields{Hash: e.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to start instance %s during restore: %s", e.Hash, err.Error())
 				continue
 			} else {
 				restored++
 				daemon.Restore.bumpInstance(e.Hash)
+				daemon.saveIdentity(e.Hash)
 			}
 		}
 		err = daemon.Restore.save()
@@ -259,14 +386,14 @@ func restoreInstances(daemon *Daemon) {
 
 func validateDHT(dht string) error {
 	if dht == "" {
-		ptp.Log(ptp.Error, "Empty bootstrap list")
+		ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Empty bootstrap list")
 		return errEmptyDHTEndpoint
 	}
 	eps := strings.Split(dht, ",")
 	for _, ep := range eps {
-		_, err := net.ResolveTCPAddr("tcp4", ep)
+		_, err := net.ResolveTCPAddr("tcp", ep)
 		if err != nil {
-			ptp.Log(ptp.Error, "Bootstrap %s have bad format or wrong address: %s", ep, err)
+			ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Bootstrap %s have bad format or wrong address: %s", ep, err)
 			return errBadDHTEndpoint
 		}
 	}
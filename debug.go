@@ -68,7 +68,7 @@ func (p *Daemon) Debug(args *Args, resp *Response) error {
 		resp.Output += fmt.Sprintf("PMTU: Disabled\n")
 	}
 	resp.Output += fmt.Sprintf("Bootstrap nodes information:\n")
-	for _, node := range bootstrap.routers {
+	for _, node := range bootstrap.getRouters() {
 		if node != nil {
 			resp.Output += fmt.Sprintf("  %s Rx: %d Tx: %d Version: %s Packet version: %s\n", node.addr.String(), node.rx, node.tx, node.version, node.packetVersion)
 		}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
-	"github.com/golang/protobuf/proto"
 	ptp "github.com/subutai-io/p2p/lib"
 	"github.com/subutai-io/p2p/protocol"
 )
@@ -20,7 +21,10 @@ var (
 // DHTConnection to a DHT bootstrap node
 type DHTConnection struct {
 	routers     []*DHTRouter             // Bootstrap nodes
-	routersList map[int]string           // List of bootstrap nodes received from SRV lookup
+	routersLock sync.RWMutex             // Mutex for list of bootstrap nodes
+	discovery   *ptp.BootstrapDiscovery  // Sources of bootstrap nodes addresses
+	tls         *tls.Config              // TLS configuration of connections with bootstrap nodes
+	plaintext   bool                     // Whether fallback to plain TCP is allowed
 	lock        sync.Mutex               // Mutex for register/unregister
 	instances   map[string]*P2PInstance  // Instances
 	registered  []string                 // List of registered swarm IDs
@@ -29,41 +33,144 @@ type DHTConnection struct {
 	isActive    bool                     // Whether DHT connection is active or not
 }
 
-func (dht *DHTConnection) init(target string) error {
-	ptp.Log(ptp.Debug, "Initializing connection to a bootstrap nodes")
-	dht.incoming = make(chan *protocol.DHTPacket)
-	var err error
-	dht.routersList, err = ptp.SrvLookup(target, "tcp", "subutai.io")
+// setTLS configures TLS for connections with bootstrap nodes
+func (dht *DHTConnection) setTLS(conf *ptp.BootstrapTLSConf) error {
+	if conf == nil {
+		return nil
+	}
+	config, err := conf.ClientConfig()
 	if err != nil {
-		ptp.Log(ptp.Debug, "Failed to get bootstrap nodes: %s", err.Error())
-		dht.routersList = make(map[int]string)
+		return err
 	}
-	if len(dht.routersList) == 0 {
+	dht.tls = config
+	dht.plaintext = conf.AllowPlaintext
+	if config == nil {
+		ptp.LogWith(ptp.Warning, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "TLS is not configured: bootstrap traffic is not encrypted")
+	}
+	return nil
+}
+
+func (dht *DHTConnection) init(discovery *ptp.BootstrapDiscovery) error {
+	ptp.LogWith(ptp.Debug, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Initializing connection to a bootstrap nodes")
+	dht.incoming = make(chan *protocol.DHTPacket)
+	dht.discovery = discovery
+	if dht.instances == nil {
+		dht.instances = make(map[string]*P2PInstance)
+	}
+	list, err := discovery.Lookup()
+	if err != nil {
+		ptp.LogWith(ptp.Debug, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Failed to get bootstrap nodes: %s", err.Error())
 		return ErrorNoRouters
 	}
-	for _, r := range dht.routersList {
-		if r == "" {
+	routers := []*DHTRouter{}
+	for _, r := range list {
+		router, err := dht.newRouter(r)
+		if err != nil {
 			continue
 		}
-		addr, err := net.ResolveTCPAddr("tcp4", r)
+		routers = append(routers, router)
+	}
+	if len(routers) == 0 {
+		return ErrorBadRouterAddress
+	}
+	dht.routersLock.Lock()
+	dht.routers = routers
+	dht.routersLock.Unlock()
+	return nil
+}
+
+// newRouter creates router for a bootstrap node address
+func (dht *DHTConnection) newRouter(r string) (*DHTRouter, error) {
+	addr, err := net.ResolveTCPAddr("tcp", r)
+	if err != nil {
+		ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Bad router address provided [%s]: %s", r, err)
+		return nil, ErrorBadRouterAddress
+	}
+	router := new(DHTRouter)
+	router.addr = addr
+	router.router = r
+	router.data = dht.incoming
+	router.tls = dht.tls
+	router.plaintext = dht.plaintext
+	return router, nil
+}
+
+// getRouters returns a copy of the list of bootstrap nodes
+func (dht *DHTConnection) getRouters() []*DHTRouter {
+	dht.routersLock.RLock()
+	defer dht.routersLock.RUnlock()
+	return append([]*DHTRouter{}, dht.routers...)
+}
+
+// watch repeats discovery of bootstrap nodes periodically
+func (dht *DHTConnection) watch() {
+	for {
+		time.Sleep(ptp.DiscoveryInterval)
+		dht.update()
+	}
+}
+
+// update connects to bootstrap nodes that have appeared in discovery
+// and disconnects from those that have gone. When discovery fails
+// current list is kept. Addresses are resolved and connections are
+// closed without holding the lock, so senders aren't blocked by them.
+// Routers are changed by a single watcher, so the list can't change
+// in between
+func (dht *DHTConnection) update() error {
+	if dht.discovery == nil {
+		return fmt.Errorf("nil discovery")
+	}
+	list, err := dht.discovery.Lookup()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, r := range list {
+		wanted[r] = true
+	}
+	routers := []*DHTRouter{}
+	removed := []*DHTRouter{}
+	for _, router := range dht.getRouters() {
+		if wanted[router.router] {
+			routers = append(routers, router)
+			delete(wanted, router.router)
+			continue
+		}
+		removed = append(removed, router)
+	}
+	added := []*DHTRouter{}
+	for _, r := range list {
+		if !wanted[r] {
+			continue
+		}
+		router, err := dht.newRouter(r)
 		if err != nil {
-			ptp.Log(ptp.Error, "Bad router address provided [%s]: %s", r, err)
-			return ErrorBadRouterAddress
+			continue
 		}
-		router := new(DHTRouter)
-		router.addr = addr
-		router.router = r
-		router.data = dht.incoming
-		dht.routers = append(dht.routers, router)
+		added = append(added, router)
+	}
+
+	dht.routersLock.Lock()
+	dht.routers = append(routers, added...)
+	dht.routersLock.Unlock()
+
+	for _, router := range removed {
+		ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Bootstrap node %s was removed", router.router)
+		router.close()
+	}
+	for _, router := range added {
+		ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Bootstrap node %s was added", router.router)
+		go router.run()
+		go router.keepAlive()
 	}
-	dht.instances = make(map[string]*P2PInstance)
 	return nil
 }
 
 func (dht *DHTConnection) registerInstance(hash string, inst *P2PInstance) error {
 	dht.lock.Lock()
 	defer dht.lock.Unlock()
-	ptp.Log(ptp.Debug, "Registering instance %s on bootstrap", hash)
+	ptp.LogWith(ptp.Debug, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Registering instance %s on bootstrap", hash)
 
 	exists := false
 	for ihash, _ := range dht.instances {
@@ -83,40 +190,48 @@ func (dht *DHTConnection) registerInstance(hash string, inst *P2PInstance) error
 	}
 	dht.instances[hash] = inst
 	dht.registered = append(dht.registered, hash)
-	inst.PTP.Dht.IncomingData = make(chan *protocol.DHTPacket)
-	inst.PTP.Dht.OutgoingData = make(chan *protocol.DHTPacket)
+	dht.attach(inst.PTP.Dht)
+	ptp.LogWith(ptp.Debug, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Instance was registered with bootstrap client")
+	return nil
+}
+
+// attach creates channels of DHT client and starts passing
+// its outgoing packets to bootstrap nodes
+func (dht *DHTConnection) attach(client *ptp.DHTClient) {
+	client.IncomingData = make(chan *protocol.DHTPacket)
+	client.OutgoingData = make(chan *protocol.DHTPacket)
 	go func() {
 		for {
-			packet := <-inst.PTP.Dht.OutgoingData
+			packet := <-client.OutgoingData
 			if packet == nil {
 				break
 			}
 			dht.send(packet)
 		}
 	}()
-	ptp.Log(ptp.Debug, "Instance was registered with bootstrap client")
-	return nil
+}
+
+// handshaked returns number of bootstrap nodes we've completed handshake with
+func (dht *DHTConnection) handshaked() int {
+	count := 0
+	for _, r := range dht.getRouters() {
+		if r.isRunning() && r.handshaked {
+			count++
+		}
+	}
+	return count
 }
 
 func (dht *DHTConnection) send(packet *protocol.DHTPacket) {
 	if packet == nil {
 		return
 	}
-	ptp.Log(ptp.Trace, "Sending DHT packet %+v", packet)
-	data, err := proto.Marshal(packet)
-	if err != nil {
-		ptp.Log(ptp.Error, "Failed to marshal DHT Packet: %s", err)
-	}
-	ptp.Log(ptp.Trace, "Sending marshaled DHT Packet of size [%d]", len(data))
-	for i, router := range dht.routers {
-		if router.running && router.handshaked {
-			n, err := router.sendRaw(data)
+	ptp.LogWith(ptp.Trace, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Sending DHT packet %+v", packet)
+	for _, router := range dht.getRouters() {
+		if router.isRunning() && router.handshaked {
+			_, err := router.send(packet)
 			if err != nil {
-				ptp.Log(ptp.Error, "Failed to send data to %s", router.addr.String())
-				continue
-			}
-			if n >= 0 {
-				dht.routers[i].tx += uint64(n)
+				ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Failed to send data to %s: %s", router.addr.String(), err)
 			}
 		}
 	}
@@ -128,10 +243,10 @@ func (dht *DHTConnection) run() {
 		if packet == nil {
 			continue
 		}
-		ptp.Log(ptp.Trace, "Routing DHT Packet %+v", packet)
+		ptp.LogWith(ptp.Trace, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Routing DHT Packet %+v", packet)
 		// Ping should always provide us with outbound IP value
 		if packet.Type == protocol.DHTPacketType_Ping && packet.Data != "" {
-			ptp.Log(ptp.Info, "Received outbound IP: %s", packet.Data)
+			ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Received outbound IP: %s", packet.Data)
 			dht.ip = packet.Data
 
 			if packet.Extra != "" && packet.Query == "handshaked" {
@@ -153,7 +268,7 @@ func (dht *DHTConnection) run() {
 		if e && i != nil && i.PTP != nil && !i.PTP.Shutdown && i.PTP.Dht != nil && i.PTP.Dht.IncomingData != nil {
 			i.PTP.Dht.IncomingData <- packet
 		} else {
-			ptp.Log(ptp.Debug, "DHT received data for unknown instance %s: %+v", packet.Infohash, packet)
+			ptp.LogWith(ptp.Debug, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "DHT received data for unknown instance %s: %+v", packet.Infohash, packet)
 		}
 	}
 }
@@ -161,7 +276,7 @@ func (dht *DHTConnection) run() {
 func (dht *DHTConnection) unregisterInstance(hash string) error {
 	dht.lock.Lock()
 	defer dht.lock.Unlock()
-	ptp.Log(ptp.Debug, "Unregistering instance %s from bootstrap", hash)
+	ptp.LogWith(ptp.Debug, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Unregistering instance %s from bootstrap", hash)
 	inst, e := dht.instances[hash]
 	if !e {
 		return fmt.Errorf("Can't unregister hash %s: Instance doesn't exists", hash)
@@ -169,7 +284,7 @@ func (dht *DHTConnection) unregisterInstance(hash string) error {
 	if inst != nil && inst.PTP != nil && inst.PTP.Dht != nil {
 		err := inst.PTP.Dht.Close()
 		if err != nil {
-			ptp.Log(ptp.Error, "Failed to stop DHT on instance %s", hash)
+			ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemBootstrap}, "Failed to stop DHT on instance %s", hash)
 		}
 	}
 	delete(dht.instances, hash)
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -13,101 +15,131 @@ import (
 
 // DHTRouter represents a connection to a router
 type DHTRouter struct {
-	conn          *net.TCPConn             // TCP connection to a bootsrap node
+	conn          net.Conn                 // Connection to a bootsrap node
 	addr          *net.TCPAddr             // TCP address of a bootstrap node
 	router        string                   // Address of a bootstrap node
-	running       bool                     // Whether router is running or not
+	running       int32                    // Whether router is running or not. Accessed atomically
 	handshaked    bool                     // Whether handshake has been completed or not
-	stop          bool                     // Whether service should be terminated
+	stop          int32                    // Whether service should be terminated. Accessed atomically
 	fails         int                      // Number of connection fails
 	tx            uint64                   // Transferred bytes
 	rx            uint64                   // Received bytes
 	data          chan *protocol.DHTPacket // Payload channel
 	lastContact   time.Time                // Last communication
 	packetVersion string                   // Version of packet on DHT
+	negotiated    int32                    // Packet version agreed during handshake
+	reader        ptp.DHTFrameReader       // Reassembles packets from stream
 	version       string                   // Version of DHT
+	tls           *tls.Config              // TLS configuration. Plain TCP is used when nil
+	plaintext     bool                     // Whether plain TCP can be used when TLS handshake fails
+}
+
+// isRunning returns true if router is connected to bootstrap node
+func (dht *DHTRouter) isRunning() bool {
+	return atomic.LoadInt32(&dht.running) == 1
+}
+
+// setRunning marks router as connected or disconnected
+func (dht *DHTRouter) setRunning(running bool) {
+	var value int32
+	if running {
+		value = 1
+	}
+	atomic.StoreInt32(&dht.running, value)
+}
+
+// stopped returns true if router was closed
+func (dht *DHTRouter) stopped() bool {
+	return atomic.LoadInt32(&dht.stop) == 1
+}
+
+// logFields returns context of log records of the bootstrap node
+func (dht *DHTRouter) logFields() ptp.Fields {
+	return ptp.Fields{Subsystem: ptp.SubsystemBootstrap, Endpoint: dht.router}
 }
 
 func (dht *DHTRouter) run() {
-	dht.running = false
+	dht.setRunning(false)
 	dht.handshaked = false
 	dht.version = "Unknown"
 	dht.packetVersion = "Unknown"
 
-	for !dht.stop {
-		for !dht.running {
+	for !dht.stopped() {
+		for !dht.isRunning() {
 			dht.connect()
-			if dht.running || dht.stop {
+			if dht.isRunning() || dht.stopped() {
 				break
 			}
 			dht.sleep()
 		}
+		conn := dht.conn
+		if conn == nil {
+			dht.setRunning(false)
+			continue
+		}
 		data := make([]byte, ptp.DHTBufferSize)
-		n, err := dht.conn.Read(data)
+		n, err := conn.Read(data)
 		if err != nil {
-			ptp.Log(ptp.Warning, "BSN socket closed: %s", err)
-			dht.running = false
-			dht.handshaked = false
+			ptp.LogWith(ptp.Warning, dht.logFields(), "BSN socket closed: %s", err)
+			dht.disconnected()
+			dht.setRunning(false)
 			continue
 		}
 		dht.lastContact = time.Now()
-		go dht.handleData(data[:n])
+		dht.handleData(data[:n])
 	}
 }
 
+// handleData passes every complete packet received so far to routeData.
+// Packets are routed in order they were received
 func (dht *DHTRouter) handleData(data []byte) {
-	length := len(data)
-	dht.rx += uint64(length)
-	i := 0
-	handled := 0
-	ptp.Log(ptp.Trace, "Handling data: data length is [%d]", len(data))
-	for i >= 0 {
-		i = bytes.Index(data, []byte{0x0a, 0x0b, 0x0c, 0x0a})
-		if i <= 0 {
-			break
+	atomic.AddUint64(&dht.rx, uint64(len(data)))
+	ptp.LogWith(ptp.Trace, dht.logFields(), "Handling data: data length is [%d]", len(data))
+	dht.reader.Write(data)
+	for {
+		packet, err := dht.reader.Next()
+		if err != nil {
+			ptp.LogWith(ptp.Warning, dht.logFields(), "Broken stream from %s: %s", dht.addr.String(), err)
+			dht.setRunning(false)
+			dht.handshaked = false
+			if dht.conn != nil {
+				dht.conn.Close()
+			}
+			return
 		}
-		handled++
-		dht.routeData(data[:i])
-		if i+4 < len(data) {
-			data = data[i+4:]
-		} else {
-			break
+		if packet == nil {
+			return
 		}
-	}
-	if handled == 0 {
-		dht.routeData(data[:length])
+		dht.routeData(packet)
 	}
 }
 
 func (dht *DHTRouter) routeData(data []byte) {
 	packet := &protocol.DHTPacket{}
 	err := proto.Unmarshal(data, packet)
-	ptp.Log(ptp.Trace, "DHTPacket size: [%d]", len(data))
-	ptp.Log(ptp.Trace, "DHTPacket contains: %+v --- %+v", bytes.NewBuffer(data).String(), packet)
+	ptp.LogWith(ptp.Trace, dht.logFields(), "DHTPacket size: [%d]", len(data))
+	ptp.LogWith(ptp.Trace, dht.logFields(), "DHTPacket contains: %+v --- %+v", bytes.NewBuffer(data).String(), packet)
 	if err != nil {
-		ptp.Log(ptp.Warning, "Corrupted data from DHT: %s [%d]", err, len(data))
+		ptp.LogWith(ptp.Warning, dht.logFields(), "Corrupted data from DHT: %s [%d]", err, len(data))
 		return
 	}
-	ptp.Log(ptp.Trace, "Received DHT packet: %+v", packet)
+	ptp.LogWith(ptp.Trace, dht.logFields(), "Received DHT packet: %+v", packet)
 	if packet.Type == protocol.DHTPacketType_Ping && dht.handshaked == false {
-		supported := false
-		for _, v := range ptp.SupportedVersion {
-			if v == packet.Version {
-				supported = true
-			}
-		}
+		version, supported := ptp.NegotiateVersion(packet)
 		if !supported {
-			ptp.Log(ptp.Error, "Version mismatch. Server have %d. We have %d", packet.Version, ptp.PacketVersion)
-			dht.stop = true
+			ptp.LogWith(ptp.Error, dht.logFields(), "Version mismatch. Server have %d. We have %d", packet.Version, ptp.PacketVersion)
+			atomic.StoreInt32(&dht.stop, 1)
 			if dht.conn != nil {
 				dht.conn.Close()
 			}
 		} else {
 			dht.handshaked = true
-			ptp.Log(ptp.Info, "Connected to a bootstrap node: %s [%s]", dht.addr.String(), packet.Data)
-			dht.packetVersion = fmt.Sprintf("%d", packet.Version)
+			dht.negotiated = version
+			ptp.LogWith(ptp.Info, dht.logFields(), "Connected to a bootstrap node: %s [%s]", dht.addr.String(), packet.Data)
+			ptp.PublishEvent(ptp.Event{Type: ptp.EventBootstrap, State: "CONNECTED", Address: dht.addr.String()})
+			dht.packetVersion = fmt.Sprintf("%d", version)
 			if packet.Extra != "" {
-				ptp.Log(ptp.Info, "DHT Version: %s", packet.Extra)
+				ptp.LogWith(ptp.Info, dht.logFields(), "DHT Version: %s", packet.Extra)
 				dht.version = packet.Extra
 			}
 			packet.Query = "handshaked"
@@ -116,7 +148,7 @@ func (dht *DHTRouter) routeData(data []byte) {
 		}
 	}
 	if !dht.handshaked {
-		ptp.Log(ptp.Trace, "Skipping packet: not handshaked")
+		ptp.LogWith(ptp.Trace, dht.logFields(), "Skipping packet: not handshaked")
 		return
 	}
 	dht.data <- packet
@@ -124,23 +156,58 @@ func (dht *DHTRouter) routeData(data []byte) {
 
 func (dht *DHTRouter) connect() {
 	dht.handshaked = false
-	dht.running = false
+	dht.setRunning(false)
+	dht.negotiated = 0
+	dht.reader.Reset()
 
 	if dht.conn != nil {
 		dht.conn.Close()
 		dht.conn = nil
 	}
 
-	var err error
-	dht.conn, err = net.DialTCP("tcp4", nil, dht.addr)
+	conn, err := dht.dial()
 	if err != nil {
 		dht.fails++
-		ptp.Log(ptp.Error, "Failed to establish connection with %s: %s", dht.addr.String(), err)
+		ptp.LogWith(ptp.Error, dht.logFields(), "Failed to establish connection with %s: %s", dht.addr.String(), err)
 		return
 	}
+	dht.conn = conn
 	dht.lastContact = time.Now()
 	dht.fails = 0
-	dht.running = true
+	dht.setRunning(true)
+}
+
+// dial opens connection with bootstrap node. TLS connection is
+// replaced with plain TCP only when it was explicitly allowed
+func (dht *DHTRouter) dial() (net.Conn, error) {
+	conn, err := net.DialTCP("tcp", nil, dht.addr)
+	if err != nil {
+		return nil, err
+	}
+	if dht.tls == nil {
+		return conn, nil
+	}
+	config := dht.tls.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(dht.router)
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(time.Second * 10))
+	err = tlsConn.Handshake()
+	if err == nil {
+		tlsConn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	}
+	conn.Close()
+	if !dht.plaintext {
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	ptp.LogWith(ptp.Warning, dht.logFields(), "TLS handshake with %s failed: %s. Falling back to plain TCP", dht.router, err)
+	plain, err := net.DialTCP("tcp", nil, dht.addr)
+	if err != nil {
+		return nil, err
+	}
+	return plain, nil
 }
 
 func (dht *DHTRouter) sleep() {
@@ -148,7 +215,7 @@ func (dht *DHTRouter) sleep() {
 	if multiplier > 30 {
 		multiplier = 30
 	}
-	ptp.Log(ptp.Info, "Waiting for %d second before reconnecting", multiplier)
+	ptp.LogWith(ptp.Info, dht.logFields(), "Waiting for %d second before reconnecting", multiplier)
 	started := time.Now()
 	timeout := time.Duration(time.Second * time.Duration(multiplier))
 	for time.Since(started) < timeout {
@@ -159,17 +226,17 @@ func (dht *DHTRouter) sleep() {
 func (dht *DHTRouter) keepAlive() {
 	lastPing := time.Now()
 	dht.lastContact = time.Now()
-	for {
+	for !dht.stopped() {
 		if time.Since(lastPing) > time.Duration(time.Millisecond*30000) && time.Since(dht.lastContact) > time.Duration(time.Millisecond*40) {
 			lastPing = time.Now()
 			if dht.ping() != nil {
-				ptp.Log(ptp.Error, "DHT router ping failed")
+				ptp.LogWith(ptp.Error, dht.logFields(), "DHT router ping failed")
 			}
 		}
-		if time.Since(dht.lastContact) > time.Duration(time.Millisecond*60000) && dht.running {
-			ptp.Log(ptp.Warning, "Disconnected from DHT router %s by timeout", dht.addr.String())
-			dht.handshaked = false
-			dht.running = false
+		if time.Since(dht.lastContact) > time.Duration(time.Millisecond*60000) && dht.isRunning() {
+			ptp.LogWith(ptp.Warning, dht.logFields(), "Disconnected from DHT router %s by timeout", dht.addr.String())
+			dht.disconnected()
+			dht.setRunning(false)
 			dht.conn.Close()
 			dht.conn = nil
 		}
@@ -177,25 +244,65 @@ func (dht *DHTRouter) keepAlive() {
 	}
 }
 
+// disconnected resets handshake and notifies about lost connection
+func (dht *DHTRouter) disconnected() {
+	if dht.handshaked {
+		ptp.PublishEvent(ptp.Event{Type: ptp.EventBootstrap, State: "DISCONNECTED", Address: dht.addr.String()})
+	}
+	dht.handshaked = false
+}
+
+// close disconnects from bootstrap node and stops router
+func (dht *DHTRouter) close() {
+	atomic.StoreInt32(&dht.stop, 1)
+	dht.setRunning(false)
+	dht.handshaked = false
+	if dht.conn != nil {
+		dht.conn.Close()
+	}
+}
+
+// send marshals packet with version agreed during handshake. Packets
+// are framed only when bootstrap node supports it
+func (dht *DHTRouter) send(packet *protocol.DHTPacket) (int, error) {
+	packet = proto.Clone(packet).(*protocol.DHTPacket)
+	packet.Version = dht.negotiated
+	if packet.Version == 0 {
+		packet.Version = ptp.LegacyPacketVersion
+	}
+	data, err := proto.Marshal(packet)
+	if err != nil {
+		return -1, err
+	}
+	ptp.LogWith(ptp.Trace, dht.logFields(), "Sending marshaled DHT Packet of size [%d]", len(data))
+	if packet.Version >= ptp.FramingVersion {
+		data, err = ptp.EncodeDHTFrame(data)
+		if err != nil {
+			return -1, err
+		}
+	}
+	return dht.sendRaw(data)
+}
+
 func (dht *DHTRouter) sendRaw(data []byte) (int, error) {
 	if dht.conn == nil {
 		return -1, fmt.Errorf("Can't send: connection is nil")
 	}
-	return dht.conn.Write(data)
+	n, err := dht.conn.Write(data)
+	if n > 0 {
+		atomic.AddUint64(&dht.tx, uint64(n))
+	}
+	return n, err
 }
 
 func (dht *DHTRouter) ping() error {
-	ptp.Log(ptp.Trace, "Sending ping to dht %s", dht.addr.String())
+	ptp.LogWith(ptp.Trace, dht.logFields(), "Sending ping to dht %s", dht.addr.String())
 	packet := &protocol.DHTPacket{
 		Type:    protocol.DHTPacketType_Ping,
 		Query:   "req",
 		Version: ptp.PacketVersion,
 	}
-	data, err := proto.Marshal(packet)
-	if err != nil {
-		return err
-	}
-	_, err = dht.sendRaw(data)
+	_, err := dht.send(packet)
 	if err != nil {
 		return err
 	}
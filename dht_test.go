@@ -1,7 +1,10 @@
 package main
 
 import (
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	ptp "github.com/subutai-io/p2p/lib"
@@ -38,3 +41,143 @@ func TestRouteData(t *testing.T) {
 		router.routeData(b)
 	}
 }
+
+func TestDHTRouter_handleData(t *testing.T) {
+	router := &DHTRouter{data: make(chan *protocol.DHTPacket, 1), addr: &net.TCPAddr{}}
+
+	// Bootstrap node which doesn't delimit packets
+	data, _ := proto.Marshal(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Data: "127.0.0.1", Version: ptp.LegacyPacketVersion})
+	router.handleData(data)
+	select {
+	case packet := <-router.data:
+		if packet.Query != "handshaked" {
+			t.Fatalf("Wrong handshake packet: %+v", packet)
+		}
+	default:
+		t.Fatalf("DHTRouter.handleData() didn't route undelimited packet")
+	}
+}
+
+func TestDHTConnection_update(t *testing.T) {
+	source := ptp.StaticSource{"127.0.0.1:1", "127.0.0.1:2"}
+	discovery := &ptp.BootstrapDiscovery{Sources: []ptp.BootstrapSource{source}}
+	dht := new(DHTConnection)
+	if err := dht.init(discovery); err != nil {
+		t.Fatalf("DHTConnection.init() error = %v", err)
+	}
+	removed := dht.getRouters()[0]
+
+	discovery.Sources[0] = ptp.StaticSource{"127.0.0.1:2", "127.0.0.1:3"}
+	if err := dht.update(); err != nil {
+		t.Fatalf("DHTConnection.update() error = %v", err)
+	}
+	routers := dht.getRouters()
+	if len(routers) != 2 || routers[0].router != "127.0.0.1:2" || routers[1].router != "127.0.0.1:3" {
+		t.Errorf("DHTConnection.update() produced wrong list of routers")
+	}
+	if !removed.stopped() {
+		t.Errorf("DHTConnection.update() didn't stop removed router")
+	}
+
+	// Failed discovery keeps current routers
+	discovery.Sources[0] = ptp.StaticSource{}
+	if err := dht.update(); err == nil || len(dht.getRouters()) != 2 {
+		t.Errorf("DHTConnection.update() changed routers after failed discovery")
+	}
+	for _, r := range dht.getRouters() {
+		r.close()
+	}
+}
+
+func TestDHTConnection_send(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	received := make(chan int)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _ := remote.Read(buf)
+		received <- n
+	}()
+	router := &DHTRouter{conn: local, addr: new(net.TCPAddr), handshaked: true}
+	router.setRunning(true)
+	dht := &DHTConnection{routers: []*DHTRouter{router}}
+	dht.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping})
+	n := <-received
+	if tx := atomic.LoadUint64(&router.tx); tx != uint64(n) {
+		t.Errorf("DHTConnection.send() counted %d bytes, sent %d", tx, n)
+	}
+}
+
+func TestDHTRouter_negotiation(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments []string
+		want      int32
+		framed    bool
+	}{
+		{"legacy bootstrap", nil, ptp.LegacyPacketVersion, false},
+		{"bootstrap with framing", []string{"20005", "20006"}, ptp.FramingVersion, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer listener.Close()
+
+			router, err := (&DHTConnection{incoming: make(chan *protocol.DHTPacket, 1)}).newRouter(listener.Addr().String())
+			if err != nil {
+				t.Fatalf("DHTConnection.newRouter() error = %v", err)
+			}
+			go router.run()
+			defer router.close()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("Failed to accept: %v", err)
+			}
+			defer conn.Close()
+
+			// Handshake is always delimited and here it's split in two writes
+			data, _ := proto.Marshal(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Data: "127.0.0.1", Version: ptp.LegacyPacketVersion, Arguments: tt.arguments})
+			data = append(data, 0x0a, 0x0b, 0x0c, 0x0a)
+			conn.Write(data[:5])
+			time.Sleep(time.Millisecond * 20)
+			conn.Write(data[5:])
+			select {
+			case packet := <-router.data:
+				if packet.Query != "handshaked" {
+					t.Fatalf("Wrong handshake packet: %+v", packet)
+				}
+			case <-time.After(time.Second * 3):
+				t.Fatalf("Handshake wasn't completed")
+			}
+			if router.negotiated != tt.want {
+				t.Errorf("DHTRouter negotiated version %d, want %d", router.negotiated, tt.want)
+			}
+
+			if err := router.ping(); err != nil {
+				t.Fatalf("DHTRouter.ping() error = %v", err)
+			}
+			buf := make([]byte, ptp.DHTBufferSize)
+			conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Failed to read ping: %v", err)
+			}
+			if ptp.IsDHTFrame(buf[:n]) != tt.framed {
+				t.Fatalf("DHTRouter.ping() framed = %v, want %v", !tt.framed, tt.framed)
+			}
+			if tt.framed {
+				buf = buf[4:n]
+			} else {
+				buf = buf[:n]
+			}
+			packet := &protocol.DHTPacket{}
+			if err := proto.Unmarshal(buf, packet); err != nil || packet.Version != tt.want {
+				t.Errorf("DHTRouter.ping() sent %+v, %v", packet, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// EventsKeepAlive is how often comments are sent to idle event streams
+const EventsKeepAlive = time.Duration(time.Second * 15)
+
+// CommandEvents prints events of the daemon as they happen
+func CommandEvents(rpcPort int, hash, types string, raw bool) {
+	query := url.Values{}
+	if hash != "" {
+		query.Set("hash", hash)
+	}
+	if types != "" {
+		query.Set("type", types)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/rest/v1/events?%s", rpcPort, query.Encode()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't subscribe to events. Check if p2p daemon is running.")
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		data := strings.TrimPrefix(line, "data: ")
+		if raw {
+			fmt.Println(data)
+			continue
+		}
+		e := ptp.Event{}
+		if json.Unmarshal([]byte(data), &e) != nil {
+			continue
+		}
+		fmt.Println(formatEvent(&e))
+	}
+	fmt.Fprintln(os.Stderr, "Event stream was closed by daemon")
+	os.Exit(1)
+}
+
+// formatEvent returns single line description of event
+func formatEvent(e *ptp.Event) string {
+	out := e.Time.Format(time.RFC3339) + "\t" + string(e.Type)
+	for _, field := range []string{e.Hash, e.Peer, e.State, e.IP, e.Address} {
+		if field != "" {
+			out += "\t" + field
+		}
+	}
+	return out
+}
+
+// eventFilter selects events requested by subscriber
+type eventFilter struct {
+	hash  string
+	types map[ptp.EventType]bool
+}
+
+func newEventFilter(query url.Values) *eventFilter {
+	f := &eventFilter{hash: query.Get("hash"), types: make(map[ptp.EventType]bool)}
+	for _, t := range strings.Split(query.Get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.types[ptp.EventType(t)] = true
+		}
+	}
+	return f
+}
+
+func (f *eventFilter) match(e *ptp.Event) bool {
+	if f.hash != "" && e.Hash != "" && e.Hash != f.hash {
+		return false
+	}
+	return len(f.types) == 0 || f.types[e.Type]
+}
+
+// execRESTEvents streams events as Server-Sent Events. Events can be
+// filtered by instance hash and comma-separated list of event types
+func (d *Daemon) execRESTEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	filter := newEventFilter(r.URL.Query())
+	sub := ptp.SubscribeEvents()
+	defer ptp.UnsubscribeEvents(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": dropped %d\n\n", sub.Dropped())
+			flusher.Flush()
+		case e := <-sub.C:
+			if !filter.match(&e) {
+				continue
+			}
+			data, err := json.Marshal(&e)
+			if err != nil {
+				ptp.Log(ptp.Error, "Failed to marshal event: %s", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
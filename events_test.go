@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestDaemon_execRESTEvents(t *testing.T) {
+	d := new(Daemon)
+	server := httptest.NewServer(http.HandlerFunc(d.execRESTEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?hash=hash1&type=peer-state,bootstrap")
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Wrong content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	ptp.PublishEvent(ptp.Event{Type: ptp.EventPeerState, Hash: "hash2", Peer: "peer2"})
+	ptp.PublishEvent(ptp.Event{Type: ptp.EventProxy, Hash: "hash1"})
+	ptp.PublishEvent(ptp.Event{Type: ptp.EventPeerState, Hash: "hash1", Peer: "peer1"})
+	ptp.PublishEvent(ptp.Event{Type: ptp.EventBootstrap, State: "CONNECTED"})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "event: ") {
+				lines <- scanner.Text()
+			}
+		}
+	}()
+	for _, want := range []string{"event: peer-state", "event: bootstrap"} {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("Received %s, want %s", line, want)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("Event wasn't received: %s", want)
+		}
+	}
+}
+
+func Test_formatEvent(t *testing.T) {
+	e := &ptp.Event{Type: ptp.EventIPSet, Time: time.Unix(0, 0).UTC(), Hash: "hash", Peer: "peer", IP: "10.0.0.2"}
+	want := "1970-01-01T00:00:00Z\tip-set\thash\tpeer\t10.0.0.2"
+	if got := formatEvent(e); got != want {
+		t.Errorf("formatEvent() = %q, want %q", got, want)
+	}
+}
@@ -13,6 +13,7 @@ import (
 // some other RPC calls
 type RunArgs struct {
 	IP          string `json:"ip"`
+	IPv6        string `json:"ipv6"`
 	Mac         string `json:"mac"`
 	Dev         string `json:"dev"`
 	Hash        string `json:"hash"`
@@ -22,7 +23,15 @@ type RunArgs struct {
 	TTL         string `json:"ttl"`
 	Fwd         bool   `json:"fwd"`
 	Port        int    `json:"port"`
+	VLAN        int    `json:"vlan"`
+	Trunk       string `json:"trunk"`
+	Static      string `json:"static"` // Path to a file with static peers
+	Invite      string `json:"invite"` // Invite token the instance was started with
 	LastSuccess time.Time
+	Peers       *ptp.PeerCache `json:"-"` // Peers cached before restart
+	Identity    string         `json:"-"` // Identity key of the instance before restart
+	Allow       []string       `json:"-"` // Peers allowed in the swarm before restart
+	Deny        []string       `json:"-"` // Peers denied in the swarm before restart
 }
 
 type ShowArgs struct {
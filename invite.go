@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// CommandInvite creates an invite token for a running instance. Token
+// lets another instance join the swarm until it expires
+func CommandInvite(rpcPort int, hash, expires string, singleUse bool) {
+	if hash == "" {
+		fmt.Fprintln(os.Stderr, "Hash of the swarm should be specified with -hash VALUE argument")
+		os.Exit(12)
+	}
+	args := &DaemonArgs{Hash: hash, TTL: expires, SingleUse: singleUse, Command: "create"}
+	out, err := sendRequest(rpcPort, "invite", args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if out.Code > 0 {
+		fmt.Fprintln(os.Stderr, out.Message)
+	} else {
+		fmt.Println(out.Message)
+	}
+	os.Exit(out.Code)
+}
+
+func (d *Daemon) execRESTInvite(w http.ResponseWriter, r *http.Request) {
+	if !ReadyToServe {
+		resp, _ := getResponse(105, "P2P Daemon is in initialization state")
+		w.Write(resp)
+		return
+	}
+	if !isLocalRequest(r) {
+		ptp.Log(ptp.Warning, "Refused to create invite for remote client %s", r.RemoteAddr)
+		resp, _ := getResponse(108, "Invites can be created from local host only")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(resp)
+		return
+	}
+	args := new(DaemonArgs)
+	err := getJSON(r.Body, args)
+	if handleMarshalError(err, w) != nil {
+		return
+	}
+	response := new(Response)
+	if args.Command == "create" {
+		d.createInvite(args, response)
+	} else {
+		response.ExitCode = 1
+		response.Output = "Unknown command"
+	}
+	resp, err := getResponse(response.ExitCode, response.Output)
+	if err != nil {
+		ptp.Log(ptp.Error, "Internal error: %s", err)
+		return
+	}
+	w.Write(resp)
+}
+
+// createInvite mints an invite signed with active key of the instance
+func (d *Daemon) createInvite(args *DaemonArgs, resp *Response) error {
+	inst := d.Instances.getInstance(args.Hash)
+	if inst == nil || inst.PTP == nil {
+		resp.ExitCode = 4
+		resp.Output = "Instance " + args.Hash + " wasn't found"
+		return fmt.Errorf("Instance %s not found", args.Hash)
+	}
+	if !inst.PTP.Crypter.IsActive() {
+		resp.ExitCode = 17
+		resp.Output = "Invites require encryption to be enabled for this instance"
+		return fmt.Errorf("encryption is disabled")
+	}
+	if inst.PTP.JoinedWithInvite() {
+		resp.ExitCode = 19
+		resp.Output = "Instances joined with an invite can't issue invites"
+		return fmt.Errorf("instance has joined with an invite")
+	}
+	ttl := ptp.InviteDefaultTTL
+	if args.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(args.TTL)
+		if err != nil || ttl <= 0 {
+			resp.ExitCode = 18
+			resp.Output = "Bad invite lifetime: " + args.TTL
+			return fmt.Errorf("bad invite lifetime")
+		}
+	}
+	expires := time.Now().Add(ttl)
+	key := inst.PTP.Crypter.GetActiveKey()
+	if key.Until.Before(expires) {
+		ptp.LogWith(ptp.Warning, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Invite for %s outlives active key, which expires at %s", args.Hash, key.Until.String())
+	}
+	invite, err := ptp.NewInvite(args.Hash, key.Key, expires, args.SingleUse)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Failed to create invite: " + err.Error()
+		return err
+	}
+	ptp.LogWith(ptp.Info, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Created invite %s for %s valid until %s", invite.ID, args.Hash, expires.String())
+	resp.ExitCode = 0
+	resp.Output = invite.Encode()
+	return nil
+}
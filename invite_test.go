@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestDaemon_createInvite(t *testing.T) {
+	key := ptp.CryptoKey{Key: []byte("01234567890123456789012345678901"), Until: time.Now().Add(time.Hour * 48)}
+	plain := &P2PInstance{PTP: &ptp.PeerToPeer{Hash: "plain"}}
+	encrypted := &P2PInstance{PTP: &ptp.PeerToPeer{Hash: "encrypted"}}
+	encrypted.PTP.Crypter.Active = true
+	encrypted.PTP.Crypter.ActiveKey = key
+
+	d := &Daemon{Instances: new(InstanceList)}
+	d.Instances.init()
+	d.Instances.update("plain", plain)
+	d.Instances.update("encrypted", encrypted)
+
+	tests := []struct {
+		name     string
+		args     *DaemonArgs
+		wantCode int
+	}{
+		{"unknown instance", &DaemonArgs{Hash: "unknown"}, 4},
+		{"encryption disabled", &DaemonArgs{Hash: "plain"}, 17},
+		{"bad lifetime", &DaemonArgs{Hash: "encrypted", TTL: "tomorrow"}, 18},
+		{"default lifetime", &DaemonArgs{Hash: "encrypted"}, 0},
+		{"single-use", &DaemonArgs{Hash: "encrypted", TTL: "72h", SingleUse: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(Response)
+			d.createInvite(tt.args, resp)
+			if resp.ExitCode != tt.wantCode {
+				t.Fatalf("Daemon.createInvite() code = %d, want %d: %s", resp.ExitCode, tt.wantCode, resp.Output)
+			}
+			if tt.wantCode != 0 {
+				return
+			}
+			invite, err := ptp.DecodeInvite(resp.Output)
+			if err != nil {
+				t.Fatalf("Created invite can't be decoded: %v", err)
+			}
+			if invite.Hash != "encrypted" || len(invite.Secret) == 0 || invite.SingleUse != tt.args.SingleUse {
+				t.Errorf("Daemon.createInvite() = %+v", invite)
+			}
+		})
+	}
+}
+
+func TestIsLocalRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		want   bool
+	}{
+		{"ipv4 loopback", "127.0.0.1:5555", true},
+		{"ipv6 loopback", "[::1]:5555", true},
+		{"remote", "10.0.0.2:5555", false},
+		{"broken", "localhost", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLocalRequest(&http.Request{RemoteAddr: tt.remote}); got != tt.want {
+				t.Errorf("isLocalRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
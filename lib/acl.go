@@ -0,0 +1,172 @@
+package ptp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Access control lists limit membership of the swarm. Entries are peer
+// IDs or base64-encoded identity keys, which are stored as IDs derived
+// from them. Denied peers are dropped from peer lists received from DHT
+// and their introductions are ignored, so they never get a network peer
+// or a reply. When allow list is not empty, only peers listed in it can
+// join the swarm. In encrypted swarms with access lists every peer must
+// complete key exchange, which binds its ID to identity key, so entries
+// can't be bypassed by presenting another ID
+
+// ACL is an allow/deny list of peers of a swarm
+type ACL struct {
+	allow map[string]bool
+	deny  map[string]bool
+	lock  sync.RWMutex
+}
+
+// aclEntry converts identity key to peer ID
+func aclEntry(entry string) (string, error) {
+	if len(entry) == 36 {
+		return entry, nil
+	}
+	key, err := decodeIdentityKey(entry)
+	if err != nil {
+		return "", fmt.Errorf("%s is neither peer ID nor identity key", entry)
+	}
+	return IdentityID(key), nil
+}
+
+// aclEntries converts every entry to peer ID
+func aclEntries(entries []string) ([]string, error) {
+	ids := []string{}
+	for _, entry := range entries {
+		id, err := aclEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Allowed returns true if peer with specified ID can join the swarm
+func (a *ACL) Allowed(id string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.deny[id] {
+		return false
+	}
+	return len(a.allow) == 0 || a.allow[id]
+}
+
+// denied returns true if peer is listed in deny list
+func (a *ACL) denied(id string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.deny[id]
+}
+
+// active returns true if any of the lists is not empty
+func (a *ACL) active() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return len(a.allow) > 0 || len(a.deny) > 0
+}
+
+// Allow adds peers to allow list and removes them from deny list
+func (a *ACL) Allow(entries ...string) error {
+	ids, err := aclEntries(entries)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.allow == nil {
+		a.allow = make(map[string]bool)
+	}
+	for _, id := range ids {
+		a.allow[id] = true
+		delete(a.deny, id)
+	}
+	return nil
+}
+
+// Deny adds peers to deny list and removes them from allow list
+func (a *ACL) Deny(entries ...string) error {
+	ids, err := aclEntries(entries)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.deny == nil {
+		a.deny = make(map[string]bool)
+	}
+	for _, id := range ids {
+		a.deny[id] = true
+		delete(a.allow, id)
+	}
+	return nil
+}
+
+// Remove deletes peers from both lists
+func (a *ACL) Remove(entries ...string) error {
+	ids, err := aclEntries(entries)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, id := range ids {
+		delete(a.allow, id)
+		delete(a.deny, id)
+	}
+	return nil
+}
+
+// Lists returns sorted allow and deny lists
+func (a *ACL) Lists() ([]string, []string) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	allow := []string{}
+	for id := range a.allow {
+		allow = append(allow, id)
+	}
+	deny := []string{}
+	for id := range a.deny {
+		deny = append(deny, id)
+	}
+	sort.Strings(allow)
+	sort.Strings(deny)
+	return allow, deny
+}
+
+// member returns true if peer is allowed by access lists or has joined
+// with an invite which hasn't expired yet. Invites let peers join even
+// when they are not in allow list, but never override deny list
+func (p *PeerToPeer) member(id string) bool {
+	if p.ACL.Allowed(id) {
+		return true
+	}
+	return !p.ACL.denied(id) && p.invited(id, time.Now())
+}
+
+// EnforceACL disconnects peers which are not allowed in the swarm anymore
+func (p *PeerToPeer) EnforceACL() int {
+	if p.Swarm == nil {
+		return 0
+	}
+	count := 0
+	for _, peer := range p.Swarm.Get() {
+		if peer == nil || p.member(peer.ID) {
+			continue
+		}
+		if peer.State == PeerStateDisconnect || peer.State == PeerStateStop {
+			continue
+		}
+		LogWith(Info, p.logFields(SubsystemPeer), "Peer %s is denied by access list. Disconnecting it", peer.ID)
+		peer.SetState(PeerStateDisconnect, p)
+		p.Swarm.Update(peer.ID, peer)
+		count++
+	}
+	return count
+}
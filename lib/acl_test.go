@@ -0,0 +1,181 @@
+package ptp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/p2p/protocol"
+)
+
+func TestACL(t *testing.T) {
+	id0 := "00000000-0000-0000-0000-000000000000"
+	id1 := "11111111-1111-1111-1111-111111111111"
+	identity, _ := NewIdentity()
+
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		remove  []string
+		allowed map[string]bool
+		wantErr bool
+	}{
+		{"empty lists", nil, nil, nil, map[string]bool{id0: true, id1: true}, false},
+		{"denied peer", nil, []string{id1}, nil, map[string]bool{id0: true, id1: false}, false},
+		{"allow list", []string{id0}, nil, nil, map[string]bool{id0: true, id1: false}, false},
+		{"deny overrides allow", []string{id0, id1}, []string{id1}, nil, map[string]bool{id0: true, id1: false}, false},
+		{"removed from deny list", nil, []string{id1}, []string{id1}, map[string]bool{id0: true, id1: true}, false},
+		{"denied by key", nil, []string{identity.PublicKey()}, nil, map[string]bool{id0: true, identity.ID(): false}, false},
+		{"bad entry", []string{"peer"}, nil, nil, map[string]bool{id0: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := new(ACL)
+			var err error
+			if len(tt.allow) > 0 {
+				err = a.Allow(tt.allow...)
+			}
+			if err == nil && len(tt.deny) > 0 {
+				err = a.Deny(tt.deny...)
+			}
+			if err == nil && len(tt.remove) > 0 {
+				err = a.Remove(tt.remove...)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ACL error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for id, want := range tt.allowed {
+				if got := a.Allowed(id); got != want {
+					t.Errorf("ACL.Allowed(%s) = %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestACL_Lists(t *testing.T) {
+	a := new(ACL)
+	a.Allow("22222222-2222-2222-2222-222222222222", "11111111-1111-1111-1111-111111111111")
+	a.Deny("00000000-0000-0000-0000-000000000000", "22222222-2222-2222-2222-222222222222")
+	allow, deny := a.Lists()
+	if !reflect.DeepEqual(allow, []string{"11111111-1111-1111-1111-111111111111"}) {
+		t.Errorf("ACL.Lists() allow = %v", allow)
+	}
+	if !reflect.DeepEqual(deny, []string{"00000000-0000-0000-0000-000000000000", "22222222-2222-2222-2222-222222222222"}) {
+		t.Errorf("ACL.Lists() deny = %v", deny)
+	}
+}
+
+func TestPeerToPeer_packetFind_acl(t *testing.T) {
+	id := "11111111-1111-1111-1111-111111111111"
+	p := &PeerToPeer{
+		Dht:          &DHTClient{ID: "00000000-0000-0000-0000-000000000000"},
+		Swarm:        new(Swarm),
+		ProxyManager: new(ProxyManager),
+	}
+	p.Swarm.Init()
+	p.ACL.Deny(id)
+	packet := &protocol.DHTPacket{Data: id, Arguments: []string{"1.2.3.4:6000"}, Extra: "skip"}
+	if err := p.packetFind(packet); err != nil {
+		t.Fatalf("PeerToPeer.packetFind() error = %v", err)
+	}
+	if p.Swarm.GetPeer(id) != nil {
+		t.Errorf("Denied peer was added to the swarm")
+	}
+	if err := p.packetNode(packet); err == nil {
+		t.Errorf("PeerToPeer.packetNode() accepted denied peer")
+	}
+}
+
+func TestPeerToPeer_HandleIntroRequestMessage_acl(t *testing.T) {
+	id := "11111111-1111-1111-1111-111111111111"
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 0)
+	defer socket.Close()
+	p := &PeerToPeer{Dht: &DHTClient{ID: "00000000-0000-0000-0000-000000000000"}, Swarm: new(Swarm), UDPSocket: socket}
+	p.Swarm.Init()
+	src := listener.LocalAddr().(*net.UDPAddr)
+	p.Swarm.peers[id] = &NetworkPeer{ID: id, KnownIPs: []*net.UDPAddr{src}}
+	p.ACL.Deny(id)
+
+	msg := &P2PMessage{Data: []byte(id + src.String())}
+	if err := p.HandleIntroRequestMessage(msg, src); err == nil {
+		t.Errorf("PeerToPeer.HandleIntroRequestMessage() accepted denied peer")
+	}
+	if err := p.HandleIntroMessage(&P2PMessage{Data: []byte(id + ",00:11:22:33:44:55,10.0.0.2," + src.String())}, src); err == nil {
+		t.Errorf("PeerToPeer.HandleIntroMessage() accepted denied peer")
+	}
+	listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buf := make([]byte, 1024)
+	if _, _, err := listener.ReadFromUDP(buf); err == nil {
+		t.Errorf("Denied peer received a reply")
+	}
+}
+
+func TestPeerToPeer_EnforceACL(t *testing.T) {
+	p := &PeerToPeer{Dht: new(DHTClient), Swarm: new(Swarm)}
+	p.Swarm.Init()
+	p.Swarm.peers["00000000-0000-0000-0000-000000000000"] = &NetworkPeer{ID: "00000000-0000-0000-0000-000000000000", State: PeerStateConnected}
+	p.Swarm.peers["11111111-1111-1111-1111-111111111111"] = &NetworkPeer{ID: "11111111-1111-1111-1111-111111111111", State: PeerStateConnected}
+	p.ACL.Allow("00000000-0000-0000-0000-000000000000")
+	if n := p.EnforceACL(); n != 1 {
+		t.Fatalf("PeerToPeer.EnforceACL() = %d, want 1", n)
+	}
+	if p.Swarm.peers["11111111-1111-1111-1111-111111111111"].State != PeerStateDisconnect {
+		t.Errorf("Peer outside of allow list wasn't disconnected")
+	}
+	if p.Swarm.peers["00000000-0000-0000-0000-000000000000"].State != PeerStateConnected {
+		t.Errorf("Allowed peer was disconnected")
+	}
+}
+
+func TestPeerToPeer_introKeyExchange_acl(t *testing.T) {
+	p := new(PeerToPeer)
+	p.Crypter = Crypto{Active: true, ActiveKey: CryptoKey{Key: []byte("1234567812345678")}}
+	p.Crypter.initAEAD()
+	p.Identity, _ = NewIdentity()
+
+	remote, _ := NewIdentity()
+	other, _ := NewIdentity()
+	remoteEph, _ := NewIdentity()
+	kx := func(static *Identity) []byte {
+		payload := []byte{keyExchangeVersion}
+		payload = append(payload, static.Public...)
+		payload = append(payload, remoteEph.Public...)
+		payload = append(payload, 0x1, 0x2, 0x3, 0x4)
+		return append(payload, swarmKeyID(p.Crypter.ActiveKey.Key)...)
+	}
+	p.ACL.Allow(remote.ID(), other.ID())
+
+	tests := []struct {
+		name    string
+		kx      []byte
+		wantErr bool
+	}{
+		{"missing keys", nil, true},
+		{"key of another peer", kx(other), true},
+		{"matching key", kx(remote), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := &NetworkPeer{ID: remote.ID()}
+			if err := p.introKeyExchange(peer, tt.kx); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.introKeyExchange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Denied key is refused even when it matches ID of the peer
+	p.ACL.Deny(other.PublicKey())
+	if err := p.introKeyExchange(&NetworkPeer{ID: other.ID()}, kx(other)); err == nil {
+		t.Errorf("PeerToPeer.introKeyExchange() accepted denied key")
+	}
+}
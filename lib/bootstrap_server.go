@@ -0,0 +1,771 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/subutai-io/p2p/protocol"
+)
+
+// Bootstrap server keeps track of swarms and tells peers how to reach
+// each other. Every daemon keeps a single TCP connection to the server
+// which is shared by all of its instances, so nodes are identified by
+// IDs and the connection they were registered on. Nodes and proxies
+// are forgotten when their connection is closed. Node which claims ID
+// still registered on another connection, e.g. after restart, must
+// answer a challenge with proof of owning identity key the ID is
+// derived from
+
+// Bootstrap server settings
+const (
+	BootstrapIdleTimeout = time.Duration(time.Second * 90)
+	BootstrapProxyLimit  = 3 // Number of proxies offered to a peer
+)
+
+var (
+	errBootstrapUnknownNode = errors.New("unknown node")
+	errBootstrapNoNetwork   = errors.New("network of this swarm is unknown")
+	errBootstrapNoFreeIP    = errors.New("no free IP addresses left in swarm network")
+)
+
+// bootstrapChallenge is a query of connect reply which challenges node
+// to prove its identity
+const bootstrapChallenge = "challenge"
+
+// bootstrapConn is a connection with a single daemon or relay
+type bootstrapConn struct {
+	conn    net.Conn
+	ip      net.IP
+	framed  bool   // Whether client sends length-prefixed frames
+	pending []byte // Undelimited data of older client waiting for the rest of packet
+	lock    sync.Mutex
+
+	challenges map[string]*Identity // Challenges sent to nodes claiming taken IDs
+}
+
+// send marshals packet and writes it in a frame if client supports
+// framing or followed by delimiter otherwise
+func (c *bootstrapConn) send(packet *protocol.DHTPacket) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	packet.Version = LegacyPacketVersion
+	if c.framed {
+		packet.Version = PacketVersion
+	}
+	data, err := proto.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	if c.framed {
+		data, err = EncodeDHTFrame(data)
+		if err != nil {
+			return err
+		}
+	} else {
+		data = append(data, dhtDelimiter...)
+	}
+	_, err = c.conn.Write(data)
+	return err
+}
+
+// setFramed switches connection to length-prefixed frames
+func (c *bootstrapConn) setFramed() {
+	c.lock.Lock()
+	c.framed = true
+	c.lock.Unlock()
+}
+
+// challenge returns key pair of challenge sent to node with specified
+// ID. The same challenge is used until node answers it
+func (c *bootstrapConn) challenge(id string) (*Identity, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if challenge, exists := c.challenges[id]; exists {
+		return challenge, nil
+	}
+	challenge, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if c.challenges == nil {
+		c.challenges = make(map[string]*Identity)
+	}
+	c.challenges[id] = challenge
+	return challenge, nil
+}
+
+// challenged returns true if node with specified ID was challenged
+func (c *bootstrapConn) challenged(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, exists := c.challenges[id]
+	return exists
+}
+
+// proven checks proof of identity sent by node in reply to challenge
+func (c *bootstrapConn) proven(node *bootstrapNode, proof []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	challenge, exists := c.challenges[node.id]
+	if !exists || len(proof) == 0 {
+		return false
+	}
+	expected, err := identityProof(challenge.Private, node.key, node.id, node.infohash)
+	if err != nil || !hmac.Equal(expected, proof) {
+		return false
+	}
+	delete(c.challenges, node.id)
+	return true
+}
+
+// bootstrapNode is a peer participating in a swarm
+type bootstrapNode struct {
+	id        string
+	infohash  string
+	conn      *bootstrapConn
+	endpoints []string   // Public endpoint followed by local ones
+	proxies   []string   // Proxy tunnels reported by node
+	ip        net.IP     // IP of the node's p2p interface
+	network   *net.IPNet // Network of the node's p2p interface
+	key       []byte     // Identity key presented by node
+}
+
+// bootstrapProxy is a relay registered on this server
+type bootstrapProxy struct {
+	id       string
+	endpoint string
+	conn     *bootstrapConn
+	load     int
+}
+
+type bootstrapHandler func(c *bootstrapConn, packet *protocol.DHTPacket) error
+
+// BootstrapServer implements server side of DHT protocol
+type BootstrapServer struct {
+	Version  string      // Version reported to clients during handshake
+	TLS      *tls.Config // Plain TCP is used when not set
+	listener net.Listener
+	nodes    map[string]*bootstrapNode
+	proxies  map[string]*bootstrapProxy
+	handlers map[protocol.DHTPacketType]bootstrapHandler
+	lock     sync.RWMutex
+	shutdown int32 // Set atomically when server is closed
+}
+
+// NewBootstrapServer creates bootstrap server. Listener is started with Run
+func NewBootstrapServer(version string) *BootstrapServer {
+	s := &BootstrapServer{
+		Version: version,
+		nodes:   make(map[string]*bootstrapNode),
+		proxies: make(map[string]*bootstrapProxy),
+	}
+	s.handlers = map[protocol.DHTPacketType]bootstrapHandler{
+		protocol.DHTPacketType_Connect:       s.handleConnect,
+		protocol.DHTPacketType_Find:          s.handleFind,
+		protocol.DHTPacketType_Node:          s.handleNode,
+		protocol.DHTPacketType_Ping:          s.handlePing,
+		protocol.DHTPacketType_RegisterProxy: s.handleRegisterProxy,
+		protocol.DHTPacketType_ReportLoad:    s.handleReportLoad,
+		protocol.DHTPacketType_Proxy:         s.handleProxy,
+		protocol.DHTPacketType_RequestProxy:  s.handleRequestProxy,
+		protocol.DHTPacketType_ReportProxy:   s.handleReportProxy,
+		protocol.DHTPacketType_State:         s.handleState,
+		protocol.DHTPacketType_DHCP:          s.handleDHCP,
+		protocol.DHTPacketType_Stop:          s.handleStop,
+	}
+	return s
+}
+
+// Listen opens TCP listener on specified address
+func (s *BootstrapServer) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if s.TLS != nil {
+		listener = tls.NewListener(listener, s.TLS)
+	}
+	s.listener = listener
+	return nil
+}
+
+// Addr returns address server is listening on
+func (s *BootstrapServer) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Run accepts connections until server is closed
+func (s *BootstrapServer) Run() error {
+	if s.listener == nil {
+		return fmt.Errorf("nil listener")
+	}
+	for !s.closed() {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.closed() {
+				break
+			}
+			LogWith(Error, Fields{Subsystem: SubsystemBootstrap}, "Failed to accept connection: %s", err)
+			continue
+		}
+		go s.serve(conn)
+	}
+	return nil
+}
+
+// Close stops listener
+func (s *BootstrapServer) Close() error {
+	atomic.StoreInt32(&s.shutdown, 1)
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// closed returns true if server was closed
+func (s *BootstrapServer) closed() bool {
+	return atomic.LoadInt32(&s.shutdown) == 1
+}
+
+// serve handshakes with a client and processes its packets
+func (s *BootstrapServer) serve(conn net.Conn) {
+	c := &bootstrapConn{conn: conn}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		c.ip = addr.IP
+	}
+	LogWith(Info, Fields{Subsystem: SubsystemBootstrap, Endpoint: conn.RemoteAddr().String()}, "New connection from %s", conn.RemoteAddr())
+	defer s.disconnect(c)
+
+	// Client waits for ping with its outbound IP before sending anything.
+	// Supported versions are listed in arguments, so clients supporting
+	// framing can switch to it, while older ones see legacy version
+	versions := []string{}
+	for _, v := range SupportedVersion {
+		versions = append(versions, strconv.Itoa(int(v)))
+	}
+	err := c.send(&protocol.DHTPacket{
+		Type:      protocol.DHTPacketType_Ping,
+		Data:      c.ip.String(),
+		Extra:     s.Version,
+		Arguments: versions,
+	})
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, DHTBufferSize)
+	reader := new(DHTFrameReader)
+	for !s.closed() {
+		conn.SetReadDeadline(time.Now().Add(BootstrapIdleTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			LogWith(Info, Fields{Subsystem: SubsystemBootstrap, Endpoint: conn.RemoteAddr().String()}, "Connection with %s closed: %s", conn.RemoteAddr(), err)
+			return
+		}
+		if !c.framed && (c.pending != nil || !IsDHTFrame(buf[:n])) {
+			if err := s.handleLegacy(c, buf[:n]); err != nil {
+				LogWith(Warning, Fields{Subsystem: SubsystemBootstrap, Endpoint: conn.RemoteAddr().String()}, "Broken stream from %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+			continue
+		}
+		if !c.framed {
+			LogWith(Debug, Fields{Subsystem: SubsystemBootstrap, Endpoint: conn.RemoteAddr().String()}, "%s switched to framed packets", conn.RemoteAddr())
+			c.setFramed()
+		}
+		reader.Write(buf[:n])
+		for {
+			data, err := reader.Next()
+			if err != nil {
+				LogWith(Warning, Fields{Subsystem: SubsystemBootstrap, Endpoint: conn.RemoteAddr().String()}, "Broken stream from %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+			if data == nil {
+				break
+			}
+			s.handleData(c, data)
+		}
+	}
+}
+
+// handleLegacy processes data of older clients, which don't delimit
+// packets. Data is kept until it can be unmarshaled, because packet may
+// be split between several reads
+func (s *BootstrapServer) handleLegacy(c *bootstrapConn, data []byte) error {
+	chunks := bytes.Split(append(c.pending, data...), dhtDelimiter)
+	c.pending = nil
+	for _, chunk := range chunks[:len(chunks)-1] {
+		s.handleData(c, chunk)
+	}
+	last := chunks[len(chunks)-1]
+	if len(last) == 0 {
+		return nil
+	}
+	if proto.Unmarshal(last, &protocol.DHTPacket{}) == nil {
+		s.handleData(c, last)
+		return nil
+	}
+	if len(last) > DHTMaxFrameSize {
+		return errFrameTooLarge
+	}
+	c.pending = append([]byte{}, last...)
+	return nil
+}
+
+// handleData unmarshals single packet received from client
+func (s *BootstrapServer) handleData(c *bootstrapConn, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	packet := &protocol.DHTPacket{}
+	if err := proto.Unmarshal(data, packet); err != nil {
+		LogWith(Warning, Fields{Subsystem: SubsystemBootstrap, Endpoint: c.conn.RemoteAddr().String()}, "Corrupted packet from %s: %s", c.conn.RemoteAddr(), err)
+		return
+	}
+	if err := s.handlePacket(c, packet); err != nil {
+		LogWith(Debug, Fields{Subsystem: SubsystemBootstrap, Endpoint: c.conn.RemoteAddr().String()}, "Failed to handle %s from %s: %s", packet.Type, c.conn.RemoteAddr(), err)
+	}
+}
+
+// handlePacket checks packet version and passes it to the handler
+func (s *BootstrapServer) handlePacket(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	supported := false
+	for _, v := range SupportedVersion {
+		if v == packet.Version {
+			supported = true
+		}
+	}
+	if !supported {
+		c.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Unsupported, Infohash: packet.Infohash})
+		return fmt.Errorf("unsupported version %d", packet.Version)
+	}
+	handler, exists := s.handlers[packet.Type]
+	if !exists {
+		return s.sendError(c, packet, fmt.Errorf("unsupported packet type %s", packet.Type))
+	}
+	return handler(c, packet)
+}
+
+// sendError notifies client about failed request
+func (s *BootstrapServer) sendError(c *bootstrapConn, packet *protocol.DHTPacket, err error) error {
+	c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Error,
+		Infohash: packet.Infohash,
+		Data:     "Error",
+		Extra:    err.Error(),
+	})
+	return err
+}
+
+// node returns node registered on this connection
+func (s *BootstrapServer) node(c *bootstrapConn, id string) *bootstrapNode {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	node, exists := s.nodes[id]
+	if !exists || node.conn != c {
+		return nil
+	}
+	return node
+}
+
+// knownNode replies with Unknown packet to nodes that must reconnect
+func (s *BootstrapServer) knownNode(c *bootstrapConn, packet *protocol.DHTPacket) (*bootstrapNode, error) {
+	node := s.node(c, packet.Id)
+	if node == nil || node.infohash != packet.Infohash {
+		c.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Unknown, Infohash: packet.Infohash})
+		return nil, errBootstrapUnknownNode
+	}
+	return node, nil
+}
+
+// swarm returns every node of the swarm
+func (s *BootstrapServer) swarm(infohash string) []*bootstrapNode {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	nodes := []*bootstrapNode{}
+	for _, node := range s.nodes {
+		if node.infohash == infohash {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// findPacket describes node to other members of the swarm
+func (s *BootstrapServer) findPacket(node *bootstrapNode) *protocol.DHTPacket {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return &protocol.DHTPacket{
+		Type:      protocol.DHTPacketType_Find,
+		Infohash:  node.infohash,
+		Data:      node.id,
+		Arguments: append([]string{}, node.endpoints...),
+		Proxies:   append([]string{}, node.proxies...),
+	}
+}
+
+// handleConnect registers node in a swarm. Node ID is generated by
+// client, but server assigns a new one if it's malformed or taken.
+// Node which proves ownership of identity key its ID is derived from
+// replaces stale registration left after restart
+func (s *BootstrapServer) handleConnect(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	if packet.Infohash == "" {
+		return s.sendError(c, packet, fmt.Errorf("empty infohash"))
+	}
+	localPort, err := strconv.Atoi(packet.Data)
+	if err != nil {
+		return s.sendError(c, packet, fmt.Errorf("bad local port: %s", packet.Data))
+	}
+	remotePort, err := strconv.Atoi(packet.Query)
+	if err != nil || remotePort == 0 {
+		remotePort = localPort
+	}
+
+	node := &bootstrapNode{
+		id:       packet.Id,
+		infohash: packet.Infohash,
+		conn:     c,
+		proxies:  packet.Proxies,
+	}
+	if key, err := base64.StdEncoding.DecodeString(packet.Extra); err == nil && len(key) == 32 {
+		node.key = key
+	}
+	if c.ip != nil {
+		node.endpoints = append(node.endpoints, net.JoinHostPort(c.ip.String(), strconv.Itoa(remotePort)))
+	}
+	for _, ip := range packet.Arguments {
+		if net.ParseIP(ip) == nil {
+			continue
+		}
+		node.endpoints = append(node.endpoints, net.JoinHostPort(ip, strconv.Itoa(localPort)))
+	}
+
+	returning := node.key != nil && IdentityID(node.key) == node.id
+	proven := returning && c.proven(node, packet.Payload)
+	s.lock.RLock()
+	existing, taken := s.nodes[node.id]
+	s.lock.RUnlock()
+	if returning && !proven && taken && existing.conn != c {
+		if len(packet.Payload) != 0 && c.challenged(node.id) {
+			// Proof is either forged or answers challenge of
+			// another bootstrap node the client is connected to
+			return fmt.Errorf("node %s failed to prove its identity", node.id)
+		}
+		challenge, err := c.challenge(node.id)
+		if err != nil {
+			return s.sendError(c, packet, err)
+		}
+		LogWith(Debug, Fields{Hash: node.infohash, Peer: node.id, Subsystem: SubsystemBootstrap, Endpoint: c.conn.RemoteAddr().String()}, "Node %s must prove its identity", node.id)
+		return c.send(&protocol.DHTPacket{
+			Type:     protocol.DHTPacketType_Connect,
+			Id:       node.id,
+			Infohash: node.infohash,
+			Query:    bootstrapChallenge,
+			Extra:    challenge.PublicKey(),
+		})
+	}
+
+	s.lock.Lock()
+	existing, taken = s.nodes[node.id]
+	if taken && existing.conn != c && proven {
+		LogWith(Info, Fields{Hash: node.infohash, Peer: node.id, Subsystem: SubsystemBootstrap, Endpoint: c.conn.RemoteAddr().String()}, "Node %s has returned", node.id)
+	} else if len(node.id) != 36 || taken && existing.conn != c {
+		node.id = GenerateToken()
+	}
+	s.nodes[node.id] = node
+	s.lock.Unlock()
+	LogWith(Info, Fields{Hash: node.infohash, Peer: node.id, Subsystem: SubsystemBootstrap, Endpoint: c.conn.RemoteAddr().String()}, "Node %s joined swarm %s", node.id, node.infohash)
+
+	err = c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Connect,
+		Id:       node.id,
+		Infohash: node.infohash,
+	})
+	if err != nil {
+		return err
+	}
+	// Let members of the swarm know about newcomer without waiting
+	// for their next find request
+	announce := s.findPacket(node)
+	for _, member := range s.swarm(node.infohash) {
+		if member.id != node.id {
+			member.conn.send(announce)
+		}
+	}
+	return nil
+}
+
+// handleFind sends description of every other node of the swarm
+func (s *BootstrapServer) handleFind(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	node, err := s.knownNode(c, packet)
+	if err != nil {
+		return err
+	}
+	for _, member := range s.swarm(node.infohash) {
+		if member.id == node.id {
+			continue
+		}
+		if err := c.send(s.findPacket(member)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleNode sends endpoints of a single node
+func (s *BootstrapServer) handleNode(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	node, err := s.knownNode(c, packet)
+	if err != nil {
+		return err
+	}
+	s.lock.RLock()
+	target, exists := s.nodes[packet.Data]
+	s.lock.RUnlock()
+	if !exists || target.infohash != node.infohash {
+		return s.sendError(c, packet, fmt.Errorf("node %s not found", packet.Data))
+	}
+	response := s.findPacket(target)
+	response.Type = protocol.DHTPacketType_Node
+	response.Proxies = nil
+	return c.send(response)
+}
+
+// handlePing reports outbound IP of the client
+func (s *BootstrapServer) handlePing(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	return c.send(&protocol.DHTPacket{
+		Type: protocol.DHTPacketType_Ping,
+		Data: c.ip.String(),
+	})
+}
+
+// handleRegisterProxy adds relay to the list of proxies offered to peers
+func (s *BootstrapServer) handleRegisterProxy(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	if len(packet.Id) != 36 {
+		return s.sendError(c, packet, fmt.Errorf("malformed proxy ID"))
+	}
+	if _, err := resolveUDPAddr(packet.Data); err != nil {
+		return s.sendError(c, packet, fmt.Errorf("bad proxy address %s", packet.Data))
+	}
+	s.lock.Lock()
+	existing, exists := s.proxies[packet.Id]
+	if exists && existing.conn != c {
+		s.lock.Unlock()
+		return s.sendError(c, packet, fmt.Errorf("proxy %s is already registered", packet.Id))
+	}
+	s.proxies[packet.Id] = &bootstrapProxy{
+		id:       packet.Id,
+		endpoint: packet.Data,
+		conn:     c,
+	}
+	s.lock.Unlock()
+	LogWith(Info, Fields{Subsystem: SubsystemBootstrap, Endpoint: c.conn.RemoteAddr().String()}, "Registered proxy %s at %s", packet.Id, packet.Data)
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_RegisterProxy,
+		Id:       packet.Id,
+		Infohash: packet.Infohash,
+		Data:     "OK",
+	})
+}
+
+// handleReportLoad updates number of clients served by a proxy
+func (s *BootstrapServer) handleReportLoad(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	load, err := strconv.Atoi(packet.Data)
+	if err != nil || load < 0 {
+		return s.sendError(c, packet, fmt.Errorf("bad load value %s", packet.Data))
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	proxy, exists := s.proxies[packet.Id]
+	if !exists || proxy.conn != c {
+		return errBootstrapUnknownNode
+	}
+	proxy.load = load
+	return nil
+}
+
+// handleProxy offers least loaded proxies
+func (s *BootstrapServer) handleProxy(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	if _, err := s.knownNode(c, packet); err != nil {
+		return err
+	}
+	s.lock.RLock()
+	list := []*bootstrapProxy{}
+	for _, proxy := range s.proxies {
+		list = append(list, proxy)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].load == list[j].load {
+			return list[i].id < list[j].id
+		}
+		return list[i].load < list[j].load
+	})
+	proxies := []string{}
+	for i := 0; i < len(list) && i < BootstrapProxyLimit; i++ {
+		proxies = append(proxies, list[i].endpoint)
+	}
+	s.lock.RUnlock()
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_Proxy,
+		Infohash: packet.Infohash,
+		Proxies:  proxies,
+	})
+}
+
+// handleRequestProxy sends proxies reported by particular node
+func (s *BootstrapServer) handleRequestProxy(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	node, err := s.knownNode(c, packet)
+	if err != nil {
+		return err
+	}
+	s.lock.RLock()
+	target, exists := s.nodes[packet.Data]
+	s.lock.RUnlock()
+	if !exists || target.infohash != node.infohash {
+		return s.sendError(c, packet, fmt.Errorf("node %s not found", packet.Data))
+	}
+	response := s.findPacket(target)
+	response.Type = protocol.DHTPacketType_RequestProxy
+	response.Arguments = nil
+	return c.send(response)
+}
+
+// handleReportProxy saves proxies node is reachable over
+func (s *BootstrapServer) handleReportProxy(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	node, err := s.knownNode(c, packet)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	node.proxies = packet.Proxies
+	s.lock.Unlock()
+	return nil
+}
+
+// handleState passes state of connection to the peer it's about
+func (s *BootstrapServer) handleState(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	node, err := s.knownNode(c, packet)
+	if err != nil {
+		return err
+	}
+	s.lock.RLock()
+	target, exists := s.nodes[packet.Data]
+	s.lock.RUnlock()
+	if !exists || target.infohash != node.infohash {
+		return nil
+	}
+	return target.conn.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_State,
+		Infohash: target.infohash,
+		Data:     node.id,
+		Extra:    packet.Extra,
+	})
+}
+
+// handleDHCP saves network configuration reported by a node or picks
+// a free address for a node which requests it
+func (s *BootstrapServer) handleDHCP(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	node, err := s.knownNode(c, packet)
+	if err != nil {
+		return err
+	}
+	if packet.Data != "127.0.0.1" || packet.Extra != "0" {
+		ip, network, err := net.ParseCIDR(fmt.Sprintf("%s/%s", packet.Data, packet.Extra))
+		if err != nil {
+			return s.sendError(c, packet, fmt.Errorf("bad network information: %s", err))
+		}
+		s.lock.Lock()
+		node.ip, node.network = ip, network
+		s.lock.Unlock()
+		return nil
+	}
+
+	ip, network, err := s.allocateIP(node)
+	if err != nil {
+		return s.sendError(c, packet, err)
+	}
+	ones, _ := network.Mask.Size()
+	return c.send(&protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_DHCP,
+		Infohash: node.infohash,
+		Data:     ip.String(),
+		Extra:    strconv.Itoa(ones),
+	})
+}
+
+// allocateIP picks first unused IPv4 address in the network of the swarm
+func (s *BootstrapServer) allocateIP(node *bootstrapNode) (net.IP, *net.IPNet, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var network *net.IPNet
+	used := make(map[string]bool)
+	for _, member := range s.nodes {
+		if member.infohash != node.infohash || member.ip == nil {
+			continue
+		}
+		if network == nil {
+			network = member.network
+		}
+		used[member.ip.String()] = true
+	}
+	if network == nil || network.IP.To4() == nil {
+		return nil, nil, errBootstrapNoNetwork
+	}
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	ones, bits := network.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	// Network and broadcast addresses are skipped
+	for i := uint32(1); i+1 < size; i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+i)
+		if !used[ip.String()] {
+			node.ip, node.network = ip, network
+			return ip, network, nil
+		}
+	}
+	return nil, nil, errBootstrapNoFreeIP
+}
+
+// handleStop removes node from the swarm
+func (s *BootstrapServer) handleStop(c *bootstrapConn, packet *protocol.DHTPacket) error {
+	node := s.node(c, packet.Id)
+	if node == nil {
+		return errBootstrapUnknownNode
+	}
+	s.lock.Lock()
+	delete(s.nodes, node.id)
+	s.lock.Unlock()
+	LogWith(Info, Fields{Hash: node.infohash, Peer: node.id, Subsystem: SubsystemBootstrap, Endpoint: c.conn.RemoteAddr().String()}, "Node %s left swarm %s", node.id, node.infohash)
+	return nil
+}
+
+// disconnect forgets nodes and proxies registered over closed connection
+func (s *BootstrapServer) disconnect(c *bootstrapConn) {
+	c.conn.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, node := range s.nodes {
+		if node.conn == c {
+			delete(s.nodes, id)
+		}
+	}
+	for id, proxy := range s.proxies {
+		if proxy.conn == c {
+			delete(s.proxies, id)
+		}
+	}
+}
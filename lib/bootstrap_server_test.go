@@ -0,0 +1,328 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/subutai-io/p2p/protocol"
+)
+
+// bootstrapTestClient speaks to bootstrap server the way daemon does
+type bootstrapTestClient struct {
+	t       *testing.T
+	conn    net.Conn
+	version int32
+	reader  DHTFrameReader
+}
+
+func dialBootstrap(t *testing.T, s *BootstrapServer) *bootstrapTestClient {
+	return dialBootstrapVersion(t, s, PacketVersion)
+}
+
+// dialBootstrapVersion connects to bootstrap as a client which supports
+// packet versions up to specified one
+func dialBootstrapVersion(t *testing.T, s *BootstrapServer, max int32) *bootstrapTestClient {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to bootstrap: %v", err)
+	}
+	c := &bootstrapTestClient{t: t, conn: conn}
+	ping := c.read()
+	if ping.Type != protocol.DHTPacketType_Ping || ping.Data != "127.0.0.1" {
+		t.Fatalf("Bootstrap didn't send handshake: %+v", ping)
+	}
+	c.version = ping.Version
+	if version, ok := NegotiateVersion(ping); ok && version <= max {
+		c.version = version
+	}
+	return c
+}
+
+func (c *bootstrapTestClient) send(packet *protocol.DHTPacket) {
+	packet.Version = c.version
+	data, _ := proto.Marshal(packet)
+	if c.version >= FramingVersion {
+		data, _ = EncodeDHTFrame(data)
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatalf("Failed to send packet: %v", err)
+	}
+	if c.version < FramingVersion {
+		// Legacy client doesn't delimit packets, so they must not be merged
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func (c *bootstrapTestClient) read() *protocol.DHTPacket {
+	for {
+		data, err := c.reader.Next()
+		if err != nil {
+			c.t.Fatalf("Failed to read packet: %v", err)
+		}
+		if data != nil {
+			packet := &protocol.DHTPacket{}
+			if err := proto.Unmarshal(data, packet); err != nil {
+				c.t.Fatalf("Failed to unmarshal packet: %v", err)
+			}
+			return packet
+		}
+		buf := make([]byte, DHTBufferSize)
+		c.conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.t.Fatalf("Failed to read packet: %v", err)
+		}
+		c.reader.Write(buf[:n])
+	}
+}
+
+func TestBootstrapServer(t *testing.T) {
+	s := NewBootstrapServer("test")
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("BootstrapServer.Listen() error = %v", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	// First node doesn't support framing
+	id1 := "11111111-1111-1111-1111-111111111111"
+	c1 := dialBootstrapVersion(t, s, LegacyPacketVersion)
+	defer c1.conn.Close()
+	c2 := dialBootstrap(t, s)
+	defer c2.conn.Close()
+
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Find, Id: id1, Infohash: "swarm"})
+	if got := c1.read(); got.Type != protocol.DHTPacketType_Unknown {
+		t.Fatalf("Unregistered node wasn't asked to reconnect: %+v", got)
+	}
+
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: id1, Infohash: "swarm", Data: "1000", Query: "2000", Arguments: []string{"192.168.0.1"}})
+	if got := c1.read(); got.Type != protocol.DHTPacketType_Connect || got.Id != id1 {
+		t.Fatalf("Connect wasn't confirmed: %+v", got)
+	}
+	// ID of the first node is taken, so second one receives new ID
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: id1, Infohash: "swarm", Data: "1000"})
+	got := c2.read()
+	if got.Type != protocol.DHTPacketType_Connect || len(got.Id) != 36 || got.Id == id1 {
+		t.Fatalf("Second node received wrong ID: %+v", got)
+	}
+	id2 := got.Id
+
+	// First node is notified about newcomer
+	got = c1.read()
+	if got.Type != protocol.DHTPacketType_Find || got.Data != id2 || len(got.Arguments) != 1 || got.Arguments[0] != "127.0.0.1:1000" {
+		t.Fatalf("Node wasn't announced: %+v", got)
+	}
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Find, Id: id2, Infohash: "swarm"})
+	got = c2.read()
+	if got.Type != protocol.DHTPacketType_Find || got.Data != id1 || len(got.Arguments) != 2 || got.Arguments[0] != "127.0.0.1:2000" || got.Arguments[1] != "192.168.0.1:1000" {
+		t.Fatalf("Find returned wrong peer: %+v", got)
+	}
+
+	// State is passed to the peer it's about
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_State, Id: id2, Infohash: "swarm", Data: id1, Extra: "3"})
+	if got := c1.read(); got.Type != protocol.DHTPacketType_State || got.Data != id2 || got.Extra != "3" {
+		t.Fatalf("State wasn't relayed: %+v", got)
+	}
+
+	// DHCP
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_DHCP, Id: id1, Infohash: "swarm", Data: "10.0.0.1", Extra: "24"})
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_DHCP, Id: id2, Infohash: "swarm", Data: "127.0.0.1", Extra: "0"})
+	if got := c2.read(); got.Type != protocol.DHTPacketType_DHCP || got.Data != "10.0.0.2" || got.Extra != "24" {
+		t.Fatalf("Wrong DHCP response: %+v", got)
+	}
+
+	// Proxies
+	proxyID := "33333333-3333-3333-3333-333333333333"
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_RegisterProxy, Id: proxyID, Data: "10.10.10.10:6882"})
+	if got := c1.read(); got.Type != protocol.DHTPacketType_RegisterProxy || got.Data != "OK" {
+		t.Fatalf("Proxy registration wasn't confirmed: %+v", got)
+	}
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_ReportLoad, Id: proxyID, Data: "5"})
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Proxy, Id: id2, Infohash: "swarm"})
+	if got := c2.read(); got.Type != protocol.DHTPacketType_Proxy || len(got.Proxies) != 1 || got.Proxies[0] != "10.10.10.10:6882" {
+		t.Fatalf("Wrong proxy list: %+v", got)
+	}
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_ReportProxy, Id: id1, Infohash: "swarm", Proxies: []string{"10.10.10.10:40000"}})
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_RequestProxy, Id: id2, Infohash: "swarm", Data: id1})
+	if got := c2.read(); got.Type != protocol.DHTPacketType_RequestProxy || got.Data != id1 || len(got.Proxies) != 1 {
+		t.Fatalf("Wrong proxies of peer: %+v", got)
+	}
+
+	// Stopped node is not returned anymore
+	c1.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Stop, Id: id1, Infohash: "swarm"})
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Node, Id: id2, Infohash: "swarm", Data: id1})
+	if got := c2.read(); got.Type != protocol.DHTPacketType_Error {
+		t.Fatalf("Stopped node is still known: %+v", got)
+	}
+
+	// Packets of unsupported version are refused
+	data, _ := proto.Marshal(&protocol.DHTPacket{Type: protocol.DHTPacketType_Find, Id: id2, Infohash: "swarm", Version: 1})
+	frame, _ := EncodeDHTFrame(data)
+	c2.conn.Write(frame)
+	if got := c2.read(); got.Type != protocol.DHTPacketType_Unsupported {
+		t.Fatalf("Unsupported version was accepted: %+v", got)
+	}
+}
+
+func TestBootstrapServer_framing(t *testing.T) {
+	s := NewBootstrapServer("test")
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("BootstrapServer.Listen() error = %v", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	legacy := dialBootstrapVersion(t, s, LegacyPacketVersion)
+	defer legacy.conn.Close()
+	if legacy.version != LegacyPacketVersion {
+		t.Fatalf("Legacy client negotiated version %d", legacy.version)
+	}
+	c := dialBootstrap(t, s)
+	defer c.conn.Close()
+	if c.version != PacketVersion {
+		t.Fatalf("Client negotiated version %d", c.version)
+	}
+
+	// Coalesced frames followed by a frame split in two writes
+	stream := []byte{}
+	for i := 0; i < 3; i++ {
+		data, _ := proto.Marshal(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Query: "req", Version: PacketVersion})
+		frame, _ := EncodeDHTFrame(data)
+		stream = append(stream, frame...)
+	}
+	c.conn.Write(stream[:len(stream)-3])
+	time.Sleep(time.Millisecond * 20)
+	c.conn.Write(stream[len(stream)-3:])
+	for i := 0; i < 3; i++ {
+		if got := c.read(); got.Type != protocol.DHTPacketType_Ping || got.Version != PacketVersion {
+			t.Fatalf("Wrong reply to packet %d: %+v", i, got)
+		}
+	}
+	legacy.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Query: "req"})
+	if got := legacy.read(); got.Type != protocol.DHTPacketType_Ping || got.Version != LegacyPacketVersion {
+		t.Fatalf("Wrong reply to legacy client: %+v", got)
+	}
+
+	// Undelimited legacy packet split in two reads
+	data, _ := proto.Marshal(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping, Query: "split-request", Version: LegacyPacketVersion})
+	split := bytes.Index(data, []byte("split")) + 3
+	legacy.conn.Write(data[:split])
+	time.Sleep(time.Millisecond * 20)
+	legacy.conn.Write(data[split:])
+	if got := legacy.read(); got.Type != protocol.DHTPacketType_Ping {
+		t.Fatalf("Wrong reply to split legacy packet: %+v", got)
+	}
+
+	// Oversized frame breaks the stream
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, DHTMaxFrameSize+1)
+	c.conn.Write(header)
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err := c.conn.Read(make([]byte, DHTBufferSize)); err == nil {
+		t.Errorf("Connection wasn't closed after oversized frame")
+	}
+}
+
+func TestBootstrapServer_allocateIP(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/30")
+	_, v6, _ := net.ParseCIDR("fd00::/64")
+	member := func(ip string, network *net.IPNet) *bootstrapNode {
+		return &bootstrapNode{id: ip, infohash: "swarm", ip: net.ParseIP(ip), network: network}
+	}
+
+	tests := []struct {
+		name    string
+		members []*bootstrapNode
+		want    string
+		wantErr error
+	}{
+		{"empty swarm", nil, "", errBootstrapNoNetwork},
+		{"ipv6 network", []*bootstrapNode{member("fd00::1", v6)}, "", errBootstrapNoNetwork},
+		{"first free", []*bootstrapNode{member("10.0.0.2", network)}, "10.0.0.1", nil},
+		{"second free", []*bootstrapNode{member("10.0.0.1", network)}, "10.0.0.2", nil},
+		{"exhausted", []*bootstrapNode{member("10.0.0.1", network), member("10.0.0.2", network)}, "", errBootstrapNoFreeIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewBootstrapServer("test")
+			for _, m := range tt.members {
+				s.nodes[m.id] = m
+			}
+			node := &bootstrapNode{id: "new", infohash: "swarm"}
+			s.nodes[node.id] = node
+			got, _, err := s.allocateIP(node)
+			if err != tt.wantErr {
+				t.Fatalf("BootstrapServer.allocateIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("BootstrapServer.allocateIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBootstrapServer_returningNode(t *testing.T) {
+	s := NewBootstrapServer("test")
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("BootstrapServer.Listen() error = %v", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	identity, _ := NewIdentity()
+	key := identity.PublicKey()
+	connect := &protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: identity.ID(), Infohash: "swarm", Data: "1000", Extra: key}
+
+	stale := dialBootstrap(t, s)
+	defer stale.conn.Close()
+	stale.send(connect)
+	if got := stale.read(); got.Id != identity.ID() {
+		t.Fatalf("Connect wasn't confirmed: %+v", got)
+	}
+
+	// Restarted node presents the same identity while its old
+	// connection is still registered and must prove it owns the key
+	c := dialBootstrap(t, s)
+	defer c.conn.Close()
+	c.send(connect)
+	challenge := c.read()
+	if challenge.Type != protocol.DHTPacketType_Connect || challenge.Query != bootstrapChallenge {
+		t.Fatalf("Returning node wasn't challenged: %+v", challenge)
+	}
+	public, _ := decodeIdentityKey(challenge.Extra)
+
+	// Node which only knows public key can't answer the challenge
+	attacker, _ := NewIdentity()
+	forged, _ := identityProof(attacker.Private, public, identity.ID(), "swarm")
+	c.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: identity.ID(), Infohash: "swarm", Data: "1000", Extra: key, Payload: forged})
+	c.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Ping})
+	if got := c.read(); got.Type != protocol.DHTPacketType_Ping {
+		t.Fatalf("Forged proof was accepted: %+v", got)
+	}
+
+	proof, _ := identityProof(identity.Private, public, identity.ID(), "swarm")
+	c.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: identity.ID(), Infohash: "swarm", Data: "1000", Extra: key, Payload: proof})
+	if got := c.read(); got.Type != protocol.DHTPacketType_Connect || got.Query != "" || got.Id != identity.ID() {
+		t.Fatalf("Returning node received wrong ID: %+v", got)
+	}
+	s.lock.Lock()
+	node := s.nodes[identity.ID()]
+	s.lock.Unlock()
+	if node == nil || node.conn.conn.RemoteAddr().String() != c.conn.LocalAddr().String() {
+		t.Fatalf("Returning node didn't replace stale registration")
+	}
+
+	// Key which doesn't match ID doesn't allow to take it
+	other, _ := NewIdentity()
+	c2 := dialBootstrap(t, s)
+	defer c2.conn.Close()
+	c2.send(&protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: identity.ID(), Infohash: "swarm", Data: "1000", Extra: other.PublicKey()})
+	if got := c2.read(); got.Type != protocol.DHTPacketType_Connect || got.Id == identity.ID() {
+		t.Fatalf("Node took ID of another identity: %+v", got)
+	}
+}
@@ -0,0 +1,155 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS for connections with bootstrap nodes. Server certificate is
+// verified against system roots or a CA bundle from configuration.
+// Certificates may also be pinned by SHA-256 hash of their public key,
+// which allows self-signed certificates on private bootstrap nodes
+
+var errPinMismatch = errors.New("bootstrap certificate doesn't match any of pinned keys")
+
+// BootstrapTLSConf is a TLS configuration of bootstrap connections
+type BootstrapTLSConf struct {
+	Enabled        bool     `yaml:"enabled"`         // Use TLS even if nothing else is configured
+	CA             string   `yaml:"ca"`              // Path to CA bundle in PEM format
+	Pins           []string `yaml:"pins"`            // Base64 encoded SHA-256 hashes of server public keys
+	Cert           string   `yaml:"cert"`            // Path to client certificate
+	Key            string   `yaml:"key"`             // Path to client key
+	ServerName     string   `yaml:"server_name"`     // Name expected in server certificate
+	AllowPlaintext bool     `yaml:"allow_plaintext"` // Connect without TLS if handshake fails
+}
+
+// Active returns true when bootstrap connections should use TLS
+func (c *BootstrapTLSConf) Active() bool {
+	return c.Enabled || c.CA != "" || len(c.Pins) > 0 || c.Cert != ""
+}
+
+// ClientConfig creates TLS configuration for connections with
+// bootstrap nodes. Nil is returned when TLS is not configured
+func (c *BootstrapTLSConf) ClientConfig() (*tls.Config, error) {
+	if !c.Active() {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CA != "" {
+		pool, err := loadCertPool(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.Pins) > 0 {
+		pins := [][]byte{}
+		for _, pin := range c.Pins {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("Bad pin %s: must be base64 encoded SHA-256 hash", pin)
+			}
+			pins = append(pins, hash)
+		}
+		// Pinned certificates don't need to be signed by known CA
+		// unless CA bundle was provided as well
+		config.InsecureSkipVerify = c.CA == ""
+		config.VerifyPeerCertificate = verifyPins(pins)
+	}
+	return config, nil
+}
+
+// ServerTLSConfig creates TLS configuration for bootstrap node. When
+// clientCA is specified, clients must present certificates signed by it
+func ServerTLSConfig(cert, key, clientCA string) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load certificate: %s", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pool, err := loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool reads PEM encoded certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CA bundle: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// PublicKeyPin returns base64 encoded SHA-256 hash of certificate's public key
+func PublicKeyPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// verifyPins returns callback which accepts connection when server
+// certificate matches a pin. Other certificates sent by server are not
+// verified without CA, so only the leaf is checked then. With CA any
+// certificate of a verified chain may be pinned
+func verifyPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if matchesPin(cert, pins) {
+					return nil
+				}
+			}
+		}
+		if len(verifiedChains) > 0 || len(rawCerts) == 0 {
+			return errPinMismatch
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if matchesPin(cert, pins) {
+			return nil
+		}
+		return errPinMismatch
+	}
+}
+
+// matchesPin returns true if hash of certificate's public key is pinned
+func matchesPin(cert *x509.Certificate, pins [][]byte) bool {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if bytes.Equal(hash[:], pin) {
+			return true
+		}
+	}
+	return false
+}
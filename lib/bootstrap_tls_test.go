@@ -0,0 +1,183 @@
+package ptp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate creates self-signed certificate for 127.0.0.1
+// and returns paths to certificate and key along with the certificate
+func writeTestCertificate(t *testing.T, dir, name string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certPath, keyPath, cert
+}
+
+func TestBootstrapTLSConf_ClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath, cert := writeTestCertificate(t, dir, "server")
+	pin := PublicKeyPin(cert)
+
+	tests := []struct {
+		name         string
+		conf         BootstrapTLSConf
+		wantNil      bool
+		wantErr      bool
+		wantInsecure bool
+	}{
+		{"not configured", BootstrapTLSConf{}, true, false, false},
+		{"plaintext only", BootstrapTLSConf{AllowPlaintext: true}, true, false, false},
+		{"enabled", BootstrapTLSConf{Enabled: true}, false, false, false},
+		{"missing CA", BootstrapTLSConf{CA: filepath.Join(dir, "missing")}, false, true, false},
+		{"bad CA", BootstrapTLSConf{CA: keyPath}, false, true, false},
+		{"CA", BootstrapTLSConf{CA: certPath}, false, false, false},
+		{"bad pin", BootstrapTLSConf{Pins: []string{"abc"}}, false, true, false},
+		{"pin", BootstrapTLSConf{Pins: []string{pin}}, false, false, true},
+		{"pin with CA", BootstrapTLSConf{CA: certPath, Pins: []string{pin}}, false, false, false},
+		{"client certificate without key", BootstrapTLSConf{Cert: certPath}, false, true, false},
+		{"client certificate", BootstrapTLSConf{Cert: certPath, Key: keyPath}, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.conf.ClientConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BootstrapTLSConf.ClientConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if (got == nil) != tt.wantNil {
+				t.Fatalf("BootstrapTLSConf.ClientConfig() = %v, wantNil %v", got, tt.wantNil)
+			}
+			if got != nil && got.InsecureSkipVerify != tt.wantInsecure {
+				t.Errorf("BootstrapTLSConf.ClientConfig() InsecureSkipVerify = %v", got.InsecureSkipVerify)
+			}
+		})
+	}
+}
+
+func Test_verifyPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-pins")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	_, _, leaf := writeTestCertificate(t, dir, "leaf")
+	_, _, pinned := writeTestCertificate(t, dir, "pinned")
+	pin, _ := base64.StdEncoding.DecodeString(PublicKeyPin(pinned))
+	verify := verifyPins([][]byte{pin})
+
+	tests := []struct {
+		name     string
+		rawCerts [][]byte
+		chains   [][]*x509.Certificate
+		wantErr  bool
+	}{
+		{"no certificates", nil, nil, true},
+		{"pinned leaf", [][]byte{pinned.Raw}, nil, false},
+		{"pinned certificate after leaf", [][]byte{leaf.Raw, pinned.Raw}, nil, true},
+		{"pinned certificate in verified chain", [][]byte{leaf.Raw}, [][]*x509.Certificate{{leaf, pinned}}, false},
+		{"pinned certificate outside verified chain", [][]byte{leaf.Raw, pinned.Raw}, [][]*x509.Certificate{{leaf}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verify(tt.rawCerts, tt.chains); (err != nil) != tt.wantErr {
+				t.Errorf("verifyPins() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBootstrapServer_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath, cert := writeTestCertificate(t, dir, "server")
+	clientCert, clientKey, _ := writeTestCertificate(t, dir, "client")
+	_, _, other := writeTestCertificate(t, dir, "other")
+
+	s := NewBootstrapServer("test")
+	s.TLS, err = ServerTLSConfig(certPath, keyPath, clientCert)
+	if err != nil {
+		t.Fatalf("ServerTLSConfig() error = %v", err)
+	}
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("BootstrapServer.Listen() error = %v", err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	tests := []struct {
+		name    string
+		conf    BootstrapTLSConf
+		wantErr bool
+	}{
+		{"unknown CA", BootstrapTLSConf{Enabled: true, Cert: clientCert, Key: clientKey}, true},
+		{"without client certificate", BootstrapTLSConf{CA: certPath}, true},
+		{"wrong pin", BootstrapTLSConf{Pins: []string{PublicKeyPin(other)}, Cert: clientCert, Key: clientKey}, true},
+		{"pinned", BootstrapTLSConf{Pins: []string{PublicKeyPin(cert)}, Cert: clientCert, Key: clientKey}, false},
+		{"CA", BootstrapTLSConf{CA: certPath, Cert: clientCert, Key: clientKey}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.conf.ClientConfig()
+			if err != nil {
+				t.Fatalf("BootstrapTLSConf.ClientConfig() error = %v", err)
+			}
+			config.ServerName = "127.0.0.1"
+			conn, err := tls.Dial("tcp", s.Addr().String(), config)
+			if err == nil {
+				// Client certificate is verified by server after handshake
+				// from client's point of view, so read handshake ping
+				conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+				_, err = conn.Read(make([]byte, DHTBufferSize))
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Connection with bootstrap error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
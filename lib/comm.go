@@ -97,14 +97,14 @@ func commIPInfoHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 	if len(data) == 42 {
 		result := binary.BigEndian.Uint16(data[40:42])
 		if result == 0 && p.Interface.GetIP() == nil {
-			Log(Info, "IP %s is unknown to this swarm. Setting it", ip.String())
+			LogWith(Info, p.logFields(SubsystemComm), "IP %s is unknown to this swarm. Setting it", ip.String())
 			p.Interface.SetIP(ip)
 			p.Interface.Configure(false)
 			p.Interface.MarkConfigured()
 			go p.notifyIP()
 			return nil, nil
 		}
-		Log(Info, "IP %s is already known to this swarm. Ignoring it", ip.String())
+		LogWith(Info, p.logFields(SubsystemComm), "IP %s is already known to this swarm. Ignoring it", ip.String())
 		return nil, nil
 	}
 	if len(data) != 40 {
@@ -125,9 +125,9 @@ func commIPInfoHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 	}
 
 	if result == 1 {
-		Log(Debug, "Peer requested info about IP %s. That IP is known to us", ip.String())
+		LogWith(Debug, p.logFields(SubsystemComm), "Peer requested info about IP %s. That IP is known to us", ip.String())
 	} else {
-		Log(Debug, "Peer requested info about IP %s. We don't know that IP", ip.String())
+		LogWith(Debug, p.logFields(SubsystemComm), "Peer requested info about IP %s. We don't know that IP", ip.String())
 	}
 
 	response := make([]byte, 44)
@@ -160,19 +160,23 @@ func commIPSetHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 	for _, peer := range p.Swarm.Get() {
 		if bytes.Equal(peer.PeerLocalIP, ip) && peer.Endpoint != nil {
 			// That IP already set on other peer. Call a conflict
-			Log(Info, "Reporting IP conflict")
+			LogWith(Info, p.logFields(SubsystemComm), "Reporting IP conflict")
+			PublishEvent(Event{Type: EventIPConflict, Hash: p.Hash, Peer: id, IP: ip.String()})
 			payload := make([]byte, 42)
 			binary.BigEndian.PutUint16(payload[0:2], CommIPConflict)
 			copy(payload[2:38], p.Dht.ID)
 			copy(payload[38:42], ip)
 			msg, _ := p.CreateMessage(MsgTypeComm, payload, 0, true)
-			p.UDPSocket.SendMessage(msg, peer.Endpoint)
+			p.sendToPeer(peer, msg)
 			return nil, nil
 		}
 	}
 
 	for _, peer := range p.Swarm.Get() {
 		if peer.ID == id {
+			if !peer.PeerLocalIP.Equal(ip) {
+				PublishEvent(Event{Type: EventIPSet, Hash: p.Hash, Peer: id, IP: ip.String()})
+			}
 			peer.PeerLocalIP = ip
 			return nil, nil
 		}
@@ -181,6 +185,50 @@ func commIPSetHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 	return nil, fmt.Errorf("Can't update peer IP. Peer %s not found", id)
 }
 
+// commIPv6SetHandler will handle notification from another peer about
+// IPv6 address assigned to it's interface
+// id[36] ip[16]
+func commIPv6SetHandler(data []byte, p *PeerToPeer) ([]byte, error) {
+	if p.Swarm == nil {
+		return nil, fmt.Errorf("nil swarm")
+	}
+	err := commPacketCheck(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 52 {
+		return nil, fmt.Errorf("data is too small")
+	}
+
+	id := string(data[0:36])
+	ip := net.IP(append([]byte{}, data[36:52]...))
+	if ip.To4() != nil || !ip.IsGlobalUnicast() {
+		return nil, fmt.Errorf("wrong IPv6 address: %s", ip.String())
+	}
+
+	peer := p.Swarm.GetPeer(id)
+	if peer == nil {
+		return nil, fmt.Errorf("Can't update peer IPv6. Peer %s not found", id)
+	}
+	if bytes.Equal(peer.PeerLocalIPv6, ip) {
+		return nil, nil
+	}
+	for _, np := range p.Swarm.Get() {
+		if np.ID != id && bytes.Equal(np.PeerLocalIPv6, ip) {
+			LogWith(Warning, p.logFields(SubsystemComm), "IPv6 %s of peer %s is already used by peer %s", ip.String(), id, np.ID)
+			return nil, fmt.Errorf("IPv6 %s is in conflict", ip.String())
+		}
+	}
+	if peer.PeerLocalIPv6 != nil {
+		p.Swarm.deleteIP(peer.PeerLocalIPv6.String())
+	}
+	LogWith(Debug, p.logFields(SubsystemComm), "Peer %s is available over IPv6 %s", id, ip.String())
+	peer.PeerLocalIPv6 = ip
+	p.Swarm.Update(id, peer)
+	return nil, nil
+}
+
 func commIPConflictHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 	if p.Interface == nil {
 		return nil, fmt.Errorf("nil interface")
@@ -194,6 +242,7 @@ func commIPConflictHandler(data []byte, p *PeerToPeer) ([]byte, error) {
 	ip := net.IP(data[36:40])
 
 	if p.Interface.IsAuto() && p.Interface.IsConfigured() && bytes.Equal(ip, p.Interface.GetIP()) {
+		PublishEvent(Event{Type: EventIPConflict, Hash: p.Hash, Peer: string(data[0:36]), IP: ip.String()})
 		p.Interface.Deconfigure()
 		return nil, nil
 	}
@@ -246,6 +246,63 @@ func Test_commIPSetHandler(t *testing.T) {
 	}
 }
 
+func Test_commIPv6SetHandler(t *testing.T) {
+	type args struct {
+		data []byte
+		p    *PeerToPeer
+	}
+
+	id0 := "123e4567-e89b-12d3-a456-426655440000"
+	id1 := "123e4567-e89b-12d3-a456-426655440001"
+
+	ptp0 := new(PeerToPeer)
+
+	ptp1 := new(PeerToPeer)
+	ptp1.Swarm = new(Swarm)
+	ptp1.Swarm.Init()
+	ptp1.Swarm.Update(id0, &NetworkPeer{ID: id0, PeerLocalIPv6: net.ParseIP("fd00::2")})
+	ptp1.Swarm.Update(id1, &NetworkPeer{ID: id1})
+
+	payload := func(id, ip string) []byte {
+		return append([]byte(id), net.ParseIP(ip).To16()...)
+	}
+
+	tests := []struct {
+		name    string
+		args    args
+		want    []byte
+		wantErr bool
+	}{
+		{"nil swarm", args{nil, ptp0}, nil, true},
+		{"small size", args{[]byte(id0), ptp1}, nil, true},
+		{"ipv4 address", args{payload(id1, "10.10.10.1"), ptp1}, nil, true},
+		{"link-local address", args{payload(id1, "fe80::1"), ptp1}, nil, true},
+		{"unknown peer", args{payload("123e4567-e89b-12d3-a456-426655440002", "fd00::3"), ptp1}, nil, true},
+		{"conflict", args{payload(id1, "fd00::2"), ptp1}, nil, true},
+		{"passing", args{payload(id1, "fd00::3"), ptp1}, nil, false},
+		{"changed address", args{payload(id1, "fd00::4"), ptp1}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := commIPv6SetHandler(tt.args.data, tt.args.p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("commIPv6SetHandler() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commIPv6SetHandler() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if id, _ := ptp1.Swarm.GetID("fd00::4"); id != id1 {
+		t.Errorf("commIPv6SetHandler() didn't map new address to peer")
+	}
+	if _, err := ptp1.Swarm.GetID("fd00::3"); err == nil {
+		t.Errorf("commIPv6SetHandler() kept mapping of old address")
+	}
+}
+
 func Test_commIPConflictHandler(t *testing.T) {
 	type args struct {
 		data []byte
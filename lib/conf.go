@@ -13,8 +13,42 @@ type Conf struct {
 	INFFile string `yaml:"inf_file"`
 	MTU     int    `yaml:"mtu"`
 	PMTU    bool   `yaml:"pmtu"`
+	// Maximum number of frames per second sent to a broadcast or
+	// multicast group. Zero disables the limit
+	MulticastRate int  `yaml:"multicast_rate"`
+	IGMPSnooping  bool `yaml:"igmp_snooping"`
+	// Discovery of peers in local network with multicast beacons
+	LANDiscovery     bool `yaml:"lan_discovery"`
+	LANDiscoveryPort int  `yaml:"lan_discovery_port"`
+	// Sources of bootstrap nodes addresses
+	Bootstrap BootstrapConf `yaml:"bootstrap"`
+	// Peers with fixed endpoints, per swarm
+	Static []StaticSwarm `yaml:"static"`
+	// Executables run on lifecycle events of instances
+	Hooks HooksConf `yaml:"hooks"`
+	// Format of log records: text or json
+	LogFormat string `yaml:"log_format"`
 }
 
+// BootstrapConf describes how bootstrap nodes are discovered and connected
+type BootstrapConf struct {
+	Routers    []string `yaml:"routers"`     // Static list of addresses
+	File       string   `yaml:"file"`        // File with addresses, re-read when modified
+	SRV        string   `yaml:"srv"`         // Name of SRV entry. Overrides -srv/-target flags
+	Domain     string   `yaml:"domain"`      // Domain of SRV entry
+	DisableSRV bool     `yaml:"disable_srv"` // Don't use SRV lookup at all
+	// TLS settings of connections with bootstrap nodes
+	TLS BootstrapTLSConf `yaml:"tls"`
+}
+
+// Platform independent defaults
+const (
+	DefaultMulticastRate    = 200   // Default limit of frames per second for a multicast group
+	DefaultIGMPSnooping     = false // Default IGMP snooping switch
+	DefaultLANDiscovery     = false // Default LAN discovery switch
+	DefaultLANDiscoveryPort = 6883  // Default UDP port of LAN beacons
+)
+
 func (c *Conf) Load(filepath string) error {
 	c.SetDefaults()
 	if filepath == "" {
@@ -37,6 +71,11 @@ func (c *Conf) SetDefaults() {
 	c.INFFile = DefaultINFFile
 	c.MTU = DefaultMTU
 	c.PMTU = DefaultPMTU
+	c.MulticastRate = DefaultMulticastRate
+	c.IGMPSnooping = DefaultIGMPSnooping
+	c.LANDiscovery = DefaultLANDiscovery
+	c.LANDiscoveryPort = DefaultLANDiscoveryPort
+	c.Bootstrap = BootstrapConf{Domain: DefaultBootstrapDomain}
 }
 
 func (c *Conf) GetIPTool(preset string) string {
@@ -70,3 +109,50 @@ func (c *Conf) GetMTU(preset int) int {
 func (c *Conf) GetPMTU() bool {
 	return c.PMTU
 }
+
+func (c *Conf) GetMulticastRate() int {
+	return c.MulticastRate
+}
+
+func (c *Conf) GetIGMPSnooping() bool {
+	return c.IGMPSnooping
+}
+
+func (c *Conf) GetLANDiscovery() bool {
+	return c.LANDiscovery
+}
+
+func (c *Conf) GetLANDiscoveryPort() int {
+	if c.LANDiscoveryPort <= 0 || c.LANDiscoveryPort > 65535 {
+		return DefaultLANDiscoveryPort
+	}
+	return c.LANDiscoveryPort
+}
+
+// GetStaticSwarm returns static peers of a swarm or nil if there are none
+func (c *Conf) GetStaticSwarm(hash string) *StaticSwarm {
+	for i := range c.Static {
+		if c.Static[i].Hash == hash {
+			return &c.Static[i]
+		}
+	}
+	return nil
+}
+
+// GetHooks returns hooks of the swarm. Hooks which are not set for the
+// swarm are taken from defaults
+func (c *Conf) GetHooks(hash string) Hooks {
+	for _, swarm := range c.Hooks.Swarms {
+		if swarm.Hash == hash {
+			return swarm.Hooks.merge(c.Hooks.Hooks)
+		}
+	}
+	return c.Hooks.Hooks
+}
+
+func (c *Conf) GetBootstrapDomain() string {
+	if c.Bootstrap.Domain == "" {
+		return DefaultBootstrapDomain
+	}
+	return c.Bootstrap.Domain
+}
@@ -281,3 +281,47 @@ func Test_Conf_getPMTU(t *testing.T) {
 		})
 	}
 }
+
+func Test_Conf_getLANDiscoveryPort(t *testing.T) {
+	tests := []struct {
+		name string
+		port int
+		want int
+	}{
+		{"configured port", 7000, 7000},
+		{"empty port", 0, DefaultLANDiscoveryPort},
+		{"bad port", 70000, DefaultLANDiscoveryPort},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{LANDiscoveryPort: tt.port}
+			if got := c.GetLANDiscoveryPort(); got != tt.want {
+				t.Errorf("Conf.GetLANDiscoveryPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Conf_GetHooks(t *testing.T) {
+	c := &Conf{Hooks: HooksConf{
+		Hooks: Hooks{Up: "/bin/up", Down: "/bin/down", Timeout: 10},
+		Swarms: []SwarmHooks{
+			{Hash: "swarm", Hooks: Hooks{Up: "/bin/swarm-up", PeerConnect: "/bin/connect"}},
+		},
+	}}
+	tests := []struct {
+		name string
+		hash string
+		want Hooks
+	}{
+		{"default hooks", "other", Hooks{Up: "/bin/up", Down: "/bin/down", Timeout: 10}},
+		{"swarm hooks", "swarm", Hooks{Up: "/bin/swarm-up", Down: "/bin/down", PeerConnect: "/bin/connect", Timeout: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.GetHooks(tt.hash); got != tt.want {
+				t.Errorf("Conf.GetHooks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -15,70 +20,277 @@ import (
 
 // CryptoKey represents a key and it's expiration date
 type CryptoKey struct {
-	TTLConfig string `yaml:"ttl"`
-	KeyConfig string `yaml:"key"`
-	Until     time.Time
-	Key       []byte
+	TTLConfig  string    `yaml:"ttl"`
+	KeyConfig  string    `yaml:"key"`
+	FromConfig string    `yaml:"from"`
+	Swarms     []string  `yaml:"swarms"`
+	Until      time.Time `yaml:"-"`
+	From       time.Time `yaml:"-"` // Key can't be activated before this moment
+	Key        []byte    `yaml:"-"`
+	fromFile   bool      // Key was loaded from keyring and will be replaced on reload
 }
 
-// Crypto is a object used by crypto subsystem
+// keyring is a format of key file. Single key can be specified on the
+// top level for compatibility with older key files
+type keyring struct {
+	CryptoKey `yaml:",inline"`
+	Keys      []CryptoKey `yaml:"keys"`
+}
+
+// Crypto is a object used by crypto subsystem. Keys are rotated and
+// reloaded while packets are encrypted, so fields must be accessed
+// with methods which hold the lock
 type Crypto struct {
-	Keys      []CryptoKey
-	ActiveKey CryptoKey
-	Active    bool
+	Keys        []CryptoKey
+	ActiveKey   CryptoKey
+	PreviousKey CryptoKey // Key that was active before last rotation
+	Active      bool
+	aead        *aeadState // State used to seal data frames
+	lock        sync.RWMutex
 }
 
+// aeadState holds information needed to generate unique nonces
+// for AES-GCM. Nonce consists of a random salt generated once per
+// instance and a counter incremented for every sealed frame
+type aeadState struct {
+	salt    []byte
+	counter uint64
+}
+
+// AEAD nonce layout
+const (
+	aeadSaltSize    int = 4
+	aeadCounterSize int = 8
+	aeadNonceSize       = aeadSaltSize + aeadCounterSize
+)
+
+// Key states reported by KeysInfo
+const (
+	KeyStateActive    string = "active"    // Key is used to encrypt traffic
+	KeyStatePrevious  string = "previous"  // Key was replaced recently and still accepted
+	KeyStateNext      string = "next"      // Key will become active after current one expires
+	KeyStateScheduled string = "scheduled" // Key will be used later
+	KeyStateExpired   string = "expired"   // Key is not used anymore
+)
+
+// KeyInfo describes a key in rotation schedule without exposing key itself
+type KeyInfo struct {
+	Fingerprint string
+	Until       time.Time
+	State       string
+}
+
+// replayWindowSize is a number of frames tracked by replay window
+const replayWindowSize uint64 = 1024
+
+// aeadKeyContext is mixed into shared key when AES-GCM key is derived,
+// so the same key is never used with both CBC and GCM
+var aeadKeyContext = []byte("p2p-aead-data-frame")
+
 // EnrichKeyValues update information about current and feature keys
-func (c Crypto) EnrichKeyValues(ckey CryptoKey, key, datetime string) CryptoKey {
-	var err error
+func (c *Crypto) EnrichKeyValues(ckey CryptoKey, key, datetime string) (CryptoKey, error) {
+	if err := ValidateKey(key); err != nil {
+		return ckey, err
+	}
 	i, err := strconv.ParseInt(datetime, 10, 64)
 	ckey.Until = time.Now()
 	// Default value is +1 hour
 	ckey.Until = ckey.Until.Add(60 * time.Minute)
 	if err != nil {
-		Log(Warning, "Failed to parse TTL. Falling back to default value of 1 hour")
+		LogWith(Warning, Fields{Subsystem: SubsystemInstance}, "Failed to parse TTL. Falling back to default value of 1 hour")
 	} else {
 		ckey.Until = time.Unix(i, 0)
 	}
 	ckey.Key = []byte(key)
 	if err != nil {
-		Log(Error, "Failed to parse provided TTL value: %v", err)
-		return ckey
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to parse provided TTL value: %v", err)
 	}
-	return ckey
+	return ckey, nil
 }
 
-// ReadKeysFromFile read a file stored in a file system and extracts keys to be used
-func (c Crypto) ReadKeysFromFile(filepath string) {
+// ReadKeysFromFile reads a keyring file and replaces keys previously loaded
+// from file. Keys bound to other swarms are skipped. Keys added with AddKey
+// are kept
+func (c *Crypto) ReadKeysFromFile(filepath, hash string) error {
 	yamlFile, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		Log(Error, "Failed to read key file yaml: %v", err)
-		c.Active = false
-		return
+		return fmt.Errorf("Failed to read key file: %s", err)
 	}
-	var ckey CryptoKey
-	err = yaml.Unmarshal(yamlFile, ckey)
+	var ring keyring
+	err = yaml.Unmarshal(yamlFile, &ring)
 	if err != nil {
-		Log(Error, "Failed to parse config: %v", err)
-		c.Active = false
+		return fmt.Errorf("Failed to parse key file: %s", err)
+	}
+	entries := ring.Keys
+	if ring.KeyConfig != "" {
+		entries = append([]CryptoKey{ring.CryptoKey}, entries...)
+	}
+
+	loaded := []CryptoKey{}
+	for i, entry := range entries {
+		if entry.KeyConfig == "" {
+			return fmt.Errorf("Key #%d in %s is empty", i, filepath)
+		}
+		if !entry.boundTo(hash) {
+			continue
+		}
+		ckey, err := c.EnrichKeyValues(entry, entry.KeyConfig, entry.TTLConfig)
+		if err != nil {
+			return fmt.Errorf("Key #%d in %s is invalid: %s", i, filepath, err)
+		}
+		if entry.FromConfig != "" {
+			from, err := strconv.ParseInt(entry.FromConfig, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Failed to parse start date of key #%d: %s", i, err)
+			}
+			ckey.From = time.Unix(from, 0)
+		}
+		ckey.fromFile = true
+		loaded = append(loaded, ckey)
+	}
+	if len(loaded) == 0 {
+		return fmt.Errorf("No keys for this swarm were found in %s", filepath)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := []CryptoKey{}
+	for _, key := range c.Keys {
+		if !key.fromFile {
+			keys = append(keys, key)
+		}
+	}
+	c.Keys = keys
+	for _, key := range loaded {
+		c.addKey(key)
+	}
+	if !c.scheduled(c.PreviousKey) {
+		c.PreviousKey = CryptoKey{}
+	}
+	c.selectActive(time.Now())
+	return nil
+}
+
+// scheduled returns true if key is present in schedule. Lock must be held
+func (c *Crypto) scheduled(key CryptoKey) bool {
+	for _, k := range c.Keys {
+		if bytes.Equal(k.Key, key.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// boundTo returns true if key can be used by swarm with specified hash
+func (k CryptoKey) boundTo(hash string) bool {
+	if len(k.Swarms) == 0 {
+		return true
+	}
+	for _, swarm := range k.Swarms {
+		if swarm == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// usable returns true if key can be activated at specified moment
+func (k CryptoKey) usable(now time.Time) bool {
+	return k.Until.After(now) && !k.From.After(now)
+}
+
+// ValidateKey returns error if key can't be used as AES-128, AES-192
+// or AES-256 key. Keys are never padded, because padded key is weak
+func ValidateKey(key string) error {
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("Key must be 16, 24 or 32 characters long, got %d", len(key))
+}
+
+// selectActive makes sure that active key is present in schedule and can
+// be used. Otherwise usable key with the nearest expiration date is
+// activated. Lock must be held
+func (c *Crypto) selectActive(now time.Time) {
+	if !c.Active {
 		return
 	}
-	ckey = c.EnrichKeyValues(ckey, ckey.KeyConfig, ckey.TTLConfig)
-	c.Active = true
-	c.Keys = append(c.Keys, ckey)
+	var best CryptoKey
+	found := false
+	present := false
+	for _, key := range c.Keys {
+		if bytes.Equal(key.Key, c.ActiveKey.Key) {
+			if key.usable(now) {
+				return
+			}
+			present = true
+		}
+		if key.usable(now) && (!found || key.Until.Before(best.Until)) {
+			best = key
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+	// Key that was removed from schedule must not be accepted anymore
+	if present {
+		c.PreviousKey = c.ActiveKey
+	}
+	c.ActiveKey = best
+}
+
+// IsActive returns true if traffic encryption is enabled
+func (c *Crypto) IsActive() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.Active
+}
+
+// GetActiveKey returns a key used to encrypt traffic
+func (c *Crypto) GetActiveKey() CryptoKey {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.ActiveKey
+}
+
+// AddKey appends a key to rotation schedule. If encryption
+// was disabled, this key becomes active
+func (c *Crypto) AddKey(key CryptoKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.addKey(key)
+}
+
+// SetActiveKey appends a key to rotation schedule and activates it
+func (c *Crypto) SetActiveKey(key CryptoKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.addKey(key)
+	c.ActiveKey = key
+}
+
+// addKey appends a key to rotation schedule. Lock must be held
+func (c *Crypto) addKey(key CryptoKey) {
+	c.Keys = append(c.Keys, key)
+	if !c.Active {
+		c.ActiveKey = key
+		c.Active = true
+	}
 }
 
 // Encrypt encrypts data
-func (c Crypto) encrypt(key []byte, data []byte) ([]byte, error) {
+func (c *Crypto) encrypt(key []byte, data []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(data) != aes.BlockSize {
-		padding := aes.BlockSize - len(data)%aes.BlockSize
-		data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
-	}
+	// Data is always padded, so receivers can tell a wrong key during
+	// rotation. Legacy receivers cut padding by length from the header
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
 
 	encData := make([]byte, aes.BlockSize+len(data))
 	iv := encData[:aes.BlockSize]
@@ -93,11 +305,14 @@ func (c Crypto) encrypt(key []byte, data []byte) ([]byte, error) {
 }
 
 // Decrypt decrypts data
-func (c Crypto) decrypt(key []byte, data []byte) ([]byte, error) {
+func (c *Crypto) decrypt(key []byte, data []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	if len(data) < aes.BlockSize {
+		return nil, fmt.Errorf("Input is too short: %d", len(data))
+	}
 	encData := data[aes.BlockSize:]
 	if len(data)%aes.BlockSize != 0 {
 		return nil, fmt.Errorf("Input not full blocks: %s", string(data))
@@ -107,3 +322,311 @@ func (c Crypto) decrypt(key []byte, data []byte) ([]byte, error) {
 
 	return encData, nil
 }
+
+// decryptAny decrypts data with active key. If it fails, keys accepted during
+// rotation grace period are tried
+func (c *Crypto) decryptAny(data []byte, length int) ([]byte, error) {
+	return c.decryptWith(c.decryptionKeys(time.Now()), data, length)
+}
+
+// decryptWith decrypts data with the first of specified keys that fits.
+// CBC can't detect a wrong key, so padding is verified against length
+// of original data
+func (c *Crypto) decryptWith(keys []CryptoKey, data []byte, length int) ([]byte, error) {
+	err := fmt.Errorf("no keys available")
+	for _, key := range keys {
+		buf := make([]byte, len(data))
+		copy(buf, data)
+		var plain []byte
+		plain, err = c.decrypt(key.Key, buf)
+		if err != nil {
+			continue
+		}
+		if !validPadding(plain, length) {
+			err = fmt.Errorf("Wrong padding")
+			continue
+		}
+		return plain[:length], nil
+	}
+	return nil, err
+}
+
+// validPadding checks that data was padded by encrypt. Unpadded data
+// can't be verified and is refused
+func validPadding(data []byte, length int) bool {
+	if length < 0 || length > len(data) {
+		return false
+	}
+	padding := len(data) - length
+	if padding == 0 || padding > aes.BlockSize {
+		return false
+	}
+	for _, b := range data[length:] {
+		if int(b) != padding {
+			return false
+		}
+	}
+	return true
+}
+
+// nextKey returns a key that will replace active key when it expires.
+// This is an unexpired key with the nearest expiration date after
+// expiration date of active key. Lock must be held
+func (c *Crypto) nextKey(now time.Time) (CryptoKey, bool) {
+	after := c.ActiveKey.Until
+	if now.After(after) {
+		after = now
+	}
+	var next CryptoKey
+	found := false
+	for _, key := range c.Keys {
+		if bytes.Equal(key.Key, c.ActiveKey.Key) || !key.Until.After(after) || key.From.After(now) {
+			continue
+		}
+		if !found || key.Until.Before(next.Until) {
+			next = key
+			found = true
+		}
+	}
+	return next, found
+}
+
+// decryptionKeys returns list of keys that are accepted at specified moment.
+// Active key goes first. Previous key is accepted during grace period after
+// rotation and next key is accepted during grace period before rotation
+func (c *Crypto) decryptionKeys(now time.Time) []CryptoKey {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	keys := []CryptoKey{c.ActiveKey}
+	if c.PreviousKey.Key != nil && now.Before(c.PreviousKey.Until.Add(KeyGracePeriod)) {
+		keys = append(keys, c.PreviousKey)
+	}
+	if now.After(c.ActiveKey.Until.Add(-KeyGracePeriod)) {
+		next, exists := c.nextKey(now)
+		if exists {
+			keys = append(keys, next)
+		}
+	}
+	return keys
+}
+
+// rotate replaces expired active key with the next one and removes keys
+// that are not accepted anymore. Returns true if active key has changed
+func (c *Crypto) rotate(now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.Active || c.ActiveKey.Until.After(now) {
+		return false
+	}
+	next, exists := c.nextKey(now)
+	if !exists {
+		return false
+	}
+	c.PreviousKey = c.ActiveKey
+	c.ActiveKey = next
+
+	keys := []CryptoKey{}
+	for _, key := range c.Keys {
+		if now.Before(key.Until.Add(KeyGracePeriod)) || bytes.Equal(key.Key, c.ActiveKey.Key) {
+			keys = append(keys, key)
+		}
+	}
+	c.Keys = keys
+	return true
+}
+
+// KeysInfo returns state of every key in rotation schedule
+func (c *Crypto) KeysInfo() []KeyInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	now := time.Now()
+	next, nextExists := c.nextKey(now)
+	result := []KeyInfo{}
+	seen := false
+	for _, key := range c.Keys {
+		info := KeyInfo{
+			Fingerprint: keyFingerprint(key.Key),
+			Until:       key.Until,
+			State:       KeyStateScheduled,
+		}
+		if bytes.Equal(key.Key, c.ActiveKey.Key) {
+			info.State = KeyStateActive
+			seen = true
+		} else if c.PreviousKey.Key != nil && bytes.Equal(key.Key, c.PreviousKey.Key) && now.Before(key.Until.Add(KeyGracePeriod)) {
+			info.State = KeyStatePrevious
+		} else if !key.Until.After(now) {
+			info.State = KeyStateExpired
+		} else if nextExists && bytes.Equal(key.Key, next.Key) {
+			info.State = KeyStateNext
+		}
+		result = append(result, info)
+	}
+	if !seen && c.ActiveKey.Key != nil {
+		result = append([]KeyInfo{{Fingerprint: keyFingerprint(c.ActiveKey.Key), Until: c.ActiveKey.Until, State: KeyStateActive}}, result...)
+	}
+	return result
+}
+
+// keyFingerprint returns a short representation of the key
+// that can be displayed to user
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+// initAEAD generates new nonce salt. Must be called once before
+// any frame is sealed
+func (c *Crypto) initAEAD() error {
+	state := new(aeadState)
+	state.salt = make([]byte, aeadSaltSize)
+	if _, err := rand.Read(state.salt); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.aead = state
+	c.lock.Unlock()
+	return nil
+}
+
+// aeadSalt returns nonce salt used by this instance
+func (c *Crypto) aeadSalt() []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.aead == nil {
+		return nil
+	}
+	return c.aead.salt
+}
+
+// newAEAD creates AES-GCM cipher with a key derived from session key
+func (c *Crypto) newAEAD(key []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(aeadKeyContext)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts and authenticates data. Additional data is authenticated
+// but not encrypted. Result is a nonce followed by ciphertext and tag
+func (c *Crypto) seal(key, data, ad []byte) ([]byte, error) {
+	c.lock.RLock()
+	state := c.aead
+	c.lock.RUnlock()
+	if state == nil {
+		return nil, fmt.Errorf("aead is not initialized")
+	}
+	gcm, err := c.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aeadNonceSize, aeadNonceSize+len(data)+gcm.Overhead())
+	copy(nonce[:aeadSaltSize], state.salt)
+	binary.BigEndian.PutUint64(nonce[aeadSaltSize:], atomic.AddUint64(&state.counter, 1))
+	return gcm.Seal(nonce, nonce, data, ad), nil
+}
+
+// open verifies and decrypts data produced by seal. Returns plain data
+// along with the salt and counter extracted from the nonce
+func (c *Crypto) open(key, data, ad []byte) ([]byte, []byte, uint64, error) {
+	if len(data) < aeadNonceSize {
+		return nil, nil, 0, fmt.Errorf("sealed data is too short: %d", len(data))
+	}
+	gcm, err := c.newAEAD(key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	nonce := data[:aeadNonceSize]
+	plain, err := gcm.Open(nil, nonce, data[aeadNonceSize:], ad)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return plain, nonce[:aeadSaltSize], binary.BigEndian.Uint64(nonce[aeadSaltSize:]), nil
+}
+
+// sealedSalt returns salt of the sealed data nonce. Salt is not
+// authenticated until data is opened
+func sealedSalt(data []byte) []byte {
+	if len(data) < aeadNonceSize {
+		return nil
+	}
+	return data[:aeadSaltSize]
+}
+
+// replayWindow tracks counters of sealed frames received from a peer
+// and rejects frames that were already seen or are too old
+type replayWindow struct {
+	salt   []byte
+	last   uint64
+	bitmap [replayWindowSize / 64]uint64
+	lock   sync.Mutex
+}
+
+// reset clears the window and binds it to a new salt
+func (w *replayWindow) reset(salt []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.salt = make([]byte, len(salt))
+	copy(w.salt, salt)
+	w.last = 0
+	for i := range w.bitmap {
+		w.bitmap[i] = 0
+	}
+}
+
+// matches returns true if window is bound to specified salt
+func (w *replayWindow) matches(salt []byte) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.salt != nil && bytes.Equal(w.salt, salt)
+}
+
+// accept returns true if frame with specified counter wasn't seen before
+// and marks it as seen. Must be called only for authenticated frames
+func (w *replayWindow) accept(counter uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if counter == 0 {
+		return false
+	}
+	if counter > w.last {
+		diff := counter - w.last
+		if diff >= replayWindowSize {
+			for i := range w.bitmap {
+				w.bitmap[i] = 0
+			}
+		} else {
+			for i := w.last + 1; i < counter; i++ {
+				w.clear(i)
+			}
+		}
+		w.last = counter
+		w.set(counter)
+		return true
+	}
+	if w.last-counter >= replayWindowSize {
+		return false
+	}
+	if w.isSet(counter) {
+		return false
+	}
+	w.set(counter)
+	return true
+}
+
+func (w *replayWindow) set(counter uint64) {
+	i := counter % replayWindowSize
+	w.bitmap[i/64] |= 1 << (i % 64)
+}
+
+func (w *replayWindow) clear(counter uint64) {
+	i := counter % replayWindowSize
+	w.bitmap[i/64] &^= 1 << (i % 64)
+}
+
+func (w *replayWindow) isSet(counter uint64) bool {
+	i := counter % replayWindowSize
+	return w.bitmap[i/64]&(1<<(i%64)) != 0
+}
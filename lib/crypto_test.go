@@ -2,6 +2,9 @@ package ptp
 
 import (
 	//"crypto/rand"
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -14,8 +17,34 @@ func TestEncrypt(t *testing.T) {
 	if err == nil {
 		t.Errorf("Encrypt didn't return error on empty key")
 	}
-	var key CryptoKey
-	crypto.EnrichKeyValues(key, "keylessthan32", "1")
+}
+
+func TestCrypto_EnrichKeyValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"short", "keylessthan32", true},
+		{"between sizes", "12345678123456781234", true},
+		{"long", "123456781234567812345678123456781", true},
+		{"aes-128", "1234567812345678", false},
+		{"aes-192", "123456781234567812345678", false},
+		{"aes-256", "12345678123456781234567812345678", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(Crypto)
+			got, err := c.EnrichKeyValues(CryptoKey{}, tt.key, "1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Crypto.EnrichKeyValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(got.Key) != tt.key {
+				t.Errorf("Crypto.EnrichKeyValues() key = %s, want %s", got.Key, tt.key)
+			}
+		})
+	}
 }
 
 func RandomString(size int) string {
@@ -34,8 +63,7 @@ func BenchmarkEncrypt(b *testing.B) {
 		data = append(data, RandomString(i*10))
 	}
 	crypto := new(Crypto)
-	var key CryptoKey
-	crypto.EnrichKeyValues(key, "keylessthan32", "1")
+	crypto.AddKey(CryptoKey{Key: []byte("1234567812345678")})
 	for i := 0; i < b.N; i++ {
 		for _, str := range data {
 			crypto.encrypt(crypto.ActiveKey.Key, []byte(str))
@@ -80,3 +108,321 @@ func TestCrypto_encrypt(t *testing.T) {
 		})
 	}
 }
+
+func TestCrypto_seal(t *testing.T) {
+	c := Crypto{}
+	if _, err := c.seal([]byte("1234567812345678"), []byte("data"), nil); err == nil {
+		t.Fatalf("Crypto.seal() didn't return error on uninitialized state")
+	}
+	if err := c.initAEAD(); err != nil {
+		t.Fatalf("Crypto.initAEAD() error = %v", err)
+	}
+	key := []byte("1234567812345678")
+	ad := []byte{0x0, 0xd, 0x8, 0x0}
+	sealed, err := c.seal(key, []byte("frame"), ad)
+	if err != nil {
+		t.Fatalf("Crypto.seal() error = %v", err)
+	}
+
+	tampered := make([]byte, len(sealed))
+	copy(tampered, sealed)
+	tampered[len(tampered)-1] ^= 0x1
+
+	tests := []struct {
+		name        string
+		key         []byte
+		data        []byte
+		ad          []byte
+		want        []byte
+		wantCounter uint64
+		wantErr     bool
+	}{
+		{"too short", key, []byte{0x1, 0x2}, ad, nil, 0, true},
+		{"wrong key", []byte("8765432187654321"), sealed, ad, nil, 0, true},
+		{"wrong additional data", key, sealed, []byte{0x0, 0x3, 0x8, 0x0}, nil, 0, true},
+		{"tampered data", key, tampered, ad, nil, 0, true},
+		{"passing", key, sealed, ad, []byte("frame"), 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, salt, counter, err := c.open(tt.key, tt.data, tt.ad)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Crypto.open() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Crypto.open() = %v, want %v", got, tt.want)
+			}
+			if counter != tt.wantCounter {
+				t.Errorf("Crypto.open() counter = %v, want %v", counter, tt.wantCounter)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(salt, c.aeadSalt()) {
+				t.Errorf("Crypto.open() salt = %v, want %v", salt, c.aeadSalt())
+			}
+		})
+	}
+}
+
+func TestReplayWindow_accept(t *testing.T) {
+	w := new(replayWindow)
+	w.reset([]byte{0x1, 0x2, 0x3, 0x4})
+
+	tests := []struct {
+		name    string
+		counter uint64
+		want    bool
+	}{
+		{"zero counter", 0, false},
+		{"first frame", 1, true},
+		{"duplicate", 1, false},
+		{"jump forward", 10, true},
+		{"reordered", 5, true},
+		{"reordered duplicate", 5, false},
+		{"far ahead", 10 + replayWindowSize, true},
+		{"out of window", 10, false},
+		{"inside window", 11 + replayWindowSize/2, true},
+		{"duplicate after jump", 10 + replayWindowSize, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.accept(tt.counter); got != tt.want {
+				t.Errorf("replayWindow.accept(%d) = %v, want %v", tt.counter, got, tt.want)
+			}
+		})
+	}
+
+	if !w.matches([]byte{0x1, 0x2, 0x3, 0x4}) {
+		t.Errorf("replayWindow.matches() returned false for bound salt")
+	}
+	w.reset([]byte{0x4, 0x3, 0x2, 0x1})
+	if !w.accept(1) {
+		t.Errorf("replayWindow.accept() rejected frame after reset")
+	}
+}
+
+func TestCrypto_rotate(t *testing.T) {
+	now := time.Now()
+	k0 := CryptoKey{Key: []byte("1111111111111111"), Until: now.Add(-2 * KeyGracePeriod)}
+	k1 := CryptoKey{Key: []byte("2222222222222222"), Until: now.Add(-time.Second)}
+	k2 := CryptoKey{Key: []byte("3333333333333333"), Until: now.Add(time.Hour)}
+	k3 := CryptoKey{Key: []byte("4444444444444444"), Until: now.Add(2 * time.Hour)}
+
+	tests := []struct {
+		name       string
+		c          Crypto
+		want       bool
+		wantActive CryptoKey
+		wantKeys   int
+	}{
+		{"inactive", Crypto{Keys: []CryptoKey{k1, k2}, ActiveKey: k1}, false, k1, 2},
+		{"not expired", Crypto{Keys: []CryptoKey{k2, k3}, ActiveKey: k2, Active: true}, false, k2, 2},
+		{"no replacement", Crypto{Keys: []CryptoKey{k1}, ActiveKey: k1, Active: true}, false, k1, 1},
+		{"rotated", Crypto{Keys: []CryptoKey{k0, k1, k3, k2}, ActiveKey: k1, Active: true}, true, k2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.rotate(now); got != tt.want {
+				t.Errorf("Crypto.rotate() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.c.ActiveKey, tt.wantActive) {
+				t.Errorf("Crypto.rotate() active key = %s, want %s", tt.c.ActiveKey.Key, tt.wantActive.Key)
+			}
+			if len(tt.c.Keys) != tt.wantKeys {
+				t.Errorf("Crypto.rotate() left %d keys, want %d", len(tt.c.Keys), tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestCrypto_concurrentRotation(t *testing.T) {
+	now := time.Now()
+	c := new(Crypto)
+	c.AddKey(CryptoKey{Key: []byte("1234567812345678"), Until: now.Add(-time.Minute)})
+	c.AddKey(CryptoKey{Key: []byte("8765432187654321"), Until: now.Add(time.Hour)})
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.rotate(time.Now())
+			c.AddKey(CryptoKey{Key: []byte("abcdefghabcdefgh"), Until: now.Add(time.Hour * 2)})
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		data, err := c.encrypt(c.GetActiveKey().Key, []byte("data"))
+		if err != nil {
+			t.Fatalf("Crypto.encrypt() error = %v", err)
+		}
+		if _, err := c.decryptAny(data, 4); err != nil {
+			t.Fatalf("Crypto.decryptAny() error = %v", err)
+		}
+	}
+	<-done
+	if !c.IsActive() || string(c.GetActiveKey().Key) != "8765432187654321" {
+		t.Errorf("Crypto.rotate() active key = %s", c.GetActiveKey().Key)
+	}
+}
+
+func TestCrypto_decryptAny(t *testing.T) {
+	now := time.Now()
+	prev := CryptoKey{Key: []byte("1111111111111111"), Until: now.Add(-time.Second)}
+	active := CryptoKey{Key: []byte("2222222222222222"), Until: now.Add(time.Second)}
+	next := CryptoKey{Key: []byte("3333333333333333"), Until: now.Add(time.Hour)}
+	other := CryptoKey{Key: []byte("4444444444444444"), Until: now.Add(time.Hour)}
+
+	c := Crypto{Keys: []CryptoKey{active, next}, ActiveKey: active, PreviousKey: prev, Active: true}
+	data := []byte("introduction")
+	if enc, _ := c.encrypt(active.Key, make([]byte, 16)); len(enc) != 48 {
+		t.Errorf("Crypto.encrypt() didn't pad a single block: %d bytes", len(enc))
+	}
+
+	tests := []struct {
+		name    string
+		key     CryptoKey
+		wantErr bool
+	}{
+		{"active key", active, false},
+		{"previous key", prev, false},
+		{"next key", next, false},
+		{"unknown key", other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, _ := c.encrypt(tt.key.Key, append([]byte{}, data...))
+			got, err := c.decryptAny(enc, len(data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Crypto.decryptAny() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, data) {
+				t.Errorf("Crypto.decryptAny() = %s, want %s", got, data)
+			}
+		})
+	}
+}
+
+func TestValidPadding(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		length int
+		want   bool
+	}{
+		{"longer than data", []byte{0x1}, 2, false},
+		{"unpadded block", make([]byte, 16), 16, false},
+		{"no padding", make([]byte, 32), 32, false},
+		{"padding block", append(make([]byte, 16), bytes.Repeat([]byte{16}, 16)...), 16, true},
+		{"broken padding", []byte{0x1, 0x2, 0x2, 0x3}, 2, false},
+		{"padding", []byte{0x1, 0x2, 0x2, 0x2}, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validPadding(tt.data, tt.length); got != tt.want {
+				t.Errorf("validPadding() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrypto_KeysInfo(t *testing.T) {
+	now := time.Now()
+	prev := CryptoKey{Key: []byte("1111111111111111"), Until: now.Add(-time.Second)}
+	expired := CryptoKey{Key: []byte("0000000000000000"), Until: now.Add(-time.Hour)}
+	active := CryptoKey{Key: []byte("2222222222222222"), Until: now.Add(time.Minute)}
+	next := CryptoKey{Key: []byte("3333333333333333"), Until: now.Add(time.Hour)}
+	later := CryptoKey{Key: []byte("4444444444444444"), Until: now.Add(2 * time.Hour)}
+
+	c := Crypto{Keys: []CryptoKey{expired, prev, active, later, next}, ActiveKey: active, PreviousKey: prev, Active: true}
+	want := []string{KeyStateExpired, KeyStatePrevious, KeyStateActive, KeyStateScheduled, KeyStateNext}
+	info := c.KeysInfo()
+	if len(info) != len(want) {
+		t.Fatalf("Crypto.KeysInfo() returned %d keys, want %d", len(info), len(want))
+	}
+	for i, state := range want {
+		if info[i].State != state {
+			t.Errorf("Crypto.KeysInfo() state of key %d = %s, want %s", i, info[i].State, state)
+		}
+		if info[i].Fingerprint == "" || info[i].Fingerprint == string(c.Keys[i].Key) {
+			t.Errorf("Crypto.KeysInfo() wrong fingerprint for key %d", i)
+		}
+	}
+}
+
+func TestCrypto_ReadKeysFromFile(t *testing.T) {
+	now := time.Now()
+	until := now.Add(time.Hour).Unix()
+	later := now.Add(2 * time.Hour).Unix()
+
+	legacy := []byte(fmt.Sprintf("key: legacykey0000000\nttl: %d\n", until))
+	ring := []byte(fmt.Sprintf(`keys:
+  - key: firstkey00000000
+    ttl: %d
+  - key: secondkey0000000
+    from: %d
+    ttl: %d
+  - key: otherswarm000000
+    ttl: %d
+    swarms:
+      - other
+`, until, until, later, until))
+	broken := []byte("keys: [")
+	empty := []byte("keys:\n  - ttl: 1\n")
+	badFrom := []byte("keys:\n  - key: k000000000000000\n    from: a\n")
+	short := []byte("keys:\n  - key: short\n")
+
+	ioutil.WriteFile("/tmp/test-p2p-keys-legacy", legacy, 0600)
+	ioutil.WriteFile("/tmp/test-p2p-keys-ring", ring, 0600)
+	ioutil.WriteFile("/tmp/test-p2p-keys-broken", broken, 0600)
+	ioutil.WriteFile("/tmp/test-p2p-keys-empty", empty, 0600)
+	ioutil.WriteFile("/tmp/test-p2p-keys-from", badFrom, 0600)
+	ioutil.WriteFile("/tmp/test-p2p-keys-short", short, 0600)
+
+	tests := []struct {
+		name       string
+		filepath   string
+		hash       string
+		wantErr    bool
+		wantKeys   int
+		wantActive string
+	}{
+		{"missing file", "/tmp/test-p2p-keys-missing", "hash", true, 0, ""},
+		{"broken file", "/tmp/test-p2p-keys-broken", "hash", true, 0, ""},
+		{"empty key", "/tmp/test-p2p-keys-empty", "hash", true, 0, ""},
+		{"broken start date", "/tmp/test-p2p-keys-from", "hash", true, 0, ""},
+		{"short key", "/tmp/test-p2p-keys-short", "hash", true, 0, ""},
+		{"not bound", "/tmp/test-p2p-keys-ring", "hash", false, 2, "firstkey00000000"},
+		{"bound", "/tmp/test-p2p-keys-ring", "other", false, 3, "firstkey00000000"},
+		{"legacy", "/tmp/test-p2p-keys-legacy", "hash", false, 1, "legacykey0000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(Crypto)
+			if err := c.ReadKeysFromFile(tt.filepath, tt.hash); (err != nil) != tt.wantErr {
+				t.Errorf("Crypto.ReadKeysFromFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(c.Keys) != tt.wantKeys {
+				t.Errorf("Crypto.ReadKeysFromFile() loaded %d keys, want %d", len(c.Keys), tt.wantKeys)
+			}
+			if string(c.ActiveKey.Key) != tt.wantActive {
+				t.Errorf("Crypto.ReadKeysFromFile() active key = %s, want %s", c.ActiveKey.Key, tt.wantActive)
+			}
+			if tt.wantKeys > 0 && !c.Active {
+				t.Errorf("Crypto.ReadKeysFromFile() didn't activate encryption")
+			}
+		})
+	}
+
+	// Reload replaces keys from file, but keeps keys added manually
+	c := new(Crypto)
+	manual, _ := c.EnrichKeyValues(CryptoKey{}, "manualkey0000000", fmt.Sprintf("%d", until))
+	c.AddKey(manual)
+	c.ReadKeysFromFile("/tmp/test-p2p-keys-ring", "hash")
+	c.ReadKeysFromFile("/tmp/test-p2p-keys-legacy", "hash")
+	if len(c.Keys) != 2 {
+		t.Errorf("Crypto.ReadKeysFromFile() reload left %d keys, want 2", len(c.Keys))
+	}
+	if string(c.ActiveKey.Key) != "manualkey0000000" {
+		t.Errorf("Crypto.ReadKeysFromFile() reload changed active key to %s", c.ActiveKey.Key)
+	}
+}
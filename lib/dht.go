@@ -1,10 +1,14 @@
 package ptp
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/google/uuid"
 	"github.com/subutai-io/p2p/protocol"
 )
@@ -29,6 +33,7 @@ type DHTClient struct {
 	Routers           string                                 // Comma-separated list of bootstrap nodes
 	NetworkHash       string                                 // Saved network hash
 	ID                string                                 // Current instance ID
+	PublicKey         []byte                                 // Identity key presented to bootstrap nodes
 	FailedRouters     []string                               // List of routes that we failed to connect to
 	LocalPort         int                                    // UDP port number used by this instance
 	RemotePort        int                                    // UDP port number reported by echo server
@@ -38,12 +43,13 @@ type DHTClient struct {
 	IPList            []net.IP                               // List of network active interfaces
 	IP                net.IP                                 // IP of local interface received from DHCP or specified manually
 	Network           *net.IPNet                             // Network information about current network. Used to inform p2p about mask for interface
-	Connected         bool                                   // Whether connection with bootstrap nodes established or not
+	connected         int32                                  // Whether connection with bootstrap nodes established or not. Accessed atomically
 	LastUpdate        time.Time                              // When last `find` packet was sent
 	OutboundIP        net.IP                                 // Outbound IP
 	ListenerIsRunning bool                                   // True if listener is runnning
 	IncomingData      chan *protocol.DHTPacket
 	OutgoingData      chan *protocol.DHTPacket
+	connectRequest    *protocol.DHTPacket // Last connect request. Repeated with proof of identity when challenged
 }
 
 // Forwarder structure represents a Proxy received from DHT server
@@ -58,6 +64,21 @@ type PeerIP struct {
 	Ips []*net.UDPAddr
 }
 
+// IsConnected returns true if bootstrap confirmed registration of instance
+func (dht *DHTClient) IsConnected() bool {
+	return atomic.LoadInt32(&dht.connected) == 1
+}
+
+// SetConnected marks instance as registered on bootstrap or tells it that
+// bootstrap nodes are unreachable
+func (dht *DHTClient) SetConnected(connected bool) {
+	var value int32
+	if connected {
+		value = 1
+	}
+	atomic.StoreInt32(&dht.connected, value)
+}
+
 // Init bootstrap for this instance
 func (dht *DHTClient) Init(hash string) error {
 	dht.IncomingData = nil
@@ -73,7 +94,7 @@ func (dht *DHTClient) Init(hash string) error {
 
 // Connect sends `conn` packet to a DHT
 func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
-	dht.Connected = false
+	dht.SetConnected(false)
 	if dht.RemotePort == 0 {
 		dht.RemotePort = dht.LocalPort
 	}
@@ -109,6 +130,11 @@ func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 		Arguments: ips,
 		Proxies:   proxies,
 	}
+	if dht.PublicKey != nil {
+		// Bootstrap node keeps ID of returning instance
+		packet.Extra = base64.StdEncoding.EncodeToString(dht.PublicKey)
+	}
+	dht.connectRequest = proto.Clone(packet).(*protocol.DHTPacket)
 	err := dht.send(packet)
 	if err != nil {
 		return fmt.Errorf("Failed to handshake with bootstrap node: %s", err)
@@ -116,12 +142,12 @@ func (dht *DHTClient) Connect(ipList []net.IP, proxyList []*proxyServer) error {
 	// Waiting for 3 seconds to get connection confirmation
 	sent := time.Now()
 	for time.Since(sent) < time.Duration(5000*time.Millisecond) {
-		if dht.Connected {
+		if dht.IsConnected() {
 			return nil
 		}
 		time.Sleep(time.Millisecond * 100)
 	}
-	Log(Error, "DHT handshake didn't finish")
+	LogWith(Error, Fields{Hash: dht.NetworkHash, Subsystem: SubsystemDHT}, "DHT handshake didn't finish")
 	return fmt.Errorf("Couldn't handshake with bootstrap node")
 }
 
@@ -179,7 +205,7 @@ func (dht *DHTClient) sendFind() error {
 	if dht.NetworkHash == "" {
 		return fmt.Errorf("Failed to find peers: Infohash is not set")
 	}
-	Log(Debug, "Requesting swarm updates")
+	LogWith(Debug, Fields{Hash: dht.NetworkHash, Subsystem: SubsystemDHT}, "Requesting swarm updates")
 	packet := &protocol.DHTPacket{
 		Type:     protocol.DHTPacketType_Find,
 		Id:       dht.ID,
@@ -258,7 +284,7 @@ func (dht *DHTClient) sendDHCP(ip net.IP, network *net.IPNet) error {
 }
 
 func (dht *DHTClient) sendProxy() error {
-	Log(Debug, "Requesting proxies")
+	LogWith(Debug, Fields{Hash: dht.NetworkHash, Subsystem: SubsystemDHT}, "Requesting proxies")
 	packet := &protocol.DHTPacket{
 		Type:     protocol.DHTPacketType_Proxy,
 		Infohash: dht.NetworkHash,
@@ -304,6 +330,15 @@ func (dht *DHTClient) Close() error {
 		dht.IncomingData = nil
 	}
 	if dht.OutgoingData != nil {
+		// Let bootstrap node remove us from the swarm right away
+		if len(dht.ID) == 36 && dht.NetworkHash != "" {
+			dht.send(&protocol.DHTPacket{
+				Type:     protocol.DHTPacketType_Stop,
+				Id:       dht.ID,
+				Infohash: dht.NetworkHash,
+				Version:  PacketVersion,
+			})
+		}
 		close(dht.OutgoingData)
 		dht.OutgoingData = nil
 	}
@@ -330,14 +365,18 @@ func (dht *DHTClient) WaitID() error {
 
 // RegisterProxy will register current node as a proxy on bootstrap node
 func (dht *DHTClient) RegisterProxy(ip net.IP, port int) error {
-	id, err := uuid.NewUUID()
-	if err != nil {
-		return fmt.Errorf("Failed to generate ID: %s", err)
+	// ID is kept, so load reports can be matched with this proxy
+	if dht.ID == "" {
+		id, err := uuid.NewUUID()
+		if err != nil {
+			return fmt.Errorf("Failed to generate ID: %s", err)
+		}
+		dht.ID = id.String()
 	}
 
 	packet := &protocol.DHTPacket{
 		Type:     protocol.DHTPacketType_RegisterProxy,
-		Id:       id.String(),
+		Id:       dht.ID,
 		Infohash: dht.NetworkHash,
 		Data:     fmt.Sprintf("%s:%d", ip.String(), port),
 		Version:  PacketVersion,
@@ -347,5 +386,15 @@ func (dht *DHTClient) RegisterProxy(ip net.IP, port int) error {
 
 // ReportLoad will send amount of tunnels created on particular proxy
 func (dht *DHTClient) ReportLoad(clientsNum int) error {
-	return nil
+	if clientsNum < 0 {
+		return fmt.Errorf("Negative number of clients")
+	}
+	packet := &protocol.DHTPacket{
+		Type:     protocol.DHTPacketType_ReportLoad,
+		Id:       dht.ID,
+		Infohash: dht.NetworkHash,
+		Data:     strconv.Itoa(clientsNum),
+		Version:  PacketVersion,
+	}
+	return dht.send(packet)
 }
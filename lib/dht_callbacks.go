@@ -13,7 +13,7 @@ type dhtCallback func(*protocol.DHTPacket) error
 
 func (p *PeerToPeer) setupTCPCallbacks() {
 	if p.Dht == nil {
-		Log(Error, "Can't setup TCP callbacks: DHT is nil")
+		LogWith(Error, p.logFields(SubsystemDHT), "Can't setup TCP callbacks: DHT is nil")
 		return
 	}
 	p.Dht.TCPCallbacks = make(map[protocol.DHTPacketType]dhtCallback)
@@ -52,9 +52,12 @@ func (p *PeerToPeer) packetConnect(packet *protocol.DHTPacket) error {
 	if len(packet.Id) != 36 {
 		return fmt.Errorf("Received malformed ID")
 	}
+	if packet.Query == bootstrapChallenge {
+		return p.proveIdentity(packet)
+	}
 	p.Dht.ID = packet.Id
-	Log(Info, "Received personal ID for this session: %s", p.Dht.ID)
-	p.Dht.Connected = true
+	LogWith(Info, p.logFields(SubsystemDHT), "Received personal ID for this session: %s", p.Dht.ID)
+	p.Dht.SetConnected(true)
 	return nil
 }
 
@@ -68,12 +71,12 @@ func (p *PeerToPeer) packetDHCP(packet *protocol.DHTPacket) error {
 	if packet.Data != "" && packet.Extra != "" {
 		ip, network, err := net.ParseCIDR(fmt.Sprintf("%s/%s", packet.Data, packet.Extra))
 		if err != nil {
-			Log(Error, "Failed to parse DHCP packet: %s", err)
+			LogWith(Error, p.logFields(SubsystemDHT), "Failed to parse DHCP packet: %s", err)
 			return err
 		}
 		p.Dht.IP = ip
 		p.Dht.Network = network
-		Log(Info, "Received network information: %s", network.String())
+		LogWith(Info, p.logFields(SubsystemDHT), "Received network information: %s", network.String())
 	}
 	return nil
 }
@@ -90,7 +93,7 @@ func (p *PeerToPeer) packetError(packet *protocol.DHTPacket) error {
 	} else if packet.Data == "Error" {
 		lvl = Error
 	}
-	Log(lvl, "Bootstrap node returns: %s", packet.Extra)
+	LogWith(lvl, p.logFields(SubsystemDHT), "Bootstrap node returns: %s", packet.Extra)
 	return nil
 }
 
@@ -102,11 +105,11 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 		return fmt.Errorf("nil dht")
 	}
 	if len(packet.Arguments) == 0 {
-		Log(Warning, "Received empty peer list")
+		LogWith(Warning, p.logFields(SubsystemDHT), "Received empty peer list")
 		return nil
 	}
 	if packet.Data == p.Dht.ID {
-		Log(Debug, "Skipping self [%s = %s]", packet.Data, p.Dht.ID)
+		LogWith(Debug, p.logFields(SubsystemDHT), "Skipping self [%s = %s]", packet.Data, p.Dht.ID)
 		return nil
 	}
 	if p.Swarm == nil {
@@ -116,15 +119,23 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 		return fmt.Errorf("nil proxy manager")
 	}
 
-	Log(Debug, "Received `find`: %+v", packet)
+	LogWith(Debug, p.logFields(SubsystemDHT), "Received `find`: %+v", packet)
 	peer := p.Swarm.GetPeer(packet.Data)
 
+	if !p.member(packet.Data) {
+		LogWith(Debug, p.logFields(SubsystemDHT), "Skipping peer %s denied by access list", packet.Data)
+		if peer != nil {
+			p.EnforceACL()
+		}
+		return nil
+	}
+
 	if peer == nil {
 		peer := new(NetworkPeer)
-		Log(Debug, "Received new peer %s", packet.Data)
+		LogWith(Debug, p.logFields(SubsystemDHT), "Received new peer %s", packet.Data)
 		peer.ID = packet.Data
 		for _, ip := range packet.Arguments {
-			addr, err := net.ResolveUDPAddr("udp4", ip)
+			addr, err := resolveUDPAddr(ip)
 			if err != nil {
 				continue
 			}
@@ -144,11 +155,11 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 
 			if isNew {
 				peer.KnownIPs = append(peer.KnownIPs, addr)
-				Log(Debug, "Adding endpoint: %s", addr.String())
+				LogWith(Debug, p.logFields(SubsystemDHT), "Adding endpoint: %s", addr.String())
 			}
 		}
 		for _, proxy := range packet.Proxies {
-			addr, err := net.ResolveUDPAddr("udp4", proxy)
+			addr, err := resolveUDPAddr(proxy)
 			if err != nil {
 				continue
 			}
@@ -168,7 +179,7 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 
 			if isNew {
 				peer.Proxies = append(peer.Proxies, addr)
-				Log(Debug, "Adding proxy: %s", addr.String())
+				LogWith(Debug, p.logFields(SubsystemDHT), "Adding proxy: %s", addr.String())
 			}
 		}
 		if packet.GetExtra() != "skip" {
@@ -180,6 +191,7 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 	} else {
 		// This is an existing peer
 		peer.LastFind = time.Now()
+		peer.direct = false
 
 		ips := []*net.UDPAddr{}
 		proxies := []*net.UDPAddr{}
@@ -188,7 +200,7 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 			if ip == "" {
 				continue
 			}
-			addr, err := net.ResolveUDPAddr("udp4", ip)
+			addr, err := resolveUDPAddr(ip)
 			if err != nil {
 				continue
 			}
@@ -200,7 +212,7 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 			}
 			if isNew {
 				ips = append(ips, addr)
-				Log(Debug, "Updating endpoint: %s", addr.String())
+				LogWith(Debug, p.logFields(SubsystemDHT), "Updating endpoint: %s", addr.String())
 			}
 		}
 		peer.KnownIPs = ips
@@ -208,7 +220,7 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 			if proxy == "" {
 				continue
 			}
-			addr, err := net.ResolveUDPAddr("udp4", proxy)
+			addr, err := resolveUDPAddr(proxy)
 			if err != nil {
 				continue
 			}
@@ -220,7 +232,7 @@ func (p *PeerToPeer) packetFind(packet *protocol.DHTPacket) error {
 			}
 			if isNew {
 				proxies = append(proxies, addr)
-				Log(Debug, "Updating proxy: %s", addr.String())
+				LogWith(Debug, p.logFields(SubsystemDHT), "Updating proxy: %s", addr.String())
 			}
 		}
 		peer.Proxies = proxies
@@ -246,20 +258,24 @@ func (p *PeerToPeer) packetNode(packet *protocol.DHTPacket) error {
 		return fmt.Errorf("Empty IP's list")
 	}
 
+	if !p.member(packet.Data) {
+		return fmt.Errorf("Peer %s is denied by access list", packet.Data)
+	}
+
 	peer := p.Swarm.GetPeer(packet.Data)
 	if peer == nil {
 		return fmt.Errorf("Peer %s not found", packet.Data)
 	}
 
-	Log(Debug, "Received peer %s IPs", packet.Data)
+	LogWith(Debug, p.logFields(SubsystemDHT), "Received peer %s IPs", packet.Data)
 	list := []*net.UDPAddr{}
 	for _, addr := range packet.Arguments {
 		if addr == "" {
 			continue
 		}
-		ip, err := net.ResolveUDPAddr("udp4", addr)
+		ip, err := resolveUDPAddr(addr)
 		if err != nil {
-			Log(Error, "Failed to resolve one of peer addresses: %s", err)
+			LogWith(Error, p.logFields(SubsystemDHT), "Failed to resolve one of peer addresses: %s", err)
 			continue
 		}
 		list = append(list, ip)
@@ -291,24 +307,43 @@ func (p *PeerToPeer) packetProxy(packet *protocol.DHTPacket) error {
 	if p.Dht == nil {
 		return fmt.Errorf("nil dht")
 	}
-	Log(Debug, "Received list of proxies")
+	LogWith(Debug, p.logFields(SubsystemDHT), "Received list of proxies")
 	for _, proxy := range packet.Proxies {
-		proxyAddr, err := net.ResolveUDPAddr("udp4", proxy)
+		proxyAddr, err := resolveUDPAddr(proxy)
 		if err != nil {
 			continue
 		}
 		if p.ProxyManager.new(proxyAddr) == nil {
-			go func() {
-				msg, err := p.CreateMessage(MsgTypeProxy, []byte(p.Dht.ID), 0, false)
-				if err == nil {
-					p.UDPSocket.SendMessage(msg, proxyAddr)
-				}
-			}()
+			go p.registerProxy(proxyAddr, ProxyLegacyTimeout)
 		}
 	}
 	return nil
 }
 
+// ProxyLegacyTimeout is how long proxy is given to answer registration
+// with swarm hash before legacy registration is sent
+const ProxyLegacyTimeout = time.Second * 3
+
+// registerProxy requests a tunnel from proxy. Swarm hash lets proxy apply
+// per-swarm quotas, but proxies that don't know MsgTypeProxySwarm ignore
+// it, so legacy MsgTypeProxy with ID only is sent if there is no answer
+func (p *PeerToPeer) registerProxy(proxyAddr *net.UDPAddr, timeout time.Duration) {
+	id := p.Dht.ID
+	msg, err := p.CreateMessage(MsgTypeProxySwarm, []byte(id+p.Dht.NetworkHash), 0, false)
+	if err == nil {
+		p.UDPSocket.SendMessage(msg, proxyAddr)
+	}
+	time.Sleep(timeout)
+	if !p.ProxyManager.connecting(proxyAddr.String()) {
+		return
+	}
+	LogWith(Debug, p.logFields(SubsystemProxy), "Proxy %s didn't answer. Sending legacy registration", proxyAddr)
+	msg, err = p.CreateMessage(MsgTypeProxy, []byte(id), 0, false)
+	if err == nil {
+		p.UDPSocket.SendMessage(msg, proxyAddr)
+	}
+}
+
 // packetRequestProxy received when we was requesting proxy to connect to some peer
 func (p *PeerToPeer) packetRequestProxy(packet *protocol.DHTPacket) error {
 	if p.Swarm == nil {
@@ -316,9 +351,9 @@ func (p *PeerToPeer) packetRequestProxy(packet *protocol.DHTPacket) error {
 	}
 	list := []*net.UDPAddr{}
 	for _, proxy := range packet.Proxies {
-		addr, err := net.ResolveUDPAddr("udp4", proxy)
+		addr, err := resolveUDPAddr(proxy)
 		if err != nil {
-			Log(Error, "Can't parse proxy %s for peer %s", proxy, packet.Data)
+			LogWith(Error, p.logFields(SubsystemDHT), "Can't parse proxy %s for peer %s", proxy, packet.Data)
 			continue
 		}
 		list = append(list, addr)
@@ -332,7 +367,7 @@ func (p *PeerToPeer) packetRequestProxy(packet *protocol.DHTPacket) error {
 }
 
 func (p *PeerToPeer) packetReportProxy(packet *protocol.DHTPacket) error {
-	Log(Info, "DHT confirmed proxy registration")
+	LogWith(Info, p.logFields(SubsystemDHT), "DHT confirmed proxy registration")
 	return nil
 }
 
@@ -341,7 +376,7 @@ func (p *PeerToPeer) packetRegisterProxy(packet *protocol.DHTPacket) error {
 		return fmt.Errorf("nil packet")
 	}
 	if packet.Data == "OK" {
-		Log(Info, "Proxy registration confirmed")
+		LogWith(Info, p.logFields(SubsystemDHT), "Proxy registration confirmed")
 	}
 	return nil
 }
@@ -372,9 +407,9 @@ func (p *PeerToPeer) packetState(packet *protocol.DHTPacket) error {
 	if peer != nil {
 		peer.RemoteState = PeerState(numericState)
 		p.Swarm.Update(packet.Data, peer)
-		Log(Debug, "Peer %s reported state '%s'", peer.ID, StringifyState(peer.RemoteState))
+		LogWith(Debug, p.logFields(SubsystemDHT), "Peer %s reported state '%s'", peer.ID, StringifyState(peer.RemoteState))
 	} else {
-		Log(Trace, "Received state of unknown peer. Updating peers")
+		LogWith(Trace, p.logFields(SubsystemDHT), "Received state of unknown peer. Updating peers")
 		//p.Dht.sendFind()
 	}
 	return nil
@@ -397,14 +432,14 @@ func (p *PeerToPeer) packetUnknown(packet *protocol.DHTPacket) error {
 	if p.Interface == nil {
 		return fmt.Errorf("nil interface")
 	}
-	Log(Debug, "Received unknown packet")
+	LogWith(Debug, p.logFields(SubsystemDHT), "Received unknown packet")
 	p.FindNetworkAddresses()
 	if len(packet.Data) > 0 && packet.Data == "DHCP" {
-		Log(Warning, "Network information was requested")
+		LogWith(Warning, p.logFields(SubsystemDHT), "Network information was requested")
 		p.ReportIP(p.Interface.GetIP().String(), p.Interface.GetHardwareAddress().String(), p.Interface.GetName())
 		return nil
 	}
-	Log(Warning, "Bootstap node refuses our identity. Reconnecting")
+	LogWith(Warning, p.logFields(SubsystemDHT), "Bootstap node refuses our identity. Reconnecting")
 	return p.Dht.Connect(p.LocalIPs, p.ProxyManager.GetList())
 }
 
@@ -415,6 +450,6 @@ func (p *PeerToPeer) packetUnsupported(packet *protocol.DHTPacket) error {
 	if p.Dht == nil {
 		return fmt.Errorf("nil dht")
 	}
-	Log(Error, "Bootstap node doesn't support our version. Shutting down")
+	LogWith(Error, p.logFields(SubsystemDHT), "Bootstap node doesn't support our version. Shutting down")
 	return p.Dht.Close()
 }
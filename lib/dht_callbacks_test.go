@@ -4,6 +4,7 @@ import (
 	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/subutai-io/p2p/protocol"
 )
@@ -789,6 +790,40 @@ func TestPeerToPeer_packetProxy(t *testing.T) {
 	}
 }
 
+func TestPeerToPeer_registerProxy(t *testing.T) {
+	id := "123e4567-e89b-12d3-a456-426655440000"
+	conn, read := listenUDP(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 0)
+	defer socket.Close()
+	pm := new(ProxyManager)
+	pm.init()
+	pm.new(addr)
+	p := &PeerToPeer{UDPSocket: socket, ProxyManager: pm, Dht: &DHTClient{ID: id, NetworkHash: "swarm"}}
+
+	// Proxy which doesn't answer receives legacy registration
+	p.registerProxy(addr, time.Millisecond)
+	if msg := read(); msg == nil || msg.Header.Type != MsgTypeProxySwarm || string(msg.Data) != id+"swarm" {
+		t.Fatalf("PeerToPeer.registerProxy() sent wrong registration: %v", msg)
+	}
+	if msg := read(); msg == nil || msg.Header.Type != MsgTypeProxy || string(msg.Data) != id {
+		t.Fatalf("PeerToPeer.registerProxy() sent wrong legacy registration: %v", msg)
+	}
+
+	// Registered proxy doesn't receive legacy registration
+	pm.activate(addr.String(), addr)
+	p.registerProxy(addr, time.Millisecond)
+	if msg := read(); msg == nil || msg.Header.Type != MsgTypeProxySwarm {
+		t.Fatalf("PeerToPeer.registerProxy() sent wrong registration: %v", msg)
+	}
+	if msg := read(); msg != nil {
+		t.Errorf("PeerToPeer.registerProxy() sent legacy registration to registered proxy")
+	}
+}
+
 func TestPeerToPeer_packetRequestProxy(t *testing.T) {
 	type fields struct {
 		UDPSocket       *Network
@@ -0,0 +1,145 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/subutai-io/p2p/protocol"
+)
+
+// DHT packets are sent over TCP in frames prefixed with 4-byte big-endian
+// length. Older bootstrap nodes terminate packets with a delimiter instead
+// and older clients don't delimit packets at all, so framing is used only
+// when both sides support FramingVersion. Undelimited packets are
+// recognized by unmarshaling data received so far. Frame length never
+// exceeds DHTMaxFrameSize, which makes first byte of every frame zero.
+// Marshaled packet never starts with zero byte, because it's a field tag,
+// so both kinds of packets can be told apart on the same stream
+
+// DHTMaxFrameSize is a maximum size of a single DHT packet
+const DHTMaxFrameSize = 1 << 20
+
+// FramingVersion is the first packet version that uses length-prefixed frames
+const FramingVersion int32 = 20006
+
+// dhtDelimiter terminates packets of older protocol versions
+var dhtDelimiter = []byte{0x0a, 0x0b, 0x0c, 0x0a}
+
+var errFrameTooLarge = errors.New("DHT frame exceeds maximum size")
+
+// EncodeDHTFrame prepends packet with its length
+func EncodeDHTFrame(data []byte) ([]byte, error) {
+	if len(data) > DHTMaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return frame, nil
+}
+
+// IsDHTFrame returns true if data received from a stream starts with a frame
+func IsDHTFrame(data []byte) bool {
+	return len(data) > 0 && data[0] == 0
+}
+
+// DHTFrameReader reassembles packets received from a stream. Packets split
+// between several reads are kept until they are complete and coalesced
+// packets are returned one by one
+type DHTFrameReader struct {
+	buf       []byte
+	delimited bool // Whether delimiter was seen in the stream
+}
+
+// Write appends data received from a stream
+func (r *DHTFrameReader) Write(data []byte) (int, error) {
+	r.buf = append(r.buf, data...)
+	return len(data), nil
+}
+
+// Next returns next complete packet. Nil is returned when more data is
+// needed. Error means that stream can't be synchronized anymore and
+// connection should be closed
+func (r *DHTFrameReader) Next() ([]byte, error) {
+	for len(r.buf) > 0 {
+		if !IsDHTFrame(r.buf) {
+			i := bytes.Index(r.buf, dhtDelimiter)
+			if i < 0 {
+				if len(r.buf) > DHTMaxFrameSize+len(dhtDelimiter) {
+					return nil, errFrameTooLarge
+				}
+				if !r.delimited && proto.Unmarshal(r.buf, &protocol.DHTPacket{}) == nil {
+					// Peer doesn't delimit packets at all
+					return r.next(len(r.buf), 0), nil
+				}
+				return nil, nil
+			}
+			r.delimited = true
+			packet := r.next(i, len(dhtDelimiter))
+			if len(packet) == 0 {
+				continue
+			}
+			return packet, nil
+		}
+		if len(r.buf) < 4 {
+			return nil, nil
+		}
+		length := int(binary.BigEndian.Uint32(r.buf))
+		if length > DHTMaxFrameSize {
+			return nil, errFrameTooLarge
+		}
+		if len(r.buf) < 4+length {
+			return nil, nil
+		}
+		r.buf = r.buf[4:]
+		packet := r.next(length, 0)
+		if len(packet) == 0 {
+			continue
+		}
+		return packet, nil
+	}
+	return nil, nil
+}
+
+// next cuts packet of specified length followed by skip bytes from buffer
+func (r *DHTFrameReader) next(length, skip int) []byte {
+	packet := make([]byte, length)
+	copy(packet, r.buf)
+	r.buf = r.buf[length+skip:]
+	if len(r.buf) == 0 {
+		r.buf = nil
+	}
+	return packet
+}
+
+// Reset drops incomplete data, e.g. when connection was reestablished
+func (r *DHTFrameReader) Reset() {
+	r.buf = nil
+	r.delimited = false
+}
+
+// NegotiateVersion picks highest packet version supported by both sides
+// from a handshake. Bootstrap nodes supporting framing list their
+// versions in arguments of handshake, while version of the packet
+// itself remains readable by older clients
+func NegotiateVersion(handshake *protocol.DHTPacket) (int32, bool) {
+	offered := []int32{handshake.Version}
+	for _, arg := range handshake.Arguments {
+		v, err := strconv.ParseInt(arg, 10, 32)
+		if err == nil {
+			offered = append(offered, int32(v))
+		}
+	}
+	var version int32
+	for _, v := range offered {
+		for _, s := range SupportedVersion {
+			if v == s && v > version {
+				version = v
+			}
+		}
+	}
+	return version, version != 0
+}
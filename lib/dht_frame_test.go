@@ -0,0 +1,105 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/subutai-io/p2p/protocol"
+)
+
+func TestEncodeDHTFrame(t *testing.T) {
+	frame, err := EncodeDHTFrame([]byte{1, 2, 3})
+	if err != nil || !bytes.Equal(frame, []byte{0, 0, 0, 3, 1, 2, 3}) {
+		t.Errorf("EncodeDHTFrame() = %v, %v", frame, err)
+	}
+	if _, err := EncodeDHTFrame(make([]byte, DHTMaxFrameSize+1)); err != errFrameTooLarge {
+		t.Errorf("EncodeDHTFrame() didn't fail on large packet: %v", err)
+	}
+}
+
+func TestDHTFrameReader(t *testing.T) {
+	frame := func(data ...byte) []byte {
+		f, _ := EncodeDHTFrame(data)
+		return f
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	large := make([]byte, 4)
+	binary.BigEndian.PutUint32(large, DHTMaxFrameSize+1)
+	legacy := append([]byte{0x08, 0x01}, dhtDelimiter...)
+
+	tests := []struct {
+		name    string
+		writes  [][]byte
+		want    [][]byte
+		wantErr bool
+	}{
+		{"single frame", [][]byte{frame(1, 2, 3)}, [][]byte{{1, 2, 3}}, false},
+		{"coalesced frames", [][]byte{join(frame(1), frame(2, 2))}, [][]byte{{1}, {2, 2}}, false},
+		{"split header", [][]byte{{0, 0}, {0, 2, 5}, {6}}, [][]byte{{5, 6}}, false},
+		{"split payload", [][]byte{join(frame(1), frame(2, 3, 4))[:10], {3, 4}}, [][]byte{{1}, {2, 3, 4}}, false},
+		{"incomplete frame", [][]byte{frame(1, 2, 3)[:5]}, [][]byte{}, false},
+		{"empty frame", [][]byte{join(frame(), frame(1))}, [][]byte{{1}}, false},
+		{"legacy packets", [][]byte{join(legacy, legacy)}, [][]byte{{0x08, 0x01}, {0x08, 0x01}}, false},
+		{"split legacy packet", [][]byte{legacy[:3], legacy[3:]}, [][]byte{{0x08, 0x01}}, false},
+		{"legacy and framed", [][]byte{join(legacy, frame(1))}, [][]byte{{0x08, 0x01}, {1}}, false},
+		{"undelimited packet", [][]byte{{0x08, 0x01}}, [][]byte{{0x08, 0x01}}, false},
+		{"split undelimited packet", [][]byte{{0x12, 0x02, 0x61}, {0x62}}, [][]byte{{0x12, 0x02, 0x61, 0x62}}, false},
+		{"delimited stream", [][]byte{legacy, {0x08, 0x01}, dhtDelimiter}, [][]byte{{0x08, 0x01}, {0x08, 0x01}}, false},
+		{"oversized frame", [][]byte{large}, [][]byte{}, true},
+		{"oversized legacy packet", [][]byte{bytes.Repeat([]byte{1}, DHTMaxFrameSize+5)}, [][]byte{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := new(DHTFrameReader)
+			got := [][]byte{}
+			var err error
+			for _, w := range tt.writes {
+				r.Write(w)
+				for {
+					var data []byte
+					data, err = r.Next()
+					if data == nil || err != nil {
+						break
+					}
+					got = append(got, data)
+				}
+				if err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DHTFrameReader.Next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DHTFrameReader.Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake *protocol.DHTPacket
+		want      int32
+		wantOk    bool
+	}{
+		{"legacy server", &protocol.DHTPacket{Version: LegacyPacketVersion}, LegacyPacketVersion, true},
+		{"framing server", &protocol.DHTPacket{Version: LegacyPacketVersion, Arguments: []string{"20005", "20006"}}, FramingVersion, true},
+		{"newer server", &protocol.DHTPacket{Version: LegacyPacketVersion, Arguments: []string{"20005", "20006", "30000"}}, FramingVersion, true},
+		{"bad arguments", &protocol.DHTPacket{Version: LegacyPacketVersion, Arguments: []string{"10.0.0.1"}}, LegacyPacketVersion, true},
+		{"unsupported", &protocol.DHTPacket{Version: 1}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := NegotiateVersion(tt.handshake)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("NegotiateVersion() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -49,9 +49,7 @@ breakFirstFor:
 					errChan <- dht.Connect([]net.IP{net.IP("127.0.0.1"), net.IP(nil), net.IP("127.0.0.2")}, []*proxyServer{{Endpoint: &net.UDPAddr{IP: net.IP("192.168.0.1"), Port: 8080}}})
 				}()
 				time.Sleep(2 * time.Second)
-				if !dht.Connected {
-					dht.Connected = true
-				}
+				dht.SetConnected(true)
 				err := <-errChan
 				if err != nil {
 					t.Fatalf("Failed to connect (2): %v", err)
@@ -573,7 +571,6 @@ func TestDHTClient_WaitID(t *testing.T) {
 		IPList            []net.IP
 		IP                net.IP
 		Network           *net.IPNet
-		Connected         bool
 		LastUpdate        time.Time
 		OutboundIP        net.IP
 		ListenerIsRunning bool
@@ -603,7 +600,6 @@ func TestDHTClient_WaitID(t *testing.T) {
 				IPList:            tt.fields.IPList,
 				IP:                tt.fields.IP,
 				Network:           tt.fields.Network,
-				Connected:         tt.fields.Connected,
 				LastUpdate:        tt.fields.LastUpdate,
 				OutboundIP:        tt.fields.OutboundIP,
 				ListenerIsRunning: tt.fields.ListenerIsRunning,
@@ -632,7 +628,6 @@ func TestDHTClient_RegisterProxy(t *testing.T) {
 		IPList            []net.IP
 		IP                net.IP
 		Network           *net.IPNet
-		Connected         bool
 		LastUpdate        time.Time
 		OutboundIP        net.IP
 		ListenerIsRunning bool
@@ -666,7 +661,6 @@ func TestDHTClient_RegisterProxy(t *testing.T) {
 				IPList:            tt.fields.IPList,
 				IP:                tt.fields.IP,
 				Network:           tt.fields.Network,
-				Connected:         tt.fields.Connected,
 				LastUpdate:        tt.fields.LastUpdate,
 				OutboundIP:        tt.fields.OutboundIP,
 				ListenerIsRunning: tt.fields.ListenerIsRunning,
@@ -695,7 +689,6 @@ func TestDHTClient_ReportLoad(t *testing.T) {
 		IPList            []net.IP
 		IP                net.IP
 		Network           *net.IPNet
-		Connected         bool
 		LastUpdate        time.Time
 		OutboundIP        net.IP
 		ListenerIsRunning bool
@@ -711,7 +704,9 @@ func TestDHTClient_ReportLoad(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		{"t1", fields{}, args{}, false},
+		{"closed channel", fields{}, args{1}, true},
+		{"negative", fields{OutgoingData: make(chan *protocol.DHTPacket, 1)}, args{-1}, true},
+		{"passing", fields{OutgoingData: make(chan *protocol.DHTPacket, 1)}, args{5}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -728,7 +723,6 @@ func TestDHTClient_ReportLoad(t *testing.T) {
 				IPList:            tt.fields.IPList,
 				IP:                tt.fields.IP,
 				Network:           tt.fields.Network,
-				Connected:         tt.fields.Connected,
 				LastUpdate:        tt.fields.LastUpdate,
 				OutboundIP:        tt.fields.OutboundIP,
 				ListenerIsRunning: tt.fields.ListenerIsRunning,
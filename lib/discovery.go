@@ -0,0 +1,209 @@
+package ptp
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bootstrap nodes discovery. Addresses of bootstrap nodes are collected
+// from several sources and merged. Discovery is repeated periodically,
+// so bootstrap nodes can be added or removed while daemon is running
+
+// Discovery settings
+const (
+	DefaultBootstrapEnv    = "P2P_BOOTSTRAP" // Environment variable with comma-separated list of bootstrap nodes
+	DefaultBootstrapDomain = "subutai.io"    // Domain used for SRV lookup
+	DiscoveryInterval      = time.Duration(time.Second * 5)
+	SRVRefreshInterval     = time.Duration(time.Minute * 5)
+)
+
+// BootstrapSource provides addresses of bootstrap nodes
+type BootstrapSource interface {
+	// Lookup returns list of bootstrap nodes in host:port format
+	Lookup() ([]string, error)
+	String() string
+}
+
+// parseRouters splits list of addresses separated by commas or new lines.
+// Lines started with # are ignored
+func parseRouters(list string) []string {
+	routers := []string{}
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, r := range strings.Split(line, ",") {
+			r = strings.TrimSpace(r)
+			if r != "" {
+				routers = append(routers, r)
+			}
+		}
+	}
+	return routers
+}
+
+// StaticSource is a fixed list of bootstrap nodes
+type StaticSource []string
+
+// Lookup returns the list
+func (s StaticSource) Lookup() ([]string, error) {
+	return []string(s), nil
+}
+
+func (s StaticSource) String() string {
+	return "static list"
+}
+
+// EnvSource reads bootstrap nodes from environment variable
+type EnvSource struct {
+	Variable string
+}
+
+// Lookup returns addresses from environment variable
+func (s *EnvSource) Lookup() ([]string, error) {
+	return parseRouters(os.Getenv(s.Variable)), nil
+}
+
+func (s *EnvSource) String() string {
+	return fmt.Sprintf("environment variable %s", s.Variable)
+}
+
+// FileSource reads bootstrap nodes from a file with one address per line.
+// File is read again only when it was modified
+type FileSource struct {
+	Path     string
+	modified time.Time
+	routers  []string
+}
+
+// Lookup returns addresses listed in the file
+func (s *FileSource) Lookup() ([]string, error) {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		s.routers = nil
+		s.modified = time.Time{}
+		return nil, err
+	}
+	if s.routers != nil && info.ModTime().Equal(s.modified) {
+		return s.routers, nil
+	}
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	s.routers = parseRouters(string(data))
+	s.modified = info.ModTime()
+	return s.routers, nil
+}
+
+func (s *FileSource) String() string {
+	return fmt.Sprintf("file %s", s.Path)
+}
+
+// SRVSource looks up bootstrap nodes with DNS SRV records. Result is
+// cached, so DNS is not queried on every discovery round
+type SRVSource struct {
+	Service string
+	Domain  string
+	updated time.Time
+	routers []string
+	lookup  func(name, proto, domain string) (map[int]string, error)
+}
+
+// Lookup returns addresses from SRV records
+func (s *SRVSource) Lookup() ([]string, error) {
+	if s.routers != nil && time.Since(s.updated) < SRVRefreshInterval {
+		return s.routers, nil
+	}
+	lookup := s.lookup
+	if lookup == nil {
+		lookup = SrvLookup
+	}
+	result, err := lookup(s.Service, "tcp", s.Domain)
+	if err != nil {
+		return s.routers, err
+	}
+	routers := []string{}
+	for i := 0; i < len(result); i++ {
+		if r, exists := result[i]; exists && r != "" {
+			routers = append(routers, r)
+		}
+	}
+	s.routers = routers
+	s.updated = time.Now()
+	return s.routers, nil
+}
+
+func (s *SRVSource) String() string {
+	return fmt.Sprintf("SRV _%s._tcp.%s", s.Service, s.Domain)
+}
+
+// BootstrapDiscovery merges addresses provided by several sources
+type BootstrapDiscovery struct {
+	Sources []BootstrapSource
+	lock    sync.Mutex
+}
+
+// NewBootstrapDiscovery creates discovery from configuration. Target is
+// either a comma-separated list of bootstrap nodes or a name of SRV entry
+func NewBootstrapDiscovery(conf *Conf, target string) *BootstrapDiscovery {
+	d := new(BootstrapDiscovery)
+	if conf == nil {
+		conf = new(Conf)
+		conf.SetDefaults()
+	}
+	d.Sources = append(d.Sources, &EnvSource{Variable: DefaultBootstrapEnv})
+	if len(conf.Bootstrap.Routers) > 0 {
+		d.Sources = append(d.Sources, StaticSource(conf.Bootstrap.Routers))
+	}
+	if conf.Bootstrap.File != "" {
+		d.Sources = append(d.Sources, &FileSource{Path: conf.Bootstrap.File})
+	}
+	if strings.Contains(target, ":") {
+		d.Sources = append(d.Sources, StaticSource(parseRouters(target)))
+	} else if !conf.Bootstrap.DisableSRV && (conf.Bootstrap.SRV != "" || target != "") {
+		service := conf.Bootstrap.SRV
+		if service == "" {
+			service = target
+		}
+		d.Sources = append(d.Sources, &SRVSource{Service: service, Domain: conf.GetBootstrapDomain()})
+	}
+	return d
+}
+
+// Lookup returns merged list of bootstrap nodes. Error is returned
+// only when none of the sources has provided an address
+func (d *BootstrapDiscovery) Lookup() ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	routers := []string{}
+	seen := make(map[string]bool)
+	var lastErr error
+	for _, source := range d.Sources {
+		list, err := source.Lookup()
+		if err != nil {
+			LogWith(Debug, Fields{Subsystem: SubsystemDiscovery}, "Bootstrap discovery over %s failed: %s", source, err)
+			lastErr = err
+		}
+		for _, r := range list {
+			if !seen[r] {
+				seen[r] = true
+				routers = append(routers, r)
+			}
+		}
+	}
+	if len(routers) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no bootstrap nodes were found")
+		}
+		return nil, lastErr
+	}
+	return routers, nil
+}
@@ -0,0 +1,152 @@
+package ptp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseRouters(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{"empty", "", []string{}},
+		{"comma separated", "a:1, b:2,,c:3", []string{"a:1", "b:2", "c:3"}},
+		{"lines with comments", "# bootstrap nodes\na:1\n\n  b:2  \n#c:3", []string{"a:1", "b:2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRouters(tt.list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRouters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileSource_Lookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-discovery")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bootstrap")
+	s := &FileSource{Path: path}
+
+	if _, err := s.Lookup(); err == nil {
+		t.Errorf("FileSource.Lookup() didn't fail on missing file")
+	}
+	ioutil.WriteFile(path, []byte("a:1\nb:2\n"), 0644)
+	got, err := s.Lookup()
+	if err != nil || !reflect.DeepEqual(got, []string{"a:1", "b:2"}) {
+		t.Fatalf("FileSource.Lookup() = %v, %v", got, err)
+	}
+
+	// Modified file is read again
+	ioutil.WriteFile(path, []byte("c:3\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	got, err = s.Lookup()
+	if err != nil || !reflect.DeepEqual(got, []string{"c:3"}) {
+		t.Fatalf("FileSource.Lookup() after change = %v, %v", got, err)
+	}
+}
+
+func TestSRVSource_Lookup(t *testing.T) {
+	calls := 0
+	fail := false
+	s := &SRVSource{Service: "dht", Domain: "example.com", lookup: func(name, proto, domain string) (map[int]string, error) {
+		calls++
+		if fail {
+			return nil, fmt.Errorf("lookup failed")
+		}
+		return map[int]string{0: "a:1", 1: "b:2"}, nil
+	}}
+
+	got, err := s.Lookup()
+	if err != nil || !reflect.DeepEqual(got, []string{"a:1", "b:2"}) {
+		t.Fatalf("SRVSource.Lookup() = %v, %v", got, err)
+	}
+	s.Lookup()
+	if calls != 1 {
+		t.Errorf("SRVSource.Lookup() didn't use cache: %d calls", calls)
+	}
+
+	// Previous result is kept when lookup fails
+	s.updated = time.Now().Add(-SRVRefreshInterval)
+	fail = true
+	got, err = s.Lookup()
+	if err == nil || !reflect.DeepEqual(got, []string{"a:1", "b:2"}) {
+		t.Errorf("SRVSource.Lookup() on failure = %v, %v", got, err)
+	}
+}
+
+// brokenSource always fails
+type brokenSource struct{}
+
+func (s brokenSource) Lookup() ([]string, error) { return nil, fmt.Errorf("broken") }
+func (s brokenSource) String() string            { return "broken" }
+
+func TestBootstrapDiscovery_Lookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []BootstrapSource
+		want    []string
+		wantErr bool
+	}{
+		{"no sources", nil, nil, true},
+		{"empty source", []BootstrapSource{StaticSource{}}, nil, true},
+		{"failed source", []BootstrapSource{brokenSource{}}, nil, true},
+		{"one of sources failed", []BootstrapSource{brokenSource{}, StaticSource{"a:1"}}, []string{"a:1"}, false},
+		{"merged", []BootstrapSource{StaticSource{"a:1", "b:2"}, StaticSource{"b:2", "c:3"}}, []string{"a:1", "b:2", "c:3"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &BootstrapDiscovery{Sources: tt.sources}
+			got, err := d.Lookup()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BootstrapDiscovery.Lookup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BootstrapDiscovery.Lookup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewBootstrapDiscovery(t *testing.T) {
+	conf := new(Conf)
+	conf.SetDefaults()
+	conf.Bootstrap.Routers = []string{"a:1"}
+	conf.Bootstrap.File = "/etc/p2p/bootstrap"
+	noSRV := new(Conf)
+	noSRV.SetDefaults()
+	noSRV.Bootstrap.DisableSRV = true
+
+	tests := []struct {
+		name   string
+		conf   *Conf
+		target string
+		want   []string
+	}{
+		{"nil config", nil, "dht", []string{"environment variable P2P_BOOTSTRAP", "SRV _dht._tcp.subutai.io"}},
+		{"list of addresses", nil, "a:1,b:2", []string{"environment variable P2P_BOOTSTRAP", "static list"}},
+		{"all sources", conf, "dht", []string{"environment variable P2P_BOOTSTRAP", "static list", "file /etc/p2p/bootstrap", "SRV _dht._tcp.subutai.io"}},
+		{"srv disabled", noSRV, "dht", []string{"environment variable P2P_BOOTSTRAP"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, s := range NewBootstrapDiscovery(tt.conf, tt.target).Sources {
+				got = append(got, s.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewBootstrapDiscovery() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
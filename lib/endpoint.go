@@ -16,6 +16,7 @@ type Endpoint struct {
 	broken           bool
 	Latency          time.Duration
 	LastLatencyQuery time.Time
+	Relay            string // ID of a peer relaying traffic over this endpoint
 }
 
 // Measure will prepare and send latency packet to the endpoint
@@ -47,18 +48,22 @@ func (e *Endpoint) Measure(n *Network, id string) {
 	}
 
 	payload := []byte{}
-	payload = append(payload, LatencyRequestHeader...)
+	if len(ba) == net.IPv6len+2 {
+		payload = append(payload, LatencyRequestHeaderV6...)
+	} else {
+		payload = append(payload, LatencyRequestHeader...)
+	}
 	payload = append(payload, ba...)
 	payload = append(payload, []byte(id)...)
 	payload = append(payload, ts...)
 
 	msg, err := CreateMessageStatic(MsgTypeLatency, payload)
 	if err != nil {
-		Log(Error, "Failed to create latency measurement packet for endpoint: %s", err.Error())
+		LogWith(Error, Fields{Subsystem: SubsystemPeer, Endpoint: e.Addr.String()}, "Failed to create latency measurement packet for endpoint: %s", err.Error())
 		e.LastLatencyQuery = time.Now()
 		return
 	}
-	Log(Trace, "Measuring latency with endpoint %s", e.Addr.String())
+	LogWith(Trace, Fields{Subsystem: SubsystemPeer, Endpoint: e.Addr.String()}, "Measuring latency with endpoint %s", e.Addr.String())
 	n.SendMessage(msg, e.Addr)
 }
 
@@ -67,25 +72,39 @@ func (e *Endpoint) addrToBytes() []byte {
 		return nil
 	}
 
-	// 4 bytes of IP and 2 bytes of port
-	ipfield := make([]byte, 6)
-
-	ip4 := e.Addr.IP.To4()
-	if len(ip4) != 4 {
+	// 4 bytes of IP and 2 bytes of port for IPv4
+	// 16 bytes of IP and 2 bytes of port for IPv6
+	ip := e.Addr.IP.To4()
+	if ip == nil {
+		ip = e.Addr.IP.To16()
+	}
+	if ip == nil {
 		return nil
 	}
+	ipfield := make([]byte, len(ip)+2)
 	port := e.Addr.Port
 
-	copy(ipfield[0:4], ip4[:4])
-	binary.BigEndian.PutUint16(ipfield[4:6], uint16(port))
-
-	// Data extract
-	// net.IP{ipfield[0], ipfield[1], ipfield[2], ipfield[3]}
-	// binary.BigEndian.Uint16(ipfield[4:6])
+	copy(ipfield, ip)
+	binary.BigEndian.PutUint16(ipfield[len(ip):], uint16(port))
 	return ipfield
 }
 
-func (e *Endpoint) ping(ptpc *PeerToPeer, id string) error {
+// bytesToAddr is a reverse of addrToBytes
+func bytesToAddr(ipfield []byte) (*net.UDPAddr, error) {
+	if len(ipfield) != net.IPv4len+2 && len(ipfield) != net.IPv6len+2 {
+		return nil, fmt.Errorf("wrong address length: %d", len(ipfield))
+	}
+	size := len(ipfield) - 2
+	addr := &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, ipfield[:size]...)),
+		Port: int(binary.BigEndian.Uint16(ipfield[size:])),
+	}
+	return addr, nil
+}
+
+// ping sends cross peer ping with specified ID of this instance to the
+// endpoint of peer with specified ID
+func (e *Endpoint) ping(ptpc *PeerToPeer, id, peer string) error {
 	if ptpc == nil {
 		return fmt.Errorf("nil ptp")
 	}
@@ -97,11 +116,11 @@ func (e *Endpoint) ping(ptpc *PeerToPeer, id string) error {
 		return fmt.Errorf("nil addr")
 	}
 	payload := append([]byte("q"+id), []byte(e.Addr.String())...)
-	msg, err := ptpc.CreateMessage(MsgTypeXpeerPing, payload, 0, true)
+	msg, err := ptpc.createMessageFor(peer, MsgTypeXpeerPing, payload)
 	if err != nil {
 		return err
 	}
-	Log(Trace, "Sending ping to endpoint: %s", e.Addr.String())
+	LogWith(Trace, Fields{Hash: ptpc.Hash, Subsystem: SubsystemPeer, Peer: peer, Endpoint: e.Addr.String()}, "Sending ping to endpoint: %s", e.Addr.String())
 	_, err = ptpc.UDPSocket.SendMessage(msg, e.Addr)
 	return err
 }
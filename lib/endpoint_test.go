@@ -34,6 +34,11 @@ func TestEndpoint_addrToBytes(t *testing.T) {
 	r4 := []byte{254, 254, 254, 254, 0, 0}
 	binary.BigEndian.PutUint16(r4[4:6], uint16(65534))
 
+	a5, _ := net.ResolveUDPAddr("udp", "[2001:db8::1]:1111")
+	r5 := append([]byte{}, net.ParseIP("2001:db8::1")...)
+	r5 = append(r5, 0, 0)
+	binary.BigEndian.PutUint16(r5[16:18], uint16(1111))
+
 	tests := []struct {
 		name   string
 		fields fields
@@ -44,6 +49,7 @@ func TestEndpoint_addrToBytes(t *testing.T) {
 		{"Testing 0.0.0.0:0000", fields{Addr: a2}, r2},
 		{"Testing 255.255.255.255:65535", fields{Addr: a3}, r3},
 		{"Testing 254.254.254.254:65534", fields{Addr: a4}, r4},
+		{"Testing [2001:db8::1]:1111", fields{Addr: a5}, r5},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -62,6 +68,33 @@ func TestEndpoint_addrToBytes(t *testing.T) {
 	}
 }
 
+func Test_bytesToAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr bool
+	}{
+		{"ipv4", "192.168.0.1:1234", false},
+		{"ipv6", "[2001:db8::1]:1234", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := net.ResolveUDPAddr("udp", tt.addr)
+			got, err := bytesToAddr((&Endpoint{Addr: addr}).addrToBytes())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("bytesToAddr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.addr {
+				t.Errorf("bytesToAddr() = %v, want %v", got, tt.addr)
+			}
+		})
+	}
+	if _, err := bytesToAddr([]byte{0x1, 0x2, 0x3}); err == nil {
+		t.Errorf("bytesToAddr() should fail on wrong length")
+	}
+}
+
 func TestEndpoint_Measure(t *testing.T) {
 	type fields struct {
 		Addr             *net.UDPAddr
@@ -0,0 +1,137 @@
+package ptp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events are published by instances and by the daemon and delivered to
+// every subscriber, such as REST event stream. Publishing never blocks:
+// subscriber which doesn't read events fast enough loses them
+
+// EventType is a type of the event
+type EventType string
+
+// Types of events
+const (
+	EventPeerState  EventType = "peer-state"  // Peer has changed its state
+	EventInterface  EventType = "interface"   // Status of instance interface has changed
+	EventIPSet      EventType = "ip-set"      // Peer is available over new IP
+	EventIPConflict EventType = "ip-conflict" // IP is used by more than one peer
+	EventProxy      EventType = "proxy"       // Proxy was activated or disconnected
+	EventBootstrap  EventType = "bootstrap"   // Bootstrap node was connected or disconnected
+)
+
+// EventBufferSize is a number of events queued for a subscriber
+const EventBufferSize = 256
+
+// Event describes a change in the daemon or in one of its instances
+type Event struct {
+	ID      uint64    `json:"id"`
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Hash    string    `json:"hash,omitempty"`    // Infohash of the instance
+	Peer    string    `json:"peer,omitempty"`    // ID of the peer
+	State   string    `json:"state,omitempty"`   // New state
+	IP      string    `json:"ip,omitempty"`      // IP address of interface or peer
+	Address string    `json:"address,omitempty"` // Endpoint of proxy or bootstrap node
+}
+
+// EventSubscription receives published events
+type EventSubscription struct {
+	C       <-chan Event
+	ch      chan Event
+	dropped uint64
+}
+
+// Dropped returns number of events lost by subscriber
+func (s *EventSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+type eventBus struct {
+	subscribers map[*EventSubscription]bool
+	lastID      uint64
+	lock        sync.RWMutex
+}
+
+var events eventBus
+
+// SubscribeEvents creates new subscription to events
+func SubscribeEvents() *EventSubscription {
+	ch := make(chan Event, EventBufferSize)
+	s := &EventSubscription{C: ch, ch: ch}
+	events.lock.Lock()
+	if events.subscribers == nil {
+		events.subscribers = make(map[*EventSubscription]bool)
+	}
+	events.subscribers[s] = true
+	events.lock.Unlock()
+	return s
+}
+
+// UnsubscribeEvents stops delivery of events to subscriber
+func UnsubscribeEvents(s *EventSubscription) {
+	events.lock.Lock()
+	if events.subscribers[s] {
+		delete(events.subscribers, s)
+		close(s.ch)
+	}
+	events.lock.Unlock()
+}
+
+// PublishEvent delivers event to every subscriber
+func PublishEvent(e Event) {
+	e.ID = atomic.AddUint64(&events.lastID, 1)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	events.lock.RLock()
+	defer events.lock.RUnlock()
+	for s := range events.subscribers {
+		select {
+		case s.ch <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// StringifyInterfaceStatus returns human-readable status of interface
+func StringifyInterfaceStatus(status InterfaceStatus) string {
+	switch status {
+	case InterfaceWaiting:
+		return "WAITING"
+	case InterfaceConfiguring:
+		return "CONFIGURING"
+	case InterfaceConfigured:
+		return "CONFIGURED"
+	case InterfaceDeconfigured:
+		return "DECONFIGURED"
+	case InterfaceRunning:
+		return "RUNNING"
+	case InterfaceBroken:
+		return "BROKEN"
+	case InterfaceShutdown:
+		return "SHUTDOWN"
+	}
+	return "UNKNOWN"
+}
+
+// checkInterfaceStatus publishes changes of interface status
+func (p *PeerToPeer) checkInterfaceStatus() {
+	if p.Interface == nil {
+		return
+	}
+	status := p.Interface.GetStatus()
+	if status == p.interfaceStatus {
+		return
+	}
+	p.interfaceStatus = status
+	e := Event{Type: EventInterface, Hash: p.Hash, State: StringifyInterfaceStatus(status)}
+	if ip := p.Interface.GetIP(); ip != nil {
+		e.IP = ip.String()
+	}
+	PublishEvent(e)
+}
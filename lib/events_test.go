@@ -0,0 +1,58 @@
+package ptp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishEvent(t *testing.T) {
+	sub := SubscribeEvents()
+	defer UnsubscribeEvents(sub)
+
+	PublishEvent(Event{Type: EventBootstrap, State: "CONNECTED", Address: "test"})
+	e := <-sub.C
+	if e.Type != EventBootstrap || e.Address != "test" || e.ID == 0 || e.Time.IsZero() {
+		t.Errorf("PublishEvent() delivered %+v", e)
+	}
+
+	// Publisher doesn't wait for slow subscriber
+	for i := 0; i < EventBufferSize+10; i++ {
+		PublishEvent(Event{Type: EventProxy})
+	}
+	if sub.Dropped() < 10 {
+		t.Errorf("EventSubscription.Dropped() = %d, want at least 10", sub.Dropped())
+	}
+
+	UnsubscribeEvents(sub)
+	for range sub.C {
+	}
+	PublishEvent(Event{Type: EventProxy})
+}
+
+func TestNetworkPeer_SetState_event(t *testing.T) {
+	sub := SubscribeEvents()
+	defer UnsubscribeEvents(sub)
+
+	p := &PeerToPeer{Hash: "event hash", Dht: new(DHTClient)}
+	np := &NetworkPeer{ID: "peer", State: PeerStateConnecting}
+	np.SetState(PeerStateConnecting, p)
+	np.SetState(PeerStateConnected, p)
+	received := []Event{}
+	timeout := time.After(time.Millisecond * 200)
+	for done := false; !done; {
+		select {
+		case e := <-sub.C:
+			if e.Hash == "event hash" {
+				received = append(received, e)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if len(received) != 1 {
+		t.Fatalf("Published %d events, want 1", len(received))
+	}
+	if e := received[0]; e.Type != EventPeerState || e.Peer != "peer" || e.State != StringifyState(PeerStateConnected) {
+		t.Errorf("Wrong peer state event: %+v", e)
+	}
+}
@@ -0,0 +1,459 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/subutai-io/p2p/protocol"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Authenticated key exchange between peers.
+// Every instance owns a long-term identity key pair and generates an
+// ephemeral key pair for every peer it connects to. Public keys are
+// exchanged in introduction packets and both sides derive a pair of
+// session keys - one per direction. Swarm key is mixed into derivation,
+// so it only authorizes membership and doesn't protect traffic between
+// two other peers. Peers announce ID of their active swarm keys, so
+// sessions are established during key rotation grace period as well
+
+// Key exchange payload: version[1] static[32] ephemeral[32] salt[4] key ID[4]
+const (
+	keyExchangeVersion   byte   = 1
+	keyIDSize            int    = 4
+	keyExchangeSize      int    = 1 + 32 + 32 + aeadSaltSize + keyIDSize
+	keyExchangeSeparator string = "|"
+)
+
+// keyExchangeContext is used as info during session key derivation
+var keyExchangeContext = []byte("p2p-key-exchange")
+
+// keyIDContext is mixed into IDs of swarm keys announced to peers
+var keyIDContext = []byte("p2p-key-id")
+
+// identityProofContext is mixed into proof of identity sent to bootstrap nodes
+var identityProofContext = []byte("p2p-identity-proof")
+
+// Identity is a X25519 key pair
+type Identity struct {
+	Private []byte
+	Public  []byte
+}
+
+// NewIdentity generates new X25519 key pair
+func NewIdentity() (*Identity, error) {
+	id := &Identity{Private: make([]byte, curve25519.ScalarSize)}
+	if _, err := rand.Read(id.Private); err != nil {
+		return nil, err
+	}
+	var err error
+	id.Public, err = curve25519.X25519(id.Private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// LoadIdentity restores key pair from base64-encoded private key
+func LoadIdentity(private string) (*Identity, error) {
+	key, err := base64.StdEncoding.DecodeString(private)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("wrong identity key length: %d", len(key))
+	}
+	id := &Identity{Private: key}
+	id.Public, err = curve25519.X25519(id.Private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// Encode returns base64-encoded private key
+func (i *Identity) Encode() string {
+	return base64.StdEncoding.EncodeToString(i.Private)
+}
+
+// PublicKey returns base64-encoded public key
+func (i *Identity) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(i.Public)
+}
+
+// ID returns ID of the instance owning this key pair
+func (i *Identity) ID() string {
+	return IdentityID(i.Public)
+}
+
+// IdentityID returns peer ID derived from identity key
+func IdentityID(key []byte) string {
+	sum := sha256.Sum256(key)
+	id := hex.EncodeToString(sum[:16])
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32]
+}
+
+// identityProof proves ownership of identity key to bootstrap node. Proof
+// is keyed with X25519 of one side's private key and the other side's
+// public key, so instance signs it with its identity and bootstrap node
+// verifies it with private key of the challenge
+func identityProof(private, public []byte, id, infohash string) ([]byte, error) {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, shared)
+	mac.Write(identityProofContext)
+	mac.Write([]byte(id))
+	mac.Write([]byte(infohash))
+	return mac.Sum(nil), nil
+}
+
+// session is a state of key exchange with a single peer
+type session struct {
+	ephemeral       *Identity // Ephemeral key pair generated for this peer
+	remoteStatic    []byte    // Identity key presented by peer
+	remoteEphemeral []byte    // Ephemeral key presented by peer
+	keyIDs          []byte    // IDs of swarm keys session keys were derived with
+	sendKey         []byte    // Key used to seal frames sent to peer
+	recvKey         []byte    // Key used to open frames received from peer
+	required        bool      // Peer has presented keys once and is never accepted without them
+	lock            sync.RWMutex
+}
+
+// reset drops keys of remote peer, ephemeral key and session keys.
+// Peer which has presented keys before must present them again
+func (s *session) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ephemeral = nil
+	s.remoteStatic = nil
+	s.remoteEphemeral = nil
+	s.keyIDs = nil
+	s.sendKey = nil
+	s.recvKey = nil
+}
+
+// isRequired returns true if peer has ever presented keys
+func (s *session) isRequired() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.required
+}
+
+// IdentityKey returns base64-encoded identity key presented by peer or
+// empty string if peer hasn't presented it yet
+func (np *NetworkPeer) IdentityKey() string {
+	np.session.lock.RLock()
+	defer np.session.lock.RUnlock()
+	if np.session.remoteStatic == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(np.session.remoteStatic)
+}
+
+// established returns true if session keys were derived. Data frames
+// exchanged with peer are sealed only after that
+func (s *session) established() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sendKey != nil
+}
+
+// keys returns session keys or nils if key exchange is not finished
+func (s *session) keys() ([]byte, []byte) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sendKey, s.recvKey
+}
+
+// localEphemeral returns ephemeral key pair, generating it if necessary
+func (s *session) localEphemeral() (*Identity, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ephemeralLocked()
+}
+
+// ephemeralLocked returns ephemeral key pair, generating it if
+// necessary. Lock must be held
+func (s *session) ephemeralLocked() (*Identity, error) {
+	if s.ephemeral == nil {
+		var err error
+		s.ephemeral, err = NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.ephemeral, nil
+}
+
+// deriveSessionKeys computes a pair of session keys from local and remote
+// key pairs. Result is the same on both sides: key material is ordered by
+// identity keys, so it doesn't matter which peer started the exchange
+func deriveSessionKeys(local, localEph *Identity, remoteStatic, remoteEph, psk []byte) ([]byte, []byte, error) {
+	if local == nil || localEph == nil {
+		return nil, nil, fmt.Errorf("nil local keys")
+	}
+	if bytes.Equal(local.Public, remoteStatic) {
+		return nil, nil, fmt.Errorf("remote identity matches local identity")
+	}
+	ee, err := curve25519.X25519(localEph.Private, remoteEph)
+	if err != nil {
+		return nil, nil, err
+	}
+	se, err := curve25519.X25519(local.Private, remoteEph)
+	if err != nil {
+		return nil, nil, err
+	}
+	es, err := curve25519.X25519(localEph.Private, remoteStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	low := bytes.Compare(local.Public, remoteStatic) < 0
+	transcript := sha256.New()
+	ikm := append([]byte{}, ee...)
+	if low {
+		transcript.Write(local.Public)
+		transcript.Write(localEph.Public)
+		transcript.Write(remoteStatic)
+		transcript.Write(remoteEph)
+		ikm = append(ikm, se...)
+		ikm = append(ikm, es...)
+	} else {
+		transcript.Write(remoteStatic)
+		transcript.Write(remoteEph)
+		transcript.Write(local.Public)
+		transcript.Write(localEph.Public)
+		ikm = append(ikm, es...)
+		ikm = append(ikm, se...)
+	}
+	ikm = append(ikm, psk...)
+
+	kdf := hkdf.New(sha256.New, ikm, transcript.Sum(nil), keyExchangeContext)
+	lowKey := make([]byte, 32)
+	highKey := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, lowKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(kdf, highKey); err != nil {
+		return nil, nil, err
+	}
+	if low {
+		return lowKey, highKey, nil
+	}
+	return highKey, lowKey, nil
+}
+
+// SetIdentity replaces identity key pair of the instance. ID of the
+// instance is derived from the public key, so instance which keeps its
+// identity between restarts is recognized by bootstrap nodes and peers
+func (p *PeerToPeer) SetIdentity(identity *Identity) error {
+	if identity == nil {
+		return fmt.Errorf("nil identity")
+	}
+	if p.Dht == nil {
+		return fmt.Errorf("nil dht")
+	}
+	p.Identity = identity
+	p.Dht.ID = identity.ID()
+	p.Dht.PublicKey = identity.Public
+	return nil
+}
+
+// proveIdentity answers challenge of bootstrap node which keeps ID of
+// this instance registered on another connection, e.g. after restart.
+// Connect request is repeated along with the proof
+func (p *PeerToPeer) proveIdentity(challenge *protocol.DHTPacket) error {
+	if p.Identity == nil || p.Dht.connectRequest == nil {
+		return fmt.Errorf("identity can't be proven")
+	}
+	if challenge.Id != p.Identity.ID() || challenge.Infohash != p.Dht.NetworkHash {
+		return fmt.Errorf("challenge for another instance")
+	}
+	key, err := decodeIdentityKey(challenge.Extra)
+	if err != nil {
+		return fmt.Errorf("bad challenge: %s", err)
+	}
+	proof, err := identityProof(p.Identity.Private, key, challenge.Id, challenge.Infohash)
+	if err != nil {
+		return err
+	}
+	request := proto.Clone(p.Dht.connectRequest).(*protocol.DHTPacket)
+	request.Payload = proof
+	LogWith(Debug, p.logFields(SubsystemDHT), "Proving identity to bootstrap node")
+	return p.Dht.send(request)
+}
+
+// keyExchangePayload returns base64-encoded public keys of this instance
+// which are sent to specified peer during introduction
+func (p *PeerToPeer) keyExchangePayload(peer *NetworkPeer) (string, error) {
+	if p.Identity == nil {
+		return "", fmt.Errorf("nil identity")
+	}
+	if peer == nil {
+		return "", fmt.Errorf("nil peer")
+	}
+	eph, err := peer.session.localEphemeral()
+	if err != nil {
+		return "", err
+	}
+	payload := make([]byte, 0, keyExchangeSize)
+	payload = append(payload, keyExchangeVersion)
+	payload = append(payload, p.Identity.Public...)
+	payload = append(payload, eph.Public...)
+	payload = append(payload, p.Crypter.aeadSalt()...)
+	payload = append(payload, swarmKeyID(p.peerKey(peer.ID))...)
+	return base64.RawStdEncoding.EncodeToString(payload), nil
+}
+
+// swarmKeyID returns ID of swarm key announced during key exchange
+func swarmKeyID(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(keyIDContext)
+	return mac.Sum(nil)[:keyIDSize]
+}
+
+// sessionPSK returns swarm keys mixed into derivation of session keys
+// with peer, along with their IDs. Every side uses its own active key
+// and the key announced by the other side, which must be accepted at
+// the moment. Keys are ordered by identity keys, so result is the same
+// on both sides even if they have different active keys. Sessions with
+// invited peers use key of their invite instead of the swarm key
+func (p *PeerToPeer) sessionPSK(id string, remoteStatic, remoteKeyID []byte) ([]byte, []byte, error) {
+	local := p.peerKey(id)
+	now := time.Now()
+	keys := p.Crypter.decryptionKeys(now)
+	if p.invited(id, now) {
+		keys = append(keys, CryptoKey{Key: local})
+	}
+	var remote []byte
+	for _, key := range keys {
+		if hmac.Equal(swarmKeyID(key.Key), remoteKeyID) {
+			remote = key.Key
+			break
+		}
+	}
+	if remote == nil {
+		return nil, nil, fmt.Errorf("swarm key announced by peer is unknown")
+	}
+	localID := swarmKeyID(local)
+	if bytes.Compare(p.Identity.Public, remoteStatic) < 0 {
+		return append(append([]byte{}, local...), remote...), append(localID, remoteKeyID...), nil
+	}
+	return append(append([]byte{}, remote...), local...), append(append([]byte{}, remoteKeyID...), localID...), nil
+}
+
+// completeKeyExchange processes public keys received from peer and derives
+// session keys. Peer ID must be derived from identity key it presents.
+// Once finished, data frames to this peer are sealed with session keys
+func (p *PeerToPeer) completeKeyExchange(peer *NetworkPeer, kx []byte) error {
+	if p.Identity == nil {
+		return fmt.Errorf("nil identity")
+	}
+	if peer == nil {
+		return fmt.Errorf("nil peer")
+	}
+	if !p.Crypter.IsActive() {
+		return nil
+	}
+	// Keys are checked, derived and stored in a single critical section,
+	// so concurrent introductions can't mix ephemeral keys
+	peer.session.lock.Lock()
+	defer peer.session.lock.Unlock()
+	peer.session.required = true
+	if len(kx) != keyExchangeSize {
+		return fmt.Errorf("wrong key exchange payload size: %d", len(kx))
+	}
+	if kx[0] != keyExchangeVersion {
+		return fmt.Errorf("unsupported key exchange version: %d", kx[0])
+	}
+	remoteStatic := kx[1:33]
+	remoteEph := kx[33:65]
+	salt := kx[65 : 65+aeadSaltSize]
+	remoteKeyID := kx[65+aeadSaltSize:]
+	if IdentityID(remoteStatic) != peer.ID {
+		// Otherwise any member could present its own key under ID
+		// of another peer and read traffic sent to that peer
+		return fmt.Errorf("identity key of peer %s doesn't match its ID", peer.ID)
+	}
+	if !p.ACL.Allowed(IdentityID(remoteStatic)) {
+		return fmt.Errorf("identity key of peer %s is denied by access list", peer.ID)
+	}
+
+	eph, err := peer.session.ephemeralLocked()
+	if err != nil {
+		return err
+	}
+	established := peer.session.sendKey != nil
+	if peer.session.remoteStatic != nil && !bytes.Equal(peer.session.remoteStatic, remoteStatic) {
+		LogWith(Warning, p.logFields(SubsystemPeer), "Peer %s presented different identity key. Ignoring it", peer.ID)
+		return fmt.Errorf("identity key of peer %s has changed", peer.ID)
+	}
+	psk, keyIDs, err := p.sessionPSK(peer.ID, remoteStatic, remoteKeyID)
+	if err != nil {
+		return fmt.Errorf("peer %s: %s", peer.ID, err)
+	}
+	if bytes.Equal(peer.session.remoteEphemeral, remoteEph) && bytes.Equal(peer.session.keyIDs, keyIDs) && peer.session.sendKey != nil && peer.replay.matches(salt) {
+		return nil
+	}
+	send, recv, err := deriveSessionKeys(p.Identity, eph, remoteStatic, remoteEph, psk)
+	if err != nil {
+		return err
+	}
+	peer.session.remoteStatic = append([]byte{}, remoteStatic...)
+	peer.session.remoteEphemeral = append([]byte{}, remoteEph...)
+	peer.session.keyIDs = keyIDs
+	peer.session.sendKey = send
+	peer.session.recvKey = recv
+
+	if !peer.replay.matches(salt) {
+		peer.replay.reset(salt)
+	}
+	if !established {
+		LogWith(Debug, p.logFields(SubsystemPeer), "Session keys with peer %s has been established", peer.ID)
+	}
+	return nil
+}
+
+// introKeyExchange finishes key exchange carried by introduction packets.
+// Peer which has presented keys before is refused when keys are missing
+// or exchange fails, so the session can't be downgraded to the shared key.
+// Keys are always required when access lists are set
+func (p *PeerToPeer) introKeyExchange(peer *NetworkPeer, kx []byte) error {
+	if !p.Crypter.IsActive() {
+		return nil
+	}
+	if kx == nil {
+		if peer.session.isRequired() || p.ACL.active() || p.invited(peer.ID, time.Now()) {
+			return fmt.Errorf("peer %s didn't present keys", peer.ID)
+		}
+		return nil
+	}
+	return p.completeKeyExchange(peer, kx)
+}
+
+// splitKeyExchange separates key exchange payload from the rest of the
+// string. Returns original string and nil if payload is not present
+func splitKeyExchange(s string) (string, []byte) {
+	i := strings.LastIndex(s, keyExchangeSeparator)
+	if i < 0 {
+		return s, nil
+	}
+	kx, err := base64.RawStdEncoding.DecodeString(s[i+len(keyExchangeSeparator):])
+	if err != nil {
+		return s[:i], nil
+	}
+	return s[:i], kx
+}
@@ -0,0 +1,330 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/subutai-io/p2p/protocol"
+)
+
+func TestDeriveSessionKeys(t *testing.T) {
+	a, _ := NewIdentity()
+	aEph, _ := NewIdentity()
+	b, _ := NewIdentity()
+	bEph, _ := NewIdentity()
+	c, _ := NewIdentity()
+	psk := []byte("1234567812345678")
+
+	aSend, aRecv, err := deriveSessionKeys(a, aEph, b.Public, bEph.Public, psk)
+	if err != nil {
+		t.Fatalf("deriveSessionKeys() error = %v", err)
+	}
+	bSend, bRecv, err := deriveSessionKeys(b, bEph, a.Public, aEph.Public, psk)
+	if err != nil {
+		t.Fatalf("deriveSessionKeys() error = %v", err)
+	}
+	if !bytes.Equal(aSend, bRecv) || !bytes.Equal(aRecv, bSend) {
+		t.Errorf("deriveSessionKeys() produced different keys on both sides")
+	}
+	if bytes.Equal(aSend, aRecv) {
+		t.Errorf("deriveSessionKeys() produced same keys for both directions")
+	}
+
+	tests := []struct {
+		name         string
+		local        *Identity
+		localEph     *Identity
+		remoteStatic []byte
+		remoteEph    []byte
+		psk          []byte
+		wantErr      bool
+	}{
+		{"nil local", nil, aEph, b.Public, bEph.Public, psk, true},
+		{"same identity", a, aEph, a.Public, bEph.Public, psk, true},
+		{"broken remote key", a, aEph, b.Public, []byte{0x1}, psk, true},
+		{"different psk", b, bEph, a.Public, aEph.Public, []byte("8765432187654321"), false},
+		{"different identity", c, bEph, a.Public, aEph.Public, psk, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send, recv, err := deriveSessionKeys(tt.local, tt.localEph, tt.remoteStatic, tt.remoteEph, tt.psk)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deriveSessionKeys() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && (bytes.Equal(send, aRecv) || bytes.Equal(recv, aSend)) {
+				t.Errorf("deriveSessionKeys() matched keys with wrong input")
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_completeKeyExchange(t *testing.T) {
+	p := new(PeerToPeer)
+	p.Crypter = Crypto{Active: true, ActiveKey: CryptoKey{Key: []byte("1234567812345678")}}
+	p.Crypter.initAEAD()
+	p.Identity, _ = NewIdentity()
+
+	remote, _ := NewIdentity()
+	remoteEph, _ := NewIdentity()
+	other, _ := NewIdentity()
+
+	kx := func(static, eph *Identity, version byte) []byte {
+		payload := []byte{version}
+		payload = append(payload, static.Public...)
+		payload = append(payload, eph.Public...)
+		payload = append(payload, 0x1, 0x2, 0x3, 0x4)
+		return append(payload, swarmKeyID(p.Crypter.ActiveKey.Key)...)
+	}
+
+	peer := &NetworkPeer{ID: remote.ID()}
+	tests := []struct {
+		name            string
+		p               *PeerToPeer
+		peer            *NetworkPeer
+		kx              []byte
+		wantErr         bool
+		wantEstablished bool
+	}{
+		{"nil identity", new(PeerToPeer), peer, nil, true, false},
+		{"nil peer", p, nil, nil, true, false},
+		{"short payload", p, peer, []byte{0x1}, true, false},
+		{"wrong version", p, peer, kx(remote, remoteEph, 2), true, false},
+		{"key of another peer", p, peer, kx(other, remoteEph, 1), true, false},
+		{"passing", p, peer, kx(remote, remoteEph, 1), false, true},
+		{"changed identity", p, peer, kx(other, remoteEph, 1), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.completeKeyExchange(tt.peer, tt.kx); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.completeKeyExchange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.peer != nil && tt.peer.session.established() != tt.wantEstablished {
+				t.Errorf("PeerToPeer.completeKeyExchange() established = %v, want %v", tt.peer.session.established(), tt.wantEstablished)
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_completeKeyExchange_concurrent(t *testing.T) {
+	p := new(PeerToPeer)
+	p.Crypter = Crypto{Active: true, ActiveKey: CryptoKey{Key: []byte("1234567812345678")}}
+	p.Crypter.initAEAD()
+	p.Identity, _ = NewIdentity()
+	remote, _ := NewIdentity()
+	peer := &NetworkPeer{ID: remote.ID()}
+
+	// Introductions race with resets of the session
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%4 == 0 {
+				peer.session.reset()
+				return
+			}
+			eph, _ := NewIdentity()
+			payload := []byte{keyExchangeVersion}
+			payload = append(payload, remote.Public...)
+			payload = append(payload, eph.Public...)
+			payload = append(payload, 0x1, 0x2, 0x3, 0x4)
+			p.completeKeyExchange(peer, append(payload, swarmKeyID(p.Crypter.ActiveKey.Key)...))
+		}(i)
+	}
+	wg.Wait()
+
+	peer.session.lock.RLock()
+	defer peer.session.lock.RUnlock()
+	if peer.session.sendKey == nil {
+		return
+	}
+	// Stored keys must be derived from stored ephemeral keys
+	psk, _, _ := p.sessionPSK(peer.ID, peer.session.remoteStatic, swarmKeyID(p.Crypter.ActiveKey.Key))
+	send, recv, _ := deriveSessionKeys(p.Identity, peer.session.ephemeral, peer.session.remoteStatic, peer.session.remoteEphemeral, psk)
+	if !bytes.Equal(send, peer.session.sendKey) || !bytes.Equal(recv, peer.session.recvKey) {
+		t.Errorf("Session keys don't match ephemeral keys of the session")
+	}
+}
+
+func TestPeerToPeer_completeKeyExchange_rotation(t *testing.T) {
+	now := time.Now()
+	old := CryptoKey{Key: []byte("1111111111111111"), Until: now.Add(time.Second)}
+	next := CryptoKey{Key: []byte("2222222222222222"), Until: now.Add(time.Hour)}
+	other := CryptoKey{Key: []byte("3333333333333333"), Until: now.Add(time.Hour)}
+
+	// a hasn't rotated its key yet, b already has
+	a := new(PeerToPeer)
+	a.Crypter = Crypto{Active: true, ActiveKey: old, Keys: []CryptoKey{old, next}}
+	a.Crypter.initAEAD()
+	a.Identity, _ = NewIdentity()
+	b := new(PeerToPeer)
+	b.Crypter = Crypto{Active: true, ActiveKey: next, PreviousKey: old, Keys: []CryptoKey{next}}
+	b.Crypter.initAEAD()
+	b.Identity, _ = NewIdentity()
+	c := new(PeerToPeer)
+	c.Crypter = Crypto{Active: true, ActiveKey: other, Keys: []CryptoKey{other}}
+	c.Crypter.initAEAD()
+	c.Identity, _ = NewIdentity()
+
+	// Peers of a and b in each other's swarm
+	ab := &NetworkPeer{ID: b.Identity.ID()}
+	ba := &NetworkPeer{ID: a.Identity.ID()}
+	exchange := func(local, remote *PeerToPeer, peer, remotePeer *NetworkPeer) error {
+		payload, _ := remote.keyExchangePayload(remotePeer)
+		kx, _ := base64.RawStdEncoding.DecodeString(payload)
+		return local.completeKeyExchange(peer, kx)
+	}
+	if err := exchange(a, b, ab, ba); err != nil {
+		t.Fatalf("PeerToPeer.completeKeyExchange() error = %v", err)
+	}
+	if err := exchange(b, a, ba, ab); err != nil {
+		t.Fatalf("PeerToPeer.completeKeyExchange() error = %v", err)
+	}
+	abSend, abRecv := ab.session.keys()
+	baSend, baRecv := ba.session.keys()
+	if !bytes.Equal(abSend, baRecv) || !bytes.Equal(abRecv, baSend) {
+		t.Errorf("Peers with different active keys derived different session keys")
+	}
+	if err := exchange(a, c, &NetworkPeer{ID: c.Identity.ID()}, new(NetworkPeer)); err == nil {
+		t.Errorf("PeerToPeer.completeKeyExchange() accepted unknown swarm key")
+	}
+}
+
+func TestPeerToPeer_introKeyExchange(t *testing.T) {
+	p := new(PeerToPeer)
+	p.Crypter = Crypto{Active: true, ActiveKey: CryptoKey{Key: []byte("1234567812345678")}}
+	p.Crypter.initAEAD()
+	p.Identity, _ = NewIdentity()
+
+	remote, _ := NewIdentity()
+	remoteEph, _ := NewIdentity()
+	kx := []byte{keyExchangeVersion}
+	kx = append(kx, remote.Public...)
+	kx = append(kx, remoteEph.Public...)
+	kx = append(kx, 0x1, 0x2, 0x3, 0x4)
+	kx = append(kx, swarmKeyID(p.Crypter.ActiveKey.Key)...)
+
+	legacy := new(NetworkPeer)
+	if err := p.introKeyExchange(legacy, nil); err != nil {
+		t.Errorf("PeerToPeer.introKeyExchange() refused peer without key exchange support: %v", err)
+	}
+
+	peer := &NetworkPeer{ID: remote.ID()}
+	if err := p.introKeyExchange(peer, kx); err != nil {
+		t.Fatalf("PeerToPeer.introKeyExchange() error = %v", err)
+	}
+	peer.session.reset()
+	if peer.IdentityKey() != "" {
+		t.Errorf("session.reset() kept identity key of peer")
+	}
+	if err := p.introKeyExchange(peer, nil); err == nil {
+		t.Errorf("PeerToPeer.introKeyExchange() accepted peer which stopped presenting keys")
+	}
+	if err := p.introKeyExchange(peer, kx[:10]); err == nil {
+		t.Errorf("PeerToPeer.introKeyExchange() accepted broken key exchange")
+	}
+	if peer.session.established() {
+		t.Errorf("PeerToPeer.introKeyExchange() established session after failure")
+	}
+}
+
+func TestSplitKeyExchange(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		want   string
+		wantKx []byte
+	}{
+		{"empty", "", "", nil},
+		{"no payload", "192.168.0.1:1234", "192.168.0.1:1234", nil},
+		{"broken payload", "192.168.0.1:1234|!!", "192.168.0.1:1234", nil},
+		{"passing", "192.168.0.1:1234|AQID", "192.168.0.1:1234", []byte{0x1, 0x2, 0x3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, kx := splitKeyExchange(tt.s)
+			if got != tt.want {
+				t.Errorf("splitKeyExchange() got = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(kx, tt.wantKx) {
+				t.Errorf("splitKeyExchange() kx = %v, want %v", kx, tt.wantKx)
+			}
+		})
+	}
+}
+
+func TestLoadIdentity(t *testing.T) {
+	identity, err := NewIdentity()
+	if err != nil {
+		t.Fatalf("NewIdentity() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		private string
+		wantErr bool
+	}{
+		{"saved identity", identity.Encode(), false},
+		{"not base64", "not a key", true},
+		{"short key", "AAAA", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadIdentity(tt.private)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got.PublicKey() != identity.PublicKey() || got.ID() != identity.ID()) {
+				t.Errorf("LoadIdentity() = %s, want %s", got.PublicKey(), identity.PublicKey())
+			}
+		})
+	}
+	if id := identity.ID(); len(id) != 36 || id[8] != '-' || id[23] != '-' {
+		t.Errorf("Identity.ID() = %s", id)
+	}
+}
+
+func TestPeerToPeer_SetIdentity(t *testing.T) {
+	identity, _ := NewIdentity()
+	p := &PeerToPeer{Dht: &DHTClient{ID: GenerateToken()}}
+	if err := p.SetIdentity(nil); err == nil {
+		t.Errorf("PeerToPeer.SetIdentity() accepted nil identity")
+	}
+	if err := p.SetIdentity(identity); err != nil {
+		t.Fatalf("PeerToPeer.SetIdentity() error = %v", err)
+	}
+	if p.Identity != identity || p.Dht.ID != identity.ID() || !bytes.Equal(p.Dht.PublicKey, identity.Public) {
+		t.Errorf("PeerToPeer.SetIdentity() didn't update instance: %s", p.Dht.ID)
+	}
+}
+
+func TestPeerToPeer_proveIdentity(t *testing.T) {
+	identity, _ := NewIdentity()
+	challenge, _ := NewIdentity()
+	p := &PeerToPeer{Dht: &DHTClient{NetworkHash: "swarm", OutgoingData: make(chan *protocol.DHTPacket, 1)}}
+	p.SetIdentity(identity)
+	packet := &protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: identity.ID(), Infohash: "swarm", Query: bootstrapChallenge, Extra: challenge.PublicKey()}
+	if err := p.proveIdentity(packet); err == nil {
+		t.Fatalf("PeerToPeer.proveIdentity() answered challenge before connect")
+	}
+
+	p.Dht.connectRequest = &protocol.DHTPacket{Type: protocol.DHTPacketType_Connect, Id: identity.ID(), Infohash: "swarm", Data: "1000"}
+	if err := p.proveIdentity(&protocol.DHTPacket{Id: GenerateToken(), Infohash: "swarm", Extra: challenge.PublicKey()}); err == nil {
+		t.Errorf("PeerToPeer.proveIdentity() answered challenge for another instance")
+	}
+	if err := p.packetConnect(packet); err != nil {
+		t.Fatalf("PeerToPeer.packetConnect() error = %v", err)
+	}
+	request := <-p.Dht.OutgoingData
+	proof, _ := identityProof(challenge.Private, identity.Public, identity.ID(), "swarm")
+	if request.Data != "1000" || !bytes.Equal(request.Payload, proof) || p.Dht.IsConnected() {
+		t.Errorf("PeerToPeer.proveIdentity() sent wrong request: %+v", request)
+	}
+	if p.Dht.connectRequest.Payload != nil {
+		t.Errorf("PeerToPeer.proveIdentity() modified connect request")
+	}
+}
@@ -0,0 +1,278 @@
+package ptp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hooks are executables run when interface of an instance goes up or
+// down and when peers connect or disconnect. Hook is a command line with
+// arguments separated by spaces, arguments with spaces can be quoted.
+// Hooks of an instance are executed one by one in order of events, each
+// is limited by timeout. Instance waits for queued hooks when it stops
+// no longer than a single timeout and kills the rest
+// Details of the event are passed in environment variables:
+// P2P_EVENT, P2P_HASH, P2P_INTERFACE, P2P_IP and, for peer events,
+// P2P_PEER_ID, P2P_PEER_IP and P2P_PEER_MAC
+
+// HookEvent is a name of lifecycle event
+type HookEvent string
+
+// Lifecycle events
+const (
+	HookUp             HookEvent = "up"
+	HookDown           HookEvent = "down"
+	HookPeerConnect    HookEvent = "peer-connect"
+	HookPeerDisconnect HookEvent = "peer-disconnect"
+)
+
+// Hook settings
+const (
+	DefaultHookTimeout = 30  // Default timeout of a hook in seconds
+	hookQueueSize      = 128 // Number of events waiting for hooks
+	hookWaitDelay      = 5   // Seconds output of killed hook is awaited
+)
+
+// Hooks lists executables run on lifecycle events
+type Hooks struct {
+	Up             string `yaml:"up"`
+	Down           string `yaml:"down"`
+	PeerConnect    string `yaml:"peer_connect"`
+	PeerDisconnect string `yaml:"peer_disconnect"`
+	Timeout        int    `yaml:"timeout"` // Timeout in seconds
+}
+
+// SwarmHooks are hooks of a single swarm
+type SwarmHooks struct {
+	Hash  string `yaml:"hash"`
+	Hooks `yaml:",inline"`
+}
+
+// HooksConf holds default hooks and hooks of swarms
+type HooksConf struct {
+	Hooks  `yaml:",inline"`
+	Swarms []SwarmHooks `yaml:"swarms"`
+}
+
+// merge returns hooks with empty fields taken from defaults
+func (h Hooks) merge(defaults Hooks) Hooks {
+	if h.Up == "" {
+		h.Up = defaults.Up
+	}
+	if h.Down == "" {
+		h.Down = defaults.Down
+	}
+	if h.PeerConnect == "" {
+		h.PeerConnect = defaults.PeerConnect
+	}
+	if h.PeerDisconnect == "" {
+		h.PeerDisconnect = defaults.PeerDisconnect
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = defaults.Timeout
+	}
+	return h
+}
+
+// command returns command line of the event
+func (h Hooks) command(event HookEvent) string {
+	switch event {
+	case HookUp:
+		return h.Up
+	case HookDown:
+		return h.Down
+	case HookPeerConnect:
+		return h.PeerConnect
+	case HookPeerDisconnect:
+		return h.PeerDisconnect
+	}
+	return ""
+}
+
+// splitCommand splits command line into executable and arguments.
+// Arguments are separated by spaces unless enclosed in single or double
+// quotes. Backslashes are kept as is, so Windows paths need no escaping
+func splitCommand(command string) ([]string, error) {
+	args := []string{}
+	arg := []rune{}
+	quote := rune(0)
+	started := false
+	for _, c := range command {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg = append(arg, c)
+		case c == '"' || c == '\'':
+			quote = c
+			started = true
+		case c == ' ' || c == '\t':
+			if started {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				started = false
+			}
+		default:
+			arg = append(arg, c)
+			started = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %s", command)
+	}
+	if started {
+		args = append(args, string(arg))
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+// hookCall is a queued execution of a hook
+type hookCall struct {
+	event   HookEvent
+	command string
+	env     []string
+	fields  Fields // Context of log records
+}
+
+// hookRunner executes hooks of an instance in order
+type hookRunner struct {
+	hooks  Hooks
+	queue  chan hookCall
+	done   chan bool
+	ctx    context.Context // Canceled when instance can't wait for hooks anymore
+	cancel context.CancelFunc
+	closed bool
+	lock   sync.Mutex
+}
+
+// SetHooks configures hooks of the instance and starts their execution
+func (p *PeerToPeer) SetHooks(hooks Hooks) {
+	hooks = hooks.merge(Hooks{Timeout: DefaultHookTimeout})
+	p.hooks.lock.Lock()
+	defer p.hooks.lock.Unlock()
+	p.hooks.hooks = hooks
+	if p.hooks.queue == nil && !p.hooks.closed {
+		p.hooks.queue = make(chan hookCall, hookQueueSize)
+		p.hooks.done = make(chan bool)
+		p.hooks.ctx, p.hooks.cancel = context.WithCancel(context.Background())
+		go p.hooks.run()
+	}
+}
+
+// runHook queues hook of the event. Peer is nil for interface events
+func (p *PeerToPeer) runHook(event HookEvent, peer *NetworkPeer) {
+	p.hooks.lock.Lock()
+	defer p.hooks.lock.Unlock()
+	command := p.hooks.hooks.command(event)
+	if command == "" || p.hooks.queue == nil || p.hooks.closed {
+		return
+	}
+	env := []string{"P2P_EVENT=" + string(event), "P2P_HASH=" + p.Hash}
+	fields := p.logFields(SubsystemHooks)
+	if p.Interface != nil {
+		env = append(env, "P2P_INTERFACE="+p.Interface.GetName())
+		if ip := p.Interface.GetIP(); ip != nil {
+			env = append(env, "P2P_IP="+ip.String())
+		}
+	}
+	if peer != nil {
+		env = append(env, "P2P_PEER_ID="+peer.ID)
+		fields.Peer = peer.ID
+		if peer.PeerLocalIP != nil {
+			env = append(env, "P2P_PEER_IP="+peer.PeerLocalIP.String())
+		}
+		if peer.PeerHW != nil {
+			env = append(env, "P2P_PEER_MAC="+peer.PeerHW.String())
+		}
+	}
+	select {
+	case p.hooks.queue <- hookCall{event: event, command: command, env: env, fields: fields}:
+	default:
+		LogWith(Warning, fields, "Too many hooks are waiting. Skipping %s hook of %s", event, p.Hash)
+	}
+}
+
+// stopHooks waits until queued hooks are finished. Hooks which don't
+// finish within a single hook timeout are killed and the rest are dropped
+func (p *PeerToPeer) stopHooks() {
+	p.hooks.lock.Lock()
+	if p.hooks.closed || p.hooks.queue == nil {
+		p.hooks.closed = true
+		p.hooks.lock.Unlock()
+		return
+	}
+	p.hooks.closed = true
+	close(p.hooks.queue)
+	timeout := time.Duration(p.hooks.hooks.Timeout) * time.Second
+	p.hooks.lock.Unlock()
+	defer p.hooks.cancel()
+	select {
+	case <-p.hooks.done:
+	case <-time.After(timeout):
+		LogWith(Warning, p.logFields(SubsystemHooks), "Hooks of %s didn't finish in %s. Killing them", p.Hash, timeout)
+		p.hooks.cancel()
+		<-p.hooks.done
+	}
+}
+
+// run executes queued hooks until queue is closed
+func (r *hookRunner) run() {
+	for call := range r.queue {
+		if r.ctx.Err() != nil {
+			LogWith(Warning, call.fields, "Instance has stopped. Dropping %s hook", call.event)
+			continue
+		}
+		r.lock.Lock()
+		timeout := time.Duration(r.hooks.Timeout) * time.Second
+		r.lock.Unlock()
+		runHookCommand(r.ctx, call, timeout)
+	}
+	close(r.done)
+}
+
+// runHookCommand executes hook and logs its result. Hook is killed
+// after timeout or when parent context is canceled
+func runHookCommand(parent context.Context, call hookCall, timeout time.Duration) error {
+	args, err := splitCommand(call.command)
+	if err != nil {
+		LogWith(Error, call.fields, "Failed to parse hook %s (%s): %s", call.event, call.command, err)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), call.env...)
+	// Children of killed hook may keep its output open
+	cmd.WaitDelay = time.Duration(hookWaitDelay) * time.Second
+	started := time.Now()
+	output, err := cmd.CombinedOutput()
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		LogWith(Error, call.fields, "Hook %s (%s) was killed after %s", call.event, call.command, timeout)
+		return ctx.Err()
+	case context.Canceled:
+		LogWith(Error, call.fields, "Hook %s (%s) was killed as instance has stopped", call.event, call.command)
+		return ctx.Err()
+	}
+	if out := strings.TrimSpace(string(output)); out != "" {
+		LogWith(Debug, call.fields, "Hook %s (%s) output: %s", call.event, call.command, out)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		LogWith(Warning, call.fields, "Hook %s (%s) exited with code %d", call.event, call.command, exitErr.ExitCode())
+		return err
+	}
+	if err != nil {
+		LogWith(Error, call.fields, "Failed to execute hook %s (%s): %s", call.event, call.command, err)
+		return err
+	}
+	LogWith(Info, call.fields, "Hook %s (%s) exited with code 0 in %s", call.event, call.command, time.Since(started))
+	return nil
+}
@@ -0,0 +1,154 @@
+package ptp
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeHook creates shell script used as a hook
+func writeHook(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_runHookCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "p2p-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		command string
+		wantErr bool
+	}{
+		{"success", writeHook(t, dir, "ok", "exit 0"), false},
+		{"non-zero exit code", writeHook(t, dir, "fail", "exit 3"), true},
+		{"timeout", writeHook(t, dir, "slow", "exec sleep 5"), true},
+		{"missing executable", filepath.Join(dir, "missing"), true},
+		{"arguments", writeHook(t, dir, "args", `[ "$1" = "a b" ] && [ "$2" = "c" ]`) + ` "a b" c`, false},
+		{"unterminated quote", writeHook(t, dir, "quote", "exit 0") + ` "a`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := runHookCommand(context.Background(), hookCall{event: HookUp, command: tt.command}, time.Millisecond*500)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runHookCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_splitCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    []string
+		wantErr bool
+	}{
+		{"executable", "/bin/hook", []string{"/bin/hook"}, false},
+		{"arguments", " /bin/hook  -v\tup ", []string{"/bin/hook", "-v", "up"}, false},
+		{"quoted", `"C:\Program Files\hook.exe" 'a "b"' ""`, []string{`C:\Program Files\hook.exe`, `a "b"`, ""}, false},
+		{"unterminated quote", `/bin/hook "a`, nil, true},
+		{"empty", "  ", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitCommand(tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) && !tt.wantErr {
+				t.Errorf("splitCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_stopHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "p2p-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	slow := writeHook(t, dir, "slow", "echo $P2P_EVENT >> "+out+"\nexec sleep 30")
+
+	p := &PeerToPeer{Hash: "hooks hash", Dht: new(DHTClient)}
+	p.SetHooks(Hooks{Up: slow, Down: slow, Timeout: 1})
+	for i := 0; i < 10; i++ {
+		p.runHook(HookUp, nil)
+	}
+	started := time.Now()
+	p.stopHooks()
+	if elapsed := time.Since(started); elapsed > time.Second*3 {
+		t.Errorf("PeerToPeer.stopHooks() waited for %s", elapsed)
+	}
+	data, _ := ioutil.ReadFile(out)
+	if n := strings.Count(string(data), "up"); n > 2 {
+		t.Errorf("%d hooks were executed after instance has stopped", n)
+	}
+}
+
+func TestPeerToPeer_runHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "p2p-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	hook := writeHook(t, dir, "hook", `echo "$P2P_EVENT $P2P_HASH $P2P_PEER_ID $P2P_PEER_IP $P2P_PEER_MAC" >> `+out)
+
+	p := &PeerToPeer{Hash: "hooks hash", Dht: new(DHTClient)}
+	p.SetHooks(Hooks{PeerConnect: hook, PeerDisconnect: hook, Down: hook})
+	hw, _ := net.ParseMAC("06:00:00:00:00:01")
+	peer := &NetworkPeer{ID: "peer", PeerLocalIP: net.ParseIP("10.0.0.2"), PeerHW: hw}
+	peer.SetState(PeerStateConnecting, p)
+	peer.SetState(PeerStateConnected, p)
+	peer.SetState(PeerStateConnected, p)
+	peer.SetState(PeerStateDisconnect, p)
+	p.runHook(HookDown, nil)
+	p.runHook(HookUp, nil)
+	p.stopHooks()
+	p.runHook(HookDown, nil)
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"peer-connect hooks hash peer 10.0.0.2 06:00:00:00:00:01",
+		"peer-disconnect hooks hash peer 10.0.0.2 06:00:00:00:00:01",
+		"down hooks hash",
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("Hooks executed %q, want %q", got, want)
+	}
+	for i := range want {
+		if strings.TrimSpace(got[i]) != want[i] {
+			t.Errorf("Hook %d output = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
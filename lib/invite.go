@@ -0,0 +1,683 @@
+package ptp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Invites let new members join a swarm without handing out the swarm key.
+// Invite token carries infohash, expiration time and a secret derived from
+// them and active key of the swarm. Invited instance never receives the
+// swarm key. It encrypts traffic with a key derived from the secret and
+// asks every member for admission with a request authenticated with the
+// secret and bound to its identity key. Member which verifies the request
+// accepts key of the invite from that identity until the invite expires
+// and confirms admission with a response sealed to that identity.
+// Afterwards invited instance presents a claim of the invite in
+// introduction requests. Members verify the claim, bind single-use
+// invites to the first peer that redeemed them and disconnect invited
+// peers once the invite expires. Rotation of the swarm key revokes every
+// invite issued before it
+
+// Invite settings
+const (
+	InviteDefaultTTL        = time.Duration(time.Hour * 24)   // Default lifetime of an invite
+	InviteCheckInterval     = time.Duration(time.Second * 10) // How often expired invites are checked
+	InviteAdmissionInterval = time.Duration(time.Second * 3)  // How often admission is requested
+)
+
+const (
+	invitePrefix    = "p2pinv1." // Prefix of invite tokens
+	inviteSeparator = "!"        // Separates invite claim in introduction request
+)
+
+// Admission messages start with kind of the message. Request carries
+// invite ID[32], expiration time[8], single-use flag[1], identity key[32],
+// peer ID[36] and HMAC of all previous fields keyed with invite secret.
+// Response carries ephemeral key[32] of the member and its sealed ID[36]
+const (
+	inviteAdmissionRequest  byte = 1
+	inviteAdmissionResponse byte = 2
+	inviteRequestSize            = 1 + 32 + 8 + 1 + 32 + 36 + sha256.Size
+)
+
+// Invite errors
+var (
+	errInviteMalformed = errors.New("malformed invite")
+	errInviteSignature = errors.New("invite signature mismatch")
+	errInviteExpired   = errors.New("invite has expired")
+	errInviteRedeemed  = errors.New("invite was redeemed by another peer")
+	errInviteNotMember = errors.New("peer is neither a member nor invited")
+	errInviteInvited   = errors.New("instance has joined with an invite")
+)
+
+// Invite is an expiring permission to join a swarm
+type Invite struct {
+	ID        string    // Random identifier of the invite
+	Hash      string    // Infohash of the swarm
+	Expires   time.Time // Invite can't be redeemed after this moment
+	SingleUse bool      // Invite can be redeemed by a single peer only
+	Secret    []byte    // Derived from swarm key. Empty in claims
+	Proof     []byte    // Binds claim to the peer presenting it. Empty in tokens
+}
+
+// inviteToken is a JSON binding for invite tokens
+type inviteToken struct {
+	ID        string `json:"id"`
+	Hash      string `json:"hash"`
+	Expires   int64  `json:"expires"`
+	SingleUse bool   `json:"single_use,omitempty"`
+	Secret    string `json:"secret"`
+}
+
+// invitedPeer is a peer joined the swarm with an invite
+type invitedPeer struct {
+	invite  string
+	expires time.Time
+}
+
+// inviteState holds invite of this instance and invites redeemed by peers
+type inviteState struct {
+	invite      *Invite                // Invite this instance was started with
+	admittedBy  map[string]bool        // Members which have admitted this instance
+	lastRequest time.Time              // When admission was requested last time
+	peers       map[string]invitedPeer // Peers joined with invites
+	keys        map[string]CryptoKey   // Keys of invites redeemed by peers
+	owners      map[string]string      // Single-use invites and peers they are bound to
+	lastCheck   time.Time
+	lock        sync.Mutex
+}
+
+// inviteSigningKey derives key invite secrets are derived with
+func inviteSigningKey(hash string, key []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write([]byte("p2p invite"))
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// NewInvite creates an invite with a secret derived from the swarm key
+func NewInvite(hash string, key []byte, expires time.Time, singleUse bool) (*Invite, error) {
+	if hash == "" || len(key) == 0 {
+		return nil, fmt.Errorf("invites require hash and key of the swarm")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	invite := &Invite{
+		ID:        hex.EncodeToString(id),
+		Hash:      hash,
+		Expires:   time.Unix(expires.Unix(), 0),
+		SingleUse: singleUse,
+	}
+	invite.Secret = invite.secret(key)
+	return invite, nil
+}
+
+// secret calculates secret of the invite with specified swarm key
+func (i *Invite) secret(key []byte) []byte {
+	mac := hmac.New(sha256.New, inviteSigningKey(i.Hash, key))
+	fmt.Fprintf(mac, "%s,%s,%d,%t", i.ID, i.Hash, i.Expires.Unix(), i.SingleUse)
+	return mac.Sum(nil)
+}
+
+// verify finds secret of the invite derived from one of the keys which
+// passes specified check and makes sure invite hasn't expired
+func (i *Invite) verify(keys [][]byte, now time.Time, check func(secret []byte) bool) ([]byte, error) {
+	var secret []byte
+	for _, key := range keys {
+		s := i.secret(key)
+		if check(s) {
+			secret = s
+			break
+		}
+	}
+	if secret == nil {
+		return nil, errInviteSignature
+	}
+	if now.After(i.Expires) {
+		return nil, errInviteExpired
+	}
+	return secret, nil
+}
+
+// inviteKey derives key which invited peer encrypts traffic with
+// until the invite expires
+func inviteKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("p2p invite key"))
+	return mac.Sum(nil)
+}
+
+// inviteProof binds invite secret to the peer presenting it
+func inviteProof(secret []byte, id string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("p2p invite claim"))
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+// Encode returns invite token
+func (i *Invite) Encode() string {
+	data, _ := json.Marshal(&inviteToken{
+		ID:        i.ID,
+		Hash:      i.Hash,
+		Expires:   i.Expires.Unix(),
+		SingleUse: i.SingleUse,
+		Secret:    base64.StdEncoding.EncodeToString(i.Secret),
+	})
+	return invitePrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeInvite parses invite token and checks its expiration time.
+// Secret of the invite can be verified by members of the swarm only
+func DecodeInvite(token string) (*Invite, error) {
+	if !strings.HasPrefix(token, invitePrefix) {
+		return nil, errInviteMalformed
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, invitePrefix))
+	if err != nil {
+		return nil, errInviteMalformed
+	}
+	t := new(inviteToken)
+	if json.Unmarshal(data, t) != nil || len(t.ID) != 32 || t.Hash == "" {
+		return nil, errInviteMalformed
+	}
+	invite := &Invite{ID: t.ID, Hash: t.Hash, Expires: time.Unix(t.Expires, 0), SingleUse: t.SingleUse}
+	invite.Secret, err = base64.StdEncoding.DecodeString(t.Secret)
+	if err != nil || len(invite.Secret) != sha256.Size {
+		return nil, errInviteMalformed
+	}
+	if time.Now().After(invite.Expires) {
+		return nil, errInviteExpired
+	}
+	return invite, nil
+}
+
+// Claim returns invite without its secret, which is presented to members
+// by peer with specified ID
+func (i *Invite) Claim(id string) string {
+	single := "0"
+	if i.SingleUse {
+		single = "1"
+	}
+	return i.ID + "," + strconv.FormatInt(i.Expires.Unix(), 10) + "," + single + "," + base64.RawStdEncoding.EncodeToString(inviteProof(i.Secret, id))
+}
+
+// parseInviteClaim restores invite of the swarm from claim
+func parseInviteClaim(hash, claim string) (*Invite, error) {
+	parts := strings.Split(claim, ",")
+	if len(parts) != 4 || len(parts[0]) != 32 {
+		return nil, errInviteMalformed
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errInviteMalformed
+	}
+	proof, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, errInviteMalformed
+	}
+	return &Invite{
+		ID:        parts[0],
+		Hash:      hash,
+		Expires:   time.Unix(expires, 0),
+		SingleUse: parts[2] == "1",
+		Proof:     proof,
+	}, nil
+}
+
+// splitInviteClaim separates invite claim from introduction request
+func splitInviteClaim(s string) (string, string) {
+	i := strings.LastIndex(s, inviteSeparator)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+len(inviteSeparator):]
+}
+
+// SetInvite makes instance request admission from members of the swarm
+// and present the invite to them. Traffic is encrypted with key of the
+// invite, which members accept until the invite expires
+func (p *PeerToPeer) SetInvite(invite *Invite) error {
+	if invite == nil {
+		return fmt.Errorf("nil invite")
+	}
+	if invite.Hash != p.Hash {
+		return fmt.Errorf("invite was issued for another swarm")
+	}
+	if len(invite.Secret) == 0 {
+		return fmt.Errorf("invite has no secret")
+	}
+	p.invites.lock.Lock()
+	p.invites.invite = invite
+	p.invites.admittedBy = nil
+	p.invites.lock.Unlock()
+	p.Crypter.SetActiveKey(CryptoKey{Key: inviteKey(invite.Secret), Until: invite.Expires})
+	return nil
+}
+
+// JoinedWithInvite returns true if instance was started with an invite.
+// Such instances don't hold the swarm key and can't issue invites
+func (p *PeerToPeer) JoinedWithInvite() bool {
+	p.invites.lock.Lock()
+	defer p.invites.lock.Unlock()
+	return p.invites.invite != nil
+}
+
+// appendInviteClaim adds invite claim to introduction request payload
+func (p *PeerToPeer) appendInviteClaim(payload []byte) []byte {
+	p.invites.lock.Lock()
+	defer p.invites.lock.Unlock()
+	if p.invites.invite == nil || p.Dht == nil {
+		return payload
+	}
+	return append(payload, []byte(inviteSeparator+p.invites.invite.Claim(p.Dht.ID))...)
+}
+
+// invited returns true if peer has joined with an invite which is still valid
+func (p *PeerToPeer) invited(id string, now time.Time) bool {
+	p.invites.lock.Lock()
+	defer p.invites.lock.Unlock()
+	invited, exists := p.invites.peers[id]
+	return exists && !now.After(invited.expires)
+}
+
+// invitedWith returns true if peer has redeemed specified invite
+func (p *PeerToPeer) invitedWith(id, invite string) bool {
+	p.invites.lock.Lock()
+	defer p.invites.lock.Unlock()
+	invited, exists := p.invites.peers[id]
+	return exists && invited.invite == invite
+}
+
+// peerKey returns key messages to peer with specified ID are encrypted
+// with. Invited peers don't hold the swarm key and get messages encrypted
+// with key of their invite until it expires
+func (p *PeerToPeer) peerKey(id string) []byte {
+	p.invites.lock.Lock()
+	invited, exists := p.invites.peers[id]
+	if exists {
+		key, exists := p.invites.keys[invited.invite]
+		if exists && !time.Now().After(key.Until) {
+			p.invites.lock.Unlock()
+			return key.Key
+		}
+	}
+	p.invites.lock.Unlock()
+	return p.Crypter.GetActiveKey().Key
+}
+
+// replyKey returns key response to specified message is encrypted with.
+// Messages of invited peers are answered with key of their invite
+func (p *PeerToPeer) replyKey(request *P2PMessage) []byte {
+	if request.invite != "" {
+		p.invites.lock.Lock()
+		key, exists := p.invites.keys[request.invite]
+		p.invites.lock.Unlock()
+		if exists {
+			return key.Key
+		}
+	}
+	return p.Crypter.GetActiveKey().Key
+}
+
+// validInviteKeys returns keys of invites which haven't expired yet
+func (p *PeerToPeer) validInviteKeys(now time.Time) map[string]CryptoKey {
+	p.invites.lock.Lock()
+	defer p.invites.lock.Unlock()
+	keys := make(map[string]CryptoKey)
+	for id, key := range p.invites.keys {
+		if !now.After(key.Until) {
+			keys[id] = key
+		}
+	}
+	return keys
+}
+
+// decryptMessage decrypts message with keys of the swarm or, if it
+// fails, with keys of valid invites. Returns data and ID of the invite
+// which key has decrypted the message
+func (p *PeerToPeer) decryptMessage(data []byte, length int) ([]byte, string, error) {
+	plain, err := p.Crypter.decryptAny(data, length)
+	if err == nil {
+		return plain, "", nil
+	}
+	for id, key := range p.validInviteKeys(time.Now()) {
+		plain, keyErr := p.Crypter.decryptWith([]CryptoKey{key}, data, length)
+		if keyErr == nil {
+			return plain, id, nil
+		}
+	}
+	return nil, "", err
+}
+
+// inviteKeys returns swarm keys invite secrets are derived from
+func (p *PeerToPeer) inviteKeys(now time.Time) [][]byte {
+	keys := [][]byte{}
+	for _, key := range p.Crypter.decryptionKeys(now) {
+		keys = append(keys, key.Key)
+	}
+	return keys
+}
+
+// bindInvite records peer which has redeemed an invite and accepts key
+// of the invite until it expires. Lock must be held
+func (p *PeerToPeer) bindInvite(id string, invite *Invite, secret []byte) error {
+	if invite.SingleUse {
+		if p.invites.owners == nil {
+			p.invites.owners = make(map[string]string)
+		}
+		owner, exists := p.invites.owners[invite.ID]
+		if exists && owner != id {
+			return errInviteRedeemed
+		}
+		p.invites.owners[invite.ID] = id
+	}
+	if p.invites.peers == nil {
+		p.invites.peers = make(map[string]invitedPeer)
+	}
+	if _, exists := p.invites.peers[id]; !exists {
+		LogWith(Info, p.logFields(SubsystemPeer), "Peer %s has joined with invite %s valid until %s", id, invite.ID, invite.Expires.String())
+	}
+	p.invites.peers[id] = invitedPeer{invite: invite.ID, expires: invite.Expires}
+	if p.invites.keys == nil {
+		p.invites.keys = make(map[string]CryptoKey)
+	}
+	p.invites.keys[invite.ID] = CryptoKey{Key: inviteKey(secret), Until: invite.Expires}
+	return nil
+}
+
+// redeemInvite validates invite claim presented by peer. Peers without a
+// claim must be members: either allowed by access lists or joined with
+// an invite which hasn't expired yet
+func (p *PeerToPeer) redeemInvite(id, claim string, now time.Time) error {
+	p.invites.lock.Lock()
+	defer p.invites.lock.Unlock()
+	if claim == "" {
+		if invited, exists := p.invites.peers[id]; exists {
+			if now.After(invited.expires) {
+				return errInviteExpired
+			}
+			return nil
+		}
+		if !p.ACL.Allowed(id) {
+			return errInviteNotMember
+		}
+		return nil
+	}
+	invite, err := parseInviteClaim(p.Hash, claim)
+	if err != nil {
+		return err
+	}
+	if !p.Crypter.IsActive() {
+		return fmt.Errorf("invites require encryption")
+	}
+	secret, err := invite.verify(p.inviteKeys(now), now, func(secret []byte) bool {
+		return hmac.Equal(inviteProof(secret, id), invite.Proof)
+	})
+	if err != nil {
+		return err
+	}
+	return p.bindInvite(id, invite, secret)
+}
+
+// encodeAdmissionRequest creates admission request of peer with
+// specified ID and identity
+func encodeAdmissionRequest(invite *Invite, identity *Identity, id string) ([]byte, error) {
+	if len(invite.ID) != 32 || len(id) != 36 || identity == nil {
+		return nil, fmt.Errorf("bad admission request")
+	}
+	data := make([]byte, 0, inviteRequestSize)
+	data = append(data, inviteAdmissionRequest)
+	data = append(data, invite.ID...)
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(data[len(data)-8:], uint64(invite.Expires.Unix()))
+	if invite.SingleUse {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = append(data, identity.Public...)
+	data = append(data, id...)
+	mac := hmac.New(sha256.New, invite.Secret)
+	mac.Write(data)
+	return mac.Sum(data), nil
+}
+
+// admissionKey derives key which seals admission response to invited peer
+func admissionKey(secret, shared []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("p2p invite admission"))
+	mac.Write(shared)
+	return mac.Sum(nil)
+}
+
+// requestAdmission asks known peers to accept key of the invite. Every
+// member must admit this instance before it can decrypt our traffic, so
+// requests are repeated for peers which haven't admitted us yet or has
+// lost connection, since they might have restarted and forgotten us
+func (p *PeerToPeer) requestAdmission() error {
+	p.invites.lock.Lock()
+	invite := p.invites.invite
+	pending := invite != nil && time.Since(p.invites.lastRequest) > InviteAdmissionInterval
+	if pending {
+		p.invites.lastRequest = time.Now()
+	}
+	admittedBy := make(map[string]bool)
+	for id := range p.invites.admittedBy {
+		admittedBy[id] = true
+	}
+	p.invites.lock.Unlock()
+	if !pending || time.Now().After(invite.Expires) {
+		return nil
+	}
+	if p.Dht == nil || p.Swarm == nil || p.UDPSocket == nil {
+		return fmt.Errorf("instance is not initialized")
+	}
+	request, err := encodeAdmissionRequest(invite, p.Identity, p.Dht.ID)
+	if err != nil {
+		return err
+	}
+	msg, err := p.CreateMessage(MsgTypeInvite, request, 0, false)
+	if err != nil {
+		return err
+	}
+	for _, peer := range p.Swarm.Get() {
+		if admittedBy[peer.ID] && peer.State == PeerStateConnected {
+			continue
+		}
+		peer.Lock.RLock()
+		eps := append([]*net.UDPAddr{}, peer.KnownIPs...)
+		peer.Lock.RUnlock()
+		for _, ep := range eps {
+			if p.UDPSocket.isReachable(ep) {
+				p.UDPSocket.SendMessage(msg, ep)
+			}
+		}
+	}
+	return nil
+}
+
+// HandleInviteMessage processes admission requests of invited peers
+// and responses to our own requests
+func (p *PeerToPeer) HandleInviteMessage(msg *P2PMessage, srcAddr *net.UDPAddr) error {
+	if msg == nil {
+		return fmt.Errorf("nil message")
+	}
+	if srcAddr == nil {
+		return fmt.Errorf("nil source addr")
+	}
+	if len(msg.Data) == 0 || msg.origin != "" {
+		return errInviteMalformed
+	}
+	switch msg.Data[0] {
+	case inviteAdmissionRequest:
+		err := p.admit(msg.Data, srcAddr, time.Now())
+		if err != nil {
+			// Invalid requests get no reply
+			LogWith(Debug, p.logFields(SubsystemPeer), "Refusing admission request from %s: %s", srcAddr, err)
+		}
+		return err
+	case inviteAdmissionResponse:
+		return p.completeAdmission(msg.Data)
+	}
+	return errInviteMalformed
+}
+
+// admit verifies admission request, accepts key of the invite from
+// invited peer and confirms admission with a response sealed with its
+// identity key. The swarm key is never sent
+func (p *PeerToPeer) admit(request []byte, srcAddr *net.UDPAddr, now time.Time) error {
+	if !p.Crypter.IsActive() {
+		return fmt.Errorf("invites require encryption")
+	}
+	if p.JoinedWithInvite() {
+		return errInviteInvited
+	}
+	if p.Dht == nil {
+		return fmt.Errorf("nil dht")
+	}
+	if p.UDPSocket == nil {
+		return fmt.Errorf("nil udp socket")
+	}
+	if len(request) != inviteRequestSize {
+		return errInviteMalformed
+	}
+	expires := int64(binary.BigEndian.Uint64(request[33:41]))
+	invite := &Invite{ID: string(request[1:33]), Hash: p.Hash, Expires: time.Unix(expires, 0), SingleUse: request[41] == 1}
+	static := request[42:74]
+	id := string(request[74:110])
+	if IdentityID(static) != id {
+		return fmt.Errorf("identity key of peer %s doesn't match its ID", id)
+	}
+	if p.ACL.denied(id) {
+		return fmt.Errorf("peer %s is denied by access list", id)
+	}
+	secret, err := invite.verify(p.inviteKeys(now), now, func(secret []byte) bool {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(request[:inviteRequestSize-sha256.Size])
+		return hmac.Equal(mac.Sum(nil), request[inviteRequestSize-sha256.Size:])
+	})
+	if err != nil {
+		return err
+	}
+	p.invites.lock.Lock()
+	err = p.bindInvite(id, invite, secret)
+	p.invites.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	eph, err := NewIdentity()
+	if err != nil {
+		return err
+	}
+	shared, err := curve25519.X25519(eph.Private, static)
+	if err != nil {
+		return err
+	}
+	sealed, err := p.Crypter.seal(admissionKey(secret, shared), []byte(p.Dht.ID), request)
+	if err != nil {
+		return err
+	}
+	response := []byte{inviteAdmissionResponse}
+	response = append(response, eph.Public...)
+	response = append(response, sealed...)
+	msg, err := p.CreateMessage(MsgTypeInvite, response, 0, false)
+	if err != nil {
+		return err
+	}
+	LogWith(Info, p.logFields(SubsystemPeer), "Admitting peer %s with invite %s", id, invite.ID)
+	_, err = p.UDPSocket.SendMessage(msg, srcAddr)
+	return err
+}
+
+// completeAdmission opens admission response and records the member
+// which has admitted this instance
+func (p *PeerToPeer) completeAdmission(response []byte) error {
+	p.invites.lock.Lock()
+	defer p.invites.lock.Unlock()
+	if p.invites.invite == nil {
+		return nil
+	}
+	if p.Identity == nil || p.Dht == nil {
+		return fmt.Errorf("instance is not initialized")
+	}
+	if len(response) < 1+32 {
+		return errInviteMalformed
+	}
+	request, err := encodeAdmissionRequest(p.invites.invite, p.Identity, p.Dht.ID)
+	if err != nil {
+		return err
+	}
+	shared, err := curve25519.X25519(p.Identity.Private, response[1:33])
+	if err != nil {
+		return err
+	}
+	data, _, _, err := p.Crypter.open(admissionKey(p.invites.invite.Secret, shared), response[33:], request)
+	if err != nil || len(data) != 36 {
+		return fmt.Errorf("failed to open admission response: %v", err)
+	}
+	id := string(data)
+	if p.invites.admittedBy == nil {
+		p.invites.admittedBy = make(map[string]bool)
+	}
+	if !p.invites.admittedBy[id] {
+		LogWith(Info, p.logFields(SubsystemInstance), "Admitted by peer %s with invite %s valid until %s", id, p.invites.invite.ID, p.invites.invite.Expires.String())
+	}
+	p.invites.admittedBy[id] = true
+	return nil
+}
+
+// checkInvites disconnects peers which invites have expired
+func (p *PeerToPeer) checkInvites() error {
+	if p.Swarm == nil {
+		return fmt.Errorf("nil peer list")
+	}
+	now := time.Now()
+	p.invites.lock.Lock()
+	if now.Sub(p.invites.lastCheck) < InviteCheckInterval {
+		p.invites.lock.Unlock()
+		return nil
+	}
+	p.invites.lastCheck = now
+	expired := []string{}
+	for id, invited := range p.invites.peers {
+		if now.After(invited.expires) {
+			expired = append(expired, id)
+		}
+	}
+	for id, key := range p.invites.keys {
+		if now.After(key.Until) {
+			delete(p.invites.keys, id)
+		}
+	}
+	p.invites.lock.Unlock()
+
+	for _, id := range expired {
+		peer := p.Swarm.GetPeer(id)
+		if peer == nil || peer.State == PeerStateDisconnect || peer.State == PeerStateStop {
+			continue
+		}
+		LogWith(Info, p.logFields(SubsystemPeer), "Invite of peer %s has expired. Disconnecting it", id)
+		peer.SetState(PeerStateDisconnect, p)
+		p.Swarm.Update(id, peer)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecodeInvite(t *testing.T) {
+	key := []byte("01234567890123456789012345678901")
+	valid, _ := NewInvite("hash", key, time.Now().Add(time.Hour), true)
+	expired, _ := NewInvite("hash", key, time.Now().Add(-time.Hour), false)
+	noSecret, _ := NewInvite("hash", key, time.Now().Add(time.Hour), true)
+	noSecret.Secret = nil
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", valid.Encode(), nil},
+		{"expired", expired.Encode(), errInviteExpired},
+		{"no secret", noSecret.Encode(), errInviteMalformed},
+		{"bad prefix", "token", errInviteMalformed},
+		{"bad encoding", invitePrefix + "!!!", errInviteMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invite, err := DecodeInvite(tt.token)
+			if err != tt.wantErr {
+				t.Fatalf("DecodeInvite() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if invite.Hash != "hash" || invite.ID != valid.ID || !bytes.Equal(invite.Secret, valid.Secret) || !invite.SingleUse {
+				t.Errorf("DecodeInvite() = %+v", invite)
+			}
+			if bytes.Contains([]byte(tt.token), []byte(base64.StdEncoding.EncodeToString(key))) {
+				t.Errorf("Invite token contains the swarm key")
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_redeemInvite(t *testing.T) {
+	key := []byte("01234567890123456789012345678901")
+	now := time.Now()
+	single, _ := NewInvite("hash", key, now.Add(time.Hour), true)
+	multi, _ := NewInvite("hash", key, now.Add(time.Hour), false)
+	short, _ := NewInvite("hash", key, now.Add(time.Minute), false)
+	other, _ := NewInvite("hash", []byte("other key"), now.Add(time.Hour), false)
+	swarm, _ := NewInvite("another hash", key, now.Add(time.Hour), false)
+	extended, _ := NewInvite("hash", key, now.Add(time.Hour), false)
+	extended.Expires = extended.Expires.Add(time.Hour * 24)
+
+	p := &PeerToPeer{Hash: "hash"}
+	p.Crypter.Active = true
+	p.Crypter.ActiveKey = CryptoKey{Key: key, Until: now.Add(time.Hour * 2)}
+	p.ACL.Allow("00000000-0000-0000-0000-000000000000")
+
+	tests := []struct {
+		name    string
+		id      string
+		claim   string
+		now     time.Time
+		wantErr error
+	}{
+		{"allowed peer without claim", "00000000-0000-0000-0000-000000000000", "", now, nil},
+		{"unknown peer without claim", "peer1", "", now, errInviteNotMember},
+		{"single-use", "peer1", single.Claim("peer1"), now, nil},
+		{"single-use by the same peer", "peer1", single.Claim("peer1"), now, nil},
+		{"invitee without claim", "peer1", "", now, nil},
+		{"single-use by another peer", "22222222-2222-2222-2222-222222222222", single.Claim("22222222-2222-2222-2222-222222222222"), now, errInviteRedeemed},
+		{"claim of another peer", "22222222-2222-2222-2222-222222222222", multi.Claim("peer3"), now, errInviteSignature},
+		{"multi-use", "22222222-2222-2222-2222-222222222222", multi.Claim("22222222-2222-2222-2222-222222222222"), now, nil},
+		{"multi-use by another peer", "peer3", multi.Claim("peer3"), now, nil},
+		{"extended expiration", "peer4", extended.Claim("peer4"), now, errInviteSignature},
+		{"signed with another key", "peer4", other.Claim("peer4"), now, errInviteSignature},
+		{"another swarm", "peer4", swarm.Claim("peer4"), now, errInviteSignature},
+		{"malformed", "peer4", "claim", now, errInviteMalformed},
+		{"short invite", "peer5", short.Claim("peer5"), now, nil},
+		{"expired invite", "peer6", short.Claim("peer6"), now.Add(time.Hour), errInviteExpired},
+		{"expired invitee without claim", "peer5", "", now.Add(time.Hour), errInviteExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.redeemInvite(tt.id, tt.claim, tt.now); err != tt.wantErr {
+				t.Errorf("PeerToPeer.redeemInvite() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	if !p.member("22222222-2222-2222-2222-222222222222") || p.member("peer4") {
+		t.Errorf("PeerToPeer.member() doesn't match redeemed invites")
+	}
+	p.ACL.Deny("22222222-2222-2222-2222-222222222222")
+	if p.member("22222222-2222-2222-2222-222222222222") {
+		t.Errorf("PeerToPeer.member() let denied invitee in")
+	}
+}
+
+func TestPeerToPeer_admit(t *testing.T) {
+	key := CryptoKey{Key: []byte("01234567890123456789012345678901"), Until: time.Now().Add(time.Hour * 2)}
+	invite, _ := NewInvite("hash", key.Key, time.Now().Add(time.Hour), true)
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	src := listener.LocalAddr().(*net.UDPAddr)
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 0)
+	defer socket.Close()
+	member := &PeerToPeer{Hash: "hash", UDPSocket: socket}
+	member.Identity, _ = NewIdentity()
+	member.Dht = &DHTClient{ID: member.Identity.ID()}
+	member.Crypter.SetActiveKey(key)
+	member.Crypter.initAEAD()
+
+	newInvitee := func() *PeerToPeer {
+		q := &PeerToPeer{Hash: "hash"}
+		q.Identity, _ = NewIdentity()
+		q.Dht = &DHTClient{ID: q.Identity.ID()}
+		q.Crypter.initAEAD()
+		q.SetInvite(invite)
+		return q
+	}
+	invitee := newInvitee()
+	request, _ := encodeAdmissionRequest(invite, invitee.Identity, invitee.Dht.ID)
+	forged, _ := encodeAdmissionRequest(&Invite{ID: invite.ID, Expires: invite.Expires, SingleUse: true, Secret: make([]byte, 32)}, invitee.Identity, invitee.Dht.ID)
+	other, _ := NewIdentity()
+	spoofed, _ := encodeAdmissionRequest(invite, other, invitee.Dht.ID)
+
+	tests := []struct {
+		name    string
+		request []byte
+		wantErr bool
+	}{
+		{"short request", request[:10], true},
+		{"wrong secret", forged, true},
+		{"identity of another peer", spoofed, true},
+		{"valid request", request, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := member.admit(tt.request, src, time.Now()); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.admit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if !member.invited(invitee.Dht.ID, time.Now()) {
+		t.Errorf("PeerToPeer.admit() didn't record invitee")
+	}
+
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := listener.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Invitee didn't receive admission response: %v", err)
+	}
+	msg, err := P2PMessageFromBytes(buf[:n])
+	if err != nil {
+		t.Fatalf("P2PMessageFromBytes() error = %v", err)
+	}
+	if err := newInvitee().completeAdmission(msg.Data); err == nil {
+		t.Errorf("PeerToPeer.completeAdmission() opened response sealed for another identity")
+	}
+	if bytes.Contains(msg.Data, key.Key) {
+		t.Errorf("Admission response contains the swarm key")
+	}
+	if err := invitee.completeAdmission(msg.Data); err != nil {
+		t.Fatalf("PeerToPeer.completeAdmission() error = %v", err)
+	}
+	if !invitee.invites.admittedBy[member.Dht.ID] {
+		t.Errorf("PeerToPeer.completeAdmission() didn't record member")
+	}
+	if !bytes.Equal(invitee.Crypter.GetActiveKey().Key, inviteKey(invite.Secret)) || !invitee.Crypter.GetActiveKey().Until.Equal(invite.Expires) {
+		t.Errorf("Invitee doesn't encrypt traffic with key of the invite")
+	}
+
+	// Member accepts key of the invite from invitee and answers with it
+	sent, _ := invitee.CreateMessage(MsgTypeIntroReq, []byte(invitee.Dht.ID), 0, true)
+	data, id, err := member.decryptMessage(sent.Data, int(sent.Header.Length))
+	if err != nil || id != invite.ID || string(data) != invitee.Dht.ID {
+		t.Errorf("PeerToPeer.decryptMessage() = %s, %s, %v", data, id, err)
+	}
+	if !bytes.Equal(member.peerKey(invitee.Dht.ID), inviteKey(invite.Secret)) || !bytes.Equal(member.peerKey(member.Dht.ID), key.Key) {
+		t.Errorf("PeerToPeer.peerKey() doesn't match invites")
+	}
+
+	// Single-use invite can't admit another peer
+	second := newInvitee()
+	request, _ = encodeAdmissionRequest(invite, second.Identity, second.Dht.ID)
+	if err := member.admit(request, src, time.Now()); err != errInviteRedeemed {
+		t.Errorf("PeerToPeer.admit() error = %v, want %v", err, errInviteRedeemed)
+	}
+}
+
+func TestPeerToPeer_expiredInvitee(t *testing.T) {
+	key := CryptoKey{Key: []byte("01234567890123456789012345678901"), Until: time.Now().Add(time.Hour * 2)}
+	invite, _ := NewInvite("hash", key.Key, time.Now().Add(-time.Minute), false)
+	src := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 0)
+	defer socket.Close()
+	member := &PeerToPeer{Hash: "hash", UDPSocket: socket, Swarm: new(Swarm)}
+	member.Swarm.Init()
+	member.Identity, _ = NewIdentity()
+	member.Dht = &DHTClient{ID: member.Identity.ID()}
+	member.Crypter.SetActiveKey(key)
+	member.Crypter.initAEAD()
+
+	invitee := &PeerToPeer{Hash: "hash"}
+	invitee.Identity, _ = NewIdentity()
+	invitee.Dht = &DHTClient{ID: invitee.Identity.ID()}
+	invitee.Crypter.initAEAD()
+	invitee.SetInvite(invite)
+
+	// Invitee was admitted while the invite was valid
+	request, _ := encodeAdmissionRequest(invite, invitee.Identity, invitee.Dht.ID)
+	if err := member.admit(request, src, invite.Expires.Add(-time.Hour)); err != nil {
+		t.Fatalf("PeerToPeer.admit() error = %v", err)
+	}
+	for _, k := range invitee.Crypter.Keys {
+		if bytes.Equal(k.Key, key.Key) {
+			t.Fatalf("Invitee holds the swarm key")
+		}
+	}
+
+	now := time.Now()
+	if err := member.admit(request, src, now); err != errInviteExpired {
+		t.Errorf("PeerToPeer.admit() error = %v, want %v", err, errInviteExpired)
+	}
+	if err := member.redeemInvite(invitee.Dht.ID, "", now); err != errInviteExpired {
+		t.Errorf("PeerToPeer.redeemInvite() error = %v, want %v", err, errInviteExpired)
+	}
+	if !bytes.Equal(member.peerKey(invitee.Dht.ID), key.Key) {
+		t.Errorf("PeerToPeer.peerKey() returned key of expired invite")
+	}
+
+	// Neither invitee nor a new identity with the key invitee holds
+	// can reach the member
+	fresh := &PeerToPeer{Hash: "hash"}
+	fresh.Identity, _ = NewIdentity()
+	fresh.Dht = &DHTClient{ID: fresh.Identity.ID()}
+	fresh.Crypter.SetActiveKey(invitee.Crypter.GetActiveKey())
+	for _, q := range []*PeerToPeer{invitee, fresh} {
+		member.Swarm.peers[q.Dht.ID] = &NetworkPeer{ID: q.Dht.ID}
+		payload := []byte(q.Dht.ID + "127.0.0.1:9" + keyExchangeSeparator + "kx")
+		msg, _ := q.CreateMessage(MsgTypeIntroReq, payload, 0, true)
+		if _, _, err := member.decryptMessage(msg.Data, int(msg.Header.Length)); err == nil {
+			t.Errorf("Member decrypted message of %s after the invite has expired", q.Dht.ID)
+		}
+		member.MessageHandlers = map[uint16]MessageHandler{MsgTypeIntroReq: member.HandleIntroRequestMessage}
+		if err := member.handleMessage(msg, src); err == nil {
+			t.Errorf("Member accepted introduction request of %s after the invite has expired", q.Dht.ID)
+		}
+	}
+}
+
+func TestPeerToPeer_checkInvites(t *testing.T) {
+	p := &PeerToPeer{Dht: new(DHTClient), Swarm: new(Swarm)}
+	p.Swarm.Init()
+	p.Swarm.peers["peer1"] = &NetworkPeer{ID: "peer1", State: PeerStateConnected}
+	p.Swarm.peers["peer2"] = &NetworkPeer{ID: "peer2", State: PeerStateConnected}
+	p.invites.peers = map[string]invitedPeer{
+		"peer1": {invite: "invite1", expires: time.Now().Add(-time.Minute)},
+		"peer2": {invite: "invite2", expires: time.Now().Add(time.Hour)},
+	}
+	p.checkInvites()
+	if p.Swarm.peers["peer1"].State != PeerStateDisconnect {
+		t.Errorf("Peer with expired invite wasn't disconnected")
+	}
+	if p.Swarm.peers["peer2"].State != PeerStateConnected {
+		t.Errorf("Peer with valid invite was disconnected")
+	}
+}
+
+func TestPeerToPeer_appendInviteClaim(t *testing.T) {
+	invite, _ := NewInvite("hash", []byte("key"), time.Now().Add(time.Hour), false)
+	p := &PeerToPeer{Hash: "hash", Dht: &DHTClient{ID: "00000000-0000-0000-0000-000000000000"}}
+	if err := p.SetInvite(&Invite{Hash: "another hash"}); err == nil {
+		t.Errorf("PeerToPeer.SetInvite() accepted invite of another swarm")
+	}
+	p.SetInvite(invite)
+	payload := p.appendInviteClaim([]byte("1.2.3.4:6000" + keyExchangeSeparator + "kx"))
+	data, claim := splitInviteClaim(string(payload))
+	if claim != invite.Claim(p.Dht.ID) {
+		t.Errorf("splitInviteClaim() claim = %s, want %s", claim, invite.Claim(p.Dht.ID))
+	}
+	if endpoint, _ := splitKeyExchange(data); endpoint != "1.2.3.4:6000" {
+		t.Errorf("splitKeyExchange() endpoint = %s", endpoint)
+	}
+}
@@ -0,0 +1,299 @@
+package ptp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Instances announce themselves in local network with beacons sent to a
+// multicast group and to a broadcast address. Beacon carries ID of the
+// instance and port of its UDP socket, so peers in the same segment can
+// find each other without bootstrap nodes. Swarm is identified by a keyed
+// hash of infohash, so beacons don't reveal it. Beacons are signed with a
+// key derived from infohash and, when encryption is enabled, active key
+// of the swarm. Every beacon carries a random nonce and nonces seen
+// within LANBeaconMaxAge are rejected, so captured beacons can't be
+// replayed from another address. Forward mode disables discovery
+
+// LAN discovery settings
+const (
+	LANDiscoveryGroup = "239.255.68.80"                 // Multicast group of beacons
+	LANBeaconInterval = time.Duration(time.Second * 5)  // How often beacons are sent
+	LANBeaconMaxAge   = time.Duration(time.Second * 60) // Maximum clock difference between peers
+)
+
+// UseLANDiscovery enables discovery of peers with local network beacons
+var UseLANDiscovery = DefaultLANDiscovery
+
+// LANDiscoveryPort is UDP port beacons are sent to
+var LANDiscoveryPort = DefaultLANDiscoveryPort
+
+// Beacon layout: magic, version, blinded swarm ID, peer ID,
+// port, timestamp, nonce and HMAC-SHA256 of all previous fields
+const (
+	lanBeaconVersion   = 1
+	lanBeaconSwarmSize = sha256.Size
+	lanBeaconNonceSize = 8
+	lanBeaconMACSize   = sha256.Size
+	lanBeaconSize      = 4 + 1 + lanBeaconSwarmSize + 36 + 2 + 8 + lanBeaconNonceSize + lanBeaconMACSize
+)
+
+var lanBeaconMagic = []byte("P2PL")
+
+// Beacon errors
+var (
+	errBeaconMalformed = errors.New("malformed beacon")
+	errBeaconSwarm     = errors.New("beacon of another swarm")
+	errBeaconStale     = errors.New("beacon timestamp is out of range")
+	errBeaconMAC       = errors.New("beacon signature mismatch")
+	errBeaconReplayed  = errors.New("beacon was already received")
+)
+
+// lanBeacon is an announcement received from another instance
+type lanBeacon struct {
+	ID    string
+	Port  int
+	Nonce string
+}
+
+// lanDiscovery holds state of LAN discovery of an instance
+type lanDiscovery struct {
+	conn     *net.UDPConn
+	targets  []*net.UDPAddr // Multicast group and broadcast address
+	lastSent time.Time
+	seen     map[string]time.Time // Nonces of received beacons
+	lock     sync.Mutex
+}
+
+// replayed remembers nonce of a beacon and returns true if it was
+// received before. Nonces are kept while beacons carrying them are valid
+func (l *lanDiscovery) replayed(nonce string, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.seen == nil {
+		l.seen = make(map[string]time.Time)
+	}
+	for n, received := range l.seen {
+		if now.Sub(received) > LANBeaconMaxAge*2 {
+			delete(l.seen, n)
+		}
+	}
+	if _, exists := l.seen[nonce]; exists {
+		return true
+	}
+	l.seen[nonce] = now
+	return false
+}
+
+// blindSwarm returns identifier of the swarm used in beacons
+func blindSwarm(hash string) []byte {
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write([]byte("p2p lan swarm"))
+	return mac.Sum(nil)
+}
+
+// lanBeaconKey derives key used to sign beacons
+func lanBeaconKey(hash string, key []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(hash))
+	mac.Write([]byte("p2p lan beacon"))
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// encodeLANBeacon creates signed beacon of an instance
+func encodeLANBeacon(hash, id string, port int, key []byte, now time.Time) ([]byte, error) {
+	if len(id) != 36 {
+		return nil, fmt.Errorf("bad instance ID")
+	}
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("bad port")
+	}
+	data := make([]byte, 0, lanBeaconSize)
+	data = append(data, lanBeaconMagic...)
+	data = append(data, lanBeaconVersion)
+	data = append(data, blindSwarm(hash)...)
+	data = append(data, id...)
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-10:], uint16(port))
+	binary.BigEndian.PutUint64(data[len(data)-8:], uint64(now.Unix()))
+	nonce := make([]byte, lanBeaconNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %s", err)
+	}
+	data = append(data, nonce...)
+	mac := hmac.New(sha256.New, lanBeaconKey(hash, key))
+	mac.Write(data)
+	return mac.Sum(data), nil
+}
+
+// decodeLANBeacon verifies beacon against swarm and keys accepted by it
+func decodeLANBeacon(data []byte, hash string, keys [][]byte, now time.Time) (*lanBeacon, error) {
+	if len(data) != lanBeaconSize || !bytes.HasPrefix(data, lanBeaconMagic) || data[4] != lanBeaconVersion {
+		return nil, errBeaconMalformed
+	}
+	offset := 5
+	if !hmac.Equal(data[offset:offset+lanBeaconSwarmSize], blindSwarm(hash)) {
+		return nil, errBeaconSwarm
+	}
+	offset += lanBeaconSwarmSize
+	signed := data[:len(data)-lanBeaconMACSize]
+	valid := false
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, lanBeaconKey(hash, key))
+		mac.Write(signed)
+		if hmac.Equal(mac.Sum(nil), data[len(signed):]) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, errBeaconMAC
+	}
+	beacon := &lanBeacon{ID: string(data[offset : offset+36])}
+	offset += 36
+	beacon.Port = int(binary.BigEndian.Uint16(data[offset : offset+2]))
+	sent := time.Unix(int64(binary.BigEndian.Uint64(data[offset+2:offset+10])), 0)
+	offset += 10
+	beacon.Nonce = string(data[offset : offset+lanBeaconNonceSize])
+	if sent.Before(now.Add(-LANBeaconMaxAge)) || sent.After(now.Add(LANBeaconMaxAge)) {
+		return nil, errBeaconStale
+	}
+	if beacon.Port == 0 {
+		return nil, errBeaconMalformed
+	}
+	return beacon, nil
+}
+
+// beaconKeys returns keys used to verify beacons
+func (p *PeerToPeer) beaconKeys(now time.Time) [][]byte {
+	if !p.Crypter.IsActive() {
+		return [][]byte{nil}
+	}
+	keys := [][]byte{}
+	for _, key := range p.Crypter.decryptionKeys(now) {
+		keys = append(keys, key.Key)
+	}
+	return keys
+}
+
+// startLANDiscovery joins multicast group of beacons
+func (p *PeerToPeer) startLANDiscovery() error {
+	if !UseLANDiscovery || p.ForwardMode || p.lan != nil {
+		return nil
+	}
+	group := &net.UDPAddr{IP: net.ParseIP(LANDiscoveryGroup), Port: LANDiscoveryPort}
+	p.lan = &lanDiscovery{
+		targets: []*net.UDPAddr{group, {IP: net.IPv4bcast, Port: LANDiscoveryPort}},
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		// We are still announced to other peers
+		LogWith(Warning, p.logFields(SubsystemDiscovery), "Failed to listen for LAN beacons: %s", err)
+		return err
+	}
+	p.lan.conn = conn
+	LogWith(Info, p.logFields(SubsystemDiscovery), "LAN discovery is enabled on port %d", LANDiscoveryPort)
+	go p.listenBeacons(conn)
+	return nil
+}
+
+// stopLANDiscovery leaves multicast group
+func (p *PeerToPeer) stopLANDiscovery() error {
+	if p.lan == nil || p.lan.conn == nil {
+		return nil
+	}
+	return p.lan.conn.Close()
+}
+
+// listenBeacons reads beacons until socket is closed
+func (p *PeerToPeer) listenBeacons(conn *net.UDPConn) {
+	buf := make([]byte, 512)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			LogWith(Debug, p.logFields(SubsystemDiscovery), "Stopped listening for LAN beacons: %s", err)
+			return
+		}
+		err = p.handleBeacon(buf[:n], src)
+		if err != nil && err != errBeaconSwarm {
+			LogWith(Trace, p.logFields(SubsystemDiscovery), "Dropped LAN beacon from %s: %s", src, err)
+		}
+	}
+}
+
+// sendBeacon announces instance in local network
+func (p *PeerToPeer) sendBeacon() error {
+	if p.lan == nil {
+		return nil
+	}
+	if time.Since(p.lan.lastSent) < LANBeaconInterval {
+		return nil
+	}
+	p.lan.lastSent = time.Now()
+	if p.Dht == nil || p.UDPSocket == nil {
+		return fmt.Errorf("instance is not initialized")
+	}
+	var key []byte
+	if p.Crypter.IsActive() {
+		key = p.Crypter.GetActiveKey().Key
+	}
+	beacon, err := encodeLANBeacon(p.Hash, p.Dht.ID, p.UDPSocket.GetPort(), key, p.lan.lastSent)
+	if err != nil {
+		return err
+	}
+	for _, target := range p.lan.targets {
+		_, err := p.UDPSocket.SendRawBytes(beacon, target)
+		if err != nil {
+			LogWith(Trace, p.logFields(SubsystemDiscovery), "Failed to send LAN beacon to %s: %s", target, err)
+		}
+	}
+	return nil
+}
+
+// handleBeacon adds endpoint from beacon to the peer. Unknown peers are
+// connected directly, the same way as cached ones
+func (p *PeerToPeer) handleBeacon(data []byte, src *net.UDPAddr) error {
+	if p.Dht == nil || p.Swarm == nil || p.Shutdown {
+		return fmt.Errorf("instance is not running")
+	}
+	now := time.Now()
+	beacon, err := decodeLANBeacon(data, p.Hash, p.beaconKeys(now), now)
+	if err != nil {
+		return err
+	}
+	if beacon.ID == p.Dht.ID || !p.ACL.Allowed(beacon.ID) {
+		return nil
+	}
+	if p.lan != nil && p.lan.replayed(beacon.Nonce, now) {
+		return errBeaconReplayed
+	}
+	endpoint := &net.UDPAddr{IP: src.IP, Port: beacon.Port}
+	peer := p.Swarm.GetPeer(beacon.ID)
+	if peer != nil {
+		if peer.State == PeerStateStop {
+			return nil
+		}
+		if peer.addKnownIP(endpoint) {
+			LogWith(Debug, p.logFields(SubsystemDiscovery), "Discovered LAN endpoint %s of peer %s", endpoint, peer.ID)
+		}
+		return nil
+	}
+	LogWith(Info, p.logFields(SubsystemDiscovery), "Discovered peer %s in local network on %s", beacon.ID, endpoint)
+	peer = &NetworkPeer{
+		ID:       beacon.ID,
+		KnownIPs: []*net.UDPAddr{endpoint},
+		direct:   true,
+	}
+	peer.SetState(PeerStateConnecting, p)
+	p.Swarm.Update(peer.ID, peer)
+	p.Swarm.RunPeer(peer.ID, p)
+	return nil
+}
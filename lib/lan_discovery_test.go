@@ -0,0 +1,128 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDecodeLANBeacon(t *testing.T) {
+	id := "11111111-1111-1111-1111-111111111111"
+	now := time.Now()
+	key := []byte("01234567890123456789012345678901")
+	beacon := func(hash string, key []byte, sent time.Time) []byte {
+		data, _ := encodeLANBeacon(hash, id, 6000, key, sent)
+		return data
+	}
+	tampered := beacon("swarm", nil, now)
+	tampered[len(tampered)-lanBeaconMACSize-12]++
+
+	tests := []struct {
+		name    string
+		data    []byte
+		keys    [][]byte
+		wantErr error
+	}{
+		{"valid beacon", beacon("swarm", nil, now), [][]byte{nil}, nil},
+		{"valid encrypted beacon", beacon("swarm", key, now), [][]byte{[]byte("other"), key}, nil},
+		{"another swarm", beacon("other", nil, now), [][]byte{nil}, errBeaconSwarm},
+		{"wrong key", beacon("swarm", key, now), [][]byte{nil}, errBeaconMAC},
+		{"tampered beacon", tampered, [][]byte{nil}, errBeaconMAC},
+		{"old beacon", beacon("swarm", nil, now.Add(-LANBeaconMaxAge*2)), [][]byte{nil}, errBeaconStale},
+		{"future beacon", beacon("swarm", nil, now.Add(LANBeaconMaxAge*2)), [][]byte{nil}, errBeaconStale},
+		{"truncated beacon", beacon("swarm", nil, now)[:lanBeaconSize-1], [][]byte{nil}, errBeaconMalformed},
+		{"not a beacon", make([]byte, lanBeaconSize), [][]byte{nil}, errBeaconMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeLANBeacon(tt.data, "swarm", tt.keys, now)
+			if err != tt.wantErr {
+				t.Fatalf("decodeLANBeacon() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got.ID != id || got.Port != 6000 || len(got.Nonce) != lanBeaconNonceSize) {
+				t.Errorf("decodeLANBeacon() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestEncodeLANBeacon(t *testing.T) {
+	if _, err := encodeLANBeacon("swarm", "short", 6000, nil, time.Now()); err == nil {
+		t.Errorf("encodeLANBeacon() accepted bad ID")
+	}
+	if _, err := encodeLANBeacon("swarm", "11111111-1111-1111-1111-111111111111", 0, nil, time.Now()); err == nil {
+		t.Errorf("encodeLANBeacon() accepted bad port")
+	}
+}
+
+func TestPeerToPeer_handleBeacon(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 40000}
+	p := &PeerToPeer{Hash: "swarm", Dht: &DHTClient{ID: "00000000-0000-0000-0000-000000000000"}, Swarm: new(Swarm)}
+	p.Swarm.Init()
+	p.Swarm.Update("22222222-2222-2222-2222-222222222222", &NetworkPeer{
+		ID:       "22222222-2222-2222-2222-222222222222",
+		State:    PeerStateConnected,
+		KnownIPs: []*net.UDPAddr{{IP: net.ParseIP("1.2.3.4"), Port: 6000}},
+		Running:  true,
+	})
+	beacon := func(id string) []byte {
+		data, _ := encodeLANBeacon("swarm", id, 6000, nil, time.Now())
+		return data
+	}
+
+	if err := p.handleBeacon(beacon(p.Dht.ID), src); err != nil || p.Swarm.Length() != 1 {
+		t.Fatalf("Own beacon wasn't ignored: %v", err)
+	}
+
+	if err := p.handleBeacon(beacon("11111111-1111-1111-1111-111111111111"), src); err != nil {
+		t.Fatalf("PeerToPeer.handleBeacon() error = %v", err)
+	}
+	peer := p.Swarm.GetPeer("11111111-1111-1111-1111-111111111111")
+	if peer == nil || !peer.direct || len(peer.KnownIPs) != 1 || peer.KnownIPs[0].String() != "192.168.0.2:6000" {
+		t.Fatalf("Discovered peer was added incorrectly: %+v", peer)
+	}
+	peer.SetState(PeerStateStop, p)
+
+	known := p.Swarm.GetPeer("22222222-2222-2222-2222-222222222222")
+	for i := 0; i < 2; i++ {
+		if err := p.handleBeacon(beacon(known.ID), src); err != nil {
+			t.Fatalf("PeerToPeer.handleBeacon() error = %v", err)
+		}
+	}
+	if len(known.KnownIPs) != 2 || known.KnownIPs[1].String() != "192.168.0.2:6000" || known.State != PeerStateConnected {
+		t.Errorf("LAN endpoint wasn't added to known peer: %v", known.KnownIPs)
+	}
+	// Beacon replayed from another address is dropped
+	p.lan = new(lanDiscovery)
+	replayed := beacon(known.ID)
+	if err := p.handleBeacon(replayed, src); err != nil {
+		t.Fatalf("PeerToPeer.handleBeacon() error = %v", err)
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.0.3"), Port: 40000}
+	if err := p.handleBeacon(replayed, other); err != errBeaconReplayed || len(known.KnownIPs) != 2 {
+		t.Errorf("Replayed beacon wasn't rejected: %v, %v", err, known.KnownIPs)
+	}
+}
+
+func TestLANDiscovery_replayed(t *testing.T) {
+	l := new(lanDiscovery)
+	now := time.Now()
+	if l.replayed("nonce", now) || !l.replayed("nonce", now.Add(LANBeaconMaxAge)) {
+		t.Fatalf("lanDiscovery.replayed() didn't detect repeated nonce")
+	}
+	if l.replayed("nonce", now.Add(LANBeaconMaxAge*3)) || len(l.seen) != 1 {
+		t.Errorf("lanDiscovery.replayed() didn't expire old nonce")
+	}
+}
+
+func TestPeerToPeer_startLANDiscovery(t *testing.T) {
+	defer func(enabled bool) { UseLANDiscovery = enabled }(UseLANDiscovery)
+	UseLANDiscovery = true
+	p := &PeerToPeer{ForwardMode: true}
+	if err := p.startLANDiscovery(); err != nil || p.lan != nil {
+		t.Errorf("LAN discovery was started in forward mode")
+	}
+	if err := p.sendBeacon(); err != nil {
+		t.Errorf("PeerToPeer.sendBeacon() error = %v", err)
+	}
+}
@@ -1,10 +1,14 @@
 package ptp
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"strings"
-	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // LogLevel is a level of the log message
@@ -19,7 +23,55 @@ const (
 	Error
 )
 
+// LogFormat is an output format of log records
+type LogFormat int32
+
+// Log formats
+const (
+	LogText LogFormat = iota // Human-readable lines with fields appended
+	LogJSON                  // One JSON object per record
+)
+
+// Subsystems which log records are attributed to
+const (
+	SubsystemInstance  = "instance"
+	SubsystemPeer      = "peer"
+	SubsystemPacket    = "packet"
+	SubsystemDHT       = "dht"
+	SubsystemProxy     = "proxy"
+	SubsystemComm      = "comm"
+	SubsystemDiscovery = "discovery"
+	SubsystemRelay     = "relay"
+	SubsystemHooks     = "hooks"
+	SubsystemBootstrap = "bootstrap"
+)
+
+// LogSubsystems lists subsystems which log level can be modified
+var LogSubsystems = []string{
+	SubsystemInstance,
+	SubsystemPeer,
+	SubsystemPacket,
+	SubsystemDHT,
+	SubsystemProxy,
+	SubsystemComm,
+	SubsystemDiscovery,
+	SubsystemRelay,
+	SubsystemHooks,
+	SubsystemBootstrap,
+}
+
+// IsLogSubsystem returns true if subsystem is known
+func IsLogSubsystem(subsystem string) bool {
+	for _, s := range LogSubsystems {
+		if s == subsystem {
+			return true
+		}
+	}
+	return false
+}
+
 var logPrefixes = [...]string{"[TRACE] ", "[DEBUG] ", "[INFO] ", "[WARNING] ", "[ERROR] "}
+var logNames = [...]string{"trace", "debug", "info", "warning", "error"}
 var logFlags = [...]int{log.Ldate | log.Ltime,
 	log.Ldate | log.Ltime,
 	log.Ldate | log.Ltime,
@@ -27,51 +79,172 @@ var logFlags = [...]int{log.Ldate | log.Ltime,
 	log.Ldate | log.Ltime}
 
 var logLevelMin = Info
+var logFormat = LogText
 var syslogSocket = ""
 var stdLoggers = [...]*log.Logger{log.New(os.Stdout, logPrefixes[Trace], logFlags[Trace]),
 	log.New(os.Stdout, logPrefixes[Debug], logFlags[Debug]),
 	log.New(os.Stdout, logPrefixes[Info], logFlags[Info]),
 	log.New(os.Stdout, logPrefixes[Warning], logFlags[Warning]),
 	log.New(os.Stdout, logPrefixes[Error], logFlags[Error])}
+var jsonLogger = log.New(os.Stdout, "", 0)
+
+// Fields are context of a log record. Empty fields are omitted
+type Fields struct {
+	Hash      string `json:"hash,omitempty"`      // Infohash of the instance
+	Peer      string `json:"peer,omitempty"`      // ID of the peer
+	Subsystem string `json:"subsystem,omitempty"` // Part of p2p which produced the record
+	Endpoint  string `json:"endpoint,omitempty"`  // Remote address
+}
+
+// logRecord is a JSON binding for log records
+type logRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+	Fields
+}
+
+// logLevelKey selects records of an instance, of a subsystem or both
+type logLevelKey struct {
+	hash      string
+	subsystem string
+}
+
+// logOverrides are levels set for instances and subsystems
+var logOverrides = struct {
+	levels map[logLevelKey]LogLevel
+	count  int32 // Number of overrides. Allows to skip lookup when zero
+	lock   sync.RWMutex
+}{levels: make(map[logLevelKey]LogLevel)}
 
 // SetMinLogLevel sets a minimal logging level. Accepts a LogLevel constant for setting
 func SetMinLogLevel(level LogLevel) {
 	logLevelMin = level
 }
 
-// SetMinLogLevel sets a minimal logging level. Accepts a string for setting
-func SetMinLogLevelString(level string) error {
+// ParseLogLevel converts name of the level to LogLevel
+func ParseLogLevel(level string) (LogLevel, error) {
 	level = strings.ToLower(level)
-	if level == "trace" {
-		SetMinLogLevel(Trace)
-	} else if level == "debug" {
-		SetMinLogLevel(Debug)
-	} else if level == "info" {
-		SetMinLogLevel(Info)
-	} else if level == "warning" {
-		SetMinLogLevel(Warning)
-	} else if level == "error" {
-		SetMinLogLevel(Error)
-	} else {
+	for i, name := range logNames {
+		if name == level {
+			return LogLevel(i), nil
+		}
+	}
+	return Info, fmt.Errorf("Unknown log level %s", level)
+}
+
+// SetMinLogLevelString sets a minimal logging level. Accepts a string for setting
+func SetMinLogLevelString(level string) error {
+	parsed, err := ParseLogLevel(level)
+	if err != nil {
 		Log(Warning, "Unknown log level %s was provided. Supported log levels are:\ntrace\ndebug\ninfo\nwarning\nerror\n", level)
 		return fmt.Errorf("Could not set provided log level")
 	}
-	Log(Info, "Logging level has switched to %s level", level)
+	SetMinLogLevel(parsed)
+	Log(Info, "Logging level has switched to %s level", strings.ToLower(level))
 	return nil
 }
 
 // MinLogLevel returns minimal log level
 func MinLogLevel() LogLevel { return logLevelMin }
 
+// SetLogLevel sets minimal level of records of an instance, a subsystem
+// or a subsystem of an instance. Empty hash or subsystem matches any
+func SetLogLevel(hash, subsystem string, level LogLevel) {
+	logOverrides.lock.Lock()
+	logOverrides.levels[logLevelKey{hash, subsystem}] = level
+	atomic.StoreInt32(&logOverrides.count, int32(len(logOverrides.levels)))
+	logOverrides.lock.Unlock()
+}
+
+// ResetLogLevel removes level set for an instance, a subsystem or both
+func ResetLogLevel(hash, subsystem string) {
+	logOverrides.lock.Lock()
+	delete(logOverrides.levels, logLevelKey{hash, subsystem})
+	atomic.StoreInt32(&logOverrides.count, int32(len(logOverrides.levels)))
+	logOverrides.lock.Unlock()
+}
+
+// logLevelFor returns minimal level of records with specified fields.
+// Level of subsystem of an instance has priority over level of the
+// instance, which has priority over level of the subsystem
+func logLevelFor(fields *Fields) LogLevel {
+	if atomic.LoadInt32(&logOverrides.count) == 0 {
+		return logLevelMin
+	}
+	logOverrides.lock.RLock()
+	defer logOverrides.lock.RUnlock()
+	for _, key := range []logLevelKey{
+		{fields.Hash, fields.Subsystem},
+		{fields.Hash, ""},
+		{"", fields.Subsystem},
+	} {
+		if key == (logLevelKey{}) {
+			continue
+		}
+		if level, exists := logOverrides.levels[key]; exists {
+			return level
+		}
+	}
+	return logLevelMin
+}
+
+// SetLogFormat sets output format of log records: text or json
+func SetLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", "text":
+		atomic.StoreInt32((*int32)(&logFormat), int32(LogText))
+	case "json":
+		atomic.StoreInt32((*int32)(&logFormat), int32(LogJSON))
+	default:
+		return fmt.Errorf("Unknown log format %s", format)
+	}
+	return nil
+}
+
 // Log writes a log message
 func Log(level LogLevel, format string, v ...interface{}) {
-	if level < logLevelMin {
+	LogWith(level, Fields{}, format, v...)
+}
+
+// LogWith writes a log message with context
+func LogWith(level LogLevel, fields Fields, format string, v ...interface{}) {
+	if level < Trace || level > Error || level < logLevelFor(&fields) {
 		return
 	}
-	stdLoggers[level].Printf(format, v...)
+	message := fmt.Sprintf(format, v...)
+	if LogFormat(atomic.LoadInt32((*int32)(&logFormat))) == LogJSON {
+		data, err := json.Marshal(&logRecord{
+			Time:    time.Now().Format(time.RFC3339Nano),
+			Level:   logNames[level],
+			Message: message,
+			Fields:  fields,
+		})
+		if err == nil {
+			jsonLogger.Println(string(data))
+		}
+	} else {
+		stdLoggers[level].Print(message + fields.String())
+	}
 	if level != Trace && len(syslogSocket) != 0 {
-		go Syslog(level, format, v...)
+		go Syslog(level, "%s", message+fields.String())
+	}
+}
+
+// String returns fields as space-separated key=value pairs with leading space
+func (f Fields) String() string {
+	out := ""
+	for _, field := range [][2]string{
+		{"subsystem", f.Subsystem},
+		{"hash", f.Hash},
+		{"peer", f.Peer},
+		{"endpoint", f.Endpoint},
+	} {
+		if field[1] != "" {
+			out += " " + field[0] + "=" + field[1]
+		}
 	}
+	return out
 }
 
 // SetSyslogSocket sets an adders of the syslog server
@@ -1,6 +1,12 @@
 package ptp
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
 
 // import "testing"
 
@@ -135,3 +141,121 @@ func TestSetSyslogSocket(t *testing.T) {
 		})
 	}
 }
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   string
+		want    LogLevel
+		wantErr bool
+	}{
+		{"trace", "trace", Trace, false},
+		{"upper case", "WARNING", Warning, false},
+		{"unknown", "verbose", Info, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLogLevel(tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseLogLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLogLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_logLevelFor(t *testing.T) {
+	SetMinLogLevel(Info)
+	SetLogLevel("hash1", "", Debug)
+	SetLogLevel("", SubsystemDHT, Error)
+	SetLogLevel("hash1", SubsystemDHT, Trace)
+	defer ResetLogLevel("hash1", "")
+	defer ResetLogLevel("", SubsystemDHT)
+	defer ResetLogLevel("hash1", SubsystemDHT)
+
+	tests := []struct {
+		name   string
+		fields Fields
+		want   LogLevel
+	}{
+		{"no fields", Fields{}, Info},
+		{"other instance", Fields{Hash: "hash2", Subsystem: SubsystemPeer}, Info},
+		{"instance", Fields{Hash: "hash1", Subsystem: SubsystemPeer}, Debug},
+		{"subsystem", Fields{Hash: "hash2", Subsystem: SubsystemDHT}, Error},
+		{"subsystem of instance", Fields{Hash: "hash1", Subsystem: SubsystemDHT}, Trace},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logLevelFor(&tt.fields); got != tt.want {
+				t.Errorf("logLevelFor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogWith(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jsonLogger.SetOutput(buf)
+	defer jsonLogger.SetOutput(os.Stdout)
+	if err := SetLogFormat("json"); err != nil {
+		t.Fatalf("SetLogFormat() error = %v", err)
+	}
+	defer SetLogFormat("text")
+	SetMinLogLevel(Info)
+
+	LogWith(Debug, Fields{Hash: "hash"}, "skipped")
+	LogWith(Warning, Fields{Hash: "hash", Peer: "peer", Subsystem: SubsystemPeer, Endpoint: "192.168.1.2:6000"}, "Peer %s is lost", "peer")
+
+	// Records of instances running in background are skipped
+	want := Fields{Hash: "hash", Peer: "peer", Subsystem: SubsystemPeer, Endpoint: "192.168.1.2:6000"}
+	found := 0
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		record := new(logRecord)
+		if err := json.Unmarshal([]byte(line), record); err != nil {
+			t.Fatalf("Failed to parse log record %q: %v", line, err)
+		}
+		if record.Message == "skipped" {
+			t.Errorf("Record below minimal level was written")
+		}
+		if record.Message != "Peer peer is lost" {
+			continue
+		}
+		found++
+		if record.Level != "warning" || record.Fields != want {
+			t.Errorf("LogWith() wrote %+v", record)
+		}
+	}
+	if found != 1 {
+		t.Errorf("LogWith() wrote %d records, want 1", found)
+	}
+}
+
+func TestSetLogFormat(t *testing.T) {
+	defer SetLogFormat("text")
+	tests := []struct {
+		name    string
+		format  string
+		wantErr bool
+	}{
+		{"text", "text", false},
+		{"json", "JSON", false},
+		{"default", "", false},
+		{"unknown", "xml", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetLogFormat(tt.format); (err != nil) != tt.wantErr {
+				t.Errorf("SetLogFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFields_String(t *testing.T) {
+	f := Fields{Hash: "hash", Subsystem: SubsystemDHT}
+	if got, want := f.String(), " subsystem=dht hash=hash"; got != want {
+		t.Errorf("Fields.String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+package ptp
+
+import "sync/atomic"
+
+// Metrics are counters of an instance exported by the daemon. Counters
+// are updated atomically from packet handlers
+type Metrics struct {
+	BytesIn         uint64 // Bytes of data frames received from peers
+	BytesOut        uint64 // Bytes of messages sent to peers
+	PacketsIn       uint64 // Data frames received from peers
+	PacketsOut      uint64 // Messages sent to peers
+	DecryptFailures uint64 // Messages which failed decryption or authentication
+	TAPReadErrors   uint64 // Failed reads from interface
+	TAPWriteErrors  uint64 // Failed writes to interface
+}
+
+// Get returns a consistent copy of counters
+func (m *Metrics) Get() Metrics {
+	return Metrics{
+		BytesIn:         atomic.LoadUint64(&m.BytesIn),
+		BytesOut:        atomic.LoadUint64(&m.BytesOut),
+		PacketsIn:       atomic.LoadUint64(&m.PacketsIn),
+		PacketsOut:      atomic.LoadUint64(&m.PacketsOut),
+		DecryptFailures: atomic.LoadUint64(&m.DecryptFailures),
+		TAPReadErrors:   atomic.LoadUint64(&m.TAPReadErrors),
+		TAPWriteErrors:  atomic.LoadUint64(&m.TAPWriteErrors),
+	}
+}
+
+// received counts data frame received from peer
+func (m *Metrics) received(size int) {
+	atomic.AddUint64(&m.PacketsIn, 1)
+	atomic.AddUint64(&m.BytesIn, uint64(size))
+}
+
+// sent counts message sent to peer
+func (m *Metrics) sent(size int) {
+	atomic.AddUint64(&m.PacketsOut, 1)
+	atomic.AddUint64(&m.BytesOut, uint64(size))
+}
+
+func (m *Metrics) decryptFailure() {
+	atomic.AddUint64(&m.DecryptFailures, 1)
+}
+
+func (m *Metrics) tapReadError() {
+	atomic.AddUint64(&m.TAPReadErrors, 1)
+}
+
+func (m *Metrics) tapWriteError() {
+	atomic.AddUint64(&m.TAPWriteErrors, 1)
+}
@@ -0,0 +1,33 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMetrics_Get(t *testing.T) {
+	m := new(Metrics)
+	m.received(100)
+	m.received(50)
+	m.sent(70)
+	m.decryptFailure()
+	m.tapReadError()
+	m.tapWriteError()
+	m.tapWriteError()
+	want := Metrics{BytesIn: 150, BytesOut: 70, PacketsIn: 2, PacketsOut: 1, DecryptFailures: 1, TAPReadErrors: 1, TAPWriteErrors: 2}
+	if got := m.Get(); got != want {
+		t.Errorf("Metrics.Get() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPeerToPeer_handleMessage_decryptFailure(t *testing.T) {
+	p := &PeerToPeer{}
+	p.Crypter.Active = true
+	msg := &P2PMessage{Header: &P2PMessageHeader{Type: MsgTypeNenc, Length: 3}, Data: []byte{1, 2, 3}}
+	if err := p.handleMessage(msg, &net.UDPAddr{}); err == nil {
+		t.Fatalf("handleMessage() accepted garbage")
+	}
+	if got := p.Metrics.Get().DecryptFailures; got != 1 {
+		t.Errorf("DecryptFailures = %d, want 1", got)
+	}
+}
@@ -0,0 +1,342 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Broadcast and multicast frames have no single destination in the swarm,
+// so they are delivered to every connected peer. Amount of frames sent to
+// a single group is limited per second. When IGMP snooping is enabled
+// IPv4 multicast traffic is delivered only to peers which reported
+// membership in the group. Like a snooping switch, groups without known
+// members, link-local groups (224.0.0.0/24), IPv6 multicast and IGMP
+// messages themselves are delivered to everyone. Every instance acts as
+// a querier for its own interface, so hosts keep reporting membership
+// and it doesn't expire while they stay in a group
+
+// MulticastRate is a maximum number of frames per second delivered to a
+// single broadcast or multicast group. Zero disables the limit
+var MulticastRate = DefaultMulticastRate
+
+// UseIGMPSnooping enables delivery of IPv4 multicast to group members only
+var UseIGMPSnooping = DefaultIGMPSnooping
+
+// IGMP constants
+const (
+	ipv4ProtocolIGMP       uint8 = 2
+	igmpMembershipQuery    uint8 = 0x11
+	igmpV1MembershipReport uint8 = 0x12
+	igmpV2MembershipReport uint8 = 0x16
+	igmpV2LeaveGroup       uint8 = 0x17
+	igmpV3MembershipReport uint8 = 0x22
+	// Query interval, query response interval and group membership
+	// interval as defined by RFC 2236
+	igmpQueryInterval     = time.Second * 125
+	igmpQueryResponse     = time.Second * 10
+	igmpMembershipTimeout = igmpQueryInterval*2 + igmpQueryResponse
+)
+
+// igmpAllSystems is a destination of general queries
+var igmpAllSystems = net.IPv4(224, 0, 0, 1)
+
+// multicastLimiter counts frames sent to each group within one second
+type multicastLimiter struct {
+	groups map[string]*groupRate
+	lock   sync.Mutex
+}
+
+type groupRate struct {
+	started time.Time
+	count   int
+}
+
+// allow reports whether another frame may be sent to the group
+func (m *multicastLimiter) allow(group string, limit int, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.groups == nil {
+		m.groups = make(map[string]*groupRate)
+	}
+	rate, exists := m.groups[group]
+	if !exists || now.Sub(rate.started) >= time.Second {
+		m.groups[group] = &groupRate{started: now, count: 1}
+		return true
+	}
+	if rate.count >= limit {
+		return false
+	}
+	rate.count++
+	return true
+}
+
+// igmpSnooper keeps track of peers which joined multicast groups.
+// Groups are identified by hardware address they are mapped to
+type igmpSnooper struct {
+	groups  map[string]map[string]time.Time
+	queried time.Time // Time of the last general query
+	lock    sync.Mutex
+}
+
+func (s *igmpSnooper) join(group, id string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.groups == nil {
+		s.groups = make(map[string]map[string]time.Time)
+	}
+	if s.groups[group] == nil {
+		s.groups[group] = make(map[string]time.Time)
+	}
+	s.groups[group][id] = now.Add(igmpMembershipTimeout)
+}
+
+func (s *igmpSnooper) leave(group, id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.groups[group], id)
+	if len(s.groups[group]) == 0 {
+		delete(s.groups, group)
+	}
+}
+
+// members returns IDs of peers which membership in the group didn't
+// expire. Returns nil if group has no members, so it's flooded
+func (s *igmpSnooper) members(group string, now time.Time) map[string]bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make(map[string]bool)
+	for id, expires := range s.groups[group] {
+		if now.After(expires) {
+			delete(s.groups[group], id)
+			continue
+		}
+		result[id] = true
+	}
+	if len(result) == 0 {
+		delete(s.groups, group)
+		return nil
+	}
+	return result
+}
+
+// queryDue reports whether next general query should be sent and
+// remembers the time of the query
+func (s *igmpSnooper) queryDue(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.queried.IsZero() && now.Sub(s.queried) < igmpQueryInterval {
+		return false
+	}
+	s.queried = now
+	return true
+}
+
+// multicastGroupHW returns hardware address of IPv4 multicast group
+func multicastGroupHW(group net.IP) net.HardwareAddr {
+	ip := group.To4()
+	return net.HardwareAddr{0x01, 0x00, 0x5e, ip[1] & 0x7f, ip[2], ip[3]}
+}
+
+// newIGMPQuery creates ethernet frame with IGMPv3 general query sent
+// from src. IGMPv1 and IGMPv2 hosts answer it as a query of own version
+func newIGMPQuery(srcHW net.HardwareAddr, src net.IP) ([]byte, error) {
+	src = src.To4()
+	if src == nil {
+		return nil, fmt.Errorf("query source is not an IPv4 address")
+	}
+	if len(srcHW) != 6 {
+		return nil, ErrInvalidHardwareAddr
+	}
+	// type[1] max response[1] checksum[2] group[4] flags[1] qqic[1] sources[2]
+	igmp := make([]byte, 12)
+	igmp[0] = igmpMembershipQuery
+	igmp[1] = byte(igmpQueryResponse / (time.Second / 10))
+	igmp[8] = 2 // Robustness variable
+	igmp[9] = byte(igmpQueryInterval / time.Second)
+	binary.BigEndian.PutUint16(igmp[2:4], ipv4Checksum(igmp))
+
+	// IPv4 header with router alert option
+	header := make([]byte, 24)
+	header[0] = 0x46
+	header[1] = 0xc0
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+len(igmp)))
+	header[8] = 1
+	header[9] = ipv4ProtocolIGMP
+	copy(header[12:16], src)
+	copy(header[16:20], igmpAllSystems.To4())
+	header[20] = 0x94
+	header[21] = 0x04
+	binary.BigEndian.PutUint16(header[10:12], ipv4Checksum(header))
+
+	frame := make([]byte, 14, 14+len(header)+len(igmp))
+	copy(frame[0:6], multicastGroupHW(igmpAllSystems))
+	copy(frame[6:12], srcHW)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(PacketIPv4))
+	frame = append(frame, header...)
+	return append(frame, igmp...), nil
+}
+
+// ipv4Checksum calculates internet checksum of IPv4 header or IGMP message
+func ipv4Checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// queryIGMP periodically writes general query to the interface. Hosts
+// answer with membership reports which are flooded to every peer and
+// refresh membership of this instance in their snoopers
+func (p *PeerToPeer) queryIGMP() error {
+	if !UseIGMPSnooping || p.Interface == nil {
+		return nil
+	}
+	ip := p.Interface.GetIP()
+	if ip == nil || ip.To4() == nil || !p.igmp.queryDue(time.Now()) {
+		return nil
+	}
+	query, err := newIGMPQuery(p.Interface.GetHardwareAddress(), ip)
+	if err != nil {
+		return err
+	}
+	LogWith(Trace, p.logFields(SubsystemPacket), "Sending IGMP general query")
+	return p.WriteToDevice(query, uint16(PacketIPv4), false)
+}
+
+// ipv4Payload returns IPv4 packet carried by ethernet frame or nil
+func ipv4Payload(contents []byte) []byte {
+	if len(contents) < 14+20 || binary.BigEndian.Uint16(contents[12:14]) != uint16(PacketIPv4) {
+		return nil
+	}
+	packet := contents[14:]
+	if packet[0]>>4 != 4 || int(packet[0]&0x0f)*4 > len(packet) {
+		return nil
+	}
+	return packet
+}
+
+// snoopedFrame reports whether frame should be delivered to group members
+// only. IGMP messages and link-local groups are always flooded
+func snoopedFrame(contents []byte) bool {
+	packet := ipv4Payload(contents)
+	if packet == nil || packet[9] == ipv4ProtocolIGMP {
+		return false
+	}
+	dst := net.IP(packet[16:20])
+	return dst.IsMulticast() && !dst.IsLinkLocalMulticast()
+}
+
+// parseIGMP extracts groups joined and left in IGMP message
+func parseIGMP(contents []byte) (joined, left []net.IP) {
+	packet := ipv4Payload(contents)
+	if packet == nil || packet[9] != ipv4ProtocolIGMP {
+		return nil, nil
+	}
+	igmp := packet[int(packet[0]&0x0f)*4:]
+	if len(igmp) < 8 {
+		return nil, nil
+	}
+	switch igmp[0] {
+	case igmpV1MembershipReport, igmpV2MembershipReport:
+		joined = append(joined, net.IP(igmp[4:8]))
+	case igmpV2LeaveGroup:
+		left = append(left, net.IP(igmp[4:8]))
+	case igmpV3MembershipReport:
+		records := int(binary.BigEndian.Uint16(igmp[6:8]))
+		data := igmp[8:]
+		for i := 0; i < records && len(data) >= 8; i++ {
+			// type[1] aux[1] sources[2] group[4] sources[4*n] aux[4*aux]
+			sources := int(binary.BigEndian.Uint16(data[2:4]))
+			size := 8 + sources*4 + int(data[1])*4
+			if size > len(data) {
+				break
+			}
+			group := net.IP(data[4:8])
+			// Include mode without sources means the group is left
+			if (data[0] == 1 || data[0] == 3) && sources == 0 {
+				left = append(left, group)
+			} else if data[0] != 6 {
+				joined = append(joined, group)
+			}
+			data = data[size:]
+		}
+	}
+	return joined, left
+}
+
+// snoopIGMP updates group membership of the peer which sent the frame.
+// Peer is resolved by the address frame came from, as source MAC address
+// of the frame is set by sender
+func (p *PeerToPeer) snoopIGMP(peer *NetworkPeer, contents []byte) {
+	if !UseIGMPSnooping || peer == nil || len(contents) < 12 {
+		return
+	}
+	joined, left := parseIGMP(contents)
+	if joined == nil && left == nil {
+		return
+	}
+	now := time.Now()
+	for _, group := range joined {
+		if group.IsMulticast() {
+			LogWith(Trace, p.logFields(SubsystemPacket), "Peer %s joined multicast group %s", peer.ID, group)
+			p.igmp.join(multicastGroupHW(group).String(), peer.ID, now)
+		}
+	}
+	for _, group := range left {
+		if group.IsMulticast() {
+			LogWith(Trace, p.logFields(SubsystemPacket), "Peer %s left multicast group %s", peer.ID, group)
+			p.igmp.leave(multicastGroupHW(group).String(), peer.ID)
+		}
+	}
+}
+
+// floodFrame sends a copy of broadcast or multicast frame to every
+// connected peer interested in it
+func (p *PeerToPeer) floodFrame(contents []byte, proto int) error {
+	if p.Swarm == nil {
+		return fmt.Errorf("nil peer list")
+	}
+	if p.UDPSocket == nil {
+		return fmt.Errorf("nil udp socket")
+	}
+	if len(contents) < 6 {
+		return fmt.Errorf("frame is too short")
+	}
+	group := net.HardwareAddr(contents[0:6]).String()
+	now := time.Now()
+	if !p.multicast.allow(group, MulticastRate, now) {
+		LogWith(Trace, p.logFields(SubsystemPacket), "Rate limit exceeded for group %s", group)
+		return nil
+	}
+	var members map[string]bool
+	if UseIGMPSnooping && snoopedFrame(contents) {
+		members = p.igmp.members(group, now)
+	}
+	for _, peer := range p.Swarm.Get() {
+		if peer.State != PeerStateConnected || peer.Endpoint == nil {
+			continue
+		}
+		if members != nil && !members[peer.ID] {
+			continue
+		}
+		msg, err := p.CreateFrameMessage(peer.PeerHW, contents, uint16(proto))
+		if err != nil || msg == nil {
+			continue
+		}
+		p.sendToPeer(peer, msg)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// buildIPv4Frame returns ethernet frame with IPv4 packet
+func buildIPv4Frame(src net.HardwareAddr, dst net.IP, protocol uint8, payload []byte) []byte {
+	frame := make([]byte, 14+20)
+	copy(frame[0:6], multicastGroupHW(dst))
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(PacketIPv4))
+	frame[14] = 0x45
+	frame[14+9] = protocol
+	copy(frame[14+16:14+20], dst.To4())
+	return append(frame, payload...)
+}
+
+// buildIGMP returns IGMPv2 message
+func buildIGMP(kind uint8, group net.IP) []byte {
+	igmp := make([]byte, 8)
+	igmp[0] = kind
+	copy(igmp[4:8], group.To4())
+	return igmp
+}
+
+// buildIGMPv3 returns IGMPv3 report with a single group record
+func buildIGMPv3(record uint8, group net.IP, sources int) []byte {
+	igmp := make([]byte, 8)
+	igmp[0] = igmpV3MembershipReport
+	binary.BigEndian.PutUint16(igmp[6:8], 1)
+	rec := make([]byte, 8+sources*4)
+	rec[0] = record
+	binary.BigEndian.PutUint16(rec[2:4], uint16(sources))
+	copy(rec[4:8], group.To4())
+	return append(igmp, rec...)
+}
+
+func TestMulticastLimiter_allow(t *testing.T) {
+	m := new(multicastLimiter)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !m.allow("a", 3, now) {
+			t.Fatalf("multicastLimiter.allow() denied frame #%d", i)
+		}
+	}
+	if m.allow("a", 3, now) {
+		t.Errorf("multicastLimiter.allow() allowed frame over the limit")
+	}
+	if !m.allow("b", 3, now) {
+		t.Errorf("multicastLimiter.allow() limited another group")
+	}
+	if !m.allow("a", 3, now.Add(time.Second)) {
+		t.Errorf("multicastLimiter.allow() didn't reset the limit")
+	}
+	if !m.allow("a", 0, now) {
+		t.Errorf("multicastLimiter.allow() denied frame with disabled limit")
+	}
+}
+
+func TestIGMPSnooper(t *testing.T) {
+	s := new(igmpSnooper)
+	now := time.Now()
+	s.join("g", "1", now)
+	s.join("g", "2", now.Add(-igmpMembershipTimeout*2))
+	members := s.members("g", now)
+	if !members["1"] || members["2"] || len(members) != 1 {
+		t.Fatalf("igmpSnooper.members() = %v", members)
+	}
+	s.leave("g", "1")
+	if members := s.members("g", now); members != nil {
+		t.Errorf("igmpSnooper.members() after leave = %v", members)
+	}
+	// Expired group is flooded
+	s.join("e", "1", now.Add(-igmpMembershipTimeout*2))
+	if members := s.members("e", now); members != nil {
+		t.Errorf("igmpSnooper.members() of expired group = %v", members)
+	}
+}
+
+func TestIGMPSnooper_queryDue(t *testing.T) {
+	s := new(igmpSnooper)
+	now := time.Now()
+	if !s.queryDue(now) {
+		t.Fatalf("igmpSnooper.queryDue() skipped first query")
+	}
+	if s.queryDue(now.Add(time.Second)) {
+		t.Errorf("igmpSnooper.queryDue() repeated query within interval")
+	}
+	if !s.queryDue(now.Add(igmpQueryInterval)) {
+		t.Errorf("igmpSnooper.queryDue() skipped query after interval")
+	}
+}
+
+func TestNewIGMPQuery(t *testing.T) {
+	hw, _ := net.ParseMAC("06:07:08:09:0a:0b")
+	if _, err := newIGMPQuery(hw, net.ParseIP("fe80::1")); err == nil {
+		t.Errorf("newIGMPQuery() accepted IPv6 source")
+	}
+	if _, err := newIGMPQuery(nil, net.ParseIP("10.0.0.1")); err == nil {
+		t.Errorf("newIGMPQuery() accepted nil hardware address")
+	}
+	frame, err := newIGMPQuery(hw, net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatalf("newIGMPQuery() error = %v", err)
+	}
+	packet := ipv4Payload(frame)
+	if packet == nil {
+		t.Fatalf("newIGMPQuery() returned malformed frame")
+	}
+	size := int(packet[0]&0x0f) * 4
+	if ipv4Checksum(packet[:size]) != 0 || ipv4Checksum(packet[size:]) != 0 {
+		t.Errorf("newIGMPQuery() returned wrong checksum")
+	}
+	if packet[size] != igmpMembershipQuery || !net.IP(packet[16:20]).Equal(igmpAllSystems) {
+		t.Errorf("newIGMPQuery() returned wrong query")
+	}
+	if joined, left := parseIGMP(frame); joined != nil || left != nil {
+		t.Errorf("parseIGMP() of query = %v %v", joined, left)
+	}
+}
+
+func TestParseIGMP(t *testing.T) {
+	src, _ := net.ParseMAC("06:07:08:09:0a:0b")
+	group := net.ParseIP("239.1.2.3")
+	all := net.ParseIP("224.0.0.1")
+	reports := net.ParseIP("224.0.0.22")
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantJoined int
+		wantLeft   int
+	}{
+		{"nil data", nil, 0, 0},
+		{"not igmp", buildIPv4Frame(src, group, 17, make([]byte, 8)), 0, 0},
+		{"short igmp", buildIPv4Frame(src, group, ipv4ProtocolIGMP, make([]byte, 4)), 0, 0},
+		{"v2 report", buildIPv4Frame(src, group, ipv4ProtocolIGMP, buildIGMP(igmpV2MembershipReport, group)), 1, 0},
+		{"v2 leave", buildIPv4Frame(src, all, ipv4ProtocolIGMP, buildIGMP(igmpV2LeaveGroup, group)), 0, 1},
+		{"v3 exclude", buildIPv4Frame(src, reports, ipv4ProtocolIGMP, buildIGMPv3(4, group, 0)), 1, 0},
+		{"v3 include sources", buildIPv4Frame(src, reports, ipv4ProtocolIGMP, buildIGMPv3(3, group, 2)), 1, 0},
+		{"v3 include empty", buildIPv4Frame(src, reports, ipv4ProtocolIGMP, buildIGMPv3(3, group, 0)), 0, 1},
+		{"v3 truncated record", buildIPv4Frame(src, reports, ipv4ProtocolIGMP, buildIGMPv3(4, group, 2)[:18]), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			joined, left := parseIGMP(tt.data)
+			if len(joined) != tt.wantJoined || len(left) != tt.wantLeft {
+				t.Errorf("parseIGMP() = %v %v, want %d joined %d left", joined, left, tt.wantJoined, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestSnoopedFrame(t *testing.T) {
+	src, _ := net.ParseMAC("06:07:08:09:0a:0b")
+	group := net.ParseIP("239.1.2.3")
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"nil data", nil, false},
+		{"link-local group", buildIPv4Frame(src, net.ParseIP("224.0.0.251"), 17, nil), false},
+		{"igmp report", buildIPv4Frame(src, group, ipv4ProtocolIGMP, buildIGMP(igmpV2MembershipReport, group)), false},
+		{"routable group", buildIPv4Frame(src, group, 17, nil), true},
+		{"ipv6 group", append([]byte{0x33, 0x33, 0, 0, 0, 0x16, 6, 7, 8, 9, 10, 11, 0x86, 0xdd}, make([]byte, 40)...), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snoopedFrame(tt.data); got != tt.want {
+				t.Errorf("snoopedFrame() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_snoopIGMP(t *testing.T) {
+	peerHW, _ := net.ParseMAC("00:11:22:33:44:55")
+	unknownHW, _ := net.ParseMAC("00:11:22:33:44:66")
+	group := net.ParseIP("239.1.2.3")
+	groupHW := multicastGroupHW(group).String()
+
+	peerEP := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6000}
+	otherEP := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6000}
+	swarm := new(Swarm)
+	swarm.Init()
+	swarm.Update("1", &NetworkPeer{ID: "1", PeerHW: peerHW, Endpoint: peerEP})
+	swarm.Update("2", &NetworkPeer{ID: "2", Endpoint: otherEP})
+	p := &PeerToPeer{Swarm: swarm}
+	snoop := func(frame []byte, src *net.UDPAddr) {
+		p.snoopIGMP(p.framePeer(&P2PMessage{Data: frame}, src), frame)
+	}
+
+	defer func(enabled bool) { UseIGMPSnooping = enabled }(UseIGMPSnooping)
+	report := buildIPv4Frame(peerHW, group, ipv4ProtocolIGMP, buildIGMP(igmpV2MembershipReport, group))
+
+	UseIGMPSnooping = false
+	snoop(report, peerEP)
+	if len(p.igmp.members(groupHW, time.Now())) != 0 {
+		t.Fatalf("PeerToPeer.snoopIGMP() snooped while disabled")
+	}
+
+	UseIGMPSnooping = true
+	snoop(buildIPv4Frame(unknownHW, group, ipv4ProtocolIGMP, buildIGMP(igmpV2MembershipReport, group)), &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 6000})
+	if len(p.igmp.members(groupHW, time.Now())) != 0 {
+		t.Fatalf("PeerToPeer.snoopIGMP() added unknown peer")
+	}
+	// Peer 2 sends a report with MAC address of peer 1
+	snoop(report, otherEP)
+	if members := p.igmp.members(groupHW, time.Now()); members["1"] || !members["2"] {
+		t.Fatalf("PeerToPeer.snoopIGMP() trusted spoofed source MAC: %v", members)
+	}
+	snoop(report, peerEP)
+	if !p.igmp.members(groupHW, time.Now())["1"] {
+		t.Fatalf("PeerToPeer.snoopIGMP() didn't add member")
+	}
+	leave := buildIPv4Frame(peerHW, net.ParseIP("224.0.0.2"), ipv4ProtocolIGMP, buildIGMP(igmpV2LeaveGroup, group))
+	snoop(leave, otherEP)
+	if !p.igmp.members(groupHW, time.Now())["1"] {
+		t.Fatalf("PeerToPeer.snoopIGMP() let another peer leave group on behalf of member")
+	}
+	snoop(leave, peerEP)
+	if p.igmp.members(groupHW, time.Now())["1"] {
+		t.Errorf("PeerToPeer.snoopIGMP() didn't remove member")
+	}
+}
+
+func TestPeerToPeer_floodFrame(t *testing.T) {
+	src, _ := net.ParseMAC("06:07:08:09:0a:0b")
+	socket := new(Network)
+	socket.Init("127.0.0.1", 1234)
+	swarm := new(Swarm)
+	swarm.Init()
+
+	tests := []struct {
+		name    string
+		p       *PeerToPeer
+		data    []byte
+		wantErr bool
+	}{
+		{"nil swarm", &PeerToPeer{UDPSocket: socket}, buildIPv4Frame(src, net.ParseIP("224.0.0.251"), 17, nil), true},
+		{"nil socket", &PeerToPeer{Swarm: swarm}, buildIPv4Frame(src, net.ParseIP("224.0.0.251"), 17, nil), true},
+		{"short frame", &PeerToPeer{Swarm: swarm, UDPSocket: socket}, []byte{0x01}, true},
+		{"passing", &PeerToPeer{Swarm: swarm, UDPSocket: socket}, buildIPv4Frame(src, net.ParseIP("224.0.0.251"), 17, nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.floodFrame(tt.data, int(PacketIPv4)); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.floodFrame() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
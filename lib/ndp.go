@@ -0,0 +1,194 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// Neighbor Discovery Protocol (RFC 4861) support.
+// Neighbor solicitations for addresses known to this swarm are answered
+// locally with advertisements on behalf of the peer, the same way ARP
+// requests are answered. Solicitations for unknown addresses are sent to
+// every connected peer, so link-local and duplicate address detection
+// keep working across the swarm. Other multicast frames are flooded as is
+
+// IPv6 and ICMPv6 constants used by NDP
+const (
+	ipv6HeaderSize          int   = 40
+	ipv6NextHeaderICMP      uint8 = 58
+	ndpHopLimit             uint8 = 255
+	icmpv6NeighborSolicit   uint8 = 135
+	icmpv6NeighborAdvertise uint8 = 136
+	ndpOptionSourceLinkAddr uint8 = 1
+	ndpOptionTargetLinkAddr uint8 = 2
+	ndpFlagSolicited        uint8 = 0x40
+	ndpFlagOverride         uint8 = 0x20
+)
+
+var (
+	errInvalidIPv6Packet  = errors.New("invalid IPv6 packet")
+	errNotNeighborSolicit = errors.New("not a neighbor solicitation")
+)
+
+// NeighborSolicitation represents an ICMPv6 neighbor solicitation
+type NeighborSolicitation struct {
+	// Source is an IPv6 address of the soliciting node. Unspecified
+	// address means duplicate address detection
+	Source net.IP
+
+	// Destination is an IPv6 destination of the packet. Usually it's a
+	// solicited-node multicast address of the target
+	Destination net.IP
+
+	// Target is an IPv6 address being resolved
+	Target net.IP
+
+	// SourceHardwareAddr is a link-layer address of the soliciting node
+	// if it was provided in options
+	SourceHardwareAddr net.HardwareAddr
+}
+
+// UnmarshalNDP extracts neighbor solicitation from IPv6 packet
+func (n *NeighborSolicitation) UnmarshalNDP(b []byte) error {
+	if len(b) < ipv6HeaderSize {
+		return errInvalidIPv6Packet
+	}
+	if b[0]>>4 != 6 {
+		return errInvalidIPv6Packet
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if len(b) < ipv6HeaderSize+length {
+		return errInvalidIPv6Packet
+	}
+	if b[6] != ipv6NextHeaderICMP {
+		return errNotNeighborSolicit
+	}
+	icmp := b[ipv6HeaderSize : ipv6HeaderSize+length]
+	// type[1] code[1] checksum[2] reserved[4] target[16]
+	if len(icmp) < 24 || icmp[0] != icmpv6NeighborSolicit || icmp[1] != 0 {
+		return errNotNeighborSolicit
+	}
+	n.Source = net.IP(b[8:24])
+	n.Destination = net.IP(b[24:40])
+	n.Target = net.IP(icmp[8:24])
+	n.SourceHardwareAddr = nil
+
+	options := icmp[24:]
+	for len(options) >= 8 {
+		size := int(options[1]) * 8
+		if size == 0 || size > len(options) {
+			break
+		}
+		if options[0] == ndpOptionSourceLinkAddr {
+			n.SourceHardwareAddr = net.HardwareAddr(options[2:8])
+		}
+		options = options[size:]
+	}
+	return nil
+}
+
+// NewNeighborAdvertisement creates IPv6 packet with solicited neighbor
+// advertisement telling that target is reachable over targetHW
+func NewNeighborAdvertisement(target net.IP, targetHW net.HardwareAddr, dst net.IP) ([]byte, error) {
+	target = target.To16()
+	dst = dst.To16()
+	if target == nil || target.To4() != nil || dst == nil || dst.To4() != nil {
+		return nil, errInvalidIPv6Packet
+	}
+	if len(targetHW) != 6 {
+		return nil, ErrInvalidHardwareAddr
+	}
+
+	// type[1] code[1] checksum[2] flags[1] reserved[3] target[16] option[8]
+	icmp := make([]byte, 32)
+	icmp[0] = icmpv6NeighborAdvertise
+	icmp[4] = ndpFlagSolicited | ndpFlagOverride
+	copy(icmp[8:24], target)
+	icmp[24] = ndpOptionTargetLinkAddr
+	icmp[25] = 1
+	copy(icmp[26:32], targetHW)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(target, dst, icmp))
+
+	packet := make([]byte, ipv6HeaderSize+len(icmp))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(icmp)))
+	packet[6] = ipv6NextHeaderICMP
+	packet[7] = ndpHopLimit
+	copy(packet[8:24], target)
+	copy(packet[24:40], dst)
+	copy(packet[40:], icmp)
+	return packet, nil
+}
+
+// icmpv6Checksum calculates ICMPv6 checksum including IPv6 pseudo-header
+func icmpv6Checksum(src, dst net.IP, payload []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.To16())
+	add(dst.To16())
+	pseudo := make([]byte, 8)
+	binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(payload)))
+	pseudo[7] = ipv6NextHeaderICMP
+	add(pseudo)
+	add(payload)
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// handleNDP answers neighbor solicitation captured on the interface if
+// target belongs to one of the peers, or floods the frame across the swarm
+func (p *PeerToPeer) handleNDP(f *ethernet.Frame, contents []byte, proto int) error {
+	if p.Swarm == nil {
+		return fmt.Errorf("nil peer list")
+	}
+	ns := new(NeighborSolicitation)
+	if err := ns.UnmarshalNDP(f.Payload); err != nil {
+		if err == errNotNeighborSolicit {
+			return p.floodFrame(contents, proto)
+		}
+		return fmt.Errorf("failed to unmarshal neighbor solicitation: %s", err)
+	}
+	if ns.Source.IsUnspecified() {
+		// Duplicate address detection must reach all nodes
+		return p.floodFrame(contents, proto)
+	}
+
+	id, err := p.Swarm.GetID(ns.Target.String())
+	if err != nil {
+		LogWith(Trace, p.logFields(SubsystemPacket), "Unknown IPv6 requested: %s", ns.Target.String())
+		return p.floodFrame(contents, proto)
+	}
+	peer := p.Swarm.GetPeer(id)
+	if peer == nil || peer.PeerHW == nil {
+		return p.floodFrame(contents, proto)
+	}
+
+	na, err := NewNeighborAdvertisement(ns.Target, peer.PeerHW, ns.Source)
+	if err != nil {
+		return fmt.Errorf("failed to create neighbor advertisement: %s", err)
+	}
+	fr := &ethernet.Frame{
+		Destination: f.Source,
+		Source:      peer.PeerHW,
+		EtherType:   ethernet.EtherTypeIPv6,
+		Payload:     na,
+	}
+	fb, err := fr.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to marshal NDP ethernet frame: %s", err)
+	}
+	return p.WriteToDevice(fb, uint16(proto), false)
+}
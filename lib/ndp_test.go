@@ -0,0 +1,181 @@
+package ptp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// buildNeighborSolicitation returns IPv6 packet with neighbor solicitation
+func buildNeighborSolicitation(src, dst, target net.IP, hw net.HardwareAddr) []byte {
+	icmp := make([]byte, 24)
+	icmp[0] = icmpv6NeighborSolicit
+	copy(icmp[8:24], target.To16())
+	if hw != nil {
+		icmp = append(icmp, ndpOptionSourceLinkAddr, 1)
+		icmp = append(icmp, hw...)
+	}
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(src, dst, icmp))
+
+	packet := make([]byte, ipv6HeaderSize)
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(icmp)))
+	packet[6] = ipv6NextHeaderICMP
+	packet[7] = ndpHopLimit
+	copy(packet[8:24], src.To16())
+	copy(packet[24:40], dst.To16())
+	return append(packet, icmp...)
+}
+
+func TestNeighborSolicitation_UnmarshalNDP(t *testing.T) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("ff02::1:ff00:2")
+	target := net.ParseIP("fd00::2")
+	hw, _ := net.ParseMAC("06:07:08:09:0a:0b")
+
+	ns := buildNeighborSolicitation(src, dst, target, hw)
+	nsNoOpt := buildNeighborSolicitation(src, dst, target, nil)
+	truncated := ns[:len(ns)-10]
+	wrongVersion := append([]byte{}, ns...)
+	wrongVersion[0] = 4 << 4
+	notICMP := append([]byte{}, ns...)
+	notICMP[6] = 17
+	notNS := append([]byte{}, ns...)
+	notNS[ipv6HeaderSize] = icmpv6NeighborAdvertise
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+		wantHW  net.HardwareAddr
+	}{
+		{"nil data", nil, errInvalidIPv6Packet, nil},
+		{"truncated", truncated, errInvalidIPv6Packet, nil},
+		{"wrong version", wrongVersion, errInvalidIPv6Packet, nil},
+		{"not icmp", notICMP, errNotNeighborSolicit, nil},
+		{"not solicitation", notNS, errNotNeighborSolicit, nil},
+		{"without options", nsNoOpt, nil, nil},
+		{"with source address", ns, nil, hw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := new(NeighborSolicitation)
+			err := n.UnmarshalNDP(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("NeighborSolicitation.UnmarshalNDP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !n.Source.Equal(src) || !n.Destination.Equal(dst) || !n.Target.Equal(target) {
+				t.Errorf("NeighborSolicitation.UnmarshalNDP() = %s %s %s", n.Source, n.Destination, n.Target)
+			}
+			if !bytes.Equal(n.SourceHardwareAddr, tt.wantHW) {
+				t.Errorf("NeighborSolicitation.UnmarshalNDP() hw = %s, want %s", n.SourceHardwareAddr, tt.wantHW)
+			}
+		})
+	}
+}
+
+func TestNewNeighborAdvertisement(t *testing.T) {
+	target := net.ParseIP("fd00::2")
+	dst := net.ParseIP("fd00::1")
+	hw, _ := net.ParseMAC("06:07:08:09:0a:0b")
+
+	tests := []struct {
+		name    string
+		target  net.IP
+		hw      net.HardwareAddr
+		dst     net.IP
+		wantErr bool
+	}{
+		{"nil target", nil, hw, dst, true},
+		{"ipv4 target", net.ParseIP("10.10.10.1"), hw, dst, true},
+		{"nil destination", target, hw, nil, true},
+		{"bad hardware address", target, net.HardwareAddr{0x01}, dst, true},
+		{"passing", target, hw, dst, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewNeighborAdvertisement(tt.target, tt.hw, tt.dst)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewNeighborAdvertisement() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(got) != ipv6HeaderSize+32 {
+				t.Fatalf("NewNeighborAdvertisement() length = %d", len(got))
+			}
+			if got[7] != ndpHopLimit || !net.IP(got[8:24]).Equal(tt.target) || !net.IP(got[24:40]).Equal(tt.dst) {
+				t.Errorf("NewNeighborAdvertisement() produced wrong IPv6 header")
+			}
+			icmp := got[ipv6HeaderSize:]
+			if icmp[0] != icmpv6NeighborAdvertise || icmp[4] != ndpFlagSolicited|ndpFlagOverride {
+				t.Errorf("NewNeighborAdvertisement() produced wrong ICMPv6 header")
+			}
+			if !net.IP(icmp[8:24]).Equal(tt.target) || !bytes.Equal(icmp[26:32], tt.hw) {
+				t.Errorf("NewNeighborAdvertisement() produced wrong target")
+			}
+			// Checksum over message with checksum field set must be zero
+			if sum := icmpv6Checksum(tt.target, tt.dst, icmp); sum != 0 {
+				t.Errorf("NewNeighborAdvertisement() wrong checksum: %x", sum)
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_handleNDP(t *testing.T) {
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("ff02::1:ff00:2")
+	known := net.ParseIP("fd00::2")
+	unknown := net.ParseIP("fd00::3")
+	srcHW, _ := net.ParseMAC("06:07:08:09:0a:0b")
+	peerHW, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	swarm := new(Swarm)
+	swarm.Init()
+	swarm.Update("1", &NetworkPeer{ID: "1", PeerHW: peerHW, PeerLocalIPv6: known})
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 1234)
+
+	frame := func(payload []byte) *ethernet.Frame {
+		return &ethernet.Frame{
+			Destination: net.HardwareAddr{0x33, 0x33, 0xff, 0x00, 0x00, 0x02},
+			Source:      srcHW,
+			EtherType:   ethernet.EtherTypeIPv6,
+			Payload:     payload,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		swarm   *Swarm
+		frame   *ethernet.Frame
+		wantErr bool
+	}{
+		{"nil swarm", nil, frame(nil), true},
+		{"malformed packet", swarm, frame([]byte{0x60}), true},
+		{"wrong IP version", swarm, frame(make([]byte, ipv6HeaderSize)), true},
+		{"duplicate address detection", swarm, frame(buildNeighborSolicitation(net.IPv6unspecified, dst, known, nil)), false},
+		{"unknown target", swarm, frame(buildNeighborSolicitation(src, dst, unknown, srcHW)), false},
+		// Known target is answered through interface, which is missing here
+		{"known target", swarm, frame(buildNeighborSolicitation(src, dst, known, srcHW)), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PeerToPeer{
+				Swarm:     tt.swarm,
+				UDPSocket: socket,
+			}
+			contents, _ := tt.frame.MarshalBinary()
+			if err := p.handleNDP(tt.frame, contents, int(PacketIPv6)); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.handleNDP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -21,6 +21,8 @@ type P2PMessageHeader struct {
 type P2PMessage struct {
 	Header *P2PMessageHeader
 	Data   []byte
+	origin string // ID of a peer which sent this message over relay
+	invite string // ID of invite which key has decrypted this message
 }
 
 // Serialize does a header serialization
@@ -87,9 +89,9 @@ func (p *PeerToPeer) CreateMessage(msgType MsgType, payload []byte, proto uint16
 	msg.Header.Type = uint16(msgType)
 	msg.Header.NetProto = proto
 	msg.Header.Length = uint16(len(payload))
-	if p.Crypter.Active && encrypt {
+	if p.Crypter.IsActive() && encrypt {
 		var err error
-		msg.Data, err = p.Crypter.encrypt(p.Crypter.ActiveKey.Key, payload)
+		msg.Data, err = p.Crypter.encrypt(p.Crypter.GetActiveKey().Key, payload)
 		if err != nil {
 			return nil, err
 		}
@@ -99,6 +101,74 @@ func (p *PeerToPeer) CreateMessage(msgType MsgType, payload []byte, proto uint16
 	return msg, nil
 }
 
+// createMessageWith creates a message encrypted with specified key. Message
+// is not encrypted when encryption is disabled
+func (p *PeerToPeer) createMessageWith(key []byte, msgType MsgType, payload []byte) (*P2PMessage, error) {
+	msg, err := p.CreateMessage(msgType, payload, 0, false)
+	if err != nil || !p.Crypter.IsActive() {
+		return msg, err
+	}
+	msg.Data, err = p.Crypter.encrypt(key, payload)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// createMessageFor creates an encrypted message to peer with specified ID
+func (p *PeerToPeer) createMessageFor(id string, msgType MsgType, payload []byte) (*P2PMessage, error) {
+	return p.createMessageWith(p.peerKey(id), msgType, payload)
+}
+
+// createReply creates an encrypted response to received message
+func (p *PeerToPeer) createReply(request *P2PMessage, msgType MsgType, payload []byte) (*P2PMessage, error) {
+	return p.createMessageWith(p.replyKey(request), msgType, payload)
+}
+
+// CreateFrameMessage creates a message that carries ethernet frame to the peer
+// with specified hardware address. If session keys were derived during
+// introduction, frame is sealed with AES-GCM. Otherwise it falls back to
+// a regular MsgTypeNenc message
+func (p *PeerToPeer) CreateFrameMessage(dst net.HardwareAddr, frame []byte, proto uint16) (*P2PMessage, error) {
+	if !p.Crypter.IsActive() || p.Swarm == nil || dst == nil {
+		return p.CreateMessage(MsgTypeNenc, frame, proto, true)
+	}
+	peer := p.Swarm.GetPeerByMAC(dst.String())
+	if peer == nil {
+		return p.CreateMessage(MsgTypeNenc, frame, proto, true)
+	}
+	key, _ := peer.session.keys()
+	if key == nil {
+		if peer.session.isRequired() {
+			// Peer which supports key exchange never receives frames
+			// encrypted with the shared key
+			return nil, fmt.Errorf("session keys with %s are not established", peer.ID)
+		}
+		return p.CreateMessage(MsgTypeNenc, frame, proto, true)
+	}
+	msg := new(P2PMessage)
+	msg.Header = new(P2PMessageHeader)
+	msg.Header.Magic = MagicCookie
+	msg.Header.Type = uint16(MsgTypeSealed)
+	msg.Header.NetProto = proto
+	msg.Header.Length = uint16(len(frame))
+	var err error
+	msg.Data, err = p.Crypter.seal(key, frame, msg.Header.sealedData())
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// sealedData returns header fields that are authenticated
+// along with the sealed payload
+func (v *P2PMessageHeader) sealedData() []byte {
+	ad := make([]byte, 4)
+	binary.BigEndian.PutUint16(ad[0:2], v.Type)
+	binary.BigEndian.PutUint16(ad[2:4], v.NetProto)
+	return ad
+}
+
 // CreateMessageStatic is a static method for a P2P Message
 func CreateMessageStatic(msgType MsgType, payload []byte) (*P2PMessage, error) {
 	p := PeerToPeer{}
@@ -107,6 +177,10 @@ func CreateMessageStatic(msgType MsgType, payload []byte) (*P2PMessage, error) {
 
 ///////////////////////////////////////////////////////////////////////////////////////////
 
+// networkBufferSize is a size of buffer for received datagrams. Larger
+// datagrams are truncated
+const networkBufferSize = 4096
+
 // Network is a network subsystem
 type Network struct {
 	host       string
@@ -114,8 +188,9 @@ type Network struct {
 	remotePort int
 	addr       *net.UDPAddr
 	conn       *net.UDPConn
-	inBuffer   [4096]byte
+	inBuffer   [networkBufferSize]byte
 	disposed   bool
+	ipv6       bool // Whether socket accepts IPv6 traffic
 }
 
 // Close will terminate packet reader
@@ -150,18 +225,39 @@ func (uc *Network) Init(host string, port int) error {
 	uc.disposed = true
 
 	//todo check if we need Host and Port
-	uc.addr, err = net.ResolveUDPAddr("udp4", fmt.Sprintf(":%d", port))
+	uc.addr, err = net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return err
 	}
-	uc.conn, err = net.ListenUDP("udp4", uc.addr)
+	// Socket is bound to both address families when system supports IPv6
+	uc.conn, err = net.ListenUDP("udp", uc.addr)
 	if err != nil {
 		return err
 	}
+	local, ok := uc.conn.LocalAddr().(*net.UDPAddr)
+	uc.ipv6 = ok && local.IP.To4() == nil
 	uc.disposed = false
 	return nil
 }
 
+// IPv6 returns true if socket can be used to communicate
+// with IPv6 endpoints
+func (uc *Network) IPv6() bool {
+	return uc != nil && uc.ipv6
+}
+
+// isReachable returns false for IPv6 addresses when socket
+// is bound to IPv4 only
+func (uc *Network) isReachable(addr *net.UDPAddr) bool {
+	if addr == nil {
+		return false
+	}
+	if addr.IP.To4() != nil {
+		return true
+	}
+	return uc.IPv6()
+}
+
 // KeepAlive will send keep alive packet periodically to keep
 // UDP port bind
 func (uc *Network) KeepAlive(target string) error {
@@ -182,14 +278,14 @@ func (uc *Network) KeepAlive(target string) error {
 		return fmt.Errorf("Failed to retrieve keep alive address at index 0")
 	}
 
-	addr, err := net.ResolveUDPAddr("udp4", firstAddr)
+	addr, err := net.ResolveUDPAddr("udp", firstAddr)
 	if err != nil {
 		return fmt.Errorf("Failed to resolve UDP addr for keep alive session: %s", err.Error())
 	}
 
 	data := []byte{0x0D, 0x0A}
 	keepAlive := time.Now()
-	Log(Debug, "Started keep alive session with %s", addr)
+	LogWith(Debug, Fields{Subsystem: SubsystemPacket, Endpoint: addr.String()}, "Started keep alive session with %s", addr)
 	i := 0
 	for i < 20 {
 		uc.SendRawBytes(data, addr)
@@ -211,7 +307,10 @@ func (uc *Network) GetPort() int {
 	if uc.conn == nil {
 		return -1
 	}
-	addr, _ := net.ResolveUDPAddr("udp4", uc.conn.LocalAddr().String())
+	addr, ok := uc.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return -1
+	}
 	return addr.Port
 }
 
@@ -220,7 +319,7 @@ type UDPReceivedCallback func(count int, src_addr *net.UDPAddr, err error, buff
 
 // Listen is a main listener of a network traffic
 func (uc *Network) Listen(receivedCallback UDPReceivedCallback) error {
-	Log(Info, "Started UDP listener")
+	LogWith(Info, Fields{Subsystem: SubsystemPacket}, "Started UDP listener")
 	if uc.conn == nil {
 		return fmt.Errorf("Nil connection")
 	}
@@ -228,7 +327,7 @@ func (uc *Network) Listen(receivedCallback UDPReceivedCallback) error {
 		n, src, err := uc.conn.ReadFromUDP(uc.inBuffer[:])
 		receivedCallback(n, src, err, uc.inBuffer[:])
 	}
-	Log(Info, "Stopping UDP Listener")
+	LogWith(Info, Fields{Subsystem: SubsystemPacket}, "Stopping UDP Listener")
 	return nil
 }
 
@@ -553,3 +553,29 @@ func TestNetwork_Stop(t *testing.T) {
 		})
 	}
 }
+
+func TestNetwork_isReachable(t *testing.T) {
+	v4, _ := net.ResolveUDPAddr("udp", "192.168.0.1:1234")
+	v6, _ := net.ResolveUDPAddr("udp", "[2001:db8::1]:1234")
+
+	tests := []struct {
+		name string
+		uc   *Network
+		addr *net.UDPAddr
+		want bool
+	}{
+		{"nil addr", &Network{}, nil, false},
+		{"nil network ipv4", nil, v4, true},
+		{"nil network ipv6", nil, v6, false},
+		{"ipv4 only", &Network{}, v6, false},
+		{"dual stack ipv4", &Network{ipv6: true}, v4, true},
+		{"dual stack ipv6", &Network{ipv6: true}, v6, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.uc.isReachable(tt.addr); got != tt.want {
+				t.Errorf("Network.isReachable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
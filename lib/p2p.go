@@ -33,8 +33,24 @@ type PeerToPeer struct {
 	ProxyManager    *ProxyManager                        // Proxy manager
 	outboundIP      net.IP                               // Outbound IP
 	UsePMTU         bool                                 // Whether PMTU capabilities are enabled or not
+	Identity        *Identity                            // Long-term key pair used for key exchange with peers
 	StartedAt       time.Time                            // Timestamp of instance creation time
 	ConfiguredAt    time.Time                            // Time when configuration of the instance was finished
+	Trunk           *PeerToPeer                          // Instance which interface carries traffic of this instance
+	VLAN            uint16                               // VLAN ID of this instance on trunk interface
+	vlans           map[uint16]*PeerToPeer               // Instances attached to VLANs of this instance interface
+	vlanLock        sync.RWMutex                         // Mutex for VLAN table and trunk
+	multicast       multicastLimiter                     // Rate limiter for broadcast and multicast groups
+	igmp            igmpSnooper                          // Multicast group membership of peers
+	lastAdvertise   time.Time                            // Last time reachability was advertised to peers
+	lan             *lanDiscovery                        // Discovery of peers in local network
+	static          []StaticPeer                         // Peers with fixed endpoints
+	staticLock      sync.Mutex                           // Mutex for static peers
+	ACL             ACL                                  // Peers allowed and denied in the swarm
+	invites         inviteState                          // Invite of this instance and invites redeemed by peers
+	interfaceStatus InterfaceStatus                      // Interface status published last
+	hooks           hookRunner                           // Hooks executed on lifecycle events
+	Metrics         Metrics                              // Traffic and error counters
 }
 
 // PeerHandshake holds handshake information received from peer
@@ -43,7 +59,8 @@ type PeerHandshake struct {
 	IP           net.IP
 	HardwareAddr net.HardwareAddr
 	Endpoint     *net.UDPAddr
-	AutoIP       bool // Whether or not peer have automatic IP
+	AutoIP       bool   // Whether or not peer have automatic IP
+	KeyExchange  []byte // Key exchange payload. Empty if peer doesn't support key exchange
 }
 
 // ActiveInterfaces is a global (daemon-wise) list of reserved IP addresses
@@ -73,16 +90,16 @@ func (p *PeerToPeer) AssignInterface(interfaceName string) error {
 	// Extract necessary information from config file
 	// err = p.Config.Read()
 	// if err != nil {
-	// 	Log(Error, "Failed to extract information from config file: %v", err)
+	// 	LogWith(Error, p.logFields(SubsystemInstance), "Failed to extract information from config file: %v", err)
 	// 	return err
 	// }
 
 	err = p.Interface.Open()
 	if err != nil {
-		Log(Error, "Failed to open TAP device %s: %v", p.Interface.GetName(), err)
+		LogWith(Error, p.logFields(SubsystemInstance), "Failed to open TAP device %s: %v", p.Interface.GetName(), err)
 		return err
 	}
-	Log(Debug, "%v TAP Device created", p.Interface.GetName())
+	LogWith(Debug, p.logFields(SubsystemInstance), "%v TAP Device created", p.Interface.GetName())
 
 	lazy := false
 	if p.Interface.IsAuto() {
@@ -94,8 +111,11 @@ func (p *PeerToPeer) AssignInterface(interfaceName string) error {
 		return err
 	}
 	ActiveInterfaces = append(ActiveInterfaces, p.Interface.GetIP())
+	if p.Interface.GetIPv6() != nil {
+		ActiveInterfaces = append(ActiveInterfaces, p.Interface.GetIPv6())
+	}
 	if !p.Interface.IsAuto() {
-		Log(Debug, "Interface has been configured")
+		LogWith(Debug, p.logFields(SubsystemInstance), "Interface has been configured")
 		p.Interface.MarkConfigured()
 	}
 	return err
@@ -106,7 +126,7 @@ func (p *PeerToPeer) AssignInterface(interfaceName string) error {
 // This goroutine will execute a callback method based on packet type
 func (p *PeerToPeer) ListenInterface() error {
 	if p.Interface == nil {
-		Log(Error, "Failed to start TAP listener: nil object")
+		LogWith(Error, p.logFields(SubsystemInstance), "Failed to start TAP listener: nil object")
 		return fmt.Errorf("nil interface")
 	}
 	p.Interface.Run()
@@ -119,8 +139,11 @@ func (p *PeerToPeer) ListenInterface() error {
 			continue
 		}
 		packet, err := p.Interface.ReadPacket()
+		if err != nil {
+			p.Metrics.tapReadError()
+		}
 		if err != nil && err != errPacketTooBig {
-			Log(Error, "Reading packet: %s", err)
+			LogWith(Error, p.logFields(SubsystemInstance), "Reading packet: %s", err)
 			p.Close()
 			break
 		}
@@ -128,7 +151,7 @@ func (p *PeerToPeer) ListenInterface() error {
 			go p.handlePacket(packet.Packet, packet.Protocol)
 		}
 	}
-	Log(Debug, "Shutting down interface listener")
+	LogWith(Debug, p.logFields(SubsystemInstance), "Shutting down interface listener")
 
 	if p.Interface != nil {
 		return p.Interface.Close()
@@ -163,15 +186,16 @@ func (p *PeerToPeer) IsIPv4(ip string) bool {
 // This function will return new PeerToPeer object which later
 // should be configured and started using Run() method
 func New(mac, hash, keyfile, key, ttl, target string, fwd bool, port int, outboundIP net.IP) *PeerToPeer {
-	Log(Debug, "Starting new P2P Instance: %s", hash)
-	Log(Debug, "Mac: %s", mac)
+	fields := Fields{Hash: hash, Subsystem: SubsystemInstance}
+	LogWith(Debug, fields, "Starting new P2P Instance: %s", hash)
+	LogWith(Debug, fields, "Mac: %s", mac)
 	p := new(PeerToPeer)
 	p.outboundIP = outboundIP
 	p.Init()
 	var err error
 	p.Interface, err = newTAP(GetConfigurationTool(), "127.0.0.1", "00:00:00:00:00:00", "", DefaultMTU, UsePMTU)
 	if err != nil {
-		Log(Error, "Failed to create TAP object: %s", err)
+		LogWith(Error, fields, "Failed to create TAP object: %s", err)
 		return nil
 	}
 	p.Interface.SetHardwareAddress(p.validateMac(mac))
@@ -182,24 +206,39 @@ func New(mac, hash, keyfile, key, ttl, target string, fwd bool, port int, outbou
 	}
 
 	if keyfile != "" {
-		p.Crypter.ReadKeysFromFile(keyfile)
+		err = p.Crypter.ReadKeysFromFile(keyfile, hash)
+		if err != nil {
+			LogWith(Error, fields, "Failed to load keys from %s: %s", keyfile, err)
+			return nil
+		}
 	}
 	if key != "" {
 		// Override key from file
 		if ttl == "" {
 			ttl = "default"
 		}
-		var newKey CryptoKey
-		newKey = p.Crypter.EnrichKeyValues(newKey, key, ttl)
-		p.Crypter.Keys = append(p.Crypter.Keys, newKey)
-		p.Crypter.ActiveKey = p.Crypter.Keys[0]
-		p.Crypter.Active = true
+		newKey, err := p.Crypter.EnrichKeyValues(CryptoKey{}, key, ttl)
+		if err != nil {
+			LogWith(Error, fields, "Failed to use provided key: %s", err)
+			return nil
+		}
+		p.Crypter.SetActiveKey(newKey)
 	}
 
-	if p.Crypter.Active {
-		Log(Debug, "Traffic encryption is enabled. Key valid until %s", p.Crypter.ActiveKey.Until.String())
+	if err := p.Crypter.initAEAD(); err != nil {
+		LogWith(Error, fields, "Failed to initialize authenticated encryption: %s", err)
+		return nil
+	}
+	p.Identity, err = NewIdentity()
+	if err != nil {
+		LogWith(Error, fields, "Failed to generate identity key: %s", err)
+		return nil
+	}
+
+	if p.Crypter.IsActive() {
+		LogWith(Debug, fields, "Traffic encryption is enabled. Key valid until %s", p.Crypter.GetActiveKey().Until.String())
 	} else {
-		Log(Debug, "No AES key were provided. Traffic encryption is disabled")
+		LogWith(Debug, fields, "No AES key were provided. Traffic encryption is disabled")
 	}
 
 	p.Hash = hash
@@ -207,7 +246,15 @@ func New(mac, hash, keyfile, key, ttl, target string, fwd bool, port int, outbou
 	p.setupHandlers()
 
 	p.UDPSocket = new(Network)
-	p.UDPSocket.Init("", port)
+	err = p.UDPSocket.Init("", port)
+	if err != nil && port != 0 {
+		LogWith(Warning, fields, "Failed to listen on port %d: %s. Using random port", port, err)
+		err = p.UDPSocket.Init("", 0)
+	}
+	if err != nil {
+		LogWith(Error, fields, "Failed to start UDP listener: %s", err)
+		return nil
+	}
 	go p.UDPSocket.Listen(p.HandleP2PMessage)
 	go p.UDPSocket.KeepAlive(target)
 	p.waitForRemotePort()
@@ -217,18 +264,20 @@ func New(mac, hash, keyfile, key, ttl, target string, fwd bool, port int, outbou
 	// a introduction packet along with a hash to a DHT bootstrap
 	// nodes that was hardcoded into it's code
 
-	Log(Debug, "Started UDP Listener at port %d", p.UDPSocket.GetPort())
+	LogWith(Debug, fields, "Started UDP Listener at port %d", p.UDPSocket.GetPort())
 
 	p.Dht = new(DHTClient)
 	err = p.Dht.Init(p.Hash)
 	if err != nil {
-		Log(Error, "Failed to initialize DHT: %s", err)
+		LogWith(Error, fields, "Failed to initialize DHT: %s", err)
 		return nil
 	}
+	p.SetIdentity(p.Identity)
 
 	p.setupTCPCallbacks()
 	p.ProxyManager = new(ProxyManager)
 	p.ProxyManager.init()
+	p.ProxyManager.hash = p.Hash
 	return p
 }
 
@@ -245,12 +294,12 @@ func (p *PeerToPeer) ReadDHT() error {
 		go func() {
 			cb, e := p.Dht.TCPCallbacks[packet.Type]
 			if !e {
-				Log(Error, "Unsupported packet from DHT")
+				LogWith(Error, p.logFields(SubsystemInstance), "Unsupported packet from DHT")
 				return
 			}
 			err = cb(packet)
 			if err != nil {
-				Log(Error, "DHT: %s", err)
+				LogWith(Error, p.logFields(SubsystemInstance), "DHT: %s", err)
 			}
 		}()
 	}
@@ -271,28 +320,45 @@ func (p *PeerToPeer) waitForRemotePort() error {
 		}
 	}
 	if p.UDPSocket != nil && p.UDPSocket.remotePort == 0 {
-		Log(Warning, "Didn't receive remote port")
+		LogWith(Warning, p.logFields(SubsystemInstance), "Didn't receive remote port")
 		p.UDPSocket.remotePort = p.UDPSocket.GetPort()
 		return fmt.Errorf("Didn't receive remote port")
 	}
-	Log(Warning, "Remote port received: %d", p.UDPSocket.remotePort)
+	LogWith(Warning, p.logFields(SubsystemInstance), "Remote port received: %d", p.UDPSocket.remotePort)
 	return nil
 }
 
-// PrepareInterfaces will assign IPs to interfaces
+// logFields returns context of log records of the instance
+func (p *PeerToPeer) logFields(subsystem string) Fields {
+	if p == nil {
+		return Fields{Subsystem: subsystem}
+	}
+	return Fields{Hash: p.Hash, Subsystem: subsystem}
+}
+
+// PrepareInterfaces will assign IPs to interfaces and run up hook
 func (p *PeerToPeer) PrepareInterfaces(ip, interfaceName string) error {
+	err := p.prepareInterfaces(ip, interfaceName)
+	if err != nil {
+		return err
+	}
+	p.runHook(HookUp, nil)
+	return nil
+}
+
+func (p *PeerToPeer) prepareInterfaces(ip, interfaceName string) error {
 	if p.Interface == nil {
 		return fmt.Errorf("PrepareInterfaces: nil interface")
 	}
 
 	iface, err := p.validateInterfaceName(interfaceName)
 	if err != nil {
-		Log(Error, "Interface name validation failed: %s", err)
+		LogWith(Error, p.logFields(SubsystemInstance), "Interface name validation failed: %s", err)
 		return fmt.Errorf("Failed to validate interface name: %s", err)
 
 	}
 	if isDeviceExists(iface) {
-		Log(Error, "Interface is already in use. Can't create duplicate")
+		LogWith(Error, p.logFields(SubsystemInstance), "Interface is already in use. Can't create duplicate")
 		return fmt.Errorf("Interface is already in use")
 	}
 
@@ -328,7 +394,7 @@ func (p *PeerToPeer) PrepareInterfaces(ip, interfaceName string) error {
 }
 
 func (p *PeerToPeer) attemptPortForward(port uint16, name string) error {
-	Log(Debug, "Trying to forward port %d", port)
+	LogWith(Debug, p.logFields(SubsystemInstance), "Trying to forward port %d", port)
 	d, err := upnp.Discover()
 	if err != nil {
 		return err
@@ -337,7 +403,7 @@ func (p *PeerToPeer) attemptPortForward(port uint16, name string) error {
 	if err != nil {
 		return err
 	}
-	Log(Debug, "Port %d has been forwarded", port)
+	LogWith(Debug, p.logFields(SubsystemInstance), "Port %d has been forwarded", port)
 	return nil
 }
 
@@ -354,13 +420,13 @@ func (p *PeerToPeer) validateMac(mac string) net.HardwareAddr {
 	if mac != "" {
 		hw, err = net.ParseMAC(mac)
 		if err != nil {
-			Log(Error, "Invalid MAC address provided: %v", err)
+			LogWith(Error, p.logFields(SubsystemInstance), "Invalid MAC address provided: %v", err)
 			return nil
 		}
 		return hw
 	}
 	mac, hw = GenerateMAC()
-	Log(Debug, "Generate MAC for TAP device: %s", mac)
+	LogWith(Debug, p.logFields(SubsystemInstance), "Generate MAC for TAP device: %s", mac)
 	return hw
 }
 
@@ -369,7 +435,7 @@ func (p *PeerToPeer) validateInterfaceName(name string) (string, error) {
 		name = p.GenerateDeviceName(1)
 	} else {
 		if len(name) > MaximumInterfaceNameLength {
-			Log(Debug, "Interface name length should be %d symbols max", MaximumInterfaceNameLength)
+			LogWith(Debug, p.logFields(SubsystemInstance), "Interface name length should be %d symbols max", MaximumInterfaceNameLength)
 			return "", fmt.Errorf("Interface name is too big")
 		}
 	}
@@ -387,6 +453,9 @@ func (p *PeerToPeer) setupHandlers() error {
 	p.MessageHandlers[MsgTypeProxy] = p.HandleProxyMessage
 	p.MessageHandlers[MsgTypeLatency] = p.HandleLatency
 	p.MessageHandlers[MsgTypeComm] = p.HandleComm
+	p.MessageHandlers[MsgTypeSealed] = p.HandleSealedMessage
+	p.MessageHandlers[MsgTypeRelay] = p.HandleRelayMessage
+	p.MessageHandlers[MsgTypeInvite] = p.HandleInviteMessage
 
 	// Register packet handlers
 	p.PacketHandlers = make(map[PacketType]PacketHandlerCallback)
@@ -409,7 +478,7 @@ func (p *PeerToPeer) RequestIP(mac, device string) (net.IP, net.IPMask, error) {
 		return nil, nil, fmt.Errorf("RequestIP: nil dht")
 	}
 
-	Log(Debug, "Requesting IP from Bootstrap node")
+	LogWith(Debug, p.logFields(SubsystemInstance), "Requesting IP from Bootstrap node")
 	requestedAt := time.Now()
 	interval := time.Duration(2 * time.Second)
 	attempt := 0
@@ -419,7 +488,7 @@ func (p *PeerToPeer) RequestIP(mac, device string) (net.IP, net.IPMask, error) {
 			if attempt >= 3 {
 				return nil, nil, fmt.Errorf("No IP were received. Swarm is empty")
 			}
-			Log(Info, "IP wasn't received. Requesting again: attempt %d/3", (attempt + 1))
+			LogWith(Info, p.logFields(SubsystemInstance), "IP wasn't received. Requesting again: attempt %d/3", (attempt + 1))
 			attempt++
 			p.Dht.sendDHCP(nil, nil)
 			requestedAt = time.Now()
@@ -441,7 +510,7 @@ func (p *PeerToPeer) ReportIP(ipAddress, mac, device string) (net.IP, net.IPMask
 		return nil, nil, fmt.Errorf("nil dht")
 	}
 
-	Log(Debug, "Reporting IP to bootstranp node: %s", ipAddress)
+	LogWith(Debug, p.logFields(SubsystemInstance), "Reporting IP to bootstranp node: %s", ipAddress)
 	ip, ipnet, err := net.ParseCIDR(ipAddress)
 	if err != nil {
 		nip := net.ParseIP(ipAddress)
@@ -449,7 +518,7 @@ func (p *PeerToPeer) ReportIP(ipAddress, mac, device string) (net.IP, net.IPMask
 			return nil, nil, fmt.Errorf("Invalid address were provided for network interface. Use -ip \"dhcp\" or specify correct IP address")
 		}
 		ipAddress += `/24`
-		Log(Debug, "IP was not in CIDR format. Assumming /24")
+		LogWith(Debug, p.logFields(SubsystemInstance), "IP was not in CIDR format. Assumming /24")
 		ip, ipnet, err = net.ParseCIDR(ipAddress)
 		if err != nil {
 			return nil, nil, fmt.Errorf("Failed to configure interface with provided IP")
@@ -479,6 +548,7 @@ func (p *PeerToPeer) Run() error {
 	}
 	// Request proxies from DHT
 	p.Dht.sendProxy()
+	p.startLANDiscovery()
 
 	initialRequestSent := false
 	started := time.Now()
@@ -496,17 +566,37 @@ func (p *PeerToPeer) Run() error {
 		p.checkLastDHTUpdate()
 		p.checkProxies()
 		p.checkPeers()
+		p.checkStaticPeers()
+		p.checkKeys()
+		p.checkInvites()
+		p.requestAdmission()
+		p.checkInterfaceStatus()
+		p.advertiseReachability()
+		p.sendBeacon()
+		p.queryIGMP()
 		time.Sleep(100 * time.Millisecond)
 		if !initialRequestSent && time.Since(started) > time.Duration(time.Millisecond*5000) {
 			initialRequestSent = true
 			p.Dht.sendFind()
 		}
 		if p.Interface.IsBroken() {
-			Log(Info, "TAP interface is broken. Shutting down instance %s", p.Hash)
+			LogWith(Info, p.logFields(SubsystemInstance), "TAP interface is broken. Shutting down instance %s", p.Hash)
 			p.Close()
 		}
 	}
-	Log(Info, "Shutting down instance %s completed", p.Dht.NetworkHash)
+	LogWith(Info, p.logFields(SubsystemInstance), "Shutting down instance %s completed", p.Dht.NetworkHash)
+	return nil
+}
+
+// checkKeys will switch to the next key when active key expires
+func (p *PeerToPeer) checkKeys() error {
+	if !p.Crypter.IsActive() {
+		return nil
+	}
+	if p.Crypter.rotate(time.Now()) {
+		active := p.Crypter.GetActiveKey()
+		LogWith(Info, p.logFields(SubsystemInstance), "Active key has expired. Switched to key %s valid until %s", keyFingerprint(active.Key), active.Until.String())
+	}
 	return nil
 }
 
@@ -519,14 +609,14 @@ func (p *PeerToPeer) checkLastDHTUpdate() error {
 	}
 	passed := time.Since(p.Dht.LastUpdate)
 	if passed > time.Duration(30*time.Second) {
-		Log(Debug, "DHT Last Update timeout passed")
+		LogWith(Debug, p.logFields(SubsystemInstance), "DHT Last Update timeout passed")
 		// Request new proxies if we don't have any more
 		if len(p.ProxyManager.get()) == 0 {
 			p.Dht.sendProxy()
 		}
 		err := p.Dht.sendFind()
 		if err != nil {
-			Log(Error, "Failed to send update: %s", err)
+			LogWith(Error, p.logFields(SubsystemInstance), "Failed to send update: %s", err)
 			return fmt.Errorf("Failed to send DHT update: %s", err)
 		}
 	}
@@ -541,9 +631,9 @@ func (p *PeerToPeer) removeStoppedPeers() error {
 	peers := p.Swarm.Get()
 	for id, peer := range peers {
 		if peer.State == PeerStateStop {
-			Log(Info, "Removing peer %s", id)
+			LogWith(Info, p.logFields(SubsystemInstance), "Removing peer %s", id)
 			p.Swarm.Delete(id)
-			Log(Info, "Peer %s has been removed", id)
+			LogWith(Info, p.logFields(SubsystemInstance), "Peer %s has been removed", id)
 			break
 		}
 	}
@@ -599,7 +689,7 @@ func (p *PeerToPeer) checkPeers() error {
 			}
 		}
 		for _, e := range peer.EndpointsHeap {
-			if e == nil {
+			if e == nil || e.Relay != "" {
 				continue
 			}
 			e.Measure(p.UDPSocket, p.Dht.ID)
@@ -621,7 +711,7 @@ func (p *PeerToPeer) discoverIP() error {
 		return fmt.Errorf("nil dht")
 	}
 
-	Log(Info, "Discovering IP for this swarm")
+	LogWith(Info, p.logFields(SubsystemInstance), "Discovering IP for this swarm")
 
 	p.Interface.SetSubnet(nil)
 	p.Interface.SetIP(nil)
@@ -633,7 +723,7 @@ func (p *PeerToPeer) discoverIP() error {
 	msg, _ := p.CreateMessage(MsgTypeComm, payload, 0, true)
 	for _, peer := range p.Swarm.Get() {
 		if peer.State == PeerStateConnected && peer.Endpoint != nil {
-			p.UDPSocket.SendMessage(msg, peer.Endpoint)
+			p.sendToPeer(peer, msg)
 		}
 	}
 
@@ -648,7 +738,7 @@ func (p *PeerToPeer) discoverIP() error {
 	}
 
 	sn := p.Interface.GetSubnet()
-	Log(Info, "Received subnet for this swarm: %s", sn.String())
+	LogWith(Info, p.logFields(SubsystemInstance), "Received subnet for this swarm: %s", sn.String())
 
 	// Discover free IP
 	i := 255
@@ -668,14 +758,14 @@ func (p *PeerToPeer) discoverIP() error {
 					continue
 				}
 
-				p.UDPSocket.SendMessage(msg, peer.Endpoint)
+				p.sendToPeer(peer, msg)
 			}
 		}
 		time.Sleep(time.Millisecond * 100)
 	}
 
 	if p.Interface.GetIP() == nil {
-		Log(Error, "Couldn't find free IP for this swarm")
+		LogWith(Error, p.logFields(SubsystemInstance), "Couldn't find free IP for this swarm")
 		return fmt.Errorf("Failed to get free IP for this swarm")
 	}
 
@@ -692,21 +782,62 @@ func (p *PeerToPeer) notifyIP() error {
 	copy(payload[2:38], p.Dht.ID)
 	copy(payload[38:42], p.Interface.GetIP().To4())
 
-	msg, _ := p.CreateMessage(MsgTypeComm, payload, 0, true)
-
 	for _, peer := range p.Swarm.Get() {
 		if peer.Endpoint != nil {
-			p.UDPSocket.SendMessage(msg, peer.Endpoint)
+			msg, err := p.createMessageFor(peer.ID, MsgTypeComm, payload)
+			if err == nil {
+				p.sendToPeer(peer, msg)
+			}
 		}
 	}
 
 	return nil
 }
 
+// notifyIPv6 will send IPv6 address of this instance to endpoint of peer
+// with specified ID. Nothing is sent when interface has no IPv6 address
+func (p *PeerToPeer) notifyIPv6(id string, endpoint *net.UDPAddr) error {
+	if p.Dht == nil {
+		return fmt.Errorf("nil dht")
+	}
+	if p.Interface == nil {
+		return fmt.Errorf("nil interface")
+	}
+	if p.UDPSocket == nil {
+		return fmt.Errorf("nil udp socket")
+	}
+	if endpoint == nil {
+		return fmt.Errorf("nil endpoint")
+	}
+	ip := p.Interface.GetIPv6().To16()
+	if ip == nil {
+		return nil
+	}
+	payload := make([]byte, 54)
+	binary.BigEndian.PutUint16(payload[0:2], CommIPv6Set)
+	copy(payload[2:38], p.Dht.ID)
+	copy(payload[38:54], ip)
+
+	msg, err := p.createMessageFor(id, MsgTypeComm, payload)
+	if err != nil {
+		return err
+	}
+	_, err = p.UDPSocket.SendMessage(msg, endpoint)
+	return err
+}
+
 // PrepareIntroductionMessage collects client ID, mac and IP address
 // and create a comma-separated line
 // endpoint is an address that received this introduction message
-func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint string) (*P2PMessage, error) {
+// kx is a key exchange payload. It's appended only when requesting peer
+// sent it's own, because older versions expect exactly four fields
+func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint, kx string) (*P2PMessage, error) {
+	return p.prepareIntroduction(p.Crypter.GetActiveKey().Key, id, endpoint, kx)
+}
+
+// prepareIntroduction creates introduction message encrypted with
+// specified key
+func (p *PeerToPeer) prepareIntroduction(key []byte, id, endpoint, kx string) (*P2PMessage, error) {
 	if p.Interface == nil {
 		return nil, fmt.Errorf("PrepareIntroductionMessage: nil interface")
 	}
@@ -717,7 +848,10 @@ func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint string) (*P2PMessag
 	}
 
 	var intro = id + "," + p.Interface.GetHardwareAddress().String() + "," + ip + "," + endpoint
-	msg, err := p.CreateMessage(MsgTypeIntro, []byte(intro), 0, true)
+	if kx != "" {
+		intro += "," + kx
+	}
+	msg, err := p.createMessageWith(key, MsgTypeIntro, []byte(intro))
 	if err != nil {
 		return nil, err
 	}
@@ -726,8 +860,15 @@ func (p *PeerToPeer) PrepareIntroductionMessage(id, endpoint string) (*P2PMessag
 
 // WriteToDevice writes data to created TAP interface
 func (p *PeerToPeer) WriteToDevice(b []byte, proto uint16, truncated bool) error {
+	if trunk, vlan := p.getTrunk(); vlan != 0 {
+		if trunk == nil {
+			// VLAN instance has no interface of its own
+			return fmt.Errorf("WriteToDevice: trunk of VLAN %d is detached", vlan)
+		}
+		return trunk.WriteToDevice(tagFrame(b, vlan), uint16(Packet8021Q), truncated)
+	}
 	if p.Interface == nil {
-		Log(Error, "TAP Interface not initialized")
+		LogWith(Error, p.logFields(SubsystemInstance), "TAP Interface not initialized")
 		return fmt.Errorf("WriteToDevice: interface is nil")
 	}
 
@@ -736,7 +877,8 @@ func (p *PeerToPeer) WriteToDevice(b []byte, proto uint16, truncated bool) error
 	packet.Packet = b
 	err := p.Interface.WritePacket(&packet)
 	if err != nil {
-		Log(Error, "Failed to write to TAP Interface: %v", err)
+		p.Metrics.tapWriteError()
+		LogWith(Error, p.logFields(SubsystemInstance), "Failed to write to TAP Interface: %v", err)
 		return fmt.Errorf("Failed to write to TAP Interface: %v", err)
 	}
 	return nil
@@ -756,10 +898,9 @@ func (p *PeerToPeer) SendTo(dst net.HardwareAddr, msg *P2PMessage) (int, error)
 	if dst == nil {
 		return -1, fmt.Errorf("SendTo: nil dst")
 	}
-	endpoint, err := p.Swarm.GetEndpoint(dst.String())
-	if err == nil && endpoint != nil {
-		size, err := p.UDPSocket.SendMessage(msg, endpoint)
-		return size, err
+	peer := p.Swarm.GetPeerByMAC(dst.String())
+	if peer != nil && peer.Endpoint != nil {
+		return p.sendToPeer(peer, msg)
 	}
 	return 0, nil
 }
@@ -770,15 +911,27 @@ func (p *PeerToPeer) Close() error {
 	if p.Dht != nil {
 		hash = p.Dht.NetworkHash
 	}
-	Log(Info, "Stopping instance %s", hash)
+	LogWith(Info, p.logFields(SubsystemInstance), "Stopping instance %s", hash)
+	// VLAN instances share interface of the trunk, which must stay open
+	// even when trunk was detached before
+	_, vlan := p.getTrunk()
+	shared := vlan != 0
+	p.detachVLANs()
 	p.deactivateInterface()
+	p.dropStaticPeers()
 	p.stopPeers()
 	p.Shutdown = true
+	p.stopLANDiscovery()
 	p.stopDHT()
 	p.stopSocket()
-	p.stopInterface()
+	if !shared {
+		p.stopInterface()
+	} else {
+		p.runHook(HookDown, nil)
+		p.stopHooks()
+	}
 	p.ReadyToStop = true
-	Log(Info, "Instance %s stopped", hash)
+	LogWith(Info, p.logFields(SubsystemInstance), "Instance %s stopped", hash)
 	return nil
 }
 
@@ -786,6 +939,14 @@ func (p *PeerToPeer) deactivateInterface() error {
 	if p.Interface == nil {
 		return fmt.Errorf("nil interface")
 	}
+	if ipv6 := p.Interface.GetIPv6(); ipv6 != nil {
+		for i, ip := range ActiveInterfaces {
+			if ip.Equal(ipv6) {
+				ActiveInterfaces = append(ActiveInterfaces[:i], ActiveInterfaces[i+1:]...)
+				break
+			}
+		}
+	}
 	for i, ip := range ActiveInterfaces {
 		if ip.Equal(p.Interface.GetIP()) {
 			ActiveInterfaces = append(ActiveInterfaces[:i], ActiveInterfaces[i+1:]...)
@@ -800,9 +961,11 @@ func (p *PeerToPeer) stopInterface() error {
 	if p.Interface == nil {
 		return fmt.Errorf("nil interface")
 	}
+	p.runHook(HookDown, nil)
+	p.stopHooks()
 	err := p.Interface.Close()
 	if err != nil {
-		Log(Error, "Failed to close TAP interface: %s", err)
+		LogWith(Error, p.logFields(SubsystemInstance), "Failed to close TAP interface: %s", err)
 		return err
 	}
 	return nil
@@ -820,12 +983,12 @@ func (p *PeerToPeer) stopPeers() error {
 	stopStarted := time.Now()
 	for p.Swarm.Length() > 0 {
 		if time.Since(stopStarted) > time.Duration(time.Second*5) {
-			Log(Warning, "Peer remove timeout passed")
+			LogWith(Warning, p.logFields(SubsystemInstance), "Peer remove timeout passed")
 			break
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
-	Log(Debug, "All peers under this instance has been removed")
+	LogWith(Debug, p.logFields(SubsystemInstance), "All peers under this instance has been removed")
 	return nil
 }
 
@@ -835,7 +998,7 @@ func (p *PeerToPeer) stopDHT() error {
 	}
 	err := p.Dht.Close()
 	if err != nil {
-		Log(Error, "Failed to stop DHT: %s", err)
+		LogWith(Error, p.logFields(SubsystemInstance), "Failed to stop DHT: %s", err)
 		return err
 	}
 	return nil
@@ -1359,7 +1359,7 @@ func TestPeerToPeer_PrepareIntroductionMessage(t *testing.T) {
 				outboundIP:   tt.fields.outboundIP,
 				UsePMTU:      tt.fields.UsePMTU,
 			}
-			got, err := p.PrepareIntroductionMessage(tt.args.id, tt.args.endpoint)
+			got, err := p.PrepareIntroductionMessage(tt.args.id, tt.args.endpoint, "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("PeerToPeer.PrepareIntroductionMessage() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -116,7 +116,7 @@ func (p *PeerToPeer) handlePacket(contents []byte, proto int) error {
 	if exists {
 		return callback(contents, proto)
 	}
-	Log(Warning, "Captured undefined packet: %d", PacketType(proto))
+	LogWith(Warning, p.logFields(SubsystemPacket), "Captured undefined packet: %d", PacketType(proto))
 	return fmt.Errorf("Captured undefined packet: %d", PacketType(proto))
 }
 
@@ -124,14 +124,18 @@ func (p *PeerToPeer) handlePacket(contents []byte, proto int) error {
 func (p *PeerToPeer) handlePacketIPv4(contents []byte, proto int) error {
 	f := new(ethernet.Frame)
 	if err := f.UnmarshalBinary(contents); err != nil {
-		Log(Error, "Failed to unmarshal IPv4 packet")
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to unmarshal IPv4 packet")
 		return fmt.Errorf("Failed to unmarshal IPv4 packet")
 	}
 	if f.EtherType != ethernet.EtherTypeIPv4 {
 		return fmt.Errorf("Wrong packet type in IPv4 handler. Got %d. Expecting %d", f.EtherType, ethernet.EtherTypeIPv4)
 	}
 
-	msg, err := p.CreateMessage(MsgTypeNenc, contents, uint16(proto), true)
+	if f.Destination[0]&0x01 == 0x01 {
+		return p.floodFrame(contents, proto)
+	}
+
+	msg, err := p.CreateFrameMessage(f.Destination, contents, uint16(proto))
 	if err == nil && msg != nil {
 		_, err = p.SendTo(f.Destination, msg)
 		return err
@@ -139,9 +143,28 @@ func (p *PeerToPeer) handlePacketIPv4(contents []byte, proto int) error {
 	return err
 }
 
-// TODO: Implement IPv6 Support
+// Handles a IPv6 packet and sends it to it's destination. Neighbor
+// solicitations are answered locally, other multicast frames are flooded
 func (p *PeerToPeer) handlePacketIPv6(contents []byte, proto int) error {
-	return nil
+	f := new(ethernet.Frame)
+	if err := f.UnmarshalBinary(contents); err != nil {
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to unmarshal IPv6 packet")
+		return fmt.Errorf("Failed to unmarshal IPv6 packet")
+	}
+	if f.EtherType != ethernet.EtherTypeIPv6 {
+		return fmt.Errorf("Wrong packet type in IPv6 handler. Got %d. Expecting %d", f.EtherType, ethernet.EtherTypeIPv6)
+	}
+
+	if f.Destination[0]&0x01 == 0x01 {
+		return p.handleNDP(f, contents, proto)
+	}
+
+	msg, err := p.CreateFrameMessage(f.Destination, contents, uint16(proto))
+	if err == nil && msg != nil {
+		_, err = p.SendTo(f.Destination, msg)
+		return err
+	}
+	return err
 }
 
 // TODO: Implement PARC Universal Support
@@ -154,9 +177,31 @@ func (p *PeerToPeer) handleRARPPacket(contents []byte, proto int) error {
 	return nil
 }
 
-// TODO: Implement 802.1q Support
+// Handles a 802.1q tagged frame. Frames of VLANs mapped to another instance
+// are untagged and passed to that instance, other frames are forwarded
+// with the tag preserved
 func (p *PeerToPeer) handle8021qPacket(contents []byte, proto int) error {
-	return nil
+	vlan, innerProto, err := parseVLANTag(contents)
+	if err != nil {
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to parse 802.1q frame: %s", err)
+		return fmt.Errorf("Failed to parse 802.1q frame: %s", err)
+	}
+	if child := p.getVLAN(vlan); child != nil {
+		return child.handlePacket(untagFrame(contents), int(innerProto))
+	}
+
+	dst := net.HardwareAddr(contents[0:6])
+	if dst[0]&0x01 == 0x01 {
+		// Broadcast and multicast frames can't be answered locally,
+		// because addresses inside VLAN are unknown to the swarm
+		return p.floodFrame(contents, proto)
+	}
+	msg, err := p.CreateFrameMessage(dst, contents, uint16(proto))
+	if err == nil && msg != nil {
+		_, err = p.SendTo(dst, msg)
+		return err
+	}
+	return err
 }
 
 // TODO: Implement PPPoE Discovery Support
@@ -174,13 +219,13 @@ func (p *PeerToPeer) handlePacketARP(contents []byte, proto int) error {
 	// contents of the packet
 	f := new(ethernet.Frame)
 	if err := f.UnmarshalBinary(contents); err != nil {
-		Log(Error, "Failed to Unmarshal ARP Binary")
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to Unmarshal ARP Binary")
 		return fmt.Errorf("failed to unmarshal ARP binary: %s", err.Error())
 	}
 
 	packet := new(ARPPacket)
 	if err := packet.UnmarshalARP(f.Payload); err != nil {
-		Log(Error, "Failed to unmarshal arp")
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to unmarshal arp")
 		return fmt.Errorf("failed to unmarshal ARP packet: %s", err.Error())
 	}
 	if p.Swarm == nil {
@@ -189,17 +234,17 @@ func (p *PeerToPeer) handlePacketARP(contents []byte, proto int) error {
 
 	id, err := p.Swarm.GetID(packet.TargetIP.String())
 	if err != nil {
-		Log(Trace, "Unknown IP requested: %s", packet.TargetIP.String())
+		LogWith(Trace, p.logFields(SubsystemPacket), "Unknown IP requested: %s", packet.TargetIP.String())
 		return fmt.Errorf("requested unknown IP: %s", packet.TargetIP)
 	}
 	peer := p.Swarm.GetPeer(id)
 	if peer == nil {
-		Log(Debug, "Can't lookup address: Specified peer was not found")
+		LogWith(Debug, p.logFields(SubsystemPacket), "Can't lookup address: Specified peer was not found")
 		return fmt.Errorf("peer not found during arp request: %s", id)
 	}
 	hwAddr := peer.PeerHW
 	if hwAddr == nil {
-		Log(Error, "Cannot find hardware address for requested IP")
+		LogWith(Error, p.logFields(SubsystemPacket), "Cannot find hardware address for requested IP")
 		_, hwAddr = GenerateMAC()
 		peer.PeerHW = hwAddr
 		p.Swarm.Update(id, peer)
@@ -213,12 +258,12 @@ func (p *PeerToPeer) handlePacketARP(contents []byte, proto int) error {
 	ip := net.ParseIP(packet.TargetIP.String())
 	response, err := reply.NewPacket(OperationReply, hwAddr, ip, packet.SenderHardwareAddr, packet.SenderIP)
 	if err != nil {
-		Log(Error, "Failed to create ARP response")
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to create ARP response")
 		return fmt.Errorf("failed to create app response: %s", err.Error())
 	}
 	rp, err := response.MarshalBinary()
 	if err != nil {
-		Log(Error, "Failed to marshal ARP response packet")
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to marshal ARP response packet")
 		return fmt.Errorf("failed to marshal arp response binary: %s", err.Error())
 	}
 
@@ -231,10 +276,10 @@ func (p *PeerToPeer) handlePacketARP(contents []byte, proto int) error {
 
 	fb, err := fr.MarshalBinary()
 	if err != nil {
-		Log(Error, "Failed to marshal ARP Ethernet Frame")
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to marshal ARP Ethernet Frame")
 		return fmt.Errorf("failed to marshal ARP ethernet frame: %s", err.Error())
 	}
-	Log(Trace, "%v", packet.String())
+	LogWith(Trace, p.logFields(SubsystemPacket), "%v", packet.String())
 	return p.WriteToDevice(fb, uint16(proto), false)
 }
 
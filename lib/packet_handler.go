@@ -16,7 +16,7 @@ type MessageHandler func(message *P2PMessage, srcAddr *net.UDPAddr) error
 // HandleP2PMessage is a handler for new messages received from P2P network
 func (p *PeerToPeer) HandleP2PMessage(count int, srcAddr *net.UDPAddr, err error, rcvBytes []byte) error {
 	if err != nil {
-		Log(Error, "P2P Message Handle: %v", err)
+		LogWith(Error, p.logFields(SubsystemPacket), "P2P Message Handle: %v", err)
 		return err
 	}
 	buf := make([]byte, count)
@@ -24,29 +24,40 @@ func (p *PeerToPeer) HandleP2PMessage(count int, srcAddr *net.UDPAddr, err error
 
 	msg, desErr := P2PMessageFromBytes(buf)
 	if desErr != nil {
-		Log(Error, "P2PMessageFromBytes error: %v", desErr)
+		LogWith(Error, p.logFields(SubsystemPacket), "P2PMessageFromBytes error: %v", desErr)
 		return fmt.Errorf("Failed to unmarshal message: %s", desErr.Error())
 	}
 	if msg == nil {
-		Log(Error, "Received broken message")
+		LogWith(Error, p.logFields(SubsystemPacket), "Received broken message")
 		return fmt.Errorf("Broken P2P message")
 	}
+	return p.handleMessage(msg, srcAddr)
+}
+
+// handleMessage decrypts message if needed and passes it to the handler
+func (p *PeerToPeer) handleMessage(msg *P2PMessage, srcAddr *net.UDPAddr) error {
 	// Decrypt message if crypter is active
-	if p.Crypter.Active && (msg.Header.Type == MsgTypeIntro || msg.Header.Type == MsgTypeNenc || msg.Header.Type == MsgTypeIntroReq || msg.Header.Type == MsgTypeTest || msg.Header.Type == MsgTypeXpeerPing || msg.Header.Type == MsgTypeComm) {
+	if p.Crypter.IsActive() && (msg.Header.Type == MsgTypeIntro || msg.Header.Type == MsgTypeNenc || msg.Header.Type == MsgTypeIntroReq || msg.Header.Type == MsgTypeTest || msg.Header.Type == MsgTypeXpeerPing || msg.Header.Type == MsgTypeComm) {
 		var decErr error
-		msg.Data, decErr = p.Crypter.decrypt(p.Crypter.ActiveKey.Key, msg.Data)
+		msg.Data, msg.invite, decErr = p.decryptMessage(msg.Data, int(msg.Header.Length))
 		if decErr != nil {
-			Log(Error, "Failed to decrypt message: %s", decErr)
+			p.Metrics.decryptFailure()
+			fields := p.logFields(SubsystemPacket)
+			fields.Endpoint = srcAddr.String()
+			LogWith(Error, fields, "Failed to decrypt message: %s", decErr)
 			return fmt.Errorf("Failed to decrypt message: %s", decErr)
 		}
-		msg.Data = msg.Data[:msg.Header.Length]
+		if msg.Header.Type == MsgTypeNenc && p.sealingRequired(msg, srcAddr) {
+			LogWith(Debug, p.logFields(SubsystemPacket), "Refusing unsealed data frame from %s", srcAddr)
+			return fmt.Errorf("Unsealed data frame from %s", srcAddr)
+		}
 	}
 
 	callback, exists := p.MessageHandlers[msg.Header.Type]
 	if exists {
 		return callback(msg, srcAddr)
 	}
-	Log(Warning, "Unknown message received")
+	LogWith(Warning, p.logFields(SubsystemPacket), "Unknown message received")
 	return fmt.Errorf("Unknown message received")
 }
 
@@ -61,11 +72,112 @@ func (p *PeerToPeer) HandleNotEncryptedMessage(msg *P2PMessage, srcAddr *net.UDP
 	if srcAddr == nil {
 		return fmt.Errorf("nil source addr")
 	}
-	Log(Trace, "Data: %s, From: %s", msg.Data, srcAddr.String())
+	LogWith(Trace, p.logFields(SubsystemPacket), "Data: %s, From: %s", msg.Data, srcAddr.String())
+	p.Metrics.received(len(msg.Data))
+	peer := p.framePeer(msg, srcAddr)
+	if peer != nil {
+		peer.Traffic.received(p.endpointClass(peer, srcAddr, msg.origin != ""), len(msg.Data), time.Now())
+	}
+	if msg.Header.NetProto == uint16(PacketIPv4) {
+		p.snoopIGMP(peer, msg.Data)
+	}
 	p.WriteToDevice(msg.Data, msg.Header.NetProto, false)
 	return nil
 }
 
+// framePeer returns peer which sent data frame. Relayed frames carry
+// ID of the peer, other frames are matched by the address they came
+// from. Source MAC address of the frame is set by sender and can't
+// identify it
+func (p *PeerToPeer) framePeer(msg *P2PMessage, addr *net.UDPAddr) *NetworkPeer {
+	if p.Swarm == nil {
+		return nil
+	}
+	if msg.origin != "" {
+		return p.Swarm.GetPeer(msg.origin)
+	}
+	if addr == nil {
+		return nil
+	}
+	return p.Swarm.GetPeerByEndpoint(addr.String())
+}
+
+// HandleSealedMessage verifies and decrypts data frame sealed with AES-GCM.
+// Frames that fail authentication or were already received are dropped
+func (p *PeerToPeer) HandleSealedMessage(msg *P2PMessage, srcAddr *net.UDPAddr) error {
+	if msg == nil {
+		return fmt.Errorf("nil message")
+	}
+	if msg.Header == nil {
+		return fmt.Errorf("nil header")
+	}
+	if srcAddr == nil {
+		return fmt.Errorf("nil source addr")
+	}
+	if p.Swarm == nil {
+		return fmt.Errorf("nil peer list")
+	}
+	if !p.Crypter.IsActive() {
+		return fmt.Errorf("sealed message received while encryption is disabled")
+	}
+	salt := sealedSalt(msg.Data)
+	peers := p.Swarm.Get()
+	if msg.origin != "" {
+		// Relayed frame must be sealed by the peer relay claims it came from
+		peers = map[string]*NetworkPeer{}
+		if origin := p.Swarm.GetPeer(msg.origin); origin != nil {
+			peers[origin.ID] = origin
+		}
+	}
+	for _, peer := range peers {
+		_, key := peer.session.keys()
+		if key == nil || !peer.replay.matches(salt) {
+			continue
+		}
+		data, _, counter, err := p.Crypter.open(key, msg.Data, msg.Header.sealedData())
+		if err != nil {
+			p.Metrics.decryptFailure()
+			LogWith(Debug, p.logFields(SubsystemPacket), "Failed to open sealed frame from %s: %s", peer.ID, err)
+			return fmt.Errorf("Failed to open sealed frame: %s", err)
+		}
+		if !peer.replay.accept(counter) {
+			LogWith(Trace, p.logFields(SubsystemPacket), "Replayed frame #%d from %s", counter, peer.ID)
+			return fmt.Errorf("Replayed frame #%d from %s", counter, peer.ID)
+		}
+		msg.Data = data
+		return p.HandleNotEncryptedMessage(msg, srcAddr)
+	}
+	LogWith(Trace, p.logFields(SubsystemPacket), "Sealed frame from unknown peer [%s]", srcAddr)
+	return fmt.Errorf("Sealed frame from unknown peer [%s]", srcAddr)
+}
+
+// sealingRequired returns true if message came from a peer which
+// presented keys during introduction. Peer is identified
+// by origin of relayed message or by the address message came from
+func (p *PeerToPeer) sealingRequired(msg *P2PMessage, addr *net.UDPAddr) bool {
+	if p.Swarm == nil || addr == nil {
+		return false
+	}
+	if msg != nil && msg.origin != "" {
+		peer := p.Swarm.GetPeer(msg.origin)
+		return peer != nil && peer.session.isRequired()
+	}
+	for _, peer := range p.Swarm.Get() {
+		if !peer.session.isRequired() {
+			continue
+		}
+		if peer.Endpoint != nil && peer.Endpoint.String() == addr.String() {
+			return true
+		}
+		for _, ep := range peer.EndpointsHeap {
+			if ep.Addr != nil && ep.Addr.String() == addr.String() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // HandlePingMessage is a PING message from a proxy handler
 func (p *PeerToPeer) HandlePingMessage(msg *P2PMessage, srcAddr *net.UDPAddr) error {
 	if msg == nil {
@@ -81,7 +193,7 @@ func (p *PeerToPeer) HandlePingMessage(msg *P2PMessage, srcAddr *net.UDPAddr) er
 		return fmt.Errorf("nil udp socket")
 	}
 
-	addr, err := net.ResolveUDPAddr("udp4", string(msg.Data))
+	addr, err := resolveUDPAddr(string(msg.Data))
 	if err != nil {
 		if p.ProxyManager.touch(srcAddr.String()) {
 			p.UDPSocket.SendMessage(msg, srcAddr)
@@ -95,7 +207,7 @@ func (p *PeerToPeer) HandlePingMessage(msg *P2PMessage, srcAddr *net.UDPAddr) er
 		return nil
 	}
 	if port != p.UDPSocket.GetPort() && port != p.UDPSocket.remotePort && port != 0 {
-		Log(Debug, "Port translation detected %d -> %d", p.UDPSocket.GetPort(), port)
+		LogWith(Debug, p.logFields(SubsystemPacket), "Port translation detected %d -> %d", p.UDPSocket.GetPort(), port)
 		p.UDPSocket.remotePort = port
 	}
 	return nil
@@ -130,9 +242,9 @@ func (p *PeerToPeer) HandleXpeerPingMessage(msg *P2PMessage, srcAddr *net.UDPAdd
 		endpoint := string(msg.Data)[37:]
 		response := append([]byte("r"), []byte(endpoint)...)
 
-		msg, err := p.CreateMessage(MsgTypeXpeerPing, response, 0, true)
+		msg, err := p.createMessageFor(id, MsgTypeXpeerPing, response)
 		if err != nil {
-			Log(Debug, "Failed to create ping response: %s", err)
+			LogWith(Debug, p.logFields(SubsystemPacket), "Failed to create ping response: %s", err)
 			return fmt.Errorf("failed to create crosspeer ping message")
 		}
 
@@ -162,7 +274,7 @@ func (p *PeerToPeer) HandleXpeerPingMessage(msg *P2PMessage, srcAddr *net.UDPAdd
 				}
 			}
 		}
-		Log(Debug, "Received ping from unknown endpoint: %s [%s ID: %s]", srcAddr.String(), endpoint, id)
+		LogWith(Debug, p.logFields(SubsystemPacket), "Received ping from unknown endpoint: %s [%s ID: %s]", srcAddr.String(), endpoint, id)
 		return fmt.Errorf("Received ping from unknown endpoint: %s [%s ID: %s]", srcAddr.String(), endpoint, id)
 	} else if query == "r" {
 		endpoint := msg.Data[1:]
@@ -192,27 +304,53 @@ func (p *PeerToPeer) HandleIntroMessage(msg *P2PMessage, srcAddr *net.UDPAddr) e
 	if p.Swarm == nil {
 		return fmt.Errorf("nil peer list")
 	}
-	Log(Debug, "Introduction string from %s", srcAddr)
+	LogWith(Debug, p.logFields(SubsystemPacket), "Introduction string from %s", srcAddr)
 	hs, err := ParseIntroString(string(msg.Data))
 	if err != nil {
-		Log(Debug, "Failed to parse handshake response: %s", err)
+		LogWith(Debug, p.logFields(SubsystemPacket), "Failed to parse handshake response: %s", err)
 		return err
 	}
 	if len(hs.ID) != 36 {
-		Log(Debug, "Received wrong ID in introduction message: %s", hs.ID)
+		LogWith(Debug, p.logFields(SubsystemPacket), "Received wrong ID in introduction message: %s", hs.ID)
 		return fmt.Errorf("ID length mismatch in introduction message: %d", len(hs.ID))
 	}
+	if !p.member(hs.ID) {
+		LogWith(Trace, p.logFields(SubsystemPacket), "Introduction from peer %s denied by access list", hs.ID)
+		return fmt.Errorf("Peer %s is denied by access list", hs.ID)
+	}
+	if err := p.redeemInvite(hs.ID, "", time.Now()); err != nil {
+		LogWith(Debug, p.logFields(SubsystemPacket), "Refusing introduction from %s: %s", hs.ID, err)
+		return fmt.Errorf("Introduction from %s refused: %s", hs.ID, err)
+	}
+	if msg.invite != "" && !p.invitedWith(hs.ID, msg.invite) {
+		// Key of an invite is accepted only from peers which redeemed it
+		return fmt.Errorf("Introduction from %s encrypted with key of invite %s", hs.ID, msg.invite)
+	}
 	peer := p.Swarm.GetPeer(hs.ID)
 	if peer == nil {
-		Log(Trace, "Unknown peer in handshke response")
+		LogWith(Trace, p.logFields(SubsystemPacket), "Unknown peer in handshke response")
 		return fmt.Errorf("Received unknown peer in handshake response")
 	}
+	if msg.origin != "" && msg.origin != hs.ID {
+		return fmt.Errorf("Relayed introduction from %s on behalf of %s", msg.origin, hs.ID)
+	}
+	if err := p.introKeyExchange(peer, hs.KeyExchange); err != nil {
+		LogWith(Debug, p.logFields(SubsystemPacket), "Key exchange with %s failed: %s", hs.ID, err)
+		return fmt.Errorf("Key exchange with %s failed: %s", hs.ID, err)
+	}
 
 	peer.PeerHW = hs.HardwareAddr
 	if !hs.AutoIP {
 		peer.PeerLocalIP = hs.IP
 	}
 	peer.LastContact = time.Now()
+	if msg.origin != "" {
+		// Endpoint is an address of the relay we've sent request to
+		peer.addRelayEndpoint(hs.Endpoint, msg.origin)
+		p.Swarm.Update(hs.ID, peer)
+		LogWith(Debug, p.logFields(SubsystemPacket), "Connection with peer %s has been established over relay %s", hs.ID, hs.Endpoint.String())
+		return nil
+	}
 	peer.addEndpoint(hs.Endpoint)
 	for _, np := range p.Swarm.Get() {
 		if np == nil {
@@ -222,13 +360,13 @@ func (p *PeerToPeer) HandleIntroMessage(msg *P2PMessage, srcAddr *net.UDPAddr) e
 			continue
 		}
 		if np.PeerHW.String() == peer.PeerHW.String() {
-			Log(Warning, "%s: Duplicate MAC has been detected on peer %s. Disconnecting it", peer.ID, np.ID)
+			LogWith(Warning, p.logFields(SubsystemPacket), "%s: Duplicate MAC has been detected on peer %s. Disconnecting it", peer.ID, np.ID)
 			np.SetState(PeerStateDisconnect, p)
 			continue
 		}
 		for _, ep := range np.EndpointsHeap {
 			if ep.Addr.String() == hs.Endpoint.String() {
-				Log(Warning, "%s: Endpoint %s was used by another peer %s. Disconnecting it.", peer.ID, ep.Addr.String(), np.ID)
+				LogWith(Warning, p.logFields(SubsystemPacket), "%s: Endpoint %s was used by another peer %s. Disconnecting it.", peer.ID, ep.Addr.String(), np.ID)
 				np.SetState(PeerStateDisconnect, p)
 				break
 			}
@@ -236,7 +374,8 @@ func (p *PeerToPeer) HandleIntroMessage(msg *P2PMessage, srcAddr *net.UDPAddr) e
 	}
 
 	p.Swarm.Update(hs.ID, peer)
-	Log(Debug, "Connection with peer %s has been established over %s", hs.ID, hs.Endpoint.String())
+	LogWith(Debug, p.logFields(SubsystemPacket), "Connection with peer %s has been established over %s", hs.ID, hs.Endpoint.String())
+	p.notifyIPv6(hs.ID, hs.Endpoint)
 	return nil
 }
 
@@ -265,20 +404,56 @@ func (p *PeerToPeer) HandleIntroRequestMessage(msg *P2PMessage, srcAddr *net.UDP
 		return fmt.Errorf("payload is too short")
 	}
 	id := string(msg.Data[0:36])
+	if p.ACL.denied(id) {
+		// Denied peers get no reply. Membership of other peers is
+		// checked along with their invite claims
+		LogWith(Trace, p.logFields(SubsystemPacket), "Introduction request from peer %s denied by access list", id)
+		return fmt.Errorf("Peer %s is denied by access list", id)
+	}
 	peer := p.Swarm.GetPeer(id)
 	if peer == nil {
-		Log(Trace, "Introduction request came from unknown peer: %s -> %s [%s]", id, msg.Data[36:], srcAddr.String())
+		LogWith(Trace, p.logFields(SubsystemPacket), "Introduction request came from unknown peer: %s -> %s [%s]", id, msg.Data[36:], srcAddr.String())
 		return fmt.Errorf("Introduction request from unknown peer: %s -> %s [%s]", id, msg.Data[36:], srcAddr.String())
 	}
-	response, err := p.PrepareIntroductionMessage(p.Dht.ID, string(msg.Data[36:]))
+	data, claim := splitInviteClaim(string(msg.Data[36:]))
+	if err := p.redeemInvite(id, claim, time.Now()); err != nil {
+		// Invalid invites get no reply
+		LogWith(Debug, p.logFields(SubsystemPacket), "Refusing introduction request from %s: %s", id, err)
+		return fmt.Errorf("Introduction request from %s refused: %s", id, err)
+	}
+	if msg.invite != "" && !p.invitedWith(id, msg.invite) {
+		// Key of an invite is accepted only from peers which redeemed it
+		return fmt.Errorf("Introduction request from %s encrypted with key of invite %s", id, msg.invite)
+	}
+	endpoint, kx := splitKeyExchange(data)
+	if err := p.introKeyExchange(peer, kx); err != nil {
+		// Reply without keys would downgrade the session to the shared key
+		LogWith(Debug, p.logFields(SubsystemPacket), "Key exchange with %s failed: %s", id, err)
+		return fmt.Errorf("Key exchange with %s failed: %s", id, err)
+	}
+	ourKx := ""
+	if kx != nil && p.Crypter.IsActive() {
+		var err error
+		ourKx, err = p.keyExchangePayload(peer)
+		if err != nil {
+			LogWith(Error, p.logFields(SubsystemPacket), "Failed to prepare key exchange payload: %s", err)
+			return fmt.Errorf("Failed to prepare key exchange payload: %s", err)
+		}
+	}
+	response, err := p.prepareIntroduction(p.peerKey(id), p.Dht.ID, endpoint, ourKx)
 	if err != nil {
-		Log(Error, "Failed to prepare intro message: %s", err.Error())
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to prepare intro message: %s", err.Error())
 		return fmt.Errorf("Failed to prepare introduction message: %s", err.Error())
 	}
+	if msg.origin != "" {
+		LogWith(Debug, p.logFields(SubsystemPacket), "Sending handshake response over relay %s", srcAddr)
+		_, err = p.replyTo(msg, srcAddr, response)
+		return err
+	}
 	eps := []*net.UDPAddr{}
 	eps = append(eps, peer.KnownIPs...)
 	eps = append(eps, peer.Proxies...)
-	Log(Debug, "Sending handshake response")
+	LogWith(Debug, p.logFields(SubsystemPacket), "Sending handshake response")
 
 	srcFound := false
 	for _, ep := range eps {
@@ -294,7 +469,7 @@ func (p *PeerToPeer) HandleIntroRequestMessage(msg *P2PMessage, srcAddr *net.UDP
 		time.Sleep(time.Millisecond * 10)
 		_, err := p.UDPSocket.SendMessage(response, ep)
 		if err != nil {
-			Log(Error, "Failed to respond to introduction request: %s", err.Error())
+			LogWith(Error, p.logFields(SubsystemPacket), "Failed to respond to introduction request: %s", err.Error())
 			return fmt.Errorf("Failed to response to introduction reuqest: %s", err.Error())
 		}
 	}
@@ -314,15 +489,15 @@ func (p *PeerToPeer) HandleProxyMessage(msg *P2PMessage, srcAddr *net.UDPAddr) e
 		return fmt.Errorf("nil proxy manager")
 	}
 
-	Log(Debug, "New proxy message from %s", srcAddr)
-	ep, err := net.ResolveUDPAddr("udp4", string(msg.Data))
+	LogWith(Debug, p.logFields(SubsystemPacket), "New proxy message from %s", srcAddr)
+	ep, err := resolveUDPAddr(string(msg.Data))
 	if err != nil {
-		Log(Error, "Failed to resolve proxy address: %s", err.Error())
+		LogWith(Error, p.logFields(SubsystemPacket), "Failed to resolve proxy address: %s", err.Error())
 		return fmt.Errorf("Failed to resolve proxy address: %s", err.Error())
 	}
 	rc := p.ProxyManager.activate(srcAddr.String(), ep)
 	if rc {
-		Log(Debug, "This peer is now available over %s", ep.String())
+		LogWith(Debug, p.logFields(SubsystemPacket), "This peer is now available over %s", ep.String())
 		return nil
 	}
 	return fmt.Errorf("Failed to activate proxy %s", ep.String())
@@ -352,7 +527,7 @@ func (p *PeerToPeer) HandleLatency(msg *P2PMessage, srcAddr *net.UDPAddr) error
 	if len(msg.Data) < 12 {
 		return fmt.Errorf("payload is too short")
 	}
-	Log(Trace, "Latency response from %s", srcAddr.String())
+	LogWith(Trace, p.logFields(SubsystemPacket), "Latency response from %s", srcAddr.String())
 
 	if bytes.Equal(msg.Data[:4], LatencyProxyHeader) {
 		// This is a response from proxy
@@ -360,68 +535,74 @@ func (p *PeerToPeer) HandleLatency(msg *P2PMessage, srcAddr *net.UDPAddr) error
 		ts := time.Time{}
 		err := ts.UnmarshalBinary(msg.Data[4:])
 		if err != nil {
-			Log(Error, "Failed to unmarshal latency packet from %s: %s", srcAddr.String(), err.Error())
+			LogWith(Error, p.logFields(SubsystemPacket), "Failed to unmarshal latency packet from %s: %s", srcAddr.String(), err.Error())
 			return fmt.Errorf("Failed to unmarshal latency from %s: %s", srcAddr.String(), err.Error())
 		}
 		latency := time.Since(ts)
 
 		if p.ProxyManager.setLatency(latency, srcAddr) != nil {
-			Log(Error, "Couldn't set latency for proxy: %s", srcAddr)
+			LogWith(Error, p.logFields(SubsystemPacket), "Couldn't set latency for proxy: %s", srcAddr)
 			return fmt.Errorf("Failed to set latency for proxy %s", srcAddr.String())
 		}
 		return nil
-	} else if bytes.Equal(msg.Data[:4], LatencyRequestHeader) {
+	}
+
+	// Address field is longer in packets for IPv6 endpoints
+	requestHeader, responseHeader, addrSize := LatencyRequestHeader, LatencyResponseHeader, net.IPv4len+2
+	if bytes.Equal(msg.Data[:4], LatencyRequestHeaderV6) || bytes.Equal(msg.Data[:4], LatencyResponseHeaderV6) {
+		requestHeader, responseHeader, addrSize = LatencyRequestHeaderV6, LatencyResponseHeaderV6, net.IPv6len+2
+	}
+	idOffset := 4 + addrSize
+	tsOffset := idOffset + 36
+
+	if bytes.Equal(msg.Data[:4], requestHeader) {
 		// This is a request of latency from endpoint
 
-		if len(msg.Data) < 52 {
-			Log(Error, "Broken latency request packet: too small [%d]", len(msg.Data))
+		if len(msg.Data) < tsOffset+6 {
+			LogWith(Error, p.logFields(SubsystemPacket), "Broken latency request packet: too small [%d]", len(msg.Data))
 			return fmt.Errorf("latency packet request is too small: %d bytes", len(msg.Data))
 		}
 
 		// Find this peer
-		peerID := string(msg.Data[10:46])
+		peerID := string(msg.Data[idOffset:tsOffset])
 		peer := p.Swarm.GetPeer(peerID)
 		if peer == nil {
-			Log(Trace, "Received latency request from unknown peers: %s [Origin: %s]", peerID, srcAddr.String())
+			LogWith(Trace, p.logFields(SubsystemPacket), "Received latency request from unknown peers: %s [Origin: %s]", peerID, srcAddr.String())
 			return fmt.Errorf("latency request from unknown peer: %s [Origin: %s]", peerID, srcAddr.String())
 		}
 		if peer.Endpoint == nil {
-			Log(Trace, "Received latency request from not integrated peer %s [Origin: %s]", peerID, srcAddr.String())
+			LogWith(Trace, p.logFields(SubsystemPacket), "Received latency request from not integrated peer %s [Origin: %s]", peerID, srcAddr.String())
 			return fmt.Errorf("Received latency request from not integrated peer %s [Origin: %s]", peerID, srcAddr.String())
 		}
 
-		Log(Trace, "Latency request from %s", srcAddr.String())
-		response, err := p.CreateMessage(MsgTypeLatency, append(LatencyResponseHeader, msg.Data[4:]...), 0, false)
+		LogWith(Trace, p.logFields(SubsystemPacket), "Latency request from %s", srcAddr.String())
+		response, err := p.CreateMessage(MsgTypeLatency, append(responseHeader, msg.Data[4:]...), 0, false)
 		if err != nil {
-			Log(Error, "Failed to create latency response for %s: %s", srcAddr.String(), err.Error())
+			LogWith(Error, p.logFields(SubsystemPacket), "Failed to create latency response for %s: %s", srcAddr.String(), err.Error())
 			return fmt.Errorf("Failed to create latency response for %s: %s", srcAddr.String(), err.Error())
 		}
 
 		p.UDPSocket.SendMessage(response, peer.Endpoint)
 		return nil
-	} else if bytes.Equal(msg.Data[:4], LatencyResponseHeader) {
+	} else if bytes.Equal(msg.Data[:4], responseHeader) {
 		// This is a response of latency from endpoint
 
-		if len(msg.Data) < 52 {
-			Log(Error, "Broken latency response packet: too small [%d]", len(msg.Data))
+		if len(msg.Data) < tsOffset+6 {
+			LogWith(Error, p.logFields(SubsystemPacket), "Broken latency response packet: too small [%d]", len(msg.Data))
 			return fmt.Errorf("latency response packet is too small: %d bytes", len(msg.Data))
 		}
 
 		// Extract IP and Port
-		ipfield := msg.Data[4:10]
-
-		ip := net.IP{ipfield[0], ipfield[1], ipfield[2], ipfield[3]}
-		port := binary.BigEndian.Uint16(ipfield[4:6])
-		addr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", ip.String(), port))
-		if err != nil || addr.String() == "255.255.255.255:65535" || addr.String() == "0.0.0.0:0" {
-			Log(Error, "Received malformed latency packet: address is broken")
+		addr, err := bytesToAddr(msg.Data[4:idOffset])
+		if err != nil || addr.IP.IsUnspecified() || addr.String() == "255.255.255.255:65535" {
+			LogWith(Error, p.logFields(SubsystemPacket), "Received malformed latency packet: address is broken")
 			return fmt.Errorf("malformed latency packet: broken address")
 		}
 
 		ts := time.Time{}
-		err = ts.UnmarshalBinary(msg.Data[46:])
+		err = ts.UnmarshalBinary(msg.Data[tsOffset:])
 		if err != nil {
-			Log(Error, "Failed to unmarshal latency packet from %s: %s", srcAddr.String(), err.Error())
+			LogWith(Error, p.logFields(SubsystemPacket), "Failed to unmarshal latency packet from %s: %s", srcAddr.String(), err.Error())
 			return fmt.Errorf("failed to unmarshal latency packet from %s: %s", srcAddr.String(), err.Error())
 		}
 		latency := time.Since(ts)
@@ -434,10 +615,10 @@ func (p *PeerToPeer) HandleLatency(msg *P2PMessage, srcAddr *net.UDPAddr) error
 				}
 			}
 		}
-		Log(Error, "Can't set latency value for endpoint %s: Peer or endpoint wasn't found", addr.String())
+		LogWith(Error, p.logFields(SubsystemPacket), "Can't set latency value for endpoint %s: Peer or endpoint wasn't found", addr.String())
 		return fmt.Errorf("couldn't set latency value for endpoint %s: not found", addr.String())
 	}
-	Log(Error, "Malformed Latency packet from %s", srcAddr.String())
+	LogWith(Error, p.logFields(SubsystemPacket), "Malformed Latency packet from %s", srcAddr.String())
 	return fmt.Errorf("malformed latency packet from %s", srcAddr.String())
 }
 
@@ -491,17 +672,27 @@ func (p *PeerToPeer) HandleComm(msg *P2PMessage, srcAddr *net.UDPAddr) error {
 		if err != nil {
 			return err
 		}
+	case CommIPv6Set:
+		response, err = commIPv6SetHandler(data, p)
+		if err != nil {
+			return err
+		}
+	case CommRelayReach:
+		response, err = commRelayReachHandler(data, p)
+		if err != nil {
+			return err
+		}
 	default:
-		Log(Error, "Unknown communication packet: %d", commType)
+		LogWith(Error, p.logFields(SubsystemPacket), "Unknown communication packet: %d", commType)
 		return fmt.Errorf("unknown comm type")
 	}
 
 	if response != nil {
-		packet, err := p.CreateMessage(MsgTypeComm, response, 0, true)
+		packet, err := p.createReply(msg, MsgTypeComm, response)
 		if err != nil {
 			return err
 		}
-		_, err = p.UDPSocket.SendMessage(packet, srcAddr)
+		_, err = p.replyTo(msg, srcAddr, packet)
 		return err
 	}
 
@@ -1,6 +1,7 @@
 package ptp
 
 import (
+	"encoding/base64"
 	"errors"
 	"net"
 	"sync"
@@ -178,6 +179,45 @@ func TestPeerToPeer_HandleNotEncryptedMessage(t *testing.T) {
 	}
 }
 
+func TestPeerToPeer_framePeer(t *testing.T) {
+	direct := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 6000}
+	relay := &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 6000}
+	hw, _ := net.ParseMAC("06:00:00:00:00:02")
+	p := &PeerToPeer{Swarm: new(Swarm)}
+	p.Swarm.Init()
+	p.Swarm.peers["peer1"] = &NetworkPeer{ID: "peer1", Endpoint: direct, PeerHW: hw}
+	p.Swarm.peers["peer2"] = &NetworkPeer{ID: "peer2", Endpoint: relay, Relay: "relay"}
+	p.Swarm.tableMacID[hw.String()] = "peer1"
+
+	// Frame claims MAC address of peer1
+	frame := append([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, hw...)
+	frame = append(frame, 0x08, 0x00)
+
+	tests := []struct {
+		name   string
+		msg    *P2PMessage
+		addr   *net.UDPAddr
+		wantID string
+	}{
+		{"direct", &P2PMessage{Data: frame}, direct, "peer1"},
+		{"spoofed source MAC", &P2PMessage{Data: frame}, &net.UDPAddr{IP: net.ParseIP("10.0.0.4"), Port: 6000}, ""},
+		{"endpoint of relay", &P2PMessage{Data: frame}, relay, ""},
+		{"relayed", &P2PMessage{Data: frame, origin: "peer2"}, relay, "peer2"},
+		{"nil address", &P2PMessage{Data: frame}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := ""
+			if peer := p.framePeer(tt.msg, tt.addr); peer != nil {
+				id = peer.ID
+			}
+			if id != tt.wantID {
+				t.Errorf("PeerToPeer.framePeer() = %q, want %q", id, tt.wantID)
+			}
+		})
+	}
+}
+
 func TestPeerToPeer_HandlePingMessage(t *testing.T) {
 	type fields struct {
 		UDPSocket       *Network
@@ -799,6 +839,11 @@ func TestPeerToPeer_HandleLatency(t *testing.T) {
 	d3 = append(d3, []byte("123e4567-e89b-12d3-a456-426655440000")...)
 	d3 = append(d3, ts0...)
 
+	src3, _ := net.ResolveUDPAddr("udp", "[fd00::1]:4627")
+	d4 := append(LatencyResponseHeaderV6, (&Endpoint{Addr: src3}).addrToBytes()...)
+	d4 = append(d4, []byte("123e4567-e89b-12d3-a456-426655440000")...)
+	d4 = append(d4, ts0...)
+
 	msg0 := &P2PMessage{}
 	msg1 := &P2PMessage{
 		Data: append(LatencyProxyHeader, []byte("bad time for covertion")...),
@@ -827,6 +872,12 @@ func TestPeerToPeer_HandleLatency(t *testing.T) {
 	msg9 := &P2PMessage{
 		Data: []byte("this is a completely broken packet for a broken test"),
 	}
+	msg10 := &P2PMessage{
+		Data: d4,
+	}
+	msg11 := &P2PMessage{
+		Data: append(LatencyRequestHeaderV6, d0[4:]...),
+	}
 
 	proxy0 := &proxyServer{
 		Addr: src0,
@@ -857,6 +908,7 @@ func TestPeerToPeer_HandleLatency(t *testing.T) {
 		Endpoint: src1,
 		EndpointsHeap: []*Endpoint{
 			&Endpoint{Addr: src2},
+			&Endpoint{Addr: src3},
 		},
 	}
 
@@ -892,6 +944,9 @@ func TestPeerToPeer_HandleLatency(t *testing.T) {
 		{"response>passing", fields{ProxyManager: pm0, Peers: pl3, UDPSocket: socket0}, args{msg8, src1}, false},
 		{"response>ep not found", fields{ProxyManager: pm0, Peers: pl2, UDPSocket: socket0}, args{msg8, src1}, true},
 		{"malformed packet", fields{ProxyManager: pm0, Peers: pl2, UDPSocket: socket0}, args{msg9, src1}, true},
+		{"response>ipv6 passing", fields{ProxyManager: pm0, Peers: pl3, UDPSocket: socket0}, args{msg10, src3}, false},
+		// IPv4 request is too short for IPv6 address field
+		{"request>ipv6 short", fields{ProxyManager: pm0, Peers: pl2, UDPSocket: socket0}, args{msg11, src3}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1040,3 +1095,71 @@ func TestPeerToPeer_HandleComm(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerToPeer_HandleSealedMessage(t *testing.T) {
+	src, _ := net.ResolveUDPAddr("udp4", "192.168.0.1:2345")
+	mac, _ := net.ParseMAC("01:02:03:04:05:06")
+
+	newInstance := func() *PeerToPeer {
+		ptp := new(PeerToPeer)
+		ptp.Crypter = Crypto{Active: true, ActiveKey: CryptoKey{Key: []byte("1234567812345678")}}
+		ptp.Crypter.initAEAD()
+		ptp.Identity, _ = NewIdentity()
+		ptp.Swarm = new(Swarm)
+		ptp.Swarm.Init()
+		return ptp
+	}
+
+	sender := newInstance()
+	p := newInstance()
+	remote := &NetworkPeer{ID: p.Identity.ID(), PeerHW: mac}
+	sender.Swarm.Update(remote.ID, remote)
+	peer := &NetworkPeer{ID: sender.Identity.ID()}
+	p.Swarm.Update(peer.ID, peer)
+
+	msg, err := sender.CreateFrameMessage(mac, []byte("frame"), 2048)
+	if err != nil || msg.Header.Type != MsgTypeNenc {
+		t.Fatalf("CreateFrameMessage() sealed frame before key exchange")
+	}
+
+	kx, _ := sender.keyExchangePayload(remote)
+	rkx, _ := p.keyExchangePayload(peer)
+	kxBytes, _ := base64.RawStdEncoding.DecodeString(kx)
+	rkxBytes, _ := base64.RawStdEncoding.DecodeString(rkx)
+	if err := p.completeKeyExchange(peer, kxBytes); err != nil {
+		t.Fatalf("completeKeyExchange() error = %v", err)
+	}
+	if err := sender.completeKeyExchange(remote, rkxBytes); err != nil {
+		t.Fatalf("completeKeyExchange() error = %v", err)
+	}
+
+	msg, err = sender.CreateFrameMessage(mac, []byte("frame"), 2048)
+	if err != nil {
+		t.Fatalf("CreateFrameMessage() error = %v", err)
+	}
+	if msg.Header.Type != MsgTypeSealed {
+		t.Fatalf("CreateFrameMessage() type = %d, want %d", msg.Header.Type, MsgTypeSealed)
+	}
+
+	copyMsg := func() *P2PMessage {
+		m, _ := P2PMessageFromBytes(msg.Serialize())
+		return m
+	}
+
+	if err := (&PeerToPeer{}).HandleSealedMessage(copyMsg(), src); err == nil {
+		t.Errorf("HandleSealedMessage() didn't return error without peer list")
+	}
+	if err := p.HandleSealedMessage(nil, src); err == nil {
+		t.Errorf("HandleSealedMessage() didn't return error on nil message")
+	}
+	if err := p.HandleSealedMessage(copyMsg(), src); err != nil {
+		t.Errorf("HandleSealedMessage() error = %v", err)
+	}
+	if err := p.HandleSealedMessage(copyMsg(), src); err == nil {
+		t.Errorf("HandleSealedMessage() accepted replayed frame")
+	}
+	peer.replay.reset([]byte{0x0, 0x0, 0x0, 0x0})
+	if err := p.HandleSealedMessage(copyMsg(), src); err == nil {
+		t.Errorf("HandleSealedMessage() accepted frame from unknown peer")
+	}
+}
@@ -178,13 +178,50 @@ func TestPeerToPeer_handlePacketIPv6(t *testing.T) {
 		contents []byte
 		proto    int
 	}
+
+	buf4 := new(bytes.Buffer)
+	binary.Write(buf4, binary.BigEndian, uint16(2048))
+	buf6 := new(bytes.Buffer)
+	binary.Write(buf6, binary.BigEndian, uint16(34525))
+
+	src := []byte{0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b}
+	p0 := []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5}
+	p0 = append(p0, src...)
+	p0 = append(p0, buf4.Bytes()...)
+	p0 = append(p0, []byte{0x01, 0x02}...)
+	p1 := []byte{0x0, 0x1, 0x2, 0x3, 0x4, 0x5}
+	p1 = append(p1, src...)
+	p1 = append(p1, buf6.Bytes()...)
+	p1 = append(p1, []byte{0x01, 0x02}...)
+	p2 := []byte{0x33, 0x33, 0x0, 0x0, 0x0, 0x1}
+	p2 = append(p2, src...)
+	p2 = append(p2, buf6.Bytes()...)
+	p2 = append(p2, []byte{0x01, 0x02}...)
+	udp := make([]byte, 40)
+	udp[0] = 0x60
+	udp[6] = 17
+	p3 := []byte{0x33, 0x33, 0x0, 0x0, 0x0, 0x1}
+	p3 = append(p3, src...)
+	p3 = append(p3, buf6.Bytes()...)
+	p3 = append(p3, udp...)
+
+	pl0 := new(Swarm)
+	pl0.Init()
+
+	socket0 := new(Network)
+	socket0.Init("127.0.0.1", 1234)
+
 	tests := []struct {
 		name    string
 		fields  fields
 		args    args
 		wantErr bool
 	}{
-		{"empty test", fields{}, args{}, false},
+		{"empty test", fields{}, args{}, true},
+		{"wrong ether type", fields{}, args{p0, 0}, true},
+		{"unicast frame", fields{Peers: pl0, UDPSocket: socket0}, args{p1, 0}, false},
+		{"malformed multicast frame", fields{Peers: pl0, UDPSocket: socket0}, args{p2, 0}, true},
+		{"multicast frame", fields{Peers: pl0, UDPSocket: socket0}, args{p3, 0}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -364,7 +401,7 @@ func TestPeerToPeer_handle8021qPacket(t *testing.T) {
 		args    args
 		wantErr bool
 	}{
-		{"empty test", fields{}, args{}, false},
+		{"empty test", fields{}, args{}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -18,6 +18,7 @@ type NetworkPeer struct {
 	KnownIPs           []*net.UDPAddr                     // List of IP addresses that accepts connection on peer
 	Proxies            []*net.UDPAddr                     // List of proxies of this peer
 	PeerLocalIP        net.IP                             // IP of peers interface. TODO: Rename to IP
+	PeerLocalIPv6      net.IP                             // IPv6 address of peers interface
 	PeerHW             net.HardwareAddr                   // Hardware address of peer interface. TODO: Rename to Mac
 	State              PeerState                          // State of a peer on our end
 	RemoteState        PeerState                          // State of remote peer
@@ -33,7 +34,26 @@ type NetworkPeer struct {
 	LastFind           time.Time                          // Moment when we got this peer from DHT
 	LastPunch          time.Time                          // Last time we run hole punch
 	Stat               PeerStats                          // Peer statistics
+	Traffic            PeerTraffic                        // Traffic exchanged with peer
 	RoutingRequired    bool                               // Whether or not routing is required
+	replay             replayWindow                       // Replay protection for sealed frames received from this peer
+	session            session                            // Key exchange state with this peer
+	Relay              string                             // ID of a peer relaying traffic to this peer. Empty when connected without relay
+	reach              map[string]time.Time               // IDs of peers reachable from this peer and time they were advertised
+	direct             bool                               // Whether peer is reconnected on known endpoints without bootstrap
+	static             bool                               // Whether peer is configured statically and never requested from DHT
+}
+
+// logFields returns context of log records of the peer
+func (np *NetworkPeer) logFields(ptpc *PeerToPeer) Fields {
+	fields := Fields{Peer: np.ID, Subsystem: SubsystemPeer}
+	if ptpc != nil {
+		fields.Hash = ptpc.Hash
+	}
+	if endpoint := np.Endpoint; endpoint != nil {
+		fields.Endpoint = endpoint.String()
+	}
+	return fields
 }
 
 func (np *NetworkPeer) reportState(ptpc *PeerToPeer) error {
@@ -41,7 +61,7 @@ func (np *NetworkPeer) reportState(ptpc *PeerToPeer) error {
 		return fmt.Errorf("reportState: nil ptp")
 	}
 	stateStr := strconv.Itoa(int(np.State))
-	Log(Trace, "Reporting state %s to %s", StringifyState(np.State), np.ID)
+	LogWith(Trace, np.logFields(ptpc), "Reporting state %s to %s", StringifyState(np.State), np.ID)
 	ptpc.Dht.sendState(np.ID, stateStr)
 	return nil
 }
@@ -55,7 +75,13 @@ func (np *NetworkPeer) SetState(state PeerState, ptpc *PeerToPeer) error {
 		return fmt.Errorf("nil dht")
 	}
 	if state != np.State {
-		Log(Debug, "Peer %s changed state from %s to %s", np.ID, StringifyState(np.State), StringifyState(state))
+		LogWith(Debug, np.logFields(ptpc), "Peer %s changed state from %s to %s", np.ID, StringifyState(np.State), StringifyState(state))
+		PublishEvent(Event{Type: EventPeerState, Hash: ptpc.Hash, Peer: np.ID, State: StringifyState(state)})
+	}
+	if state == PeerStateConnected && np.State != PeerStateConnected {
+		ptpc.runHook(HookPeerConnect, np)
+	} else if state != PeerStateConnected && np.State == PeerStateConnected {
+		ptpc.runHook(HookPeerDisconnect, np)
 	}
 	np.State = state
 	np.reportState(ptpc)
@@ -98,7 +124,7 @@ func (np *NetworkPeer) Run(ptpc *PeerToPeer) error {
 
 	for {
 		if np.State == PeerStateStop {
-			Log(Debug, "Stopping peer %s", np.ID)
+			LogWith(Debug, np.logFields(ptpc), "Stopping peer %s", np.ID)
 			break
 		}
 		if ptpc.Dht.ID == "" {
@@ -112,17 +138,17 @@ func (np *NetworkPeer) Run(ptpc *PeerToPeer) error {
 
 		callback, exists := np.handlers[np.State]
 		if !exists {
-			Log(Error, "Peer %s is in unknown state: %d", np.ID, int(np.State))
+			LogWith(Error, np.logFields(ptpc), "Peer %s is in unknown state: %d", np.ID, int(np.State))
 			time.Sleep(1 * time.Second)
 			continue
 		}
 		err := callback(ptpc)
 		if err != nil {
-			Log(Warning, "Peer %s: %v", np.ID, err)
+			LogWith(Warning, np.logFields(ptpc), "Peer %s: %v", np.ID, err)
 		}
 		time.Sleep(time.Millisecond * 500)
 	}
-	Log(Info, "Peer %s has been stopped", np.ID)
+	LogWith(Info, np.logFields(ptpc), "Peer %s has been stopped", np.ID)
 	return nil
 }
 
@@ -134,12 +160,24 @@ func (np *NetworkPeer) stateInit(ptpc *PeerToPeer) error {
 	if ptpc == nil {
 		return fmt.Errorf("nil ptp")
 	}
+	if np.static {
+		// Endpoints and addresses of static peers are configured
+		LogWith(Debug, np.logFields(ptpc), "Initializing static peer: %s", np.ID)
+		np.Endpoint = nil
+		np.Relay = ""
+		np.session.reset()
+		np.SetState(PeerStateConnecting, ptpc)
+		return nil
+	}
 	// Send request about IPs of a peer
-	Log(Debug, "Initializing new peer: %s", np.ID)
+	LogWith(Debug, np.logFields(ptpc), "Initializing new peer: %s", np.ID)
 	ptpc.Dht.sendNode(np.ID, []net.IP{})
 	np.Endpoint = nil
 	np.PeerHW = nil
 	np.PeerLocalIP = nil
+	np.PeerLocalIPv6 = nil
+	np.Relay = ""
+	np.session.reset()
 
 	if len(np.KnownIPs) == 0 {
 		np.SetState(PeerStateRequestedIP, ptpc)
@@ -164,13 +202,13 @@ func (np *NetworkPeer) stateRequestedIP(ptpc *PeerToPeer) error {
 	if ptpc.Dht == nil {
 		return fmt.Errorf("nil dht")
 	}
-	Log(Debug, "Waiting network addresses for peer: %s", np.ID)
+	LogWith(Debug, np.logFields(ptpc), "Waiting network addresses for peer: %s", np.ID)
 	requestSentAt := time.Now()
 	updateInterval := time.Duration(time.Millisecond * 1000)
 	attempts := 0
 	for {
 		if time.Since(requestSentAt) > updateInterval {
-			Log(Warning, "Didn't got network addresses for peer. Requesting again")
+			LogWith(Warning, np.logFields(ptpc), "Didn't got network addresses for peer. Requesting again")
 			requestSentAt = time.Now()
 			err := ptpc.Dht.sendNode(np.ID, []net.IP{})
 			if err != nil {
@@ -197,7 +235,7 @@ func (np *NetworkPeer) stateDisconnect(ptpc *PeerToPeer) error {
 	if ptpc == nil {
 		return fmt.Errorf("nil ptp")
 	}
-	Log(Debug, "Disconnecting %s", np.ID)
+	LogWith(Debug, np.logFields(ptpc), "Disconnecting %s", np.ID)
 	np.SetState(PeerStateStop, ptpc)
 	// TODO: Send stop to DHT
 	return nil
@@ -208,7 +246,7 @@ func (np *NetworkPeer) stateStop(ptpc *PeerToPeer) error {
 	if ptpc == nil {
 		return fmt.Errorf("nil ptp")
 	}
-	Log(Debug, "Peer %s has been stopped", np.ID)
+	LogWith(Debug, np.logFields(ptpc), "Peer %s has been stopped", np.ID)
 	return nil
 }
 
@@ -231,7 +269,7 @@ func (np *NetworkPeer) stateConnecting(ptpc *PeerToPeer) error {
 	if ptpc == nil {
 		return fmt.Errorf("nil ptp")
 	}
-	Log(Debug, "Connecting to %s", np.ID)
+	LogWith(Debug, np.logFields(ptpc), "Connecting to %s", np.ID)
 
 	started := time.Now()
 	np.punchUDPHole(ptpc)
@@ -242,13 +280,18 @@ func (np *NetworkPeer) stateConnecting(ptpc *PeerToPeer) error {
 			np.SetState(PeerStateConnected, ptpc)
 			return nil
 		}
-		if time.Since(started) > time.Duration(time.Millisecond*3000) && np.RemoteState == PeerStateWaitingToConnect {
+		if time.Since(started) > time.Duration(time.Millisecond*3000) && np.RemoteState == PeerStateWaitingToConnect && !np.static {
 			np.SetState(PeerStateDisconnect, ptpc)
 			return nil
 		}
 		time.Sleep(time.Millisecond * 100)
 	}
-	Log(Debug, "Couldn't connect to the peer in any way")
+	if np.static || (np.direct && np.ConnectionAttempts < PeerCacheAttempts) {
+		LogWith(Debug, np.logFields(ptpc), "Peer %s is not reachable on known endpoints yet", np.ID)
+		np.SetState(PeerStateCooldown, ptpc)
+		return nil
+	}
+	LogWith(Debug, np.logFields(ptpc), "Couldn't connect to the peer in any way")
 	np.SetState(PeerStateDisconnect, ptpc)
 	return nil
 }
@@ -270,12 +313,17 @@ func (np *NetworkPeer) punchUDPHole(ptpc *PeerToPeer) error {
 	np.LastPunch = time.Now()
 	eps := []*net.UDPAddr{}
 	eps = append(eps, np.Proxies...)
+	np.Lock.RLock()
 	eps = append(eps, np.KnownIPs...)
-	Log(Debug, "Hole punching %s", np.ID)
+	np.Lock.RUnlock()
+	LogWith(Debug, np.logFields(ptpc), "Hole punching %s", np.ID)
 
 	np.punchingInProgress = true
 	np.RoutingRequired = true
 	for _, ep := range eps {
+		if !ptpc.UDPSocket.isReachable(ep) {
+			continue
+		}
 		round := 0
 		maxRounds := 10
 		isPrivate, _ := isPrivateIP(ep.IP)
@@ -288,20 +336,30 @@ func (np *NetworkPeer) punchUDPHole(ptpc *PeerToPeer) error {
 				continue
 			}
 			payload := []byte(ptpc.Dht.ID + ep.String())
-			msg, err := ptpc.CreateMessage(MsgTypeIntroReq, payload, 0, true)
+			if ptpc.Crypter.IsActive() && ptpc.Identity != nil {
+				kx, err := ptpc.keyExchangePayload(np)
+				if err == nil {
+					payload = append(payload, []byte(keyExchangeSeparator+kx)...)
+				}
+			}
+			payload = ptpc.appendInviteClaim(payload)
+			msg, err := ptpc.createMessageFor(np.ID, MsgTypeIntroReq, payload)
 			if err != nil {
-				Log(Error, "Couldn't create an intro message: %s", err)
+				LogWith(Error, np.logFields(ptpc), "Couldn't create an intro message: %s", err)
 				continue
 			}
 			_, err = ptpc.UDPSocket.SendMessage(msg, ep)
 			if err != nil {
-				Log(Error, "Failed to send message to %s: %s", ep.String(), err)
+				LogWith(Error, np.logFields(ptpc), "Failed to send message to %s: %s", ep.String(), err)
 				continue
 			}
 			time.Sleep(time.Millisecond * 50)
 			round++
 		}
 	}
+	// Peers which reach both sides are used when direct
+	// connection can't be established
+	np.punchRelays(ptpc)
 	np.punchingInProgress = false
 	return nil
 }
@@ -349,14 +407,14 @@ func (np *NetworkPeer) stateWaitingToConnect(ptpc *PeerToPeer) error {
 	if ptpc == nil {
 		return fmt.Errorf("nil ptp")
 	}
-	Log(Debug, "Waiting for peer [%s] to join connection state", np.ID)
+	LogWith(Debug, np.logFields(ptpc), "Waiting for peer [%s] to join connection state", np.ID)
 	started := time.Now()
 	timeout := time.Duration(30000 * time.Millisecond)
 	recheck := time.Now()
 	recheckTimeout := time.Duration(5000 * time.Millisecond)
 	for {
 		if np.RemoteState == PeerStateWaitingToConnect || np.RemoteState == PeerStateConnecting || np.RemoteState == PeerStateConnected {
-			Log(Debug, "Peer [%s] have joined required state: %s", np.ID, StringifyState(np.RemoteState))
+			LogWith(Debug, np.logFields(ptpc), "Peer [%s] have joined required state: %s", np.ID, StringifyState(np.RemoteState))
 			np.SetState(PeerStateConnecting, ptpc)
 			break
 		}
@@ -367,7 +425,7 @@ func (np *NetworkPeer) stateWaitingToConnect(ptpc *PeerToPeer) error {
 			return fmt.Errorf("Wait for connection failed: Peer doesn't responded in a timely manner")
 		}
 		if time.Since(recheck) > recheckTimeout && int(np.RemoteState) != 0 {
-			Log(Debug, "Peer %s is in %s state", np.ID, StringifyState(np.RemoteState))
+			LogWith(Debug, np.logFields(ptpc), "Peer %s is in %s state", np.ID, StringifyState(np.RemoteState))
 			recheck = time.Now()
 			np.reportState(ptpc)
 		}
@@ -379,11 +437,12 @@ func (np *NetworkPeer) stateWaitingToConnect(ptpc *PeerToPeer) error {
 	return nil
 }
 
-func (np *NetworkPeer) sortEndpoints(ptpc *PeerToPeer) ([]*Endpoint, []*Endpoint, []*Endpoint) {
+func (np *NetworkPeer) sortEndpoints(ptpc *PeerToPeer) ([]*Endpoint, []*Endpoint, []*Endpoint, []*Endpoint) {
 	np.Lock.RLock()
 	locals := []*Endpoint{}
 	internet := []*Endpoint{}
 	proxies := []*Endpoint{}
+	relays := []*Endpoint{}
 	for _, ep := range np.EndpointsHeap {
 		if time.Since(ep.LastContact) > EndpointTimeout {
 			np.RoutingRequired = true
@@ -394,6 +453,25 @@ func (np *NetworkPeer) sortEndpoints(ptpc *PeerToPeer) ([]*Endpoint, []*Endpoint
 			continue
 		}
 
+		// IPv6 endpoints are used alongside IPv4 ones when
+		// socket supports both families
+		if ptpc != nil && !ptpc.UDPSocket.isReachable(ep.Addr) {
+			continue
+		}
+
+		isNew := true
+		if ep.Relay != "" {
+			for _, sep := range relays {
+				if sep.Addr.String() == ep.Addr.String() {
+					isNew = false
+				}
+			}
+			if isNew {
+				relays = append(relays, ep)
+			}
+			continue
+		}
+
 		// Check if it's proxy
 		isProxy := false
 		for _, proxy := range np.Proxies {
@@ -402,7 +480,6 @@ func (np *NetworkPeer) sortEndpoints(ptpc *PeerToPeer) ([]*Endpoint, []*Endpoint
 				break
 			}
 		}
-		isNew := true
 		if isProxy {
 			for _, sep := range proxies {
 				if sep.Addr.String() == ep.Addr.String() {
@@ -441,7 +518,7 @@ func (np *NetworkPeer) sortEndpoints(ptpc *PeerToPeer) ([]*Endpoint, []*Endpoint
 		}
 	}
 	np.Lock.RUnlock()
-	return locals, internet, proxies
+	return locals, internet, proxies, relays
 }
 
 func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
@@ -453,7 +530,7 @@ func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
 	}
 
 	stat := PeerStats{}
-	locals, internet, proxies := np.sortEndpoints(ptpc)
+	locals, internet, proxies, relays := np.sortEndpoints(ptpc)
 
 	if np.RoutingRequired {
 		np.RoutingRequired = false
@@ -462,19 +539,33 @@ func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
 		np.EndpointsHeap = append(np.EndpointsHeap, locals...)
 		np.EndpointsHeap = append(np.EndpointsHeap, internet...)
 		np.EndpointsHeap = append(np.EndpointsHeap, proxies...)
+		np.EndpointsHeap = append(np.EndpointsHeap, relays...)
 		np.Lock.Unlock()
 
 		stat.localNum = len(locals)
 		stat.internetNum = len(internet)
 		stat.proxyNum = len(proxies)
+		stat.relayNum = len(relays)
 		np.Stat = stat
 
 		if len(np.EndpointsHeap) > 0 {
 			np.Endpoint = np.EndpointsHeap[0].Addr
+			np.Relay = np.EndpointsHeap[0].Relay
 			np.ConnectionAttempts = 0
+		} else if np.static || (ptpc.Dht != nil && !ptpc.Dht.IsConnected() && len(np.KnownIPs) > 0) {
+			// Peer can't be found again while bootstrap nodes are
+			// unreachable, so we keep punching its known endpoints.
+			// Static peers are never found in DHT at all
+			LogWith(Debug, np.logFields(ptpc), "No active endpoints and no bootstrap. Reconnecting peer %s directly", np.ID)
+			np.Endpoint = nil
+			np.Relay = ""
+			np.direct = true
+			np.ConnectionAttempts = 0
+			np.SetState(PeerStateConnecting, ptpc)
 		} else {
-			Log(Debug, "No active endpoints. Disconnecting peer %s", np.ID)
+			LogWith(Debug, np.logFields(ptpc), "No active endpoints. Disconnecting peer %s", np.ID)
 			np.Endpoint = nil
+			np.Relay = ""
 			np.SetState(PeerStateDisconnect, ptpc)
 		}
 		return nil
@@ -485,12 +576,15 @@ func (np *NetworkPeer) route(ptpc *PeerToPeer) error {
 		return nil
 	}
 
-	// If current active endpoint is a proxy we will force routing
+	// If current active endpoint is a proxy or a relay we will force routing
 	for _, proxy := range proxies {
 		if proxy.Addr.String() == np.Endpoint.String() {
 			np.RoutingRequired = true
 		}
 	}
+	if np.Relay != "" {
+		np.RoutingRequired = true
+	}
 
 	return nil
 }
@@ -509,7 +603,7 @@ func (np *NetworkPeer) stateConnected(ptpc *PeerToPeer) error {
 
 	if time.Since(np.LastPunch) > time.Duration(time.Millisecond*30000) && np.Stat.localNum < 1 && np.Stat.internetNum < 1 {
 		np.Stat.reconnect()
-		Log(Info, "New hole punch activity: Local %d Internet %d", np.Stat.localNum, np.Stat.internetNum)
+		LogWith(Info, np.logFields(ptpc), "New hole punch activity: Local %d Internet %d", np.Stat.localNum, np.Stat.internetNum)
 		go np.punchUDPHole(ptpc)
 	}
 
@@ -517,7 +611,7 @@ func (np *NetworkPeer) stateConnected(ptpc *PeerToPeer) error {
 	np.syncWithRemoteState(ptpc)
 
 	// if time.Since(np.LastFind) > time.Duration(time.Second*90) {
-	// 	Log(Debug, "No endpoints and no updates from DHT")
+	// 	LogWith(Debug, np.logFields(ptpc), "No endpoints and no updates from DHT")
 	// 	np.SetState(PeerStateDisconnect, ptpc)
 	// }
 
@@ -528,7 +622,7 @@ func (np *NetworkPeer) stateCooldown(ptpc *PeerToPeer) error {
 	if ptpc == nil {
 		return fmt.Errorf("nil ptp")
 	}
-	Log(Debug, "Peer %s in cooldown", np.ID)
+	LogWith(Debug, np.logFields(ptpc), "Peer %s in cooldown", np.ID)
 	started := time.Now()
 	for time.Since(started) < time.Duration(time.Second*20) {
 		time.Sleep(time.Millisecond * 100)
@@ -560,6 +654,20 @@ func (np *NetworkPeer) addEndpoint(addr *net.UDPAddr) error {
 	return nil
 }
 
+// addKnownIP appends address to the list of known addresses of the peer.
+// Returns false if address is already known
+func (np *NetworkPeer) addKnownIP(addr *net.UDPAddr) bool {
+	np.Lock.Lock()
+	defer np.Lock.Unlock()
+	for _, known := range np.KnownIPs {
+		if known.String() == addr.String() {
+			return false
+		}
+	}
+	np.KnownIPs = append(np.KnownIPs, addr)
+	return true
+}
+
 // This method will send xpeer ping message to endpoints
 // if ping timeout has been passed
 func (np *NetworkPeer) pingEndpoints(ptpc *PeerToPeer) error {
@@ -574,8 +682,12 @@ func (np *NetworkPeer) pingEndpoints(ptpc *PeerToPeer) error {
 	}
 	np.Lock.RLock()
 	for _, ep := range np.EndpointsHeap {
+		// Relay endpoints are kept alive by reachability advertisements
+		if ep.Relay != "" {
+			continue
+		}
 		if time.Since(ep.LastPing) > EndpointPingInterval {
-			ep.ping(ptpc, ptpc.Dht.ID)
+			ep.ping(ptpc, ptpc.Dht.ID, np.ID)
 			time.Sleep(time.Millisecond * 50)
 		}
 	}
@@ -592,17 +704,17 @@ func (np *NetworkPeer) syncWithRemoteState(ptpc *PeerToPeer) error {
 		return fmt.Errorf("nil ptp")
 	}
 	if np.RemoteState == PeerStateDisconnect {
-		Log(Debug, "Peer %s disconnecting", np.ID)
+		LogWith(Debug, np.logFields(ptpc), "Peer %s disconnecting", np.ID)
 		np.SetState(PeerStateDisconnect, ptpc)
 	} else if np.RemoteState == PeerStateStop {
-		Log(Debug, "Peer %s has been stopped", np.ID)
+		LogWith(Debug, np.logFields(ptpc), "Peer %s has been stopped", np.ID)
 		np.SetState(PeerStateDisconnect, ptpc)
 	} else if np.RemoteState == PeerStateInit {
-		Log(Debug, "Remote peer %s decided to reconnect", np.ID)
+		LogWith(Debug, np.logFields(ptpc), "Remote peer %s decided to reconnect", np.ID)
 		// TODO: Consider moving to Disconnect state here
 		np.SetState(PeerStateInit, ptpc)
 	} else if np.RemoteState == PeerStateWaitingToConnect {
-		Log(Debug, "Peer %s is waiting for us to connect", np.ID)
+		LogWith(Debug, np.logFields(ptpc), "Peer %s is waiting for us to connect", np.ID)
 		np.SetState(PeerStateWaitingToConnect, ptpc)
 	}
 	return nil
@@ -0,0 +1,149 @@
+package ptp
+
+import (
+	"net"
+	"time"
+)
+
+// Peers of an instance are saved by daemon, so after restart instance
+// can punch holes to them directly while bootstrap nodes are unreachable
+// or haven't answered yet. Cache also keeps ID and port of the instance:
+// peers recognize us only by ID and reach us by known endpoints
+
+// Peer cache settings
+const (
+	PeerCacheMaxAge   = time.Duration(time.Hour * 24 * 7) // Peers not seen for this long are not restored
+	PeerCacheAttempts = 5                                 // Hole punching rounds before cached peer is dropped
+	PeerCacheInterval = time.Duration(time.Second * 30)   // How often daemon saves peers
+	PeerCacheWait     = time.Duration(time.Second * 10)   // How long daemon waits for bootstrap before restoring from cache
+)
+
+// CachedPeer is a snapshot of a peer saved between restarts
+type CachedPeer struct {
+	ID       string    `yaml:"id"`
+	Endpoint string    `yaml:"endpoint,omitempty"` // Last endpoint peer was reachable on
+	KnownIPs []string  `yaml:"known_ips,omitempty"`
+	Proxies  []string  `yaml:"proxies,omitempty"`
+	IP       string    `yaml:"ip,omitempty"`
+	Mac      string    `yaml:"mac,omitempty"`
+	LastSeen time.Time `yaml:"last_seen"`
+}
+
+// PeerCache is a snapshot of instance peers
+type PeerCache struct {
+	ID    string       `yaml:"id"`   // ID of the instance
+	Port  int          `yaml:"port"` // UDP port of the instance
+	Peers []CachedPeer `yaml:"peers"`
+}
+
+// SnapshotPeers returns peers which were connected at least once
+func (p *PeerToPeer) SnapshotPeers() *PeerCache {
+	cache := &PeerCache{}
+	if p.Dht != nil {
+		cache.ID = p.Dht.ID
+	}
+	if p.UDPSocket != nil {
+		cache.Port = p.UDPSocket.GetPort()
+	}
+	if p.Swarm == nil {
+		return cache
+	}
+	for _, peer := range p.Swarm.Get() {
+		if peer == nil || peer.State == PeerStateStop {
+			continue
+		}
+		seen := peer.LastContact
+		if peer.State == PeerStateConnected {
+			seen = time.Now()
+		}
+		if seen.IsZero() {
+			continue
+		}
+		cached := CachedPeer{ID: peer.ID, LastSeen: seen}
+		if peer.Endpoint != nil && peer.Relay == "" {
+			cached.Endpoint = peer.Endpoint.String()
+		}
+		for _, addr := range peer.KnownIPs {
+			cached.KnownIPs = append(cached.KnownIPs, addr.String())
+		}
+		for _, addr := range peer.Proxies {
+			cached.Proxies = append(cached.Proxies, addr.String())
+		}
+		if peer.PeerLocalIP != nil {
+			cached.IP = peer.PeerLocalIP.String()
+		}
+		if peer.PeerHW != nil {
+			cached.Mac = peer.PeerHW.String()
+		}
+		if cached.Endpoint == "" && len(cached.KnownIPs) == 0 && len(cached.Proxies) == 0 {
+			continue
+		}
+		cache.Peers = append(cache.Peers, cached)
+	}
+	return cache
+}
+
+// RestorePeers starts connecting to cached peers without waiting for
+// bootstrap nodes. Peers already known from DHT are skipped
+func (p *PeerToPeer) RestorePeers(cache *PeerCache) int {
+	if cache == nil || p.Swarm == nil || p.Dht == nil {
+		return 0
+	}
+	restored := 0
+	for _, cached := range cache.Peers {
+		if len(cached.ID) != 36 || cached.ID == p.Dht.ID || !p.ACL.Allowed(cached.ID) {
+			continue
+		}
+		if time.Since(cached.LastSeen) > PeerCacheMaxAge {
+			LogWith(Debug, p.logFields(SubsystemPeer), "Cached peer %s is too old", cached.ID)
+			continue
+		}
+		if p.Swarm.GetPeer(cached.ID) != nil {
+			continue
+		}
+		peer := cached.peer()
+		if len(peer.KnownIPs) == 0 && len(peer.Proxies) == 0 {
+			continue
+		}
+		LogWith(Info, p.logFields(SubsystemPeer), "Restoring cached peer %s", peer.ID)
+		peer.SetState(PeerStateConnecting, p)
+		p.Swarm.Update(peer.ID, peer)
+		p.Swarm.RunPeer(peer.ID, p)
+		restored++
+	}
+	return restored
+}
+
+// peer creates network peer from snapshot. Last endpoint is tried first
+func (c *CachedPeer) peer() *NetworkPeer {
+	peer := &NetworkPeer{
+		ID:          c.ID,
+		LastContact: c.LastSeen,
+		direct:      true,
+	}
+	addrs := append([]string{c.Endpoint}, c.KnownIPs...)
+	for _, a := range addrs {
+		addr, err := resolveUDPAddr(a)
+		if a == "" || err != nil {
+			continue
+		}
+		isNew := true
+		for _, known := range peer.KnownIPs {
+			if known.String() == addr.String() {
+				isNew = false
+			}
+		}
+		if isNew {
+			peer.KnownIPs = append(peer.KnownIPs, addr)
+		}
+	}
+	for _, a := range c.Proxies {
+		addr, err := resolveUDPAddr(a)
+		if err == nil {
+			peer.Proxies = append(peer.Proxies, addr)
+		}
+	}
+	peer.PeerLocalIP = net.ParseIP(c.IP)
+	peer.PeerHW, _ = net.ParseMAC(c.Mac)
+	return peer
+}
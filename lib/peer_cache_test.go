@@ -0,0 +1,120 @@
+package ptp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPeerToPeer_SnapshotPeers(t *testing.T) {
+	endpoint, _ := net.ResolveUDPAddr("udp4", "192.168.0.2:1234")
+	public, _ := net.ResolveUDPAddr("udp4", "1.2.3.4:1234")
+	proxy, _ := net.ResolveUDPAddr("udp4", "5.6.7.8:6882")
+	mac, _ := net.ParseMAC("06:00:00:00:00:01")
+
+	p := &PeerToPeer{Dht: &DHTClient{ID: "00000000-0000-0000-0000-000000000000"}, Swarm: new(Swarm)}
+	p.Swarm.Init()
+	p.Swarm.Update("11111111-1111-1111-1111-111111111111", &NetworkPeer{
+		ID:          "11111111-1111-1111-1111-111111111111",
+		State:       PeerStateConnected,
+		Endpoint:    endpoint,
+		KnownIPs:    []*net.UDPAddr{public, endpoint},
+		Proxies:     []*net.UDPAddr{proxy},
+		PeerLocalIP: net.ParseIP("10.0.0.2"),
+		PeerHW:      mac,
+	})
+	// Peer which was never reached is not cached
+	p.Swarm.Update("22222222-2222-2222-2222-222222222222", &NetworkPeer{
+		ID:       "22222222-2222-2222-2222-222222222222",
+		State:    PeerStateWaitingToConnect,
+		KnownIPs: []*net.UDPAddr{public},
+	})
+	p.Swarm.Update("33333333-3333-3333-3333-333333333333", &NetworkPeer{
+		ID:          "33333333-3333-3333-3333-333333333333",
+		State:       PeerStateStop,
+		KnownIPs:    []*net.UDPAddr{public},
+		LastContact: time.Now(),
+	})
+
+	cache := p.SnapshotPeers()
+	if cache.ID != p.Dht.ID || len(cache.Peers) != 1 {
+		t.Fatalf("PeerToPeer.SnapshotPeers() = %+v", cache)
+	}
+	got := cache.Peers[0]
+	got.LastSeen = time.Time{}
+	want := CachedPeer{
+		ID:       "11111111-1111-1111-1111-111111111111",
+		Endpoint: "192.168.0.2:1234",
+		KnownIPs: []string{"1.2.3.4:1234", "192.168.0.2:1234"},
+		Proxies:  []string{"5.6.7.8:6882"},
+		IP:       "10.0.0.2",
+		Mac:      "06:00:00:00:00:01",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PeerToPeer.SnapshotPeers() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPeerToPeer_RestorePeers(t *testing.T) {
+	p := &PeerToPeer{Dht: &DHTClient{ID: "00000000-0000-0000-0000-000000000000"}, Swarm: new(Swarm)}
+	p.Swarm.Init()
+	p.Swarm.Update("44444444-4444-4444-4444-444444444444", &NetworkPeer{ID: "44444444-4444-4444-4444-444444444444", Running: true})
+
+	cache := &PeerCache{Peers: []CachedPeer{
+		{ID: "11111111-1111-1111-1111-111111111111", Endpoint: "192.168.0.2:1234", KnownIPs: []string{"1.2.3.4:1234", "192.168.0.2:1234"}, IP: "10.0.0.2", Mac: "06:00:00:00:00:01", LastSeen: time.Now()},
+		{ID: "22222222-2222-2222-2222-222222222222", KnownIPs: []string{"1.2.3.4:1234"}, LastSeen: time.Now().Add(-PeerCacheMaxAge * 2)},
+		{ID: "00000000-0000-0000-0000-000000000000", KnownIPs: []string{"1.2.3.4:1234"}, LastSeen: time.Now()},
+		{ID: "44444444-4444-4444-4444-444444444444", KnownIPs: []string{"1.2.3.4:1234"}, LastSeen: time.Now()},
+		{ID: "55555555-5555-5555-5555-555555555555", KnownIPs: []string{"bad address"}, LastSeen: time.Now()},
+		{ID: "short", KnownIPs: []string{"1.2.3.4:1234"}, LastSeen: time.Now()},
+	}}
+	if got := p.RestorePeers(cache); got != 1 {
+		t.Fatalf("PeerToPeer.RestorePeers() = %d, want 1", got)
+	}
+	peer := p.Swarm.GetPeer("11111111-1111-1111-1111-111111111111")
+	if peer == nil || !peer.direct || len(peer.KnownIPs) != 2 || peer.KnownIPs[0].String() != "192.168.0.2:1234" {
+		t.Fatalf("Cached peer was restored incorrectly: %+v", peer)
+	}
+	if !peer.PeerLocalIP.Equal(net.ParseIP("10.0.0.2")) || peer.PeerHW.String() != "06:00:00:00:00:01" {
+		t.Errorf("Cached peer addresses weren't restored: %s %s", peer.PeerLocalIP, peer.PeerHW)
+	}
+	if id, _ := p.Swarm.GetID("10.0.0.2"); id != peer.ID {
+		t.Errorf("Cached peer isn't reachable by IP")
+	}
+	peer.SetState(PeerStateStop, p)
+}
+
+func TestNetworkPeer_route_withoutBootstrap(t *testing.T) {
+	known, _ := net.ResolveUDPAddr("udp4", "1.2.3.4:1234")
+	tests := []struct {
+		name      string
+		connected bool
+		static    bool
+		knownIPs  []*net.UDPAddr
+		want      PeerState
+		direct    bool
+	}{
+		{"bootstrap available", true, false, []*net.UDPAddr{known}, PeerStateDisconnect, false},
+		{"bootstrap unavailable", false, false, []*net.UDPAddr{known}, PeerStateConnecting, true},
+		{"no known endpoints", false, false, nil, PeerStateDisconnect, false},
+		{"static peer", true, true, []*net.UDPAddr{known}, PeerStateConnecting, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PeerToPeer{Dht: new(DHTClient)}
+			p.Dht.SetConnected(tt.connected)
+			np := &NetworkPeer{
+				State:           PeerStateConnected,
+				static:          tt.static,
+				KnownIPs:        tt.knownIPs,
+				RoutingRequired: true,
+				EndpointsHeap:   []*Endpoint{{Addr: known, LastContact: time.Now().Add(-EndpointTimeout * 2)}},
+			}
+			np.route(p)
+			if np.State != tt.want || np.direct != tt.direct {
+				t.Errorf("NetworkPeer.route() state = %s, direct = %v", StringifyState(np.State), np.direct)
+			}
+		})
+	}
+}
@@ -1,15 +1,20 @@
 package ptp
 
-import "time"
+import (
+	"net"
+	"sync"
+	"time"
+)
 
 // PeerStats represents different peer statistics
-// localNum, internetNum and proxyNum are the number of endpoints in local network, internet and over proxy
+// localNum, internetNum, proxyNum and relayNum are the number of endpoints in local network, internet, over proxy and over relay
 // connectionsNum and reconnctsNum represents number of connection attempts made during the lifetime of the peer
 // PeerStats also keeps different timestamps related to connections
 type PeerStats struct {
 	localNum         int       // Number of local network connections
 	internetNum      int       // Number of internet connections
 	proxyNum         int       // Number of proxy connections
+	relayNum         int       // Number of connections over relaying peers
 	connectionsNum   int       // Number of connections attempts in a single connection cyclce (not reconnect after connection was established)
 	reconnectsNum    int       // Number of reconnects
 	startedAt        time.Time // Time when peer was started
@@ -91,3 +96,150 @@ func (p *PeerStats) GetConnectionsNum() int {
 func (p *PeerStats) GetReconnectsNum() int {
 	return p.reconnectsNum
 }
+
+// EndpointClass is a kind of endpoint traffic with peer goes through
+type EndpointClass int
+
+// Classes of endpoints
+const (
+	EndpointLocal    EndpointClass = iota // Endpoint in local network
+	EndpointInternet                      // Public endpoint
+	EndpointProxy                         // Proxy server
+	EndpointRelay                         // Peer relaying traffic
+	endpointClasses
+)
+
+// TrafficRateInterval is a period traffic rates are calculated over
+const TrafficRateInterval = time.Duration(time.Second * 5)
+
+func (c EndpointClass) String() string {
+	switch c {
+	case EndpointLocal:
+		return "local"
+	case EndpointInternet:
+		return "internet"
+	case EndpointProxy:
+		return "proxy"
+	case EndpointRelay:
+		return "relay"
+	}
+	return "unknown"
+}
+
+// TrafficCounters are numbers of bytes and packets exchanged with peer
+type TrafficCounters struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+func (c *TrafficCounters) add(o TrafficCounters) {
+	c.BytesIn += o.BytesIn
+	c.BytesOut += o.BytesOut
+	c.PacketsIn += o.PacketsIn
+	c.PacketsOut += o.PacketsOut
+}
+
+// PeerTraffic accounts traffic exchanged with peer per class of endpoint
+// and calculates rates over the last complete interval
+type PeerTraffic struct {
+	classes     [endpointClasses]TrafficCounters
+	windowStart time.Time // Start of current rate interval
+	windowIn    uint64    // Bytes received during current interval
+	windowOut   uint64    // Bytes sent during current interval
+	rateIn      float64   // Bytes per second received during last interval
+	rateOut     float64   // Bytes per second sent during last interval
+	lock        sync.Mutex
+}
+
+// roll completes rate interval if it's over. Must be called with lock held
+func (t *PeerTraffic) roll(now time.Time) {
+	elapsed := now.Sub(t.windowStart)
+	if elapsed < TrafficRateInterval {
+		return
+	}
+	if elapsed < TrafficRateInterval*2 {
+		t.rateIn = float64(t.windowIn) / elapsed.Seconds()
+		t.rateOut = float64(t.windowOut) / elapsed.Seconds()
+	} else {
+		// No traffic was accounted during the whole previous interval
+		t.rateIn, t.rateOut = 0, 0
+	}
+	t.windowStart = now
+	t.windowIn, t.windowOut = 0, 0
+}
+
+func (t *PeerTraffic) received(class EndpointClass, size int, now time.Time) {
+	t.lock.Lock()
+	t.roll(now)
+	t.classes[class].BytesIn += uint64(size)
+	t.classes[class].PacketsIn++
+	t.windowIn += uint64(size)
+	t.lock.Unlock()
+}
+
+func (t *PeerTraffic) sent(class EndpointClass, size int, now time.Time) {
+	t.lock.Lock()
+	t.roll(now)
+	t.classes[class].BytesOut += uint64(size)
+	t.classes[class].PacketsOut++
+	t.windowOut += uint64(size)
+	t.lock.Unlock()
+}
+
+// Class returns traffic exchanged over endpoints of specified class
+func (t *PeerTraffic) Class(class EndpointClass) TrafficCounters {
+	if class < 0 || class >= endpointClasses {
+		return TrafficCounters{}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.classes[class]
+}
+
+// Total returns traffic exchanged over all endpoints
+func (t *PeerTraffic) Total() TrafficCounters {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	total := TrafficCounters{}
+	for _, c := range t.classes {
+		total.add(c)
+	}
+	return total
+}
+
+// Rates returns bytes per second received from and sent to peer
+func (t *PeerTraffic) Rates() (float64, float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.roll(time.Now())
+	return t.rateIn, t.rateOut
+}
+
+// endpointClass returns class of peer endpoint. Messages relayed by
+// another peer are accounted as relay traffic
+func (p *PeerToPeer) endpointClass(peer *NetworkPeer, addr *net.UDPAddr, relayed bool) EndpointClass {
+	if relayed {
+		return EndpointRelay
+	}
+	if addr == nil {
+		return EndpointInternet
+	}
+	for _, proxy := range peer.Proxies {
+		if proxy.IP.Equal(addr.IP) && proxy.Port == addr.Port {
+			return EndpointProxy
+		}
+	}
+	if p.ProxyManager != nil {
+		for _, proxy := range p.ProxyManager.GetList() {
+			if proxy.Addr != nil && proxy.Addr.IP.Equal(addr.IP) && proxy.Addr.Port == addr.Port {
+				return EndpointProxy
+			}
+		}
+	}
+	if private, _ := isPrivateIP(addr.IP); private {
+		return EndpointLocal
+	}
+	return EndpointInternet
+}
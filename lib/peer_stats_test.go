@@ -1,6 +1,7 @@
 package ptp
 
 import (
+	"net"
 	"reflect"
 	"testing"
 	"time"
@@ -545,3 +546,60 @@ func TestPeerStats_GetReconnectsNum(t *testing.T) {
 		})
 	}
 }
+
+func TestPeerTraffic(t *testing.T) {
+	now := time.Now()
+	traffic := &PeerTraffic{windowStart: now}
+	traffic.received(EndpointLocal, 1000, now)
+	traffic.sent(EndpointProxy, 500, now.Add(time.Second))
+	traffic.received(EndpointProxy, 4000, now.Add(time.Second*2))
+
+	if got, want := traffic.Total(), (TrafficCounters{BytesIn: 5000, BytesOut: 500, PacketsIn: 2, PacketsOut: 1}); got != want {
+		t.Errorf("PeerTraffic.Total() = %+v, want %+v", got, want)
+	}
+	if got, want := traffic.Class(EndpointProxy), (TrafficCounters{BytesIn: 4000, BytesOut: 500, PacketsIn: 1, PacketsOut: 1}); got != want {
+		t.Errorf("PeerTraffic.Class() = %+v, want %+v", got, want)
+	}
+	if got := traffic.Class(EndpointRelay); got != (TrafficCounters{}) {
+		t.Errorf("PeerTraffic.Class(relay) = %+v, want empty", got)
+	}
+
+	traffic.lock.Lock()
+	traffic.roll(now.Add(TrafficRateInterval))
+	rateIn, rateOut := traffic.rateIn, traffic.rateOut
+	traffic.roll(now.Add(TrafficRateInterval * 4))
+	idleIn := traffic.rateIn
+	traffic.lock.Unlock()
+	if rateIn != 1000 || rateOut != 100 {
+		t.Errorf("Rates = %v/%v, want 1000/100", rateIn, rateOut)
+	}
+	if idleIn != 0 {
+		t.Errorf("Rate of idle peer = %v, want 0", idleIn)
+	}
+}
+
+func TestPeerToPeer_endpointClass(t *testing.T) {
+	p := &PeerToPeer{ProxyManager: new(ProxyManager)}
+	p.ProxyManager.init()
+	p.ProxyManager.new(&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 6000})
+	peer := &NetworkPeer{Proxies: []*net.UDPAddr{{IP: net.ParseIP("198.51.100.2"), Port: 7000}}}
+	tests := []struct {
+		name    string
+		addr    *net.UDPAddr
+		relayed bool
+		want    EndpointClass
+	}{
+		{"relayed", &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 6000}, true, EndpointRelay},
+		{"local", &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 6000}, false, EndpointLocal},
+		{"internet", &net.UDPAddr{IP: net.ParseIP("203.0.113.5"), Port: 6000}, false, EndpointInternet},
+		{"own proxy", &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 6000}, false, EndpointProxy},
+		{"peer proxy", &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 7000}, false, EndpointProxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.endpointClass(peer, tt.addr, tt.relayed); got != tt.want {
+				t.Errorf("PeerToPeer.endpointClass() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
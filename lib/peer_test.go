@@ -1068,6 +1068,13 @@ func TestNetworkPeer_sortEndpoints(t *testing.T) {
 		ep4, ep5,
 	}
 
+	ep7 := &Endpoint{
+		Addr:        ra1,
+		Relay:       "relay-peer",
+		LastContact: time.Now(),
+		LastPing:    time.Now(),
+	}
+
 	tests := []struct {
 		name   string
 		fields fields
@@ -1075,13 +1082,15 @@ func TestNetworkPeer_sortEndpoints(t *testing.T) {
 		want   []*Endpoint
 		want1  []*Endpoint
 		want2  []*Endpoint
+		want3  []*Endpoint
 	}{
-		{"t1", fields{}, args{}, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}},
-		{"t2", fields{EndpointsHeap: r1}, args{}, r1, []*Endpoint{}, []*Endpoint{}},
-		{"t3", fields{EndpointsHeap: r2}, args{}, r2_2, []*Endpoint{}, []*Endpoint{}},
-		{"t4", fields{EndpointsHeap: r3}, args{}, []*Endpoint{}, r3, []*Endpoint{}},
-		{"t5", fields{EndpointsHeap: r1, Proxies: []*net.UDPAddr{la1, la2, la3}}, args{}, []*Endpoint{}, []*Endpoint{}, r1},
-		{"t6", fields{EndpointsHeap: []*Endpoint{ep6}}, args{}, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}},
+		{"t1", fields{}, args{}, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}},
+		{"t2", fields{EndpointsHeap: r1}, args{}, r1, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}},
+		{"t3", fields{EndpointsHeap: r2}, args{}, r2_2, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}},
+		{"t4", fields{EndpointsHeap: r3}, args{}, []*Endpoint{}, r3, []*Endpoint{}, []*Endpoint{}},
+		{"t5", fields{EndpointsHeap: r1, Proxies: []*net.UDPAddr{la1, la2, la3}}, args{}, []*Endpoint{}, []*Endpoint{}, r1, []*Endpoint{}},
+		{"t6", fields{EndpointsHeap: []*Endpoint{ep6}}, args{}, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}, []*Endpoint{}},
+		{"t7", fields{EndpointsHeap: []*Endpoint{ep7, ep1}, Proxies: []*net.UDPAddr{ra1}}, args{}, []*Endpoint{ep1}, []*Endpoint{}, []*Endpoint{}, []*Endpoint{ep7}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -1108,7 +1117,7 @@ func TestNetworkPeer_sortEndpoints(t *testing.T) {
 				Stat:               tt.fields.Stat,
 				RoutingRequired:    tt.fields.RoutingRequired,
 			}
-			got, got1, got2 := np.sortEndpoints(tt.args.ptpc)
+			got, got1, got2, got3 := np.sortEndpoints(tt.args.ptpc)
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NetworkPeer.sortEndpoints() got = %v, want %v", got, tt.want)
 			}
@@ -1118,6 +1127,9 @@ func TestNetworkPeer_sortEndpoints(t *testing.T) {
 			if !reflect.DeepEqual(got2, tt.want2) {
 				t.Errorf("NetworkPeer.sortEndpoints() got2 = %v, want %v", got2, tt.want2)
 			}
+			if !reflect.DeepEqual(got3, tt.want3) {
+				t.Errorf("NetworkPeer.sortEndpoints() got3 = %v, want %v", got3, tt.want3)
+			}
 		})
 	}
 }
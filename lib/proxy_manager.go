@@ -20,6 +20,7 @@ type ProxyManager struct {
 	proxies    map[string]*proxyServer
 	lock       sync.RWMutex
 	hasChanges bool
+	hash       string // Infohash of instance used in events
 }
 
 func (p *ProxyManager) init() error {
@@ -72,25 +73,35 @@ func (p *ProxyManager) new(endpoint *net.UDPAddr) error {
 	return nil
 }
 
+// connecting reports whether proxy with specified address is waiting
+// for registration to be confirmed
+func (p *ProxyManager) connecting(id string) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	proxy, exists := p.proxies[id]
+	return exists && proxy.Status == proxyConnecting
+}
+
 func (p *ProxyManager) check() {
 	proxies := p.get()
 	for id, proxy := range proxies {
 		if proxy.Status == proxyConnecting && time.Since(proxy.Created) > time.Duration(10*time.Second) {
 			err := proxy.Close()
 			if err != nil {
-				Log(Debug, "Failed to close proxy: %s", err)
+				LogWith(Debug, Fields{Hash: p.hash, Subsystem: SubsystemProxy}, "Failed to close proxy: %s", err)
 			}
-			Log(Debug, "Failed to connect to proxy %s", id)
+			LogWith(Debug, Fields{Hash: p.hash, Subsystem: SubsystemProxy}, "Failed to connect to proxy %s", id)
 		}
 		if proxy.Status == proxyActive && time.Since(proxy.LastUpdate) > time.Duration(90*time.Second) {
 			err := proxy.Close()
 			if err != nil {
-				Log(Debug, "Failed to close proxy: %s", err)
+				LogWith(Debug, Fields{Hash: p.hash, Subsystem: SubsystemProxy}, "Failed to close proxy: %s", err)
 			}
-			Log(Debug, "Proxy %s has been disconnected by timeout", id)
+			LogWith(Debug, Fields{Hash: p.hash, Subsystem: SubsystemProxy}, "Proxy %s has been disconnected by timeout", id)
+			PublishEvent(Event{Type: EventProxy, Hash: p.hash, State: "DISCONNECTED", Address: id})
 		}
 		if proxy.Status == proxyDisconnected {
-			Log(Debug, "Removing proxy %s", id)
+			LogWith(Debug, Fields{Hash: p.hash, Subsystem: SubsystemProxy}, "Removing proxy %s", id)
 			p.operate(OperateDelete, id, nil)
 			p.hasChanges = true
 		}
@@ -118,6 +129,7 @@ func (p *ProxyManager) activate(id string, endpoint *net.UDPAddr) bool {
 			proxy.LastUpdate = time.Now()
 			proxy.Endpoint = endpoint
 			p.operate(OperateUpdate, id, proxy)
+			PublishEvent(Event{Type: EventProxy, Hash: p.hash, State: "ACTIVE", Address: id})
 			return true
 		}
 	}
@@ -131,7 +143,7 @@ func (p *ProxyManager) setLatency(l time.Duration, addr *net.UDPAddr) error {
 			proxy.Latency = l
 			proxy.LastLatencyQuery = time.Now()
 			proxy.MeasureInProgress = false
-			Log(Trace, "Proxy %s is now on latency %d", addr.String(), NanoToMilliseconds(l.Nanoseconds()))
+			LogWith(Trace, Fields{Hash: p.hash, Subsystem: SubsystemProxy}, "Proxy %s is now on latency %d", addr.String(), NanoToMilliseconds(l.Nanoseconds()))
 			p.operate(OperateUpdate, id, proxy)
 			return nil
 		}
@@ -0,0 +1,352 @@
+package ptp
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Multi-hop relaying.
+// Every peer periodically tells connected peers which members of the swarm
+// it reaches directly. When neither direct nor proxy connection works, a
+// peer which reaches both sides is used as a relay: messages are wrapped
+// into an envelope with destination, origin and TTL and sent to the relay.
+// Relay passes the envelope further over its own route to the destination
+// decreasing TTL on every hop
+
+const (
+	// RelayTTL is a maximum number of hops for relayed message
+	RelayTTL uint8 = 4
+	// RelayAdvertiseInterval is how often peers advertise their reachability
+	RelayAdvertiseInterval = time.Millisecond * 5000
+	// ttl[1] dst[36] src[36]
+	relayHeaderSize = 73
+	// Reachability advertisement must fit into receive buffer after it's
+	// encrypted and wrapped into relay envelope. Larger lists are split
+	relayReachMaxSize = networkBufferSize - 2*HeaderSize - relayHeaderSize - 2*aes.BlockSize
+	relayReachMaxIDs  = (relayReachMaxSize - 38) / 36
+)
+
+// createRelayMessage wraps message into a relay envelope
+func (p *PeerToPeer) createRelayMessage(ttl uint8, dst, src string, inner *P2PMessage) (*P2PMessage, error) {
+	if inner == nil {
+		return nil, fmt.Errorf("nil message")
+	}
+	if len(dst) != 36 || len(src) != 36 {
+		return nil, fmt.Errorf("wrong ID length")
+	}
+	payload := make([]byte, relayHeaderSize)
+	payload[0] = ttl
+	copy(payload[1:37], dst)
+	copy(payload[37:73], src)
+	payload = append(payload, inner.Serialize()...)
+	return p.CreateMessage(MsgTypeRelay, payload, 0, false)
+}
+
+// sendOverRelay sends message to the peer with specified ID through relay
+// listening on provided address
+func (p *PeerToPeer) sendOverRelay(dst string, relay *net.UDPAddr, msg *P2PMessage) (int, error) {
+	if p.Dht == nil {
+		return -1, fmt.Errorf("nil dht")
+	}
+	if p.UDPSocket == nil {
+		return -1, fmt.Errorf("nil udp socket")
+	}
+	if relay == nil {
+		return -1, fmt.Errorf("nil relay address")
+	}
+	envelope, err := p.createRelayMessage(RelayTTL, dst, p.Dht.ID, msg)
+	if err != nil {
+		return -1, err
+	}
+	return p.UDPSocket.SendMessage(envelope, relay)
+}
+
+// sendToPeer sends message over active endpoint of the peer. Message is
+// wrapped into relay envelope when peer is reachable over relay only
+func (p *PeerToPeer) sendToPeer(peer *NetworkPeer, msg *P2PMessage) (int, error) {
+	if peer == nil {
+		return -1, fmt.Errorf("nil peer")
+	}
+	if p.UDPSocket == nil {
+		return -1, fmt.Errorf("nil udp socket")
+	}
+	endpoint := peer.Endpoint
+	if endpoint == nil {
+		return -1, fmt.Errorf("peer %s has no active endpoint", peer.ID)
+	}
+	var n int
+	var err error
+	if peer.Relay != "" {
+		n, err = p.sendOverRelay(peer.ID, endpoint, msg)
+	} else {
+		n, err = p.UDPSocket.SendMessage(msg, endpoint)
+	}
+	if err == nil {
+		p.Metrics.sent(n)
+		peer.Traffic.sent(p.endpointClass(peer, endpoint, peer.Relay != ""), n, time.Now())
+	}
+	return n, err
+}
+
+// replyTo sends response to the origin of received message
+func (p *PeerToPeer) replyTo(request *P2PMessage, srcAddr *net.UDPAddr, response *P2PMessage) (int, error) {
+	if request.origin != "" {
+		return p.sendOverRelay(request.origin, srcAddr, response)
+	}
+	if p.UDPSocket == nil {
+		return -1, fmt.Errorf("nil udp socket")
+	}
+	return p.UDPSocket.SendMessage(response, srcAddr)
+}
+
+// HandleRelayMessage processes relay envelope. Messages addressed to this
+// peer are unwrapped and handled as usual, other messages are passed to
+// the next hop. Envelopes are accepted only from directly connected
+// members of the swarm and only on behalf of known peers. Origin of
+// sealed frames is verified end-to-end with session keys of the origin
+func (p *PeerToPeer) HandleRelayMessage(msg *P2PMessage, srcAddr *net.UDPAddr) error {
+	if msg == nil {
+		return fmt.Errorf("nil message")
+	}
+	if srcAddr == nil {
+		return fmt.Errorf("nil source addr")
+	}
+	if p.Swarm == nil {
+		return fmt.Errorf("nil peer list")
+	}
+	if p.Dht == nil {
+		return fmt.Errorf("nil dht")
+	}
+	if len(msg.Data) < relayHeaderSize+HeaderSize {
+		return fmt.Errorf("relay message is too short")
+	}
+	ttl := msg.Data[0]
+	dst := string(msg.Data[1:37])
+	src := string(msg.Data[37:73])
+
+	if p.Swarm.GetPeerByEndpoint(srcAddr.String()) == nil {
+		LogWith(Trace, p.logFields(SubsystemRelay), "Relay envelope from unknown sender [%s]", srcAddr)
+		return fmt.Errorf("Relay envelope from unknown sender %s", srcAddr)
+	}
+	origin := p.Swarm.GetPeer(src)
+	if origin == nil {
+		LogWith(Trace, p.logFields(SubsystemRelay), "Relayed message from unknown peer %s [%s]", src, srcAddr)
+		return fmt.Errorf("Relayed message from unknown peer %s", src)
+	}
+
+	if dst == p.Dht.ID {
+		inner, err := P2PMessageFromBytes(msg.Data[relayHeaderSize:])
+		if err != nil || inner == nil {
+			return fmt.Errorf("Broken relayed message from %s", src)
+		}
+		if inner.Header.Type == MsgTypeRelay {
+			return fmt.Errorf("Nested relay message from %s", src)
+		}
+		inner.origin = src
+		origin.BumpEndpoint(srcAddr.String())
+		return p.handleMessage(inner, srcAddr)
+	}
+
+	if ttl <= 1 {
+		LogWith(Trace, p.logFields(SubsystemRelay), "Dropping relayed message from %s to %s: TTL expired", src, dst)
+		return fmt.Errorf("TTL expired")
+	}
+	target := p.Swarm.GetPeer(dst)
+	if target == nil || target.State != PeerStateConnected || target.Endpoint == nil {
+		return fmt.Errorf("Can't relay message to %s: peer is not connected", dst)
+	}
+	if target.Endpoint.String() == srcAddr.String() {
+		return fmt.Errorf("Can't relay message to %s: loop detected", dst)
+	}
+	envelope, err := p.CreateMessage(MsgTypeRelay, msg.Data, 0, false)
+	if err != nil {
+		return err
+	}
+	envelope.Data[0] = ttl - 1
+	_, err = p.UDPSocket.SendMessage(envelope, target.Endpoint)
+	return err
+}
+
+// advertiseReachability tells every connected peer which peers can be
+// reached directly from this peer
+func (p *PeerToPeer) advertiseReachability() error {
+	if p.Dht == nil {
+		return fmt.Errorf("nil dht")
+	}
+	if p.Swarm == nil {
+		return fmt.Errorf("nil peer list")
+	}
+	if time.Since(p.lastAdvertise) < RelayAdvertiseInterval {
+		return nil
+	}
+	p.lastAdvertise = time.Now()
+
+	peers := p.Swarm.Get()
+	ids := []string{}
+	for _, peer := range peers {
+		if peer.State == PeerStateConnected && peer.Endpoint != nil && peer.Relay == "" && len(peer.ID) == 36 {
+			ids = append(ids, peer.ID)
+		}
+	}
+	for _, payload := range reachPayloads(p.Dht.ID, ids) {
+		msg, err := p.CreateMessage(MsgTypeComm, payload, 0, true)
+		if err != nil {
+			return err
+		}
+		for _, peer := range peers {
+			if peer.State == PeerStateConnected && peer.Endpoint != nil {
+				p.sendToPeer(peer, msg)
+			}
+		}
+	}
+	return nil
+}
+
+// reachPayloads splits list of reachable peers into advertisements
+// of at most relayReachMaxIDs peers each
+func reachPayloads(id string, ids []string) [][]byte {
+	payloads := [][]byte{}
+	for len(payloads) == 0 || len(ids) > 0 {
+		n := len(ids)
+		if n > relayReachMaxIDs {
+			n = relayReachMaxIDs
+		}
+		payload := make([]byte, 38, 38+n*36)
+		binary.BigEndian.PutUint16(payload[0:2], CommRelayReach)
+		copy(payload[2:38], id)
+		for _, reached := range ids[:n] {
+			payload = append(payload, []byte(reached)...)
+		}
+		payloads = append(payloads, payload)
+		ids = ids[n:]
+	}
+	return payloads
+}
+
+// commRelayReachHandler stores list of peers reachable by another peer.
+// Large lists come in several messages, so entries are added to the list
+// and expire on their own
+// id[36] ids[36*n]
+func commRelayReachHandler(data []byte, p *PeerToPeer) ([]byte, error) {
+	if p.Swarm == nil {
+		return nil, fmt.Errorf("nil swarm")
+	}
+	err := commPacketCheck(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%36 != 0 {
+		return nil, fmt.Errorf("wrong payload size: %d", len(data))
+	}
+	peer := p.Swarm.GetPeer(string(data[0:36]))
+	if peer == nil {
+		return nil, fmt.Errorf("reachability from unknown peer")
+	}
+	reach := []string{}
+	for i := 36; i < len(data); i += 36 {
+		id := string(data[i : i+36])
+		reach = append(reach, id)
+		// Relay is still able to reach this peer
+		if target := p.Swarm.GetPeer(id); target != nil && peer.Endpoint != nil && peer.Relay == "" {
+			target.bumpRelayEndpoint(peer.Endpoint.String())
+		}
+	}
+	now := time.Now()
+	peer.Lock.Lock()
+	if peer.reach == nil {
+		peer.reach = make(map[string]time.Time)
+	}
+	for id, updated := range peer.reach {
+		if now.Sub(updated) > EndpointTimeout {
+			delete(peer.reach, id)
+		}
+	}
+	for _, id := range reach {
+		peer.reach[id] = now
+	}
+	peer.Lock.Unlock()
+	return nil, nil
+}
+
+// relaysFor returns directly connected peers which reach specified peer
+func (p *PeerToPeer) relaysFor(np *NetworkPeer) []*NetworkPeer {
+	relays := []*NetworkPeer{}
+	if p.Swarm == nil || np == nil {
+		return relays
+	}
+	for _, peer := range p.Swarm.Get() {
+		if peer.ID == np.ID || peer.State != PeerStateConnected || peer.Endpoint == nil || peer.Relay != "" {
+			continue
+		}
+		if peer.canReach(np.ID) {
+			relays = append(relays, peer)
+		}
+	}
+	return relays
+}
+
+// canReach reports whether peer recently advertised that it reaches
+// peer with specified ID
+func (np *NetworkPeer) canReach(id string) bool {
+	np.Lock.RLock()
+	defer np.Lock.RUnlock()
+	updated, exists := np.reach[id]
+	return exists && time.Since(updated) <= EndpointTimeout
+}
+
+// addRelayEndpoint appends endpoint of a relay which reaches this peer
+func (np *NetworkPeer) addRelayEndpoint(addr *net.UDPAddr, relay string) error {
+	if addr == nil {
+		return fmt.Errorf("nil endpoint address")
+	}
+	np.Lock.Lock()
+	defer np.Lock.Unlock()
+	for _, ep := range np.EndpointsHeap {
+		if ep.Addr != nil && ep.Addr.String() == addr.String() {
+			return fmt.Errorf("Endpoint already exists")
+		}
+	}
+	np.RoutingRequired = true
+	np.EndpointsHeap = append(np.EndpointsHeap, &Endpoint{Addr: addr, Relay: relay, LastContact: time.Now(), LastLatencyQuery: time.Unix(0, 0)})
+	return nil
+}
+
+// bumpRelayEndpoint updates last contact of relay endpoint
+func (np *NetworkPeer) bumpRelayEndpoint(addr string) {
+	np.Lock.Lock()
+	defer np.Lock.Unlock()
+	for _, ep := range np.EndpointsHeap {
+		if ep.Relay != "" && ep.Addr != nil && ep.Addr.String() == addr {
+			ep.updateLastContact()
+		}
+	}
+}
+
+// punchRelays sends introduction requests to the peer through every
+// relay that reaches it
+func (np *NetworkPeer) punchRelays(ptpc *PeerToPeer) error {
+	for _, relay := range ptpc.relaysFor(np) {
+		endpoint := relay.Endpoint
+		if active, _ := np.isEndpointActive(endpoint); active {
+			continue
+		}
+		payload := []byte(ptpc.Dht.ID + endpoint.String())
+		if ptpc.Crypter.IsActive() && ptpc.Identity != nil {
+			kx, err := ptpc.keyExchangePayload(np)
+			if err == nil {
+				payload = append(payload, []byte(keyExchangeSeparator+kx)...)
+			}
+		}
+		payload = ptpc.appendInviteClaim(payload)
+		msg, err := ptpc.createMessageFor(np.ID, MsgTypeIntroReq, payload)
+		if err != nil {
+			return err
+		}
+		LogWith(Debug, np.logFields(ptpc), "Requesting introduction with %s over relay %s", np.ID, relay.ID)
+		ptpc.sendOverRelay(np.ID, endpoint, msg)
+	}
+	return nil
+}
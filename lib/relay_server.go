@@ -0,0 +1,266 @@
+package ptp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Relay server is a proxy which peers use when they can't reach each
+// other directly. Client registers on the main port of the server with
+// MsgTypeProxySwarm message carrying swarm hash or with legacy
+// MsgTypeProxy message and receives address of a dedicated UDP port
+// (tunnel). Everything received on the tunnel is passed to the client
+// from the main port, so it passes through NAT mapping that client has
+// created during registration. Clients are kept alive with ping messages
+// and dropped when they stop responding
+
+// Relay server timings
+const (
+	RelayPingInterval   = time.Duration(time.Second * 15)
+	RelayClientTimeout  = time.Duration(time.Second * 90)
+	RelayReportInterval = time.Duration(time.Second * 30)
+)
+
+var (
+	errRelayCapacity   = errors.New("relay capacity exceeded")
+	errRelayQuota      = errors.New("swarm quota exceeded")
+	errRelayBadRequest = errors.New("malformed registration request")
+)
+
+// relayPingPayload must not look like an address, otherwise clients
+// will treat ping as a port translation notification
+var relayPingPayload = []byte("relay")
+
+// relayTunnel is a UDP port allocated for a single client
+type relayTunnel struct {
+	id          string       // ID of a client on bootstrap
+	swarm       string       // Hash of a swarm this client belongs to
+	client      *net.UDPAddr // Address client registered from
+	socket      *Network     // Socket bound to the tunnel port
+	lastContact time.Time    // Last time client has responded
+}
+
+// RelayServer forwards traffic to clients over tunnels
+type RelayServer struct {
+	IP         net.IP // Public IP of this server, reported to clients
+	Capacity   int    // Maximum number of tunnels. 0 means unlimited
+	SwarmQuota int    // Maximum number of tunnels per swarm. 0 means unlimited
+	socket     *Network
+	tunnels    map[string]*relayTunnel // Tunnels by client address
+	lock       sync.RWMutex
+	lastPing   time.Time
+	shutdown   int32 // Set atomically when server is closed
+}
+
+// NewRelayServer creates relay server listening on specified port
+func NewRelayServer(port, capacity, quota int) (*RelayServer, error) {
+	if capacity < 0 || quota < 0 {
+		return nil, fmt.Errorf("capacity and quota can't be negative")
+	}
+	s := &RelayServer{
+		Capacity:   capacity,
+		SwarmQuota: quota,
+		socket:     new(Network),
+		tunnels:    make(map[string]*relayTunnel),
+	}
+	err := s.socket.Init("", port)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on port %d: %s", port, err)
+	}
+	return s, nil
+}
+
+// Port returns main port of the server
+func (s *RelayServer) Port() int {
+	return s.socket.GetPort()
+}
+
+// Load returns number of active tunnels
+func (s *RelayServer) Load() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.tunnels)
+}
+
+// Run starts listener and maintains tunnels until server is closed
+func (s *RelayServer) Run() {
+	go s.socket.Listen(s.handleMessage)
+	for atomic.LoadInt32(&s.shutdown) == 0 {
+		if time.Since(s.lastPing) > RelayPingInterval {
+			s.lastPing = time.Now()
+			s.ping()
+			s.expire(time.Now())
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+}
+
+// Close stops server and closes every tunnel
+func (s *RelayServer) Close() error {
+	atomic.StoreInt32(&s.shutdown, 1)
+	s.lock.Lock()
+	for addr, t := range s.tunnels {
+		t.socket.Close()
+		delete(s.tunnels, addr)
+	}
+	s.lock.Unlock()
+	return s.socket.Close()
+}
+
+// handleMessage processes control messages received on the main port
+func (s *RelayServer) handleMessage(count int, srcAddr *net.UDPAddr, err error, rcvBytes []byte) error {
+	if err != nil {
+		return err
+	}
+	msg, err := P2PMessageFromBytes(rcvBytes[:count])
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		return nil
+	}
+	switch msg.Header.Type {
+	case MsgTypeProxy, MsgTypeProxySwarm:
+		t, err := s.register(msg.Data, srcAddr)
+		if err != nil {
+			LogWith(Warning, Fields{Subsystem: SubsystemRelay, Endpoint: srcAddr.String()}, "Refused registration from %s: %s", srcAddr, err)
+			return err
+		}
+		return s.confirm(t)
+	case MsgTypePing:
+		s.touch(srcAddr)
+	case MsgTypeLatency:
+		// Latency is measured by clients with their own timestamp
+		if len(msg.Data) >= 4 && bytes.Equal(msg.Data[:4], LatencyProxyHeader) {
+			_, err = s.socket.SendMessage(msg, srcAddr)
+			return err
+		}
+	}
+	return nil
+}
+
+// register allocates a tunnel for a client. Payload of registration
+// request is an ID of the client followed by swarm hash. Legacy clients
+// send ID only and are counted as a swarm without hash
+func (s *RelayServer) register(data []byte, srcAddr *net.UDPAddr) (*relayTunnel, error) {
+	if srcAddr == nil || len(data) < 36 {
+		return nil, errRelayBadRequest
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, exists := s.tunnels[srcAddr.String()]
+	if exists {
+		// Client didn't receive confirmation and retries
+		t.lastContact = time.Now()
+		return t, nil
+	}
+	if s.Capacity > 0 && len(s.tunnels) >= s.Capacity {
+		return nil, errRelayCapacity
+	}
+	swarm := string(data[36:])
+	if s.SwarmQuota > 0 {
+		used := 0
+		for _, t := range s.tunnels {
+			if t.swarm == swarm {
+				used++
+			}
+		}
+		if used >= s.SwarmQuota {
+			return nil, errRelayQuota
+		}
+	}
+
+	t = &relayTunnel{
+		id:          string(data[:36]),
+		swarm:       swarm,
+		client:      srcAddr,
+		socket:      new(Network),
+		lastContact: time.Now(),
+	}
+	err := t.socket.Init("", 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open tunnel: %s", err)
+	}
+	s.tunnels[srcAddr.String()] = t
+	go t.socket.Listen(s.forwarder(t))
+	LogWith(Info, Fields{Subsystem: SubsystemRelay, Peer: t.id, Endpoint: srcAddr.String()}, "Opened tunnel on port %d for %s [%s]", t.socket.GetPort(), t.id, srcAddr)
+	return t, nil
+}
+
+// confirm sends tunnel address to the client
+func (s *RelayServer) confirm(t *relayTunnel) error {
+	if s.IP == nil {
+		return fmt.Errorf("public IP is not set")
+	}
+	endpoint := net.JoinHostPort(s.IP.String(), strconv.Itoa(t.socket.GetPort()))
+	msg, err := CreateMessageStatic(MsgTypeProxy, []byte(endpoint))
+	if err != nil {
+		return err
+	}
+	_, err = s.socket.SendMessage(msg, t.client)
+	return err
+}
+
+// forwarder returns callback which passes traffic received
+// on the tunnel to the client
+func (s *RelayServer) forwarder(t *relayTunnel) UDPReceivedCallback {
+	return func(count int, srcAddr *net.UDPAddr, err error, rcvBytes []byte) error {
+		if err != nil {
+			return err
+		}
+		if srcAddr.String() == t.client.String() {
+			return nil
+		}
+		_, err = s.socket.SendRawBytes(rcvBytes[:count], t.client)
+		return err
+	}
+}
+
+// touch marks client as alive
+func (s *RelayServer) touch(addr *net.UDPAddr) bool {
+	if addr == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, exists := s.tunnels[addr.String()]
+	if !exists {
+		return false
+	}
+	t.lastContact = time.Now()
+	return true
+}
+
+// ping sends keep alive message to every client. Clients send it back
+func (s *RelayServer) ping() {
+	msg, err := CreateMessageStatic(MsgTypePing, relayPingPayload)
+	if err != nil {
+		return
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, t := range s.tunnels {
+		s.socket.SendMessage(msg, t.client)
+	}
+}
+
+// expire closes tunnels of clients that stopped responding
+func (s *RelayServer) expire(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for addr, t := range s.tunnels {
+		if now.Sub(t.lastContact) < RelayClientTimeout {
+			continue
+		}
+		LogWith(Info, Fields{Subsystem: SubsystemRelay, Peer: t.id, Endpoint: addr}, "Closing tunnel of %s [%s]: client timed out", t.id, addr)
+		t.socket.Close()
+		delete(s.tunnels, addr)
+	}
+}
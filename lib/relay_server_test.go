@@ -0,0 +1,175 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewRelayServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		quota    int
+		wantErr  bool
+	}{
+		{"negative capacity", -1, 0, true},
+		{"negative quota", 0, -1, true},
+		{"unlimited", 0, 0, false},
+		{"limited", 10, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewRelayServer(0, tt.capacity, tt.quota)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewRelayServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			if s.Port() <= 0 {
+				t.Errorf("NewRelayServer() port = %d", s.Port())
+			}
+		})
+	}
+}
+
+func TestRelayServer_register(t *testing.T) {
+	id := "12345678-1234-1234-1234-123456789012"
+	client := func(port int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	}
+
+	tests := []struct {
+		name     string
+		capacity int
+		quota    int
+		existing []string // Swarms of already registered clients
+		data     []byte
+		addr     *net.UDPAddr
+		wantErr  error
+	}{
+		{"nil address", 0, 0, nil, []byte(id), nil, errRelayBadRequest},
+		{"short id", 0, 0, nil, []byte("id"), client(1), errRelayBadRequest},
+		{"without swarm", 0, 0, nil, []byte(id), client(1), nil},
+		{"capacity exceeded", 2, 0, []string{"a", "b"}, []byte(id + "c"), client(1), errRelayCapacity},
+		{"quota exceeded", 0, 1, []string{"a", "b"}, []byte(id + "a"), client(1), errRelayQuota},
+		{"quota of another swarm", 0, 1, []string{"a", "b"}, []byte(id + "c"), client(1), nil},
+		{"repeated registration", 1, 1, []string{"a"}, []byte(id + "a"), client(10), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewRelayServer(0, 0, 0)
+			if err != nil {
+				t.Fatalf("NewRelayServer() error = %v", err)
+			}
+			defer s.Close()
+			for i, swarm := range tt.existing {
+				if _, err := s.register([]byte(id+swarm), client(10+i)); err != nil {
+					t.Fatalf("RelayServer.register() existing error = %v", err)
+				}
+			}
+			s.Capacity, s.SwarmQuota = tt.capacity, tt.quota
+
+			got, err := s.register(tt.data, tt.addr)
+			if err != tt.wantErr {
+				t.Fatalf("RelayServer.register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.client.String() != tt.addr.String() || got.socket.GetPort() <= 0 {
+				t.Errorf("RelayServer.register() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestRelayServer_expire(t *testing.T) {
+	s, err := NewRelayServer(0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewRelayServer() error = %v", err)
+	}
+	defer s.Close()
+	id := []byte("12345678-1234-1234-1234-123456789012")
+	alive := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	dead := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}
+	s.register(id, alive)
+	s.register(id, dead)
+
+	later := time.Now().Add(RelayClientTimeout / 2)
+	s.tunnels[dead.String()].lastContact = later.Add(-RelayClientTimeout)
+	if !s.touch(alive) || s.touch(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3}) {
+		t.Errorf("RelayServer.touch() failed")
+	}
+	s.expire(later)
+
+	if s.Load() != 1 {
+		t.Fatalf("RelayServer.expire() left %d tunnels", s.Load())
+	}
+	if _, exists := s.tunnels[alive.String()]; !exists {
+		t.Errorf("RelayServer.expire() removed active client")
+	}
+}
+
+func TestRelayServer_forwarding(t *testing.T) {
+	s, err := NewRelayServer(0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewRelayServer() error = %v", err)
+	}
+	defer s.Close()
+	s.IP = net.ParseIP("127.0.0.1")
+	go s.socket.Listen(s.handleMessage)
+	server := &net.UDPAddr{IP: s.IP, Port: s.Port()}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.IP})
+	if err != nil {
+		t.Fatalf("Failed to open client socket: %v", err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second * 3))
+	read := func() *P2PMessage {
+		buf := make([]byte, 1024)
+		n, _, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Failed to read from relay: %v", err)
+		}
+		msg, err := P2PMessageFromBytes(buf[:n])
+		if err != nil || msg == nil {
+			t.Fatalf("Bad message from relay: %v", err)
+		}
+		return msg
+	}
+
+	// Latency is echoed back
+	latency, _ := CreateMessageStatic(MsgTypeLatency, append(LatencyProxyHeader, []byte("timestamp")...))
+	client.WriteToUDP(latency.Serialize(), server)
+	if msg := read(); msg.Header.Type != uint16(MsgTypeLatency) || string(msg.Data[4:]) != "timestamp" {
+		t.Fatalf("Relay didn't echo latency: %+v", msg)
+	}
+
+	// Registration is answered with tunnel endpoint
+	register, _ := CreateMessageStatic(MsgTypeProxySwarm, []byte("12345678-1234-1234-1234-123456789012swarm"))
+	client.WriteToUDP(register.Serialize(), server)
+	msg := read()
+	if msg.Header.Type != uint16(MsgTypeProxy) {
+		t.Fatalf("Relay didn't confirm registration: %+v", msg)
+	}
+	tunnel, err := resolveUDPAddr(string(msg.Data))
+	if err != nil {
+		t.Fatalf("Relay returned bad tunnel address %s: %v", msg.Data, err)
+	}
+
+	// Traffic sent to the tunnel reaches client
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.IP})
+	if err != nil {
+		t.Fatalf("Failed to open peer socket: %v", err)
+	}
+	defer peer.Close()
+	data, _ := CreateMessageStatic(MsgTypeNenc, []byte("frame"))
+	peer.WriteToUDP(data.Serialize(), tunnel)
+	if msg := read(); msg.Header.Type != uint16(MsgTypeNenc) || string(msg.Data) != "frame" {
+		t.Fatalf("Relay didn't forward data: %+v", msg)
+	}
+}
@@ -0,0 +1,259 @@
+package ptp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// listenUDP returns local UDP listener and a function that reads
+// a single P2P message from it
+func listenUDP(t *testing.T) (*net.UDPConn, func() *P2PMessage) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	return conn, func() *P2PMessage {
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		msg, _ := P2PMessageFromBytes(buf[:n])
+		return msg
+	}
+}
+
+func TestPeerToPeer_HandleRelayMessage(t *testing.T) {
+	self := "123e4567-e89b-12d3-a456-426655440000"
+	origin := "123e4567-e89b-12d3-a456-426655440001"
+	target := "123e4567-e89b-12d3-a456-426655440002"
+	unknown := "123e4567-e89b-12d3-a456-426655440003"
+	relay := "123e4567-e89b-12d3-a456-426655440004"
+
+	conn, read := listenUDP(t)
+	defer conn.Close()
+	targetAddr := conn.LocalAddr().(*net.UDPAddr)
+	src, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:1")
+	stranger, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:2")
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 0)
+	defer socket.Close()
+
+	swarm := new(Swarm)
+	swarm.Init()
+	swarm.Update(origin, &NetworkPeer{ID: origin})
+	swarm.Update(relay, &NetworkPeer{ID: relay, State: PeerStateConnected, Endpoint: src})
+	swarm.Update(target, &NetworkPeer{ID: target, State: PeerStateConnected, Endpoint: targetAddr})
+
+	var delivered *P2PMessage
+	p := &PeerToPeer{
+		Swarm:     swarm,
+		UDPSocket: socket,
+		Dht:       &DHTClient{ID: self},
+		MessageHandlers: map[uint16]MessageHandler{
+			MsgTypeNenc: func(msg *P2PMessage, srcAddr *net.UDPAddr) error {
+				delivered = msg
+				return nil
+			},
+		},
+	}
+
+	inner, _ := p.CreateMessage(MsgTypeNenc, []byte("frame"), uint16(PacketIPv4), false)
+	envelope := func(ttl uint8, dst, src string, msg *P2PMessage) *P2PMessage {
+		m, err := p.createRelayMessage(ttl, dst, src, msg)
+		if err != nil {
+			t.Fatalf("createRelayMessage() error = %s", err)
+		}
+		return m
+	}
+
+	tests := []struct {
+		name        string
+		msg         *P2PMessage
+		sender      *net.UDPAddr
+		wantErr     bool
+		wantDeliver bool
+		wantForward bool
+	}{
+		{"nil message", nil, src, true, false, false},
+		{"short message", &P2PMessage{Header: &P2PMessageHeader{}, Data: []byte{1, 2}}, src, true, false, false},
+		{"unknown origin", envelope(RelayTTL, self, unknown, inner), src, true, false, false},
+		{"unknown sender", envelope(RelayTTL, self, origin, inner), stranger, true, false, false},
+		{"nested relay", envelope(RelayTTL, self, origin, envelope(RelayTTL, self, origin, inner)), src, true, false, false},
+		{"delivered", envelope(RelayTTL, self, origin, inner), src, false, true, false},
+		{"ttl expired", envelope(1, target, origin, inner), src, true, false, false},
+		{"unknown destination", envelope(RelayTTL, unknown, origin, inner), src, true, false, false},
+		{"forwarding for unknown origin", envelope(RelayTTL, target, unknown, inner), src, true, false, false},
+		{"forwarding for unknown sender", envelope(RelayTTL, target, origin, inner), stranger, true, false, false},
+		{"forwarded", envelope(RelayTTL, target, origin, inner), src, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivered = nil
+			if err := p.HandleRelayMessage(tt.msg, tt.sender); (err != nil) != tt.wantErr {
+				t.Fatalf("PeerToPeer.HandleRelayMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (delivered != nil) != tt.wantDeliver {
+				t.Fatalf("PeerToPeer.HandleRelayMessage() delivered = %v, want %v", delivered != nil, tt.wantDeliver)
+			}
+			if delivered != nil && (delivered.origin != origin || string(delivered.Data) != "frame") {
+				t.Errorf("PeerToPeer.HandleRelayMessage() delivered wrong message: %s from %s", delivered.Data, delivered.origin)
+			}
+			if !tt.wantForward {
+				return
+			}
+			forwarded := read()
+			if forwarded == nil || forwarded.Header.Type != MsgTypeRelay {
+				t.Fatalf("PeerToPeer.HandleRelayMessage() didn't forward message")
+			}
+			if forwarded.Data[0] != RelayTTL-1 || string(forwarded.Data[1:37]) != target {
+				t.Errorf("PeerToPeer.HandleRelayMessage() forwarded wrong envelope")
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_sendToPeer(t *testing.T) {
+	self := "123e4567-e89b-12d3-a456-426655440000"
+	id := "123e4567-e89b-12d3-a456-426655440001"
+	conn, read := listenUDP(t)
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 0)
+	defer socket.Close()
+	p := &PeerToPeer{UDPSocket: socket, Dht: &DHTClient{ID: self}}
+	msg, _ := p.CreateMessage(MsgTypeNenc, []byte("frame"), 0, false)
+
+	tests := []struct {
+		name     string
+		peer     *NetworkPeer
+		wantErr  bool
+		wantType uint16
+	}{
+		{"nil peer", nil, true, 0},
+		{"no endpoint", &NetworkPeer{ID: id}, true, 0},
+		{"direct", &NetworkPeer{ID: id, Endpoint: addr}, false, MsgTypeNenc},
+		{"relay", &NetworkPeer{ID: id, Endpoint: addr, Relay: "relay"}, false, MsgTypeRelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.sendToPeer(tt.peer, msg); (err != nil) != tt.wantErr {
+				t.Fatalf("PeerToPeer.sendToPeer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := read()
+			if got == nil || got.Header.Type != tt.wantType {
+				t.Errorf("PeerToPeer.sendToPeer() sent wrong message: %v", got)
+			}
+		})
+	}
+}
+
+func Test_commRelayReachHandler(t *testing.T) {
+	id0 := "123e4567-e89b-12d3-a456-426655440000"
+	id1 := "123e4567-e89b-12d3-a456-426655440001"
+	id2 := "123e4567-e89b-12d3-a456-426655440002"
+	relayAddr, _ := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+
+	ptp0 := new(PeerToPeer)
+	ptp1 := new(PeerToPeer)
+	ptp1.Swarm = new(Swarm)
+	ptp1.Swarm.Init()
+	relay := &NetworkPeer{ID: id0, State: PeerStateConnected, Endpoint: relayAddr}
+	stale := &Endpoint{Addr: relayAddr, Relay: id0, LastContact: time.Unix(1, 1)}
+	behind := &NetworkPeer{ID: id1, EndpointsHeap: []*Endpoint{stale}}
+	ptp1.Swarm.Update(id0, relay)
+	ptp1.Swarm.Update(id1, behind)
+	ptp1.Swarm.Update(id2, &NetworkPeer{ID: id2})
+
+	tests := []struct {
+		name    string
+		data    []byte
+		p       *PeerToPeer
+		wantErr bool
+	}{
+		{"nil swarm", []byte(id0), ptp0, true},
+		{"small size", []byte("id"), ptp1, true},
+		{"wrong size", []byte(id0 + "id"), ptp1, true},
+		{"unknown peer", []byte("123e4567-e89b-12d3-a456-426655440009"), ptp1, true},
+		{"passing", []byte(id0 + id1), ptp1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := commRelayReachHandler(tt.data, tt.p); (err != nil) != tt.wantErr {
+				t.Errorf("commRelayReachHandler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if !relay.canReach(id1) || relay.canReach(id2) {
+		t.Errorf("commRelayReachHandler() stored wrong reachability")
+	}
+	if time.Since(stale.LastContact) > time.Second {
+		t.Errorf("commRelayReachHandler() didn't refresh relay endpoint")
+	}
+	relays := ptp1.relaysFor(behind)
+	if len(relays) != 1 || relays[0] != relay {
+		t.Errorf("PeerToPeer.relaysFor() = %v", relays)
+	}
+	if relays := ptp1.relaysFor(ptp1.Swarm.GetPeer(id2)); len(relays) != 0 {
+		t.Errorf("PeerToPeer.relaysFor() returned relay for unreachable peer")
+	}
+	// Split advertisement adds to the list
+	commRelayReachHandler([]byte(id0+id2), ptp1)
+	if !relay.canReach(id1) || !relay.canReach(id2) {
+		t.Errorf("commRelayReachHandler() replaced reachability with a part of it")
+	}
+}
+
+func Test_reachPayloads(t *testing.T) {
+	id := "123e4567-e89b-12d3-a456-426655440000"
+	if payloads := reachPayloads(id, nil); len(payloads) != 1 || len(payloads[0]) != 38 {
+		t.Fatalf("reachPayloads() without peers = %v", payloads)
+	}
+	ids := []string{}
+	for i := 0; i < relayReachMaxIDs*2+1; i++ {
+		ids = append(ids, id)
+	}
+	payloads := reachPayloads(id, ids)
+	if len(payloads) != 3 {
+		t.Fatalf("reachPayloads() returned %d payloads, want 3", len(payloads))
+	}
+	total := 0
+	for _, payload := range payloads {
+		// Payload is encrypted and wrapped into relay envelope
+		if HeaderSize*2+relayHeaderSize+len(payload)+2*16 > networkBufferSize {
+			t.Errorf("reachPayloads() returned payload of %d bytes", len(payload))
+		}
+		total += (len(payload) - 38) / 36
+	}
+	if total != len(ids) {
+		t.Errorf("reachPayloads() advertised %d peers, want %d", total, len(ids))
+	}
+}
+
+func TestNetworkPeer_routeOverRelay(t *testing.T) {
+	relayAddr, _ := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+	directAddr, _ := net.ResolveUDPAddr("udp4", "2.2.2.2:1234")
+	p := &PeerToPeer{Dht: new(DHTClient)}
+
+	np := &NetworkPeer{ID: "peer"}
+	np.addRelayEndpoint(relayAddr, "relay")
+	np.route(p)
+	if np.Endpoint != relayAddr || np.Relay != "relay" || np.Stat.relayNum != 1 {
+		t.Fatalf("NetworkPeer.route() didn't select relay: %v %s", np.Endpoint, np.Relay)
+	}
+
+	np.addEndpoint(directAddr)
+	np.route(p)
+	if np.Endpoint != directAddr || np.Relay != "" {
+		t.Errorf("NetworkPeer.route() preferred relay over direct endpoint: %v %s", np.Endpoint, np.Relay)
+	}
+}
@@ -0,0 +1,167 @@
+package ptp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Static peers are listed with their endpoints and addresses in
+// configuration, so swarm is formed without bootstrap nodes. They are
+// connected directly, never requested from DHT and reconnected whenever
+// connection is lost
+
+// StaticPeer describes a peer with fixed endpoints
+type StaticPeer struct {
+	ID        string   `yaml:"id"`        // ID of the peer. Derived from key when empty
+	Key       string   `yaml:"key"`       // Base64-encoded identity key of the peer
+	Endpoints []string `yaml:"endpoints"` // UDP endpoints of the peer
+	IP        string   `yaml:"ip"`        // Address of the peer interface
+	Mac       string   `yaml:"mac"`       // Hardware address of the peer interface
+}
+
+// StaticSwarm is a list of static peers of a swarm
+type StaticSwarm struct {
+	Hash  string       `yaml:"hash"`
+	ID    string       `yaml:"id"` // ID of this instance, as listed by remote peers
+	Peers []StaticPeer `yaml:"peers"`
+}
+
+// LoadStaticSwarm reads static peers from file
+func LoadStaticSwarm(filepath string) (*StaticSwarm, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	swarm := new(StaticSwarm)
+	err = yaml.Unmarshal(data, swarm)
+	if err != nil {
+		return nil, fmt.Errorf("static peers parse failed: %s", err)
+	}
+	return swarm, nil
+}
+
+// Validate checks that every static peer is configured correctly
+func (s *StaticSwarm) Validate() error {
+	if len(s.ID) != 0 && len(s.ID) != 36 {
+		return fmt.Errorf("bad ID of instance: %s", s.ID)
+	}
+	for i := range s.Peers {
+		if _, err := s.Peers[i].peer(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeIdentityKey parses base64-encoded identity key
+func decodeIdentityKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		key, err = base64.RawStdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("wrong key length: %d", len(key))
+	}
+	return key, nil
+}
+
+// peer creates network peer from configuration
+func (s *StaticPeer) peer() (*NetworkPeer, error) {
+	peer := &NetworkPeer{ID: s.ID, direct: true, static: true}
+	if s.Key != "" {
+		key, err := decodeIdentityKey(s.Key)
+		if err != nil {
+			return nil, fmt.Errorf("bad key of static peer: %s", err)
+		}
+		if peer.ID == "" {
+			peer.ID = IdentityID(key)
+		}
+		// Peer has to present the same identity key
+		peer.session.remoteStatic = key
+	}
+	if len(peer.ID) != 36 {
+		return nil, fmt.Errorf("static peer should have ID or key")
+	}
+	for _, endpoint := range s.Endpoints {
+		addr, err := resolveUDPAddr(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("bad endpoint of static peer %s: %s", peer.ID, err)
+		}
+		peer.KnownIPs = append(peer.KnownIPs, addr)
+	}
+	if len(peer.KnownIPs) == 0 {
+		return nil, fmt.Errorf("static peer %s has no endpoints", peer.ID)
+	}
+	if s.IP != "" {
+		peer.PeerLocalIP = net.ParseIP(s.IP)
+		if peer.PeerLocalIP == nil {
+			return nil, fmt.Errorf("bad IP of static peer %s", peer.ID)
+		}
+	}
+	if s.Mac != "" {
+		var err error
+		peer.PeerHW, err = net.ParseMAC(s.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("bad MAC of static peer %s", peer.ID)
+		}
+	}
+	return peer, nil
+}
+
+// SetStaticPeers validates static peers and starts connecting to them
+func (p *PeerToPeer) SetStaticPeers(peers []StaticPeer) error {
+	static := append([]StaticPeer{}, peers...)
+	for i := range static {
+		peer, err := static[i].peer()
+		if err != nil {
+			return err
+		}
+		static[i].ID = peer.ID
+	}
+	p.staticLock.Lock()
+	p.static = static
+	p.staticLock.Unlock()
+	return p.checkStaticPeers()
+}
+
+// checkStaticPeers adds static peers which are missing in the swarm
+func (p *PeerToPeer) checkStaticPeers() error {
+	if p.Dht == nil {
+		return fmt.Errorf("nil dht")
+	}
+	if p.Swarm == nil {
+		return fmt.Errorf("nil peer list")
+	}
+	p.staticLock.Lock()
+	defer p.staticLock.Unlock()
+	for i := range p.static {
+		id := p.static[i].ID
+		if id == p.Dht.ID || !p.ACL.Allowed(id) || p.Swarm.GetPeer(id) != nil {
+			continue
+		}
+		peer, err := p.static[i].peer()
+		if err != nil {
+			LogWith(Error, p.logFields(SubsystemPeer), "Failed to add static peer %s: %s", id, err)
+			continue
+		}
+		LogWith(Info, p.logFields(SubsystemPeer), "Connecting to static peer %s", peer.ID)
+		peer.SetState(PeerStateConnecting, p)
+		p.Swarm.Update(peer.ID, peer)
+		p.Swarm.RunPeer(peer.ID, p)
+	}
+	return nil
+}
+
+// dropStaticPeers stops reconnection of static peers
+func (p *PeerToPeer) dropStaticPeers() {
+	p.staticLock.Lock()
+	p.static = nil
+	p.staticLock.Unlock()
+}
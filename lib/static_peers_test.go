@@ -0,0 +1,126 @@
+package ptp
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticPeer_peer(t *testing.T) {
+	key := make([]byte, 32)
+	key[0] = 1
+	encoded := base64.StdEncoding.EncodeToString(key)
+	tests := []struct {
+		name    string
+		peer    StaticPeer
+		wantID  string
+		wantErr bool
+	}{
+		{"peer with ID", StaticPeer{ID: "11111111-1111-1111-1111-111111111111", Endpoints: []string{"1.2.3.4:6000"}, IP: "10.0.0.2", Mac: "06:00:00:00:00:01"}, "11111111-1111-1111-1111-111111111111", false},
+		{"peer with key", StaticPeer{Key: encoded, Endpoints: []string{"1.2.3.4:6000"}}, IdentityID(key), false},
+		{"unpadded key", StaticPeer{Key: base64.RawStdEncoding.EncodeToString(key), Endpoints: []string{"1.2.3.4:6000"}}, IdentityID(key), false},
+		{"no ID", StaticPeer{Endpoints: []string{"1.2.3.4:6000"}}, "", true},
+		{"short key", StaticPeer{Key: "AAAA", Endpoints: []string{"1.2.3.4:6000"}}, "", true},
+		{"no endpoints", StaticPeer{ID: "11111111-1111-1111-1111-111111111111"}, "", true},
+		{"bad endpoint", StaticPeer{ID: "11111111-1111-1111-1111-111111111111", Endpoints: []string{"1.2.3.4"}}, "", true},
+		{"bad IP", StaticPeer{ID: "11111111-1111-1111-1111-111111111111", Endpoints: []string{"1.2.3.4:6000"}, IP: "10.0.0"}, "", true},
+		{"bad MAC", StaticPeer{ID: "11111111-1111-1111-1111-111111111111", Endpoints: []string{"1.2.3.4:6000"}, Mac: "06:00"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.peer.peer()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StaticPeer.peer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.ID != tt.wantID || !got.static || len(got.KnownIPs) != 1 {
+				t.Errorf("StaticPeer.peer() = %+v", got)
+			}
+			if tt.peer.Key != "" && len(got.session.remoteStatic) != 32 {
+				t.Errorf("StaticPeer.peer() didn't pin identity key")
+			}
+		})
+	}
+}
+
+func TestLoadStaticSwarm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "static.yaml")
+	ioutil.WriteFile(file, []byte("id: 00000000-0000-0000-0000-000000000000\npeers:\n  - id: 11111111-1111-1111-1111-111111111111\n    endpoints: [1.2.3.4:6000]\n    ip: 10.0.0.2\n"), 0600)
+
+	swarm, err := LoadStaticSwarm(file)
+	if err != nil || swarm.ID != "00000000-0000-0000-0000-000000000000" || len(swarm.Peers) != 1 || swarm.Peers[0].IP != "10.0.0.2" {
+		t.Fatalf("LoadStaticSwarm() = %+v, %v", swarm, err)
+	}
+	if err := swarm.Validate(); err != nil {
+		t.Errorf("StaticSwarm.Validate() error = %v", err)
+	}
+	if _, err := LoadStaticSwarm(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("LoadStaticSwarm() didn't fail on missing file")
+	}
+}
+
+func TestPeerToPeer_SetStaticPeers(t *testing.T) {
+	p := &PeerToPeer{Dht: &DHTClient{ID: "00000000-0000-0000-0000-000000000000"}, Swarm: new(Swarm)}
+	p.Swarm.Init()
+	if err := p.SetStaticPeers([]StaticPeer{{ID: "short"}}); err == nil {
+		t.Fatalf("PeerToPeer.SetStaticPeers() accepted bad peer")
+	}
+	err := p.SetStaticPeers([]StaticPeer{
+		{ID: "11111111-1111-1111-1111-111111111111", Endpoints: []string{"1.2.3.4:6000"}, IP: "10.0.0.2"},
+		{ID: "00000000-0000-0000-0000-000000000000", Endpoints: []string{"1.2.3.4:6001"}},
+	})
+	if err != nil {
+		t.Fatalf("PeerToPeer.SetStaticPeers() error = %v", err)
+	}
+	peer := p.Swarm.GetPeer("11111111-1111-1111-1111-111111111111")
+	if p.Swarm.Length() != 1 || peer == nil || peer.State != PeerStateConnecting {
+		t.Fatalf("Static peer wasn't added: %+v", peer)
+	}
+	if id, _ := p.Swarm.GetID("10.0.0.2"); id != peer.ID {
+		t.Errorf("Static peer isn't reachable by IP")
+	}
+
+	// Lost static peer is added again
+	peer.SetState(PeerStateStop, p)
+	for i := 0; i < 50 && peer.Running; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	p.Swarm.Delete(peer.ID)
+	p.checkStaticPeers()
+	added := p.Swarm.GetPeer(peer.ID)
+	if added == nil || added == peer {
+		t.Fatalf("Static peer wasn't reconnected")
+	}
+	added.SetState(PeerStateStop, p)
+
+	p.dropStaticPeers()
+	p.Swarm.Delete(peer.ID)
+	p.checkStaticPeers()
+	if p.Swarm.Length() != 0 {
+		t.Errorf("Static peers were added after instance stop")
+	}
+}
+
+func TestNetworkPeer_stateInit_static(t *testing.T) {
+	p := &PeerToPeer{Dht: &DHTClient{}}
+	np := &NetworkPeer{
+		static:      true,
+		KnownIPs:    []*net.UDPAddr{{IP: net.ParseIP("1.2.3.4"), Port: 6000}},
+		PeerLocalIP: net.ParseIP("10.0.0.2"),
+	}
+	np.stateInit(p)
+	if np.State != PeerStateConnecting || np.PeerLocalIP == nil {
+		t.Errorf("Static peer initialization: state = %s, IP = %s", StringifyState(np.State), np.PeerLocalIP)
+	}
+}
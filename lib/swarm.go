@@ -18,7 +18,7 @@ const (
 // Swarm is for handling list of peers with all mappings
 type Swarm struct {
 	peers      map[string]*NetworkPeer // Map of peers in this swarm
-	tableIPID  map[string]string       // Mapping for IP->ID
+	tableIPID  map[string]string       // Mapping for IP->ID. Holds both IPv4 and IPv6 addresses
 	tableMacID map[string]string       // Mapping for MAC->ID
 	lock       sync.RWMutex            // Mutex for the tables
 }
@@ -53,6 +53,9 @@ func (l *Swarm) operate(action ListOperation, id string, peer *NetworkPeer) erro
 			mac = peer.PeerHW.String()
 		}
 		l.updateTables(id, ip, mac)
+		if peer.PeerLocalIPv6 != nil {
+			l.updateTables(id, peer.PeerLocalIPv6.String(), "")
+		}
 		return nil
 	} else if action == OperateDelete {
 		peer, exists := l.peers[id]
@@ -60,6 +63,9 @@ func (l *Swarm) operate(action ListOperation, id string, peer *NetworkPeer) erro
 			return fmt.Errorf("can't delete peer: entry doesn't exists")
 		}
 		l.deleteTables(peer.PeerLocalIP.String(), peer.PeerHW.String())
+		if peer.PeerLocalIPv6 != nil {
+			l.deleteTables(peer.PeerLocalIPv6.String(), "")
+		}
 		delete(l.peers, id)
 		return nil
 	}
@@ -90,6 +96,13 @@ func (l *Swarm) deleteTables(ip, mac string) {
 	}
 }
 
+// deleteIP removes IP->ID mapping of an address that is no longer used
+func (l *Swarm) deleteIP(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.deleteTables(ip, "")
+}
+
 // Delete will remove entry with specified ID from peer list
 func (l *Swarm) Delete(id string) {
 	l.operate(OperateDelete, id, nil)
@@ -136,6 +149,41 @@ func (l *Swarm) GetEndpoint(mac string) (*net.UDPAddr, error) {
 	return nil, fmt.Errorf("Specified hardware address was not found in table")
 }
 
+// GetPeerByMAC returns peer with specified hardware address
+func (l *Swarm) GetPeerByMAC(mac string) *NetworkPeer {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	id, exists := l.tableMacID[mac]
+	if exists {
+		peer, exists := l.peers[id]
+		if exists {
+			return peer
+		}
+	}
+	return nil
+}
+
+// GetPeerByEndpoint returns peer which is reached directly over
+// specified address. Endpoints of relays and peers routed over relays
+// are skipped, so relayed traffic is attributed to the relay itself
+func (l *Swarm) GetPeerByEndpoint(addr string) *NetworkPeer {
+	for _, peer := range l.Get() {
+		peer.Lock.RLock()
+		found := peer.Relay == "" && peer.Endpoint != nil && peer.Endpoint.String() == addr
+		for _, ep := range peer.EndpointsHeap {
+			if found {
+				break
+			}
+			found = ep.Relay == "" && ep.Addr != nil && ep.Addr.String() == addr
+		}
+		peer.Lock.RUnlock()
+		if found {
+			return peer
+		}
+	}
+	return nil
+}
+
 // GetID returns ID by specified IP
 func (l *Swarm) GetID(ip string) (string, error) {
 	l.lock.RLock()
@@ -155,12 +203,12 @@ func (l *Swarm) Length() int {
 // RunPeer should be called once on each peer when added
 // to list
 func (l *Swarm) RunPeer(id string, p *PeerToPeer) {
-	Log(Info, "Running peer %s", id)
+	LogWith(Info, Fields{Hash: p.Hash, Subsystem: SubsystemPeer, Peer: id}, "Running peer %s", id)
 	l.lock.RLock()
 	defer l.lock.RUnlock()
 	if !l.peers[id].IsRunning() {
 		go l.peers[id].Run(p)
 	} else {
-		Log(Info, "Peer %s is already running", id)
+		LogWith(Info, Fields{Hash: p.Hash, Subsystem: SubsystemPeer, Peer: id}, "Peer %s is already running", id)
 	}
 }
@@ -31,6 +31,24 @@ func TestDeleteTables(t *testing.T) {
 	}
 }
 
+func TestSwarmIPv6Tables(t *testing.T) {
+	l := new(Swarm)
+	l.Init()
+	l.Update("500", &NetworkPeer{ID: "500", PeerLocalIP: net.ParseIP("10.10.10.1"), PeerLocalIPv6: net.ParseIP("fd00::1")})
+	for _, ip := range []string{"10.10.10.1", "fd00::1"} {
+		id, err := l.GetID(ip)
+		if err != nil || id != "500" {
+			t.Errorf("GetID(%s) = %s, %v", ip, id, err)
+		}
+	}
+	l.Delete("500")
+	for _, ip := range []string{"10.10.10.1", "fd00::1"} {
+		if _, err := l.GetID(ip); err == nil {
+			t.Errorf("GetID(%s) after delete should fail", ip)
+		}
+	}
+}
+
 func TestGet(t *testing.T) {
 	l := new(Swarm)
 	np1 := new(NetworkPeer)
@@ -79,6 +97,35 @@ func TestGetPeer(t *testing.T) {
 	}
 }
 
+func TestSwarm_GetPeerByEndpoint(t *testing.T) {
+	direct, _ := net.ResolveUDPAddr("udp4", "1.1.1.1:1")
+	known, _ := net.ResolveUDPAddr("udp4", "2.2.2.2:2")
+	relayed, _ := net.ResolveUDPAddr("udp4", "3.3.3.3:3")
+
+	l := new(Swarm)
+	l.Init()
+	l.peers["direct"] = &NetworkPeer{ID: "direct", Endpoint: direct, EndpointsHeap: []*Endpoint{{Addr: known}}}
+	l.peers["behind"] = &NetworkPeer{ID: "behind", Endpoint: relayed, Relay: "relay", EndpointsHeap: []*Endpoint{{Addr: relayed, Relay: "relay"}}}
+
+	tests := []struct {
+		name string
+		addr string
+		want *NetworkPeer
+	}{
+		{"active endpoint", direct.String(), l.peers["direct"]},
+		{"known endpoint", known.String(), l.peers["direct"]},
+		{"relay endpoint", relayed.String(), nil},
+		{"unknown endpoint", "4.4.4.4:4", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.GetPeerByEndpoint(tt.addr); got != tt.want {
+				t.Errorf("Swarm.GetPeerByEndpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestSwarm_GetID(t *testing.T) {
 	type fields struct {
 		peers      map[string]*NetworkPeer
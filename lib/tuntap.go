@@ -51,12 +51,14 @@ type TAP interface {
 	GetName() string
 	GetHardwareAddress() net.HardwareAddr
 	GetIP() net.IP
+	GetIPv6() net.IP
 	GetSubnet() net.IP
 	GetMask() net.IPMask
 	GetBasename() string
 	SetName(string)
 	SetHardwareAddress(net.HardwareAddr)
 	SetIP(net.IP)
+	SetIPv6(net.IP)
 	SetSubnet(net.IP)
 	SetMask(net.IPMask)
 	Init(string) error
@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 )
 
 func GetDeviceBase() string {
@@ -19,15 +20,15 @@ func GetDeviceBase() string {
 func GetConfigurationTool() string {
 	path, err := exec.LookPath("ifconfig")
 	if err != nil {
-		Log(Error, "Failed to find `ifconfig` in path. Returning default /sbin/ifconfig")
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to find `ifconfig` in path. Returning default /sbin/ifconfig")
 		return "/sbin/ifconfig"
 	}
-	Log(Info, "Network configuration tool found: %s", path)
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Network configuration tool found: %s", path)
 	return path
 }
 
 func newTAP(tool, ip, mac, mask string, mtu int, pmtu bool) (*TAPDarwin, error) {
-	Log(Info, "Acquiring TAP interface [Darwin]")
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Acquiring TAP interface [Darwin]")
 	nip := net.ParseIP(ip)
 	if nip == nil {
 		return nil, fmt.Errorf("Failed to parse IP during TAP creation")
@@ -53,6 +54,7 @@ func newEmptyTAP() *TAPDarwin {
 // TAPDarwin is an interface for TAP device on Linux platform
 type TAPDarwin struct {
 	IP         net.IP           // IP
+	IPv6       net.IP           // IPv6 address
 	Subnet     net.IP           // Subnet
 	Mask       net.IPMask       // Mask
 	Mac        net.HardwareAddr // Hardware Address
@@ -81,6 +83,11 @@ func (t *TAPDarwin) GetIP() net.IP {
 	return t.IP
 }
 
+// GetIPv6 returns IPv6 address of the interface
+func (t *TAPDarwin) GetIPv6() net.IP {
+	return t.IPv6
+}
+
 func (t *TAPDarwin) GetSubnet() net.IP {
 	return t.Subnet
 }
@@ -110,6 +117,11 @@ func (t *TAPDarwin) SetIP(ip net.IP) {
 	t.IP = ip
 }
 
+// SetIPv6 will set IPv6 address
+func (t *TAPDarwin) SetIPv6(ip net.IP) {
+	t.IPv6 = ip
+}
+
 func (t *TAPDarwin) SetSubnet(subnet net.IP) {
 	t.Subnet = subnet
 }
@@ -141,12 +153,12 @@ func (t *TAPDarwin) Close() error {
 	if t.file == nil {
 		return fmt.Errorf("nil interface file descriptor")
 	}
-	Log(Info, "Closing network interface %s", t.GetName())
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Closing network interface %s", t.GetName())
 	err := t.file.Close()
 	if err != nil {
 		return fmt.Errorf("Failed to close network interface: %s", err)
 	}
-	Log(Info, "Interface closed")
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Interface closed")
 	return nil
 }
 
@@ -158,11 +170,11 @@ func (t *TAPDarwin) Configure(lazy bool) error {
 	// if lazy {
 	// 	return nil
 	// }
-	Log(Info, "Setting hardware address to %s", t.Mac.String())
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Setting hardware address to %s", t.Mac.String())
 	setmac := exec.Command(t.Tool, t.Name, "ether", t.Mac.String())
 	err := setmac.Run()
 	if err != nil {
-		Log(Error, "Failed to set MAC: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to set MAC: %v", err)
 	}
 
 	if t.IP == nil {
@@ -174,7 +186,7 @@ func (t *TAPDarwin) Configure(lazy bool) error {
 	err = linkup.Run()
 	if err != nil {
 		t.Status = InterfaceBroken
-		Log(Error, "Failed to up link: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to up link: %v", err)
 		return err
 	}
 	t.Status = InterfaceConfigured
@@ -277,10 +289,14 @@ func FilterInterface(infName, infIP string) bool {
 			return true
 		}
 	}
-	Log(Trace, "ping -t 1 -c 1 -S %s ptest.subutai.io", infIP)
-	ping := exec.Command("ping", "-t", "1", "-c", "1", "-S", infIP, "ptest.subutai.io")
+	tool, args := "ping", []string{"-t", "1", "-c", "1", "-S", infIP, "ptest.subutai.io"}
+	if strings.Contains(infIP, ":") {
+		tool, args = "ping6", []string{"-c", "1", "-S", infIP, "ptest.subutai.io"}
+	}
+	LogWith(Trace, Fields{Subsystem: SubsystemInstance}, "%s %s", tool, strings.Join(args, " "))
+	ping := exec.Command(tool, args...)
 	if ping.Run() != nil {
-		Log(Debug, "Filtered %s %s", infName, infIP)
+		LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Filtered %s %s", infName, infIP)
 		return true
 	}
 	return false
@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strings"
 	"syscall"
 	"unsafe"
 )
@@ -22,15 +23,15 @@ func GetDeviceBase() string {
 func GetConfigurationTool() string {
 	path, err := exec.LookPath("ip")
 	if err != nil {
-		Log(Error, "Failed to find `ip` in path. Returning default /bin/ip")
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to find `ip` in path. Returning default /bin/ip")
 		return "/bin/ip"
 	}
-	Log(Info, "Network configuration tool found: %s", path)
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Network configuration tool found: %s", path)
 	return path
 }
 
 func newTAP(tool, ip, mac, mask string, mtu int, pmtu bool) (*TAPLinux, error) {
-	Log(Debug, "Acquiring TAP interface [Linux]")
+	LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Acquiring TAP interface [Linux]")
 	nip := net.ParseIP(ip)
 	if nip == nil {
 		return nil, fmt.Errorf("Failed to parse IP during TAP creation")
@@ -56,6 +57,7 @@ func newEmptyTAP() *TAPLinux {
 // TAPLinux is an interface for TAP device on Linux platform
 type TAPLinux struct {
 	IP         net.IP           // IP
+	IPv6       net.IP           // IPv6 address
 	Subnet     net.IP           // Subnet
 	Mask       net.IPMask       // Mask
 	Mac        net.HardwareAddr // Hardware Address
@@ -84,6 +86,11 @@ func (tap *TAPLinux) GetIP() net.IP {
 	return tap.IP
 }
 
+// GetIPv6 returns IPv6 address of the interface
+func (tap *TAPLinux) GetIPv6() net.IP {
+	return tap.IPv6
+}
+
 func (tap *TAPLinux) GetSubnet() net.IP {
 	return tap.Subnet
 }
@@ -113,6 +120,11 @@ func (tap *TAPLinux) SetIP(ip net.IP) {
 	tap.IP = ip
 }
 
+// SetIPv6 will set IPv6 address
+func (tap *TAPLinux) SetIPv6(ip net.IP) {
+	tap.IPv6 = ip
+}
+
 func (tap *TAPLinux) SetSubnet(subnet net.IP) {
 	tap.Subnet = subnet
 }
@@ -153,12 +165,12 @@ func (tap *TAPLinux) Close() error {
 	if tap.file == nil {
 		return fmt.Errorf("nil interface file descriptor")
 	}
-	Log(Info, "Closing network interface %s", tap.GetName())
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Closing network interface %s", tap.GetName())
 	err := tap.file.Close()
 	if err != nil {
 		return fmt.Errorf("Failed to close network interface: %s", err)
 	}
-	Log(Info, "Interface closed")
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Interface closed")
 	return nil
 }
 
@@ -168,7 +180,7 @@ func (tap *TAPLinux) Configure(lazy bool) error {
 	if lazy {
 		return nil
 	}
-	Log(Info, "Configuring %s. IP: %s, Mac: %s", tap.Name, tap.IP.String(), tap.Mac.String())
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Configuring %s. IP: %s, Mac: %s", tap.Name, tap.IP.String(), tap.Mac.String())
 	err := tap.linkUp()
 	if err != nil {
 		tap.Status = InterfaceBroken
@@ -202,6 +214,15 @@ func (tap *TAPLinux) Configure(lazy bool) error {
 		tap.Status = InterfaceBroken
 		return err
 	}
+	// IPv6 addresses are flushed when link goes down, so
+	// it's assigned after device is up again
+	if tap.IPv6 != nil {
+		err = tap.setIPv6()
+		if err != nil {
+			tap.Status = InterfaceBroken
+			return err
+		}
+	}
 	tap.Status = InterfaceConfigured
 	return nil
 }
@@ -217,7 +238,7 @@ func (tap *TAPLinux) ReadPacket() (*Packet, error) {
 
 	n, err := tap.file.Read(buf)
 	if err != nil {
-		Log(Error, "Failed to read packet: %+v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to read packet: %+v", err)
 		return nil, err
 	}
 
@@ -281,7 +302,7 @@ func (tap *TAPLinux) setMTU() error {
 	setmtu := exec.Command(tap.Tool, "link", "set", "dev", tap.Name, "mtu", mtu)
 	err := setmtu.Run()
 	if err != nil {
-		Log(Error, "Failed to set MTU on device %s: %v", tap.Name, err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to set MTU on device %s: %v", tap.Name, err)
 		return err
 	}
 	return nil
@@ -291,7 +312,7 @@ func (tap *TAPLinux) linkUp() error {
 	linkup := exec.Command(tap.Tool, "link", "set", "dev", tap.Name, "up")
 	err := linkup.Run()
 	if err != nil {
-		Log(Error, "Failed to up link: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to up link: %v", err)
 		return err
 	}
 	return nil
@@ -301,29 +322,40 @@ func (tap *TAPLinux) linkDown() error {
 	linkup := exec.Command(tap.Tool, "link", "set", "dev", tap.Name, "down")
 	err := linkup.Run()
 	if err != nil {
-		Log(Error, "Failed to up link: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to up link: %v", err)
 		return err
 	}
 	return nil
 }
 
 func (tap *TAPLinux) setIP() error {
-	Log(Info, "Setting %s IP on device %s", tap.IP.String(), tap.Name)
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Setting %s IP on device %s", tap.IP.String(), tap.Name)
 	setip := exec.Command(tap.Tool, "addr", "add", tap.IP.String()+"/24", "dev", tap.Name)
 	err := setip.Run()
 	if err != nil {
-		Log(Error, "Failed to set IP: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to set IP: %v", err)
+		return err
+	}
+	return err
+}
+
+func (tap *TAPLinux) setIPv6() error {
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Setting %s IPv6 on device %s", tap.IPv6.String(), tap.Name)
+	setip := exec.Command(tap.Tool, "-6", "addr", "add", tap.IPv6.String()+"/64", "dev", tap.Name)
+	err := setip.Run()
+	if err != nil {
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to set IPv6: %v", err)
 		return err
 	}
 	return err
 }
 
 func (tap *TAPLinux) setMac() error {
-	Log(Info, "Setting %s MAC on device %s", tap.Mac.String(), tap.Name)
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Setting %s MAC on device %s", tap.Mac.String(), tap.Name)
 	setmac := exec.Command(tap.Tool, "link", "set", "dev", tap.Name, "address", tap.Mac.String())
 	err := setmac.Run()
 	if err != nil {
-		Log(Error, "Failed to set MAC: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to set MAC: %v", err)
 		return err
 	}
 	return err
@@ -375,10 +407,14 @@ func FilterInterface(infName, infIP string) bool {
 			return true
 		}
 	}
-	Log(Trace, "ping -4 -w 1 -c 1 -I %s ptest.subutai.io", infName)
-	ping := exec.Command("ping", "-4", "-w", "1", "-c", "1", "-I", infName, "ptest.subutai.io")
+	family := "-4"
+	if strings.Contains(infIP, ":") {
+		family = "-6"
+	}
+	LogWith(Trace, Fields{Subsystem: SubsystemInstance}, "ping %s -w 1 -c 1 -I %s ptest.subutai.io", family, infName)
+	ping := exec.Command("ping", family, "-w", "1", "-c", "1", "-I", infName, "ptest.subutai.io")
 	if ping.Run() != nil {
-		Log(Debug, "Filtered %s %s", infName, infIP)
+		LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Filtered %s %s", infName, infIP)
 		return true
 	}
 	return false
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 	"unicode/utf16"
@@ -51,15 +52,15 @@ func GetDeviceBase() string {
 func GetConfigurationTool() string {
 	path, err := exec.LookPath("netsh")
 	if err != nil {
-		Log(Error, "Failed to find `netsh` in path. Returning default netsh")
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to find `netsh` in path. Returning default netsh")
 		return "netsh"
 	}
-	Log(Info, "Network configuration tool found: %s", path)
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Network configuration tool found: %s", path)
 	return path
 }
 
 func newTAP(tool, ip, mac, mask string, mtu int, pmtu bool) (*TAPWindows, error) {
-	Log(Debug, "Acquiring TAP interface [Windows]")
+	LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Acquiring TAP interface [Windows]")
 	nip := net.ParseIP(ip)
 	if nip == nil {
 		return nil, fmt.Errorf("Failed to parse IP during TAP creation")
@@ -87,6 +88,7 @@ func newEmptyTAP() *TAPWindows {
 // TAPLinux is an interface for TAP device on Linux platform
 type TAPWindows struct {
 	IP         net.IP           // IP
+	IPv6       net.IP           // IPv6 address
 	Subnet     net.IP           // Subnet
 	Mask       net.IPMask       // Mask
 	Mac        net.HardwareAddr // Hardware Address
@@ -118,7 +120,7 @@ func (t *TAPWindows) GetHardwareAddress() net.HardwareAddr {
 		var length uint32
 		err := syscall.DeviceIoControl(t.file, getMacIOCTL, &mac[0], uint32(len(mac)), &mac[0], uint32(len(mac)), &length, nil)
 		if err != nil {
-			Log(Error, "Failed to retrieve Mac")
+			LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to retrieve Mac")
 			return t.Mac
 		}
 		var macAddr bytes.Buffer
@@ -137,10 +139,10 @@ func (t *TAPWindows) GetHardwareAddress() net.HardwareAddr {
 			}
 			i++
 		}
-		Log(Debug, "MAC: %s", macAddr.String())
+		LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "MAC: %s", macAddr.String())
 		deviceMac, err := net.ParseMAC(macAddr.String())
 		if err != nil {
-			Log(Error, "Failed to extract mac: %s", err)
+			LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to extract mac: %s", err)
 		}
 		t.Mac = deviceMac
 		t.MacNotSet = false
@@ -153,6 +155,11 @@ func (t *TAPWindows) GetIP() net.IP {
 	return t.IP
 }
 
+// GetIPv6 returns IPv6 address of the interface
+func (t *TAPWindows) GetIPv6() net.IP {
+	return t.IPv6
+}
+
 func (t *TAPWindows) GetSubnet() net.IP {
 	return t.Subnet
 }
@@ -182,6 +189,11 @@ func (t *TAPWindows) SetIP(ip net.IP) {
 	t.IP = ip
 }
 
+// SetIPv6 will set IPv6 address
+func (t *TAPWindows) SetIPv6(ip net.IP) {
+	t.IPv6 = ip
+}
+
 func (t *TAPWindows) SetSubnet(subnet net.IP) {
 	t.Subnet = subnet
 }
@@ -203,21 +215,21 @@ func (t *TAPWindows) Init(name string) error {
 func (t *TAPWindows) Open() error {
 	handle, err := t.queryNetworkKey()
 	if err != nil {
-		Log(Error, "Failed to query Windows registry: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to query Windows registry: %v", err)
 		return err
 	}
 	err = t.queryAdapters(handle)
 	if err != nil {
-		Log(Error, "Failed to query network adapters: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to query network adapters: %v", err)
 		return err
 	}
 	if t.Name == "" {
-		Log(Error, "Failed to query network adapters: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to query network adapters: %v", err)
 		return errors.New("Empty network adapter")
 	}
 	err = syscall.CloseHandle(handle)
 	if err != nil {
-		Log(Error, "Failed to close retrieved handle: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to close retrieved handle: %v", err)
 	}
 	return nil
 }
@@ -242,12 +254,12 @@ func (t *TAPWindows) Configure(lazy bool) error {
 		// peers
 		return nil
 	}
-	Log(Debug, "Configuring %s. IP: %s Mask: %s", t.Interface, t.IP.String(), t.Mask.String())
+	LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Configuring %s. IP: %s Mask: %s", t.Interface, t.IP.String(), t.Mask.String())
 	setip := exec.Command("netsh")
 	setip.SysProcAttr = &syscall.SysProcAttr{}
 	// TODO: Unhardcode mask
 	cmd := fmt.Sprintf(`netsh interface ip set address "%s" static %s %s`, t.Interface, t.IP.String(), "255.255.255.0")
-	Log(Debug, "Executing: %s", cmd)
+	LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Executing: %s", cmd)
 	setip.SysProcAttr.CmdLine = cmd
 	err := setip.Run()
 	if err != nil {
@@ -281,19 +293,19 @@ func (t *TAPWindows) Deconfigure() error {
 func (t *TAPWindows) Run() {
 	t.Status = InterfaceRunning
 	t.Broken = false
-	Log(Info, "Listening for TAP interface")
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Listening for TAP interface")
 	t.Rx = make(chan []byte, 1500)
 	t.Tx = make(chan []byte, 1500)
 	// Start reader
 	go func() {
 		if err := t.read(t.Rx); err != nil {
-			Log(Error, "Failed to read packet: %v", err)
+			LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to read packet: %v", err)
 		}
 	}()
 	// Start writer
 	go func() {
 		if err := t.write(t.Tx); err != nil {
-			Log(Error, "Failed ro write packet: %v", err)
+			LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed ro write packet: %v", err)
 		}
 	}()
 	// Start TUNTAP interface checker
@@ -360,7 +372,7 @@ func (t *TAPWindows) read(ch chan []byte) (err error) {
 		if err := syscall.ReadFile(t.file, buf, &l, &rx); err != nil {
 		}
 		if _, err := syscall.WaitForSingleObject(rx.HEvent, syscall.INFINITE); err != nil {
-			Log(Error, "Failed to read from TUN/TAP: %v", err)
+			LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to read from TUN/TAP: %v", err)
 		}
 		rx.Offset += l
 		ch <- buf
@@ -402,7 +414,7 @@ func (t *TAPWindows) queryAdapters(handle syscall.Handle) error {
 		adapter := make([]uint16, length)
 		err := syscall.RegEnumKeyEx(handle, index, &adapter[0], &length, nil, nil, nil, nil)
 		if err == NoMoreItems {
-			Log(Debug, "No more items in Windows Registry")
+			LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "No more items in Windows Registry")
 			return nil
 		}
 		index++
@@ -432,7 +444,7 @@ func (t *TAPWindows) queryAdapters(handle syscall.Handle) error {
 
 		adapterName := string(utf16.Decode(aNameUtf16))
 		adapterName = t.removeZeroes(adapterName)
-		Log(Debug, "AdapterName : %s, len : %d", adapterName, len(adapterName))
+		LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "AdapterName : %s, len : %d", adapterName, len(adapterName))
 
 		var isInUse = false
 		for _, i := range UsedInterfaces {
@@ -441,7 +453,7 @@ func (t *TAPWindows) queryAdapters(handle syscall.Handle) error {
 			}
 		}
 		if isInUse {
-			Log(Debug, "Adapter already in use. Skipping.")
+			LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Adapter already in use. Skipping.")
 			continue
 		}
 		UsedInterfaces = append(UsedInterfaces, adapterName)
@@ -459,7 +471,7 @@ func (t *TAPWindows) queryAdapters(handle syscall.Handle) error {
 			syscall.CloseHandle(t.Handle)
 			continue
 		}
-		Log(Info, "Acquired control over TAP interface: %s", adapterName)
+		LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Acquired control over TAP interface: %s", adapterName)
 		t.Name = adapterID
 		t.Interface = adapterName
 		return nil
@@ -511,7 +523,7 @@ func (t *TAPWindows) IsPMTUEnabled() bool {
 func (t *TAPWindows) checkInterfaces() error {
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		Log(Error, "Failed to check interfaces: %s", err.Error())
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to check interfaces: %s", err.Error())
 		return err
 	}
 	found := false
@@ -532,18 +544,18 @@ func (t *TAPWindows) checkInterfaces() error {
 		}
 	}
 	if !found {
-		Log(Info, "Interface got deconfigured: %s %s", t.Name, t.IP.String())
+		LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Interface got deconfigured: %s %s", t.Name, t.IP.String())
 		return fmt.Errorf("Interface got deconfigured: %s %s", t.Name, t.IP.String())
 	}
 	return nil
 }
 
 func (t *TAPWindows) restoreInterface() error {
-	Log(Info, "Restoring network interface: %s %s", t.Name, t.IP.String())
+	LogWith(Info, Fields{Subsystem: SubsystemInstance}, "Restoring network interface: %s %s", t.Name, t.IP.String())
 
 	err := t.Configure(false)
 	if err != nil {
-		Log(Error, "Failed to configure interface: %s", err.Error())
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to configure interface: %s", err.Error())
 	}
 
 	return nil
@@ -585,10 +597,14 @@ func FilterInterface(infName, infIP string) bool {
 		}
 	}
 
-	Log(Trace, "ping -4 -w 1000 -n 1 -S %s ptest.subutai.io", infIP)
-	ping := exec.Command("ping", "-4", "-w", "1000", "-n", "1", "-S", infIP, "ptest.subutai.io")
+	family := "-4"
+	if strings.Contains(infIP, ":") {
+		family = "-6"
+	}
+	LogWith(Trace, Fields{Subsystem: SubsystemInstance}, "ping %s -w 1000 -n 1 -S %s ptest.subutai.io", family, infIP)
+	ping := exec.Command("ping", family, "-w", "1000", "-n", "1", "-S", infIP, "ptest.subutai.io")
 	if ping.Run() != nil {
-		Log(Debug, "Filtered %s %s", infName, infIP)
+		LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Filtered %s %s", infName, infIP)
 		return true
 	}
 	return false
@@ -2,6 +2,7 @@ package ptp
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"strings"
@@ -19,14 +20,14 @@ func GenerateMAC() (string, net.HardwareAddr) {
 	buf := make([]byte, 6)
 	_, err := rand.Read(buf)
 	if err != nil {
-		Log(Error, "Failed to generate MAC: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to generate MAC: %v", err)
 		return "", nil
 	}
 	buf[0] |= 2
 	mac := fmt.Sprintf("06:%02x:%02x:%02x:%02x:%02x", buf[1], buf[2], buf[3], buf[4], buf[5])
 	hw, err := net.ParseMAC(mac)
 	if err != nil {
-		Log(Error, "Corrupted MAC address generated: %v", err)
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Corrupted MAC address generated: %v", err)
 		return "", nil
 	}
 	return mac, hw
@@ -40,11 +41,11 @@ func GenerateToken() string {
 	result := ""
 	id, err := uuid.NewUUID()
 	if err != nil {
-		Log(Error, "Failed to generate token for peer")
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to generate token for peer")
 		return result
 	}
 	result = id.String()
-	Log(Debug, "Token generated: %s", result)
+	LogWith(Debug, Fields{Subsystem: SubsystemInstance}, "Token generated: %s", result)
 	return result
 }
 
@@ -57,10 +58,22 @@ func isPrivateIP(ip net.IP) (bool, error) {
 	_, private24, _ := net.ParseCIDR("10.0.0.0/8")
 	_, private20, _ := net.ParseCIDR("172.16.0.0/12")
 	_, private16, _ := net.ParseCIDR("192.168.0.0/16")
-	isPrivate := private24.Contains(ip) || private20.Contains(ip) || private16.Contains(ip)
+	_, privateULA, _ := net.ParseCIDR("fc00::/7")
+	isPrivate := private24.Contains(ip) || private20.Contains(ip) || private16.Contains(ip) || privateULA.Contains(ip)
 	return isPrivate, nil
 }
 
+// resolveUDPAddr resolves IPv4 or IPv6 endpoint address. IPv6 addresses
+// are accepted without brackets too, because bootstrap nodes join IP and
+// port with a colon
+func resolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+		i := strings.LastIndex(addr, ":")
+		addr = net.JoinHostPort(addr[:i], addr[i+1:])
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
 // StringifyState extracts human-readable word that represents a peer status
 func StringifyState(state PeerState) string {
 	switch state {
@@ -102,15 +115,15 @@ func IsInterfaceLocal(ip net.IP) bool {
 // FindNetworkAddresses method lists interfaces available in the system and retrieves their
 // IP addresses
 func (p *PeerToPeer) FindNetworkAddresses() error {
-	Log(Debug, "Looking for available network interfaces")
+	LogWith(Debug, p.logFields(SubsystemInstance), "Looking for available network interfaces")
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		Log(Error, "Failed to retrieve list of network interfaces: %s", err.Error())
+		LogWith(Error, p.logFields(SubsystemInstance), "Failed to retrieve list of network interfaces: %s", err.Error())
 		return fmt.Errorf("Failed to retrieve list of network interfaces: %s", err.Error())
 	}
 	p.LocalIPs = p.LocalIPs[:0]
 	p.LocalIPs = p.ParseInterfaces(interfaces)
-	Log(Trace, "%d interfaces were saved", len(p.LocalIPs))
+	LogWith(Trace, p.logFields(SubsystemInstance), "%d interfaces were saved", len(p.LocalIPs))
 	return nil
 }
 
@@ -125,21 +138,25 @@ func (p *PeerToPeer) ParseInterfaces(interfaces []net.Interface) []net.IP {
 	for _, i := range interfaces {
 		addresses, err := i.Addrs()
 		if err != nil {
-			Log(Error, "Failed to retrieve address for interface: %s", err.Error())
+			LogWith(Error, p.logFields(SubsystemInstance), "Failed to retrieve address for interface: %s", err.Error())
 			continue
 		}
 		if len(addresses) == 0 {
-			Log(Warning, "No IPs assigned to interface %s", i.Name)
+			LogWith(Warning, p.logFields(SubsystemInstance), "No IPs assigned to interface %s", i.Name)
 			continue
 		}
 		for _, addr := range addresses {
 			ip, _, err := net.ParseCIDR(addr.String())
 			if err != nil {
-				Log(Error, "Failed to parse CIDR notation: %v", err)
+				LogWith(Error, p.logFields(SubsystemInstance), "Failed to parse CIDR notation: %v", err)
 				continue
 			}
 
-			if ip.IsGlobalUnicast() && p.IsIPv4(ip.String()) {
+			if ip.To4() == nil && !p.UDPSocket.IPv6() {
+				// Socket can't be used with IPv6 addresses
+				continue
+			}
+			if ip.IsGlobalUnicast() {
 				if !FilterInterface(i.Name, ip.String()) {
 					ips = append(ips, ip)
 				} else {
@@ -168,11 +185,11 @@ func SrvLookup(name, proto, domain string) (map[int]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	Log(Debug, "SRV lookup for name cname: %s addrs: %+v", cname, addrs)
+	LogWith(Debug, Fields{Subsystem: SubsystemDiscovery}, "SRV lookup for name cname: %s addrs: %+v", cname, addrs)
 	result := make(map[int]string)
 	i := 0
 	for _, addr := range addrs {
-		Log(Trace, "Lookup result: %s:%d", addr.Target, addr.Port)
+		LogWith(Trace, Fields{Subsystem: SubsystemDiscovery}, "Lookup result: %s:%d", addr.Target, addr.Port)
 		result[i] = fmt.Sprintf("%s:%d", addr.Target, addr.Port)
 		i++
 	}
@@ -189,7 +206,7 @@ func NanoToMilliseconds(nano int64) int64 {
 func isDeviceExists(name string) bool {
 	inf, err := net.Interfaces()
 	if err != nil {
-		Log(Error, "Failed to retrieve list of network interfaces")
+		LogWith(Error, Fields{Subsystem: SubsystemInstance}, "Failed to retrieve list of network interfaces")
 		return true
 	}
 	for _, i := range inf {
@@ -205,7 +222,7 @@ func isDeviceExists(name string) bool {
 func ParseIntroString(intro string) (*PeerHandshake, error) {
 	hs := &PeerHandshake{}
 	parts := strings.Split(intro, ",")
-	if len(parts) != 4 {
+	if len(parts) != 4 && len(parts) != 5 {
 		return nil, fmt.Errorf("Failed to parse introduction string: %s", intro)
 	}
 	hs.ID = parts[0]
@@ -225,10 +242,18 @@ func ParseIntroString(intro string) (*PeerHandshake, error) {
 			return nil, fmt.Errorf("Failed to parse IP address from introduction packet")
 		}
 	}
-	hs.Endpoint, err = net.ResolveUDPAddr("udp4", parts[3])
+	// Older versions echo key exchange payload along with the endpoint
+	endpoint, _ := splitKeyExchange(parts[3])
+	hs.Endpoint, err = resolveUDPAddr(endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse handshake endpoint: %s", parts[3])
 	}
+	if len(parts) == 5 {
+		hs.KeyExchange, err = base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse key exchange payload: %s", err)
+		}
+	}
 
 	return hs, nil
 }
@@ -58,6 +58,9 @@ func Test_isPrivateIP(t *testing.T) {
 		{"172.16.x subnet", args{net.ParseIP("172.16.0.1")}, true, false},
 		{"192.168.x subnet", args{net.ParseIP("192.168.0.1")}, true, false},
 		{"192.168.x subnet", args{net.ParseIP("192.168.1.1")}, true, false},
+		{"Public IP", args{net.ParseIP("8.8.8.8")}, false, false},
+		{"IPv6 unique local", args{net.ParseIP("fd00::1")}, true, false},
+		{"IPv6 global", args{net.ParseIP("2001:db8::1")}, false, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -267,6 +270,14 @@ func TestParseIntroString(t *testing.T) {
 	hs0.HardwareAddr, _ = net.ParseMAC("00:11:22:33:44:55")
 	hs0.Endpoint, _ = net.ResolveUDPAddr("udp4", "192.168.0.1:1234")
 
+	hs1 := new(PeerHandshake)
+	*hs1 = *hs0
+	hs1.KeyExchange = []byte{0x1, 0x2, 0x3}
+
+	hs2 := new(PeerHandshake)
+	*hs2 = *hs0
+	hs2.Endpoint, _ = net.ResolveUDPAddr("udp", "[2001:db8::1]:1234")
+
 	tests := []struct {
 		name    string
 		args    args
@@ -279,6 +290,11 @@ func TestParseIntroString(t *testing.T) {
 		{"broken ip", args{",00:11:22:33:44:55,a,"}, nil, true},
 		{"broken udp addr", args{",00:11:22:33:44:55,10.11.12.13,a:b"}, nil, true},
 		{"passing", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234"}, hs0, false},
+		{"echoed key exchange", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234|AQID"}, hs0, false},
+		{"broken key exchange", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234,!!"}, nil, true},
+		{"key exchange", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234,AQID"}, hs1, false},
+		{"too many fields", args{"1,00:11:22:33:44:55,10.11.12.13,192.168.0.1:1234,AQID,"}, nil, true},
+		{"ipv6 endpoint", args{"1,00:11:22:33:44:55,10.11.12.13,[2001:db8::1]:1234"}, hs2, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -293,3 +309,30 @@ func TestParseIntroString(t *testing.T) {
 		})
 	}
 }
+
+func Test_resolveUDPAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{"ipv4", "192.168.0.1:1234", "192.168.0.1:1234", false},
+		{"ipv6", "[2001:db8::1]:1234", "[2001:db8::1]:1234", false},
+		{"ipv6 without brackets", "2001:db8::1:1234", "[2001:db8::1]:1234", false},
+		{"missing port", "192.168.0.1", "", true},
+		{"broken port", "2001:db8::1:port", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveUDPAddr(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolveUDPAddr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("resolveUDPAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
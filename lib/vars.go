@@ -5,10 +5,13 @@ import (
 )
 
 // PacketVersion is a version of packet used in DHT communication
-const PacketVersion int32 = 20005
+const PacketVersion int32 = 20006
+
+// LegacyPacketVersion is a version of packets sent without framing
+const LegacyPacketVersion int32 = 20005
 
 // SupportedVersion is a list of versions supported by DHT server
-var SupportedVersion = [...]int32{20005, 200006}
+var SupportedVersion = [...]int32{20005, 20006}
 
 // DHTBufferSize is a size of DHT buffer
 const DHTBufferSize = 4096
@@ -31,6 +34,10 @@ const (
 	MsgTypeConf              = 10 // Confirmation
 	MsgTypeLatency           = 11 // Latency measurement
 	MsgTypeComm              = 12 // Internal cross peer communication
+	MsgTypeSealed            = 13 // Authenticated and encrypted data frame
+	MsgTypeRelay             = 14 // Message relayed by another peer
+	MsgTypeProxySwarm        = 15 // Proxy registration carrying swarm hash
+	MsgTypeInvite            = 16 // Admission of a peer joining with invite
 )
 
 // Common communication packet types
@@ -46,6 +53,12 @@ const (
 	CommIPInfo            = 11 // Ask peer if it knows specified IP
 	CommIPSet             = 12 // Notify peer that this peer is now available over specified IP
 	CommIPConflict        = 13 // Notify peer that his IP is in conflict
+	CommIPv6Set           = 14 // Notify peer about IPv6 address of this peer
+)
+
+// Relay communication packets
+const (
+	CommRelayReach uint16 = 15 // Notify peer about peers reachable from this peer
 )
 
 // Discovery communication packets
@@ -77,6 +90,14 @@ var LatencyRequestHeader = []byte{0xde, 0xad, 0xde, 0xda}
 // LatencyResponseHeader used as a header when sending latency response
 var LatencyResponseHeader = []byte{0xad, 0xde, 0xad, 0xde}
 
+// LatencyRequestHeaderV6 used as a header when sending latency request
+// to IPv6 endpoint
+var LatencyRequestHeaderV6 = []byte{0xde, 0xad, 0xde, 0x06}
+
+// LatencyResponseHeaderV6 used as a header when sending latency response
+// to request from IPv6 endpoint
+var LatencyResponseHeaderV6 = []byte{0xad, 0xde, 0xad, 0x06}
+
 // List of commands used in DHT
 const (
 	DhtCmdConn        string = "conn"
@@ -131,4 +152,5 @@ const (
 	ProxyLatencyRequestInterval    time.Duration = time.Second * 15         // How often we should update latency with proxies
 	EndpointLatencyRequestInterval time.Duration = time.Second * 15         // How often we should update latency with endpoints
 	UDPHolePunchTimeout            time.Duration = time.Millisecond * 20000 // How long we will for udp hole punching to finish
+	KeyGracePeriod                 time.Duration = time.Second * 60         // How long previous and next keys are accepted around key rotation
 )
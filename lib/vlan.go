@@ -0,0 +1,145 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// 802.1Q VLAN support.
+// Tagged frames captured on the interface are forwarded to the swarm with
+// their tag preserved. A VLAN can also be mapped to a separate instance
+// (and therefore a separate swarm): frames of such VLAN are untagged and
+// handled by that instance, while frames it receives from its own swarm are
+// tagged again and written to the interface of the trunk instance
+
+const (
+	vlanTagSize int    = 4
+	vlanIDMask  uint16 = 0x0fff
+	vlanIDMax   uint16 = 4094
+)
+
+var (
+	errInvalidVLANFrame = errors.New("invalid 802.1q frame")
+	errInvalidVLANID    = errors.New("invalid VLAN ID")
+)
+
+// parseVLANTag returns VLAN ID and encapsulated ether type of a tagged frame
+func parseVLANTag(b []byte) (uint16, uint16, error) {
+	// dst[6] src[6] tpid[2] tci[2] ethertype[2]
+	if len(b) < 18 || binary.BigEndian.Uint16(b[12:14]) != uint16(Packet8021Q) {
+		return 0, 0, errInvalidVLANFrame
+	}
+	return binary.BigEndian.Uint16(b[14:16]) & vlanIDMask, binary.BigEndian.Uint16(b[16:18]), nil
+}
+
+// tagFrame inserts 802.1q tag with provided VLAN ID after MAC addresses
+func tagFrame(b []byte, vlan uint16) []byte {
+	if len(b) < 12 {
+		return b
+	}
+	tagged := make([]byte, len(b)+vlanTagSize)
+	copy(tagged[0:12], b[0:12])
+	binary.BigEndian.PutUint16(tagged[12:14], uint16(Packet8021Q))
+	binary.BigEndian.PutUint16(tagged[14:16], vlan&vlanIDMask)
+	copy(tagged[16:], b[12:])
+	return tagged
+}
+
+// untagFrame removes 802.1q tag from the frame
+func untagFrame(b []byte) []byte {
+	untagged := make([]byte, len(b)-vlanTagSize)
+	copy(untagged[0:12], b[0:12])
+	copy(untagged[12:], b[12+vlanTagSize:])
+	return untagged
+}
+
+// AttachVLAN maps VLAN to another instance. This instance becomes a trunk:
+// its interface will carry traffic of the attached instance, which will not
+// create an interface of its own
+func (p *PeerToPeer) AttachVLAN(vlan uint16, instance *PeerToPeer) error {
+	if vlan == 0 || vlan > vlanIDMax {
+		return errInvalidVLANID
+	}
+	if instance == nil || instance == p {
+		return fmt.Errorf("Can't attach VLAN %d: bad instance", vlan)
+	}
+	if trunk, _ := p.getTrunk(); trunk != nil {
+		return fmt.Errorf("Can't attach VLAN %d: instance is a VLAN itself", vlan)
+	}
+	if p.Interface == nil || instance.Interface == nil {
+		return fmt.Errorf("Can't attach VLAN %d: nil interface", vlan)
+	}
+	p.vlanLock.Lock()
+	defer p.vlanLock.Unlock()
+	if p.vlans == nil {
+		p.vlans = make(map[uint16]*PeerToPeer)
+	}
+	if _, exists := p.vlans[vlan]; exists {
+		return fmt.Errorf("VLAN %d is already attached", vlan)
+	}
+	p.vlans[vlan] = instance
+	instance.vlanLock.Lock()
+	instance.Trunk = p
+	instance.VLAN = vlan
+	instance.vlanLock.Unlock()
+	// Frames of the VLAN leave the same interface, so peers of the
+	// VLAN instance should see hardware address of the trunk
+	instance.Interface.SetHardwareAddress(p.Interface.GetHardwareAddress())
+	instance.Interface.MarkConfigured()
+	LogWith(Info, p.logFields(SubsystemInstance), "VLAN %d attached to %s", vlan, p.Interface.GetName())
+	return nil
+}
+
+// DetachVLAN removes VLAN mapping
+func (p *PeerToPeer) DetachVLAN(vlan uint16) error {
+	p.vlanLock.Lock()
+	defer p.vlanLock.Unlock()
+	instance, exists := p.vlans[vlan]
+	if !exists {
+		return fmt.Errorf("VLAN %d is not attached", vlan)
+	}
+	delete(p.vlans, vlan)
+	instance.setTrunkDetached()
+	LogWith(Info, p.logFields(SubsystemInstance), "VLAN %d detached", vlan)
+	return nil
+}
+
+// getTrunk returns instance which interface carries traffic of this
+// instance and ID of the VLAN. VLAN ID is kept after trunk is detached,
+// because interface of VLAN instance is never opened
+func (p *PeerToPeer) getTrunk() (*PeerToPeer, uint16) {
+	p.vlanLock.RLock()
+	defer p.vlanLock.RUnlock()
+	return p.Trunk, p.VLAN
+}
+
+// setTrunkDetached drops reference to the trunk. Lock of the trunk
+// is held by caller
+func (p *PeerToPeer) setTrunkDetached() {
+	p.vlanLock.Lock()
+	p.Trunk = nil
+	p.vlanLock.Unlock()
+}
+
+// getVLAN returns instance attached to VLAN or nil
+func (p *PeerToPeer) getVLAN(vlan uint16) *PeerToPeer {
+	p.vlanLock.RLock()
+	defer p.vlanLock.RUnlock()
+	return p.vlans[vlan]
+}
+
+// detachVLANs removes this instance from its trunk and detaches every
+// VLAN attached to this instance
+func (p *PeerToPeer) detachVLANs() {
+	if trunk, vlan := p.getTrunk(); trunk != nil {
+		trunk.DetachVLAN(vlan)
+	}
+	p.vlanLock.Lock()
+	defer p.vlanLock.Unlock()
+	for vlan, instance := range p.vlans {
+		LogWith(Warning, p.logFields(SubsystemInstance), "Trunk is stopping: frames of VLAN %d will be dropped", vlan)
+		instance.setTrunkDetached()
+	}
+	p.vlans = nil
+}
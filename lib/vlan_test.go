@@ -0,0 +1,172 @@
+package ptp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// buildTaggedFrame returns ethernet frame with 802.1q tag
+func buildTaggedFrame(dst net.HardwareAddr, vlan uint16, proto uint16) []byte {
+	src, _ := net.ParseMAC("06:07:08:09:0a:0b")
+	frame := make([]byte, 14, 64)
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	frame[12] = byte(proto >> 8)
+	frame[13] = byte(proto)
+	frame = append(frame, make([]byte, 46)...)
+	return tagFrame(frame, vlan)
+}
+
+func TestTagFrame(t *testing.T) {
+	frame := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x08, 0x00, 0xaa, 0xbb}
+	tagged := tagFrame(frame, 0x1064)
+	want := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x81, 0x00, 0x00, 0x64, 0x08, 0x00, 0xaa, 0xbb}
+	if !bytes.Equal(tagged, want) {
+		t.Fatalf("tagFrame() = %v, want %v", tagged, want)
+	}
+	if untagged := untagFrame(tagged); !bytes.Equal(untagged, frame) {
+		t.Errorf("untagFrame() = %v, want %v", untagged, frame)
+	}
+	if short := tagFrame([]byte{1, 2}, 1); len(short) != 2 {
+		t.Errorf("tagFrame() modified short frame")
+	}
+}
+
+func TestParseVLANTag(t *testing.T) {
+	dst, _ := net.ParseMAC("00:11:22:33:44:55")
+	untagged := make([]byte, 60)
+	untagged[12] = 0x08
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantVLAN  uint16
+		wantProto uint16
+		wantErr   bool
+	}{
+		{"nil data", nil, 0, 0, true},
+		{"short frame", make([]byte, 17), 0, 0, true},
+		{"untagged frame", untagged, 0, 0, true},
+		{"ipv4 in vlan 20", buildTaggedFrame(dst, 20, uint16(PacketIPv4)), 20, uint16(PacketIPv4), false},
+		{"arp in vlan 4094", buildTaggedFrame(dst, 4094, uint16(PacketARP)), 4094, uint16(PacketARP), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vlan, proto, err := parseVLANTag(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVLANTag() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if vlan != tt.wantVLAN || proto != tt.wantProto {
+				t.Errorf("parseVLANTag() = %d %d, want %d %d", vlan, proto, tt.wantVLAN, tt.wantProto)
+			}
+		})
+	}
+}
+
+func TestPeerToPeer_AttachVLAN(t *testing.T) {
+	hw, _ := net.ParseMAC("00:11:22:33:44:55")
+	newInstance := func() *PeerToPeer {
+		tap, _ := newTAP("ip", "10.10.10.1", hw.String(), "255.255.255.0", DefaultMTU, false)
+		return &PeerToPeer{Interface: tap}
+	}
+	trunk := newInstance()
+	trunk.Interface.SetHardwareAddress(hw)
+	child := newInstance()
+	child.Interface.SetHardwareAddress(nil)
+
+	tests := []struct {
+		name     string
+		trunk    *PeerToPeer
+		vlan     uint16
+		instance *PeerToPeer
+		wantErr  bool
+	}{
+		{"zero vlan", trunk, 0, child, true},
+		{"vlan out of range", trunk, 4095, child, true},
+		{"nil instance", trunk, 10, nil, true},
+		{"same instance", trunk, 10, trunk, true},
+		{"nil interface", trunk, 10, &PeerToPeer{}, true},
+		{"passing", trunk, 10, child, false},
+		{"duplicate", trunk, 10, newInstance(), true},
+		{"child as trunk", child, 11, newInstance(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.trunk.AttachVLAN(tt.vlan, tt.instance); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.AttachVLAN() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if trunk.getVLAN(10) != child || child.Trunk != trunk || child.VLAN != 10 {
+		t.Fatalf("VLAN wasn't attached")
+	}
+	if !bytes.Equal(child.Interface.GetHardwareAddress(), hw) || !child.Interface.IsConfigured() {
+		t.Errorf("VLAN instance interface wasn't set up")
+	}
+	if err := trunk.DetachVLAN(11); err == nil {
+		t.Errorf("PeerToPeer.DetachVLAN() detached unknown VLAN")
+	}
+	child.detachVLANs()
+	if trunk.getVLAN(10) != nil || child.Trunk != nil {
+		t.Errorf("VLAN wasn't detached")
+	}
+	// Detached VLAN instance must not fall back to its own interface
+	if err := child.WriteToDevice(make([]byte, 64), uint16(PacketIPv4), false); err == nil {
+		t.Errorf("PeerToPeer.WriteToDevice() wrote frame of detached VLAN")
+	}
+	if _, vlan := child.getTrunk(); vlan != 10 {
+		t.Errorf("PeerToPeer.getTrunk() VLAN = %d, want 10", vlan)
+	}
+}
+
+func TestPeerToPeer_handle8021qPacketVLAN(t *testing.T) {
+	hw, _ := net.ParseMAC("00:11:22:33:44:55")
+	broadcast, _ := net.ParseMAC("ff:ff:ff:ff:ff:ff")
+
+	socket := new(Network)
+	socket.Init("127.0.0.1", 1234)
+	swarm := new(Swarm)
+	swarm.Init()
+
+	var handled []byte
+	child := &PeerToPeer{PacketHandlers: map[PacketType]PacketHandlerCallback{
+		PacketIPv4: func(contents []byte, proto int) error {
+			handled = contents
+			return nil
+		},
+	}}
+	trunk := &PeerToPeer{
+		Swarm:     swarm,
+		UDPSocket: socket,
+		vlans:     map[uint16]*PeerToPeer{20: child},
+	}
+
+	tests := []struct {
+		name        string
+		data        []byte
+		wantErr     bool
+		wantHandled bool
+	}{
+		{"malformed frame", []byte{0x01, 0x02}, true, false},
+		{"mapped vlan", buildTaggedFrame(hw, 20, uint16(PacketIPv4)), false, true},
+		{"mapped vlan unknown protocol", buildTaggedFrame(hw, 20, 0x1234), true, false},
+		{"unmapped vlan broadcast", buildTaggedFrame(broadcast, 30, uint16(PacketARP)), false, false},
+		{"unmapped vlan unicast", buildTaggedFrame(hw, 30, uint16(PacketIPv4)), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = nil
+			if err := trunk.handle8021qPacket(tt.data, int(Packet8021Q)); (err != nil) != tt.wantErr {
+				t.Errorf("PeerToPeer.handle8021qPacket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (handled != nil) != tt.wantHandled {
+				t.Fatalf("PeerToPeer.handle8021qPacket() handled = %v, want %v", handled != nil, tt.wantHandled)
+			}
+			if handled != nil && !bytes.Equal(handled, untagFrame(tt.data)) {
+				t.Errorf("PeerToPeer.handle8021qPacket() passed tagged frame to VLAN instance")
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	ptp "github.com/subutai-io/p2p/lib"
@@ -73,6 +74,7 @@ func main() {
 		Syslog         string // Syslog socket
 		Infohash       string // Infohash of a swarm
 		IP             string // IP address of local p2p interface
+		IPv6           string // IPv6 address of local p2p interface
 		Mac            string // Hardware address of p2p interface
 		InterfaceName  string // Name of p2p interface
 		Keyfile        string // Path to a file with crypto key
@@ -80,18 +82,40 @@ func main() {
 		Until          string // Until date this key will be active in Unix timestamp
 		Ports          string // Ports range for an instance
 		UDPPort        int    // Specific UDP port for an instance
+		VLAN           int    // VLAN ID carried by a trunk instance
+		Trunk          string // Infohash of an instance which interface is used for VLAN
+		Static         string // Path to a file with static peers
 		UseForwarders  bool   // Whether or not p2p should force usage of proxy servers for this instance
 		ShowInterfaces bool   // Whether or not p2p show command should return information about interfaces in use
 		ShowAll        bool   //
 		ShowBind       bool   // used with show --interfaces
 		LogLevel       string // Log level
+		LogFormat      string // Format of log records
+		LogSubsystem   string // Subsystem which log level is modified
 		RemoveService  bool   // If yes - service will be removed (used with service)
 		InstallService bool   // If yes - service will be installed (used with service)
 		MTU            int    // MTU for p2p interface
 		ShowMTU        bool   // Show MTU value
+		ShowKeys       bool   // Show state of crypto keys of instance
+		ReloadKeys     bool   // Whether or not key files should be reloaded
+		ShowACL        bool   // Show access lists of instance
+		Allow          string // Comma-separated peers which are allowed in the swarm
+		Deny           string // Comma-separated peers which are denied in the swarm
+		RemoveACL      string // Comma-separated peers which are removed from access lists
+		Invite         string // Invite token used to join a swarm
+		InviteExpires  string // Lifetime of a new invite
+		SingleUse      bool   // Whether or not invite can be redeemed by a single peer only
+		EventTypes     string // Comma-separated types of events
+		RawEvents      bool   // Print events as JSON
 		PMTU           bool   // Whether or not PMTU capabilities should be used
 		SRVEntry       string // SRV Entry for service lookup
 		ConfigFile     string // Path to configuration YAML file
+		RelayCapacity  int    // Maximum number of clients served by relay
+		RelayQuota     int    // Maximum number of relay clients from a single swarm
+		Listen         string // Address bootstrap node is listening on
+		TLSCert        string // Path to TLS certificate of bootstrap node
+		TLSKey         string // Path to TLS key of bootstrap node
+		TLSClientCA    string // Path to CA bundle client certificates are verified with
 	)
 
 	app := cli.NewApp()
@@ -154,6 +178,12 @@ func main() {
 					Value:       "",
 					Destination: &LogLevel,
 				},
+				&cli.StringFlag{
+					Name:        "log-format",
+					Usage:       "Format of log records. Available formats: text, json",
+					Value:       "",
+					Destination: &LogFormat,
+				},
 				&cli.BoolFlag{
 					Name:        "pmtu",
 					Usage:       "When specified - enables PMTU capabilities",
@@ -176,7 +206,108 @@ func main() {
 				if SRVEntry == "" {
 					SRVEntry = TargetURL
 				}
-				ExecDaemon(RPCPort, SRVEntry, SaveFile, Profiling, Syslog, LogLevel, ConfigFile, MTU, PMTU)
+				ExecDaemon(RPCPort, SRVEntry, SaveFile, Profiling, Syslog, LogLevel, LogFormat, ConfigFile, MTU, PMTU)
+				return nil
+			},
+		},
+		{
+			Name:  "bootstrap",
+			Usage: "Run p2p as a bootstrap node",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "listen",
+					Usage:       "TCP address to listen on",
+					Value:       ":6881",
+					Destination: &Listen,
+				},
+				&cli.StringFlag{
+					Name:        "cert",
+					Usage:       "Path to TLS certificate. Connections are not encrypted when not specified",
+					Value:       "",
+					Destination: &TLSCert,
+				},
+				&cli.StringFlag{
+					Name:        "key",
+					Usage:       "Path to TLS private key",
+					Value:       "",
+					Destination: &TLSKey,
+				},
+				&cli.StringFlag{
+					Name:        "client-ca",
+					Usage:       "Path to CA bundle. When specified, clients must present certificates signed by it",
+					Value:       "",
+					Destination: &TLSClientCA,
+				},
+				&cli.StringFlag{
+					Name:        "log",
+					Usage:       "Log level. Available levels: trace, debug, info, warning, error",
+					Value:       "",
+					Destination: &LogLevel,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				ExecBootstrap(Listen, TLSCert, TLSKey, TLSClientCA, LogLevel)
+				return nil
+			},
+		},
+		{
+			Name:  "relay",
+			Usage: "Run p2p as a relay server for peers that can't connect directly",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "port",
+					Usage:       "UDP port clients register on. Random port is used when not specified",
+					Value:       0,
+					Destination: &UDPPort,
+				},
+				&cli.StringFlag{
+					Name:        "ip",
+					Usage:       "Public IP address of this relay. Outbound IP is used when not specified",
+					Value:       "",
+					Destination: &IP,
+				},
+				&cli.IntFlag{
+					Name:        "capacity",
+					Usage:       "Maximum number of clients. 0 means unlimited",
+					Value:       0,
+					Destination: &RelayCapacity,
+				},
+				&cli.IntFlag{
+					Name:        "quota",
+					Usage:       "Maximum number of clients from a single swarm. 0 means unlimited",
+					Value:       0,
+					Destination: &RelayQuota,
+				},
+				&cli.StringFlag{
+					Name:        "config",
+					Usage:       "Path to configuration YAML file",
+					Value:       "",
+					Destination: &ConfigFile,
+				},
+				&cli.StringFlag{
+					Name:        "target",
+					Usage:       "Comma-separated list of endpoints",
+					Value:       TargetURL,
+					Destination: &TargetURL,
+				},
+				&cli.StringFlag{
+					Name:        "srv",
+					Usage:       "Specify DHT SRV lookup entry. Supported: dht, devdht, masterdht",
+					Value:       "",
+					Destination: &SRVEntry,
+				},
+				&cli.StringFlag{
+					Name:        "log",
+					Usage:       "Log level. Available levels: trace, debug, info, warning, error",
+					Value:       "",
+					Destination: &LogLevel,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if SRVEntry == "" {
+					SRVEntry = TargetURL
+				}
+				ExecRelay(UDPPort, SRVEntry, IP, RelayCapacity, RelayQuota, LogLevel, ConfigFile)
 				return nil
 			},
 		},
@@ -229,6 +360,12 @@ func main() {
 					Value:       "dhcp",
 					Destination: &IP,
 				},
+				&cli.StringFlag{
+					Name:        "ipv6",
+					Usage:       "IPv6 address of p2p interface",
+					Value:       "",
+					Destination: &IPv6,
+				},
 				&cli.StringFlag{
 					Name:        "mac",
 					Usage:       "Hardware address of a p2p interface",
@@ -276,12 +413,75 @@ func main() {
 					Usage:       "Force proxy servers usage",
 					Destination: &UseForwarders,
 				},
+				&cli.IntFlag{
+					Name:        "vlan",
+					Usage:       "VLAN ID which traffic should be carried by this instance. Requires -trunk",
+					Value:       0,
+					Destination: &VLAN,
+				},
+				&cli.StringFlag{
+					Name:        "trunk",
+					Usage:       "Infohash of a running instance which interface should be used for VLAN",
+					Value:       "",
+					Destination: &Trunk,
+				},
+				&cli.StringFlag{
+					Name:        "static",
+					Usage:       "Path to a file with static peers of the swarm",
+					Value:       "",
+					Destination: &Static,
+				},
+				&cli.StringFlag{
+					Name:        "invite",
+					Usage:       "Invite token created with `p2p invite create`. Hash and key of the swarm are taken from it",
+					Value:       "",
+					Destination: &Invite,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandStart(RPCPort, IP, Infohash, Mac, InterfaceName, Keyfile, Key, Until, UseForwarders, UDPPort)
+				CommandStart(RPCPort, IP, IPv6, Infohash, Mac, InterfaceName, Keyfile, Key, Until, UseForwarders, UDPPort, VLAN, Trunk, Static, Invite)
 				return nil
 			},
 		},
+		{
+			Name:  "invite",
+			Usage: "Manage invites to join a swarm",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "create",
+					Usage: "Create an invite token for instance",
+					Flags: []cli.Flag{
+						&cli.IntFlag{
+							Name:        "rpc-port",
+							Usage:       "RPC port",
+							Value:       52523,
+							Destination: &RPCPort,
+						},
+						&cli.StringFlag{
+							Name:        "hash",
+							Usage:       "Infohash of instance which swarm new peer is invited to",
+							Value:       "",
+							Destination: &Infohash,
+						},
+						&cli.StringFlag{
+							Name:        "expires",
+							Usage:       "Lifetime of the invite, for example 72h. Default is 24h",
+							Value:       "",
+							Destination: &InviteExpires,
+						},
+						&cli.BoolFlag{
+							Name:        "single-use",
+							Usage:       "Invite can be redeemed by a single peer only",
+							Destination: &SingleUse,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						CommandInvite(RPCPort, Infohash, InviteExpires, SingleUse)
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:  "stop",
 			Usage: "Shutdown p2p instance",
@@ -352,9 +552,19 @@ func main() {
 					Usage:       "Display current MTU value in P2P",
 					Destination: &ShowMTU,
 				},
+				&cli.BoolFlag{
+					Name:        "keys",
+					Usage:       "In combination with -hash this will show crypto keys rotation schedule",
+					Destination: &ShowKeys,
+				},
+				&cli.BoolFlag{
+					Name:        "acl",
+					Usage:       "In combination with -hash this will show peers allowed and denied in the swarm",
+					Destination: &ShowACL,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandShow(RPCPort, Infohash, IP, ShowInterfaces, ShowAll, ShowBind, ShowMTU)
+				CommandShow(RPCPort, Infohash, IP, ShowInterfaces, ShowAll, ShowBind, ShowMTU, ShowKeys, ShowACL)
 				return nil
 			},
 		},
@@ -370,10 +580,16 @@ func main() {
 				},
 				&cli.StringFlag{
 					Name:        "log",
-					Usage:       "Log level. Available levels: trace, debug, info, warning, error",
+					Usage:       "Log level. Available levels: trace, debug, info, warning, error. Level of instance with specified hash or of specified subsystem is reset with default",
 					Value:       "",
 					Destination: &LogLevel,
 				},
+				&cli.StringFlag{
+					Name:        "subsystem",
+					Usage:       "Modify log level of subsystem: " + strings.Join(ptp.LogSubsystems, ", "),
+					Value:       "",
+					Destination: &LogSubsystem,
+				},
 				&cli.StringFlag{
 					Name:        "key",
 					Usage:       "Append specified key to a list of crypto keys. Must be used with combination of -until",
@@ -398,9 +614,74 @@ func main() {
 					Value:       "",
 					Destination: &IP,
 				},
+				&cli.BoolFlag{
+					Name:        "reload-keys",
+					Usage:       "Reload key files of all instances or instance with specified hash",
+					Destination: &ReloadKeys,
+				},
+				&cli.StringFlag{
+					Name:        "allow",
+					Usage:       "Comma-separated peer IDs or identity keys allowed in the swarm with specified hash. When allow list is not empty, other peers can't join",
+					Value:       "",
+					Destination: &Allow,
+				},
+				&cli.StringFlag{
+					Name:        "deny",
+					Usage:       "Comma-separated peer IDs or identity keys denied in the swarm with specified hash",
+					Value:       "",
+					Destination: &Deny,
+				},
+				&cli.StringFlag{
+					Name:        "remove-acl",
+					Usage:       "Comma-separated peer IDs or identity keys that should be removed from allow and deny lists",
+					Value:       "",
+					Destination: &RemoveACL,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				acl := ""
+				entries := ""
+				if Allow != "" {
+					acl, entries = "acl-allow", Allow
+				} else if Deny != "" {
+					acl, entries = "acl-deny", Deny
+				} else if RemoveACL != "" {
+					acl, entries = "acl-remove", RemoveACL
+				}
+				CommandSet(RPCPort, LogLevel, LogSubsystem, Infohash, "", Key, Until, IP, ReloadKeys, acl, entries)
+				return nil
+			},
+		},
+		{
+			Name:  "events",
+			Usage: "Display events of daemon and instances as they happen",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "rpc-port",
+					Usage:       "RPC port",
+					Value:       52523,
+					Destination: &RPCPort,
+				},
+				&cli.StringFlag{
+					Name:        "hash",
+					Usage:       "Display only events of instance with specified hash and events of daemon",
+					Value:       "",
+					Destination: &Infohash,
+				},
+				&cli.StringFlag{
+					Name:        "type",
+					Usage:       "Comma-separated types of events: peer-state, interface, ip-set, ip-conflict, proxy, bootstrap",
+					Value:       "",
+					Destination: &EventTypes,
+				},
+				&cli.BoolFlag{
+					Name:        "json",
+					Usage:       "Display events in JSON format",
+					Destination: &RawEvents,
+				},
 			},
 			Action: func(c *cli.Context) error {
-				CommandSet(RPCPort, LogLevel, Infohash, "", Key, Until, IP)
+				CommandEvents(RPCPort, Infohash, EventTypes, RawEvents)
 				return nil
 			},
 		},
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// Metrics of the daemon, its instances and peers are exposed on /metrics
+// endpoint of REST listener in Prometheus text format
+
+// metricFamily describes a metric and holds its samples
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string // counter or gauge
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels []string // Pairs of label names and values
+	value  float64
+}
+
+// metricSet collects metric families in order they were declared
+type metricSet struct {
+	families []*metricFamily
+	index    map[string]*metricFamily
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{index: make(map[string]*metricFamily)}
+}
+
+// add records a sample of the metric. Labels are passed as name, value pairs
+func (m *metricSet) add(name, kind, help string, value float64, labels ...string) {
+	family, exists := m.index[name]
+	if !exists {
+		family = &metricFamily{name: name, help: help, kind: kind}
+		m.families = append(m.families, family)
+		m.index[name] = family
+	}
+	family.samples = append(family.samples, metricSample{labels: labels, value: value})
+}
+
+func (m *metricSet) counter(name, help string, value uint64, labels ...string) {
+	m.add(name, "counter", help, float64(value), labels...)
+}
+
+func (m *metricSet) gauge(name, help string, value float64, labels ...string) {
+	m.add(name, "gauge", help, value, labels...)
+}
+
+// write outputs metrics in Prometheus text exposition format
+func (m *metricSet) write(buf *bytes.Buffer) {
+	for _, family := range m.families {
+		fmt.Fprintf(buf, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			buf.WriteString(family.name)
+			if len(sample.labels) > 0 {
+				pairs := []string{}
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", sample.labels[i], escapeLabel(sample.labels[i+1])))
+				}
+				buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			fmt.Fprintf(buf, " %g\n", sample.value)
+		}
+	}
+}
+
+// escapeLabel escapes label value as required by text format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func (d *Daemon) execRESTMetrics(w http.ResponseWriter, r *http.Request) {
+	buf := new(bytes.Buffer)
+	d.collectMetrics().write(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// collectMetrics gathers metrics of bootstrap nodes, instances and peers
+func (d *Daemon) collectMetrics() *metricSet {
+	m := newMetricSet()
+	m.gauge("p2p_up", "Whether daemon is ready to serve requests", boolValue(ReadyToServe))
+	m.gauge("p2p_bootstrap_active", "Whether daemon is connected to bootstrap nodes", boolValue(bootstrap.isActive))
+	for _, router := range bootstrap.getRouters() {
+		if router == nil {
+			continue
+		}
+		m.gauge("p2p_bootstrap_connected", "Whether handshake with bootstrap node is completed", boolValue(router.handshaked), "address", router.router)
+		m.counter("p2p_bootstrap_received_bytes_total", "Bytes received from bootstrap node", atomic.LoadUint64(&router.rx), "address", router.router)
+		m.counter("p2p_bootstrap_sent_bytes_total", "Bytes sent to bootstrap node", atomic.LoadUint64(&router.tx), "address", router.router)
+		m.gauge("p2p_bootstrap_failures", "Number of failed connections to bootstrap node in a row", float64(router.fails), "address", router.router)
+	}
+
+	instances := d.Instances.get()
+	hashes := []string{}
+	for hash := range instances {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	m.gauge("p2p_instances", "Number of running instances", float64(len(hashes)))
+	for _, hash := range hashes {
+		inst := instances[hash]
+		if inst == nil || inst.PTP == nil {
+			continue
+		}
+		collectInstanceMetrics(m, hash, inst.PTP)
+	}
+	return m
+}
+
+// collectInstanceMetrics gathers counters of an instance, its proxies and peers
+func collectInstanceMetrics(m *metricSet, hash string, p *ptp.PeerToPeer) {
+	counters := p.Metrics.Get()
+	m.counter("p2p_instance_received_bytes_total", "Bytes of data frames received from peers", counters.BytesIn, "hash", hash)
+	m.counter("p2p_instance_sent_bytes_total", "Bytes of messages sent to peers", counters.BytesOut, "hash", hash)
+	m.counter("p2p_instance_received_packets_total", "Data frames received from peers", counters.PacketsIn, "hash", hash)
+	m.counter("p2p_instance_sent_packets_total", "Messages sent to peers", counters.PacketsOut, "hash", hash)
+	m.counter("p2p_instance_decrypt_failures_total", "Messages which failed decryption or authentication", counters.DecryptFailures, "hash", hash)
+	m.counter("p2p_instance_tap_read_errors_total", "Failed reads from network interface", counters.TAPReadErrors, "hash", hash)
+	m.counter("p2p_instance_tap_write_errors_total", "Failed writes to network interface", counters.TAPWriteErrors, "hash", hash)
+
+	if p.ProxyManager != nil {
+		for _, proxy := range p.ProxyManager.GetList() {
+			if proxy.Addr == nil || proxy.Latency == 0 {
+				continue
+			}
+			m.gauge("p2p_proxy_latency_seconds", "Measured latency of proxy", proxy.Latency.Seconds(), "hash", hash, "proxy", proxy.Addr.String())
+		}
+	}
+
+	if p.Swarm == nil {
+		return
+	}
+	peers := p.Swarm.Get()
+	ids := []string{}
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	states := make(map[string]int)
+	for _, id := range ids {
+		peer := peers[id]
+		state := ptp.StringifyState(peer.State)
+		states[state]++
+		m.gauge("p2p_peer_state", "Current state of peer", 1, "hash", hash, "peer", id, "state", state)
+		m.counter("p2p_peer_hole_punch_attempts_total", "Hole punch attempts made during peer lifetime", uint64(peer.Stat.GetHolePunchNum()), "hash", hash, "peer", id)
+		m.counter("p2p_peer_reconnects_total", "Reconnection cycles of peer", uint64(peer.Stat.GetReconnectsNum()), "hash", hash, "peer", id)
+		for _, class := range []ptp.EndpointClass{ptp.EndpointLocal, ptp.EndpointInternet, ptp.EndpointProxy, ptp.EndpointRelay} {
+			traffic := peer.Traffic.Class(class)
+			m.counter("p2p_peer_received_bytes_total", "Bytes of data frames received from peer", traffic.BytesIn, "hash", hash, "peer", id, "class", class.String())
+			m.counter("p2p_peer_sent_bytes_total", "Bytes of messages sent to peer", traffic.BytesOut, "hash", hash, "peer", id, "class", class.String())
+			m.counter("p2p_peer_received_packets_total", "Data frames received from peer", traffic.PacketsIn, "hash", hash, "peer", id, "class", class.String())
+			m.counter("p2p_peer_sent_packets_total", "Messages sent to peer", traffic.PacketsOut, "hash", hash, "peer", id, "class", class.String())
+		}
+		rateIn, rateOut := peer.Traffic.Rates()
+		m.gauge("p2p_peer_receive_rate_bytes", "Bytes per second received from peer", rateIn, "hash", hash, "peer", id)
+		m.gauge("p2p_peer_send_rate_bytes", "Bytes per second sent to peer", rateOut, "hash", hash, "peer", id)
+		peer.Lock.RLock()
+		for _, ep := range peer.EndpointsHeap {
+			if ep == nil || ep.Addr == nil || ep.Latency == 0 {
+				continue
+			}
+			m.gauge("p2p_peer_endpoint_latency_seconds", "Measured latency of peer endpoint", ep.Latency.Seconds(), "hash", hash, "peer", id, "endpoint", ep.Addr.String())
+		}
+		peer.Lock.RUnlock()
+	}
+	names := []string{}
+	for state := range states {
+		names = append(names, state)
+	}
+	sort.Strings(names)
+	for _, state := range names {
+		m.gauge("p2p_peers", "Number of peers in each state", float64(states[state]), "hash", hash, "state", state)
+	}
+}
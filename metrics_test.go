@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func Test_metricSet_write(t *testing.T) {
+	m := newMetricSet()
+	m.gauge("p2p_test", "Test gauge", 1, "hash", "a")
+	m.counter("p2p_test_total", "Test counter", 42)
+	m.gauge("p2p_test", "Test gauge", 0.5, "hash", "b\"c\\d")
+
+	buf := new(bytes.Buffer)
+	m.write(buf)
+	want := "# HELP p2p_test Test gauge\n" +
+		"# TYPE p2p_test gauge\n" +
+		"p2p_test{hash=\"a\"} 1\n" +
+		"p2p_test{hash=\"b\\\"c\\\\d\"} 0.5\n" +
+		"# HELP p2p_test_total Test counter\n" +
+		"# TYPE p2p_test_total counter\n" +
+		"p2p_test_total 42\n"
+	if buf.String() != want {
+		t.Errorf("metricSet.write() = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestDaemon_collectMetrics(t *testing.T) {
+	p := &ptp.PeerToPeer{Hash: "hash"}
+	p.Init()
+	p.Metrics.BytesIn = 100
+	p.Metrics.DecryptFailures = 2
+	p.Swarm.Update("peer1", &ptp.NetworkPeer{
+		ID:    "peer1",
+		State: ptp.PeerStateConnected,
+		EndpointsHeap: []*ptp.Endpoint{
+			{Addr: &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 6000}, Latency: time.Millisecond * 5},
+		},
+	})
+	p.Swarm.Update("peer2", &ptp.NetworkPeer{ID: "peer2", State: ptp.PeerStateConnected})
+
+	d := &Daemon{Instances: new(InstanceList)}
+	d.Instances.init()
+	d.Instances.update("hash", &P2PInstance{ID: "hash", PTP: p})
+
+	buf := new(bytes.Buffer)
+	d.collectMetrics().write(buf)
+	out := buf.String()
+	for _, want := range []string{
+		"p2p_instances 1\n",
+		"p2p_instance_received_bytes_total{hash=\"hash\"} 100\n",
+		"p2p_instance_decrypt_failures_total{hash=\"hash\"} 2\n",
+		"p2p_peer_state{hash=\"hash\",peer=\"peer1\",state=\"CONNECTED\"} 1\n",
+		"p2p_peer_endpoint_latency_seconds{hash=\"hash\",peer=\"peer1\",endpoint=\"192.168.1.2:6000\"} 0.005\n",
+		"p2p_peers{hash=\"hash\",state=\"CONNECTED\"} 2\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Metrics don't contain %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// ExecRelay runs p2p as a relay server. Relay registers itself on
+// bootstrap nodes as a proxy and forwards traffic to peers that can't
+// be reached directly
+func ExecRelay(port int, targetURL, ip string, capacity, quota int, logLevel, configFile string) {
+	ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemRelay}, "Initializing P2P Relay")
+	if logLevel == "" {
+		ptp.SetMinLogLevelString(DefaultLog)
+	} else {
+		ptp.SetMinLogLevelString(logLevel)
+	}
+	if targetURL == "" {
+		targetURL = "subutai.io"
+	}
+	if configFile == "" {
+		configFile = ptp.DefaultConfigLocation
+	}
+	config, err := processConfigFile(configFile)
+	if err != nil {
+		ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemRelay}, "Failed to load config file %s: %s", configFile, err.Error())
+	}
+
+	var publicIP net.IP
+	if ip != "" {
+		publicIP = net.ParseIP(ip)
+		if publicIP == nil {
+			fmt.Printf("Bad IP address provided: %s\n", ip)
+			os.Exit(1)
+		}
+	}
+
+	server, err := ptp.NewRelayServer(port, capacity, quota)
+	if err != nil {
+		ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemRelay}, "Failed to start relay: %s", err)
+		os.Exit(1)
+	}
+
+	configureBootstrapTLS(config)
+	connectBootstrap(ptp.NewBootstrapDiscovery(config, targetURL), false)
+	go bootstrap.run()
+	go waitOutboundIP()
+
+	dht := new(ptp.DHTClient)
+	dht.Mode = ptp.DHTModeProxy
+	bootstrap.attach(dht)
+
+	// Without explicit address relay is announced with outbound IP
+	// detected by bootstrap nodes
+	for publicIP == nil {
+		publicIP = OutboundIP
+		time.Sleep(time.Millisecond * 100)
+	}
+	server.IP = publicIP
+	go server.Run()
+	go waitActiveBootstrap()
+	ptp.LogWith(ptp.Info, ptp.Fields{Subsystem: ptp.SubsystemRelay}, "Relay is listening on %s:%d", publicIP, server.Port())
+
+	SignalChannel = make(chan os.Signal, 1)
+	signal.Notify(SignalChannel, os.Interrupt)
+	go func() {
+		for sig := range SignalChannel {
+			fmt.Println("Received signal: ", sig)
+			server.Close()
+			os.Exit(0)
+		}
+	}()
+
+	registered := 0
+	lastReport := time.Unix(0, 0)
+	for {
+		// Bootstrap nodes forget about us when connection is lost,
+		// so we register again every time new handshake is completed
+		active := bootstrap.handshaked()
+		if active > registered {
+			err := dht.RegisterProxy(publicIP, server.Port())
+			if err != nil {
+				ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemRelay}, "Failed to register relay: %s", err)
+			}
+		}
+		registered = active
+		if active > 0 && time.Since(lastReport) > ptp.RelayReportInterval {
+			lastReport = time.Now()
+			err := dht.ReportLoad(server.Load())
+			if err != nil {
+				ptp.LogWith(ptp.Error, ptp.Fields{Subsystem: ptp.SubsystemRelay}, "Failed to report load: %s", err)
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
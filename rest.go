@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 
@@ -34,6 +35,8 @@ type request struct {
 	All        bool   `json:"all"`        // Used for show request
 	Bind       bool   `json:"bind"`       // Used for show request
 	MTU        bool   `json:"mtu"`        // Used for MTU show request
+	Keys       bool   `json:"keys"`       // Used for keys show request
+	ACL        bool   `json:"acl"`        // Used for access lists show request
 }
 
 type RESTResponse struct {
@@ -54,6 +57,9 @@ func setupRESTHandlers(port int, d *Daemon) {
 	http.HandleFunc("/rest/v1/status", d.execRESTStatus)
 	http.HandleFunc("/rest/v1/debug", d.execRESTDebug)
 	http.HandleFunc("/rest/v1/set", d.execRESTSet)
+	http.HandleFunc("/rest/v1/invite", d.execRESTInvite)
+	http.HandleFunc("/rest/v1/events", d.execRESTEvents)
+	http.HandleFunc("/metrics", d.execRESTMetrics)
 
 	go func() {
 		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
@@ -64,6 +70,18 @@ func setupRESTHandlers(port int, d *Daemon) {
 	}()
 }
 
+// isLocalRequest returns true if request came from loopback address.
+// REST listener is bound to every interface, so requests revealing
+// secrets are served to local clients only
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func sendRequest(port int, command string, args *DaemonArgs) (*RESTResponse, error) {
 	data, err := json.Marshal(args)
 	if err != nil {
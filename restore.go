@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 // as an argument on daemon launch using `--save`
 type Restore struct {
 	entries  []saveEntry
+	peers    map[string]*ptp.PeerCache // Cached peers of instances by hash
 	filepath string
 	lock     sync.RWMutex
 	active   bool
@@ -28,17 +30,31 @@ type Restore struct {
 
 // saveEntry is a YAML binding for data save file
 type saveEntry struct {
-	IP          string `yaml:"ip"`
-	Mac         string `yaml:"mac"`
-	Dev         string `yaml:"dev"`
-	Hash        string `yaml:"hash"`
-	Keyfile     string `yaml:"keyfile"`
-	Key         string `yaml:"key"`
-	TTL         string `yaml:"ttl"`
-	LastSuccess string `yaml:"last_success"`
+	IP          string   `yaml:"ip"`
+	IPv6        string   `yaml:"ipv6,omitempty"`
+	Mac         string   `yaml:"mac"`
+	Dev         string   `yaml:"dev"`
+	Hash        string   `yaml:"hash"`
+	Keyfile     string   `yaml:"keyfile"`
+	Key         string   `yaml:"key"`
+	TTL         string   `yaml:"ttl"`
+	VLAN        int      `yaml:"vlan,omitempty"`
+	Trunk       string   `yaml:"trunk,omitempty"`
+	Static      string   `yaml:"static,omitempty"`
+	Invite      string   `yaml:"invite,omitempty"`
+	Identity    string   `yaml:"identity,omitempty"` // Private identity key of the instance
+	Allow       []string `yaml:"allow,omitempty"`    // Peers allowed in the swarm
+	Deny        []string `yaml:"deny,omitempty"`     // Peers denied in the swarm
+	LastSuccess string   `yaml:"last_success"`
 	Enabled     bool
 }
 
+// peerCacheEntry is a YAML binding for peers file
+type peerCacheEntry struct {
+	Hash          string `yaml:"hash"`
+	ptp.PeerCache `yaml:",inline"`
+}
+
 // init will initialize restore subsystem by checking if
 // file exists and can be modified
 func (r *Restore) init(filepath string) error {
@@ -139,6 +155,7 @@ func (r *Restore) addEntry(entry saveEntry) error {
 func (r *Restore) removeEntry(hash string) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
+	delete(r.peers, hash)
 	for i, e := range r.entries {
 		if e.Hash == hash {
 			r.entries = append(r.entries[:i], r.entries[i+1:]...)
@@ -162,6 +179,33 @@ func (r *Restore) bumpInstance(hash string) error {
 	return fmt.Errorf("Can't update last success date for the instance: %s", hash)
 }
 
+// setIdentity stores identity key of the instance in its entry
+func (r *Restore) setIdentity(hash, identity string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, e := range r.entries {
+		if e.Hash == hash {
+			r.entries[i].Identity = identity
+			return nil
+		}
+	}
+	return fmt.Errorf("Can't save identity of the instance: %s not found", hash)
+}
+
+// setACL stores access lists of the instance in its entry
+func (r *Restore) setACL(hash string, allow, deny []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, e := range r.entries {
+		if e.Hash == hash {
+			r.entries[i].Allow = allow
+			r.entries[i].Deny = deny
+			return nil
+		}
+	}
+	return fmt.Errorf("Can't save access lists of the instance: %s not found", hash)
+}
+
 func (r *Restore) disableStaleInstances(inst *P2PInstance) error {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
@@ -170,12 +214,12 @@ func (r *Restore) disableStaleInstances(inst *P2PInstance) error {
 		var t time.Time
 		err := t.UnmarshalText([]byte(e.LastSuccess))
 		if err != nil {
-			ptp.Log(ptp.Error, "Failed to unmarshal date for save file entry %s. Disabling it", e.Hash)
+			ptp.LogWith(ptp.Error, ptp.Fields{Hash: e.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to unmarshal date for save file entry %s. Disabling it", e.Hash)
 			r.entries[i].Enabled = false
 			continue
 		}
 		if time.Since(t) > time.Duration(time.Hour*24*20) {
-			ptp.Log(ptp.Warning, "Instance %s was active more than 20 days ago", e.Hash)
+			ptp.LogWith(ptp.Warning, ptp.Fields{Hash: e.Hash, Subsystem: ptp.SubsystemInstance}, "Instance %s was active more than 20 days ago", e.Hash)
 			r.entries[i].Enabled = false
 		}
 	}
@@ -281,6 +325,98 @@ func (r *Restore) get() []saveEntry {
 	return r.entries
 }
 
+// trunksFirst returns entries ordered so that trunk instances are
+// started before VLAN instances attached to them
+func trunksFirst(entries []saveEntry) []saveEntry {
+	ordered := append([]saveEntry{}, entries...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Trunk == "" && ordered[j].Trunk != ""
+	})
+	return ordered
+}
+
 func (r *Restore) isActive() bool {
 	return r.active
 }
+
+// peersFile returns path to the file with cached peers, which
+// is kept next to the save file
+func (r *Restore) peersFile() string {
+	return r.filepath + ".peers"
+}
+
+// updatePeers replaces cached peers of the instance
+func (r *Restore) updatePeers(hash string, cache *ptp.PeerCache) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.peers == nil {
+		r.peers = make(map[string]*ptp.PeerCache)
+	}
+	r.peers[hash] = cache
+}
+
+// getPeers returns cached peers of the instance or nil
+func (r *Restore) getPeers(hash string) *ptp.PeerCache {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.peers[hash]
+}
+
+// hasPeers returns true if any instance has cached peers
+func (r *Restore) hasPeers() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, cache := range r.peers {
+		if cache != nil && len(cache.Peers) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// savePeers writes cached peers of every instance into peers file
+func (r *Restore) savePeers() error {
+	if r.filepath == "" {
+		return nil
+	}
+	r.lock.RLock()
+	entries := []peerCacheEntry{}
+	for hash, cache := range r.peers {
+		if cache != nil {
+			entries = append(entries, peerCacheEntry{Hash: hash, PeerCache: *cache})
+		}
+	}
+	r.lock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Hash < entries[j].Hash })
+	data, err := yaml.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.peersFile(), data, 0600)
+}
+
+// loadPeers reads peers file. Missing file is not an error
+func (r *Restore) loadPeers() error {
+	if r.filepath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(r.peersFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []peerCacheEntry
+	err = yaml.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.peers = make(map[string]*ptp.PeerCache)
+	for i := range entries {
+		r.peers[entries[i].Hash] = &entries[i].PeerCache
+	}
+	return nil
+}
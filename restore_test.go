@@ -2,10 +2,15 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
 )
 
 func TestRestore_init(t *testing.T) {
@@ -464,6 +469,25 @@ func TestRestore_get(t *testing.T) {
 	}
 }
 
+func Test_trunksFirst(t *testing.T) {
+	entries := []saveEntry{
+		{Hash: "child-1", Trunk: "trunk-1"},
+		{Hash: "trunk-1"},
+		{Hash: "child-2", Trunk: "trunk-2"},
+		{Hash: "trunk-2"},
+	}
+	want := []string{"trunk-1", "trunk-2", "child-1", "child-2"}
+	got := trunksFirst(entries)
+	for i, hash := range want {
+		if got[i].Hash != hash {
+			t.Errorf("trunksFirst()[%d] = %s, want %s", i, got[i].Hash, hash)
+		}
+	}
+	if entries[0].Hash != "child-1" {
+		t.Errorf("trunksFirst() modified provided entries")
+	}
+}
+
 func TestRestore_isActive(t *testing.T) {
 	type fields struct {
 		entries  []saveEntry
@@ -493,3 +517,112 @@ func TestRestore_isActive(t *testing.T) {
 		})
 	}
 }
+
+func TestRestore_savePeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-restore")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := new(Restore)
+	if err := r.init(filepath.Join(dir, "save.yaml")); err != nil {
+		t.Fatalf("Restore.init() error = %v", err)
+	}
+	if err := r.loadPeers(); err != nil || r.hasPeers() {
+		t.Fatalf("Restore.loadPeers() without peers file = %v", err)
+	}
+	cache := &ptp.PeerCache{
+		ID:   "00000000-0000-0000-0000-000000000000",
+		Port: 30000,
+		Peers: []ptp.CachedPeer{
+			{ID: "11111111-1111-1111-1111-111111111111", Endpoint: "1.2.3.4:1234", LastSeen: time.Now().UTC().Truncate(time.Second)},
+		},
+	}
+	r.updatePeers("test1", cache)
+	r.updatePeers("test2", &ptp.PeerCache{})
+	if err := r.savePeers(); err != nil {
+		t.Fatalf("Restore.savePeers() error = %v", err)
+	}
+
+	loaded := new(Restore)
+	loaded.init(filepath.Join(dir, "save.yaml"))
+	if err := loaded.loadPeers(); err != nil {
+		t.Fatalf("Restore.loadPeers() error = %v", err)
+	}
+	if !loaded.hasPeers() || !reflect.DeepEqual(loaded.getPeers("test1"), cache) {
+		t.Errorf("Restore.loadPeers() = %+v, want %+v", loaded.getPeers("test1"), cache)
+	}
+
+	// Peers of removed instance are forgotten
+	loaded.addEntry(saveEntry{Hash: "test1"})
+	loaded.removeEntry("test1")
+	if loaded.getPeers("test1") != nil {
+		t.Errorf("Restore.removeEntry() kept cached peers")
+	}
+}
+
+func TestRestore_setIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-restore")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := new(Restore)
+	r.init(filepath.Join(dir, "save.yaml"))
+	if err := r.setIdentity("test1", "key"); err == nil {
+		t.Errorf("Restore.setIdentity() accepted unknown instance")
+	}
+	identity, _ := ptp.NewIdentity()
+	r.addEntry(saveEntry{Hash: "test1", Enabled: true})
+	if err := r.setIdentity("test1", identity.Encode()); err != nil {
+		t.Fatalf("Restore.setIdentity() error = %v", err)
+	}
+	if err := r.save(); err != nil {
+		t.Fatalf("Restore.save() error = %v", err)
+	}
+
+	loaded := new(Restore)
+	loaded.init(filepath.Join(dir, "save.yaml"))
+	if err := loaded.load(); err != nil || len(loaded.get()) != 1 {
+		t.Fatalf("Restore.load() error = %v", err)
+	}
+	restored, err := ptp.LoadIdentity(loaded.get()[0].Identity)
+	if err != nil || restored.ID() != identity.ID() {
+		t.Errorf("Identity wasn't restored: %v", err)
+	}
+}
+
+func TestRestore_setACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-restore")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := new(Restore)
+	r.init(filepath.Join(dir, "save.yaml"))
+	allow := []string{"00000000-0000-0000-0000-000000000000"}
+	deny := []string{"11111111-1111-1111-1111-111111111111"}
+	if err := r.setACL("test1", allow, deny); err == nil {
+		t.Errorf("Restore.setACL() accepted unknown instance")
+	}
+	r.addEntry(saveEntry{Hash: "test1", Enabled: true})
+	if err := r.setACL("test1", allow, deny); err != nil {
+		t.Fatalf("Restore.setACL() error = %v", err)
+	}
+	if err := r.save(); err != nil {
+		t.Fatalf("Restore.save() error = %v", err)
+	}
+
+	loaded := new(Restore)
+	loaded.init(filepath.Join(dir, "save.yaml"))
+	if err := loaded.load(); err != nil || len(loaded.get()) != 1 {
+		t.Fatalf("Restore.load() error = %v", err)
+	}
+	e := loaded.get()[0]
+	if !reflect.DeepEqual(e.Allow, allow) || !reflect.DeepEqual(e.Deny, deny) {
+		t.Errorf("Access lists weren't restored: %v %v", e.Allow, e.Deny)
+	}
+}
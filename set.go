@@ -5,14 +5,22 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 
 	ptp "github.com/subutai-io/p2p/lib"
 )
 
 // Set modifies different options of P2P daemon
-func CommandSet(rpcPort int, log, hash, keyfile, key, ttl, ip string) {
-	out, err := sendRequest(rpcPort, "set", &DaemonArgs{Log: log, Keyfile: keyfile, Key: key, TTL: ttl, IP: ip, Hash: hash})
+func CommandSet(rpcPort int, log, subsystem, hash, keyfile, key, ttl, ip string, reloadKeys bool, acl, entries string) {
+	args := &DaemonArgs{Log: log, Subsystem: subsystem, Keyfile: keyfile, Key: key, TTL: ttl, IP: ip, Hash: hash}
+	if reloadKeys {
+		args.Command = "reload-keys"
+	} else if acl != "" {
+		args.Command = acl
+		args.Args = entries
+	}
+	out, err := sendRequest(rpcPort, "set", args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -49,10 +57,31 @@ func (d *Daemon) execRESTSet(w http.ResponseWriter, r *http.Request) {
 		d.SetLog(&NameValueArg{
 			Name:  "log",
 			Value: args.Log,
+		}, args.Hash, args.Subsystem, response)
+	} else if args.Command == "reload-keys" {
+		// User requested to re-read key files
+		count, err := d.reloadKeys(args.Hash)
+		if err != nil {
+			response.ExitCode = 1
+			response.Output = fmt.Sprintf("Keys were reloaded for %d instance(s). %s", count, err)
+		} else {
+			response.ExitCode = 0
+			response.Output = fmt.Sprintf("Keys were reloaded for %d instance(s)", count)
+		}
+	} else if strings.HasPrefix(args.Command, "acl-") {
+		// User modifying access lists of the swarm
+		d.setACL(args.Hash, args.Command, args.Args, response)
+	} else if args.Key != "" && args.Hash != "" {
+		// User adding a new key to the rotation schedule
+		ptp.LogWith(ptp.Info, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Adding new key for %s", args.Hash)
+		d.AddKey(&RunArgs{
+			Hash: args.Hash,
+			Key:  args.Key,
+			TTL:  args.TTL,
 		}, response)
 	} else if args.IP != "" && args.Hash != "" {
 		// User modifying IP of the hash
-		ptp.Log(ptp.Info, "Request IP change for %s: %s", args.Hash, args.IP)
+		ptp.LogWith(ptp.Info, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Request IP change for %s: %s", args.Hash, args.IP)
 		d.setIP(&NameValueArg{
 			Name:  args.Hash,
 			Value: args.IP,
@@ -108,11 +137,74 @@ func (d *Daemon) setIP(args *NameValueArg, resp *Response) error {
 	return nil
 }
 
-// SetLog modifies specific option
-func (d *Daemon) SetLog(args *NameValueArg, resp *Response) error {
+// setACL adds or removes peers in access lists of the swarm. Peers which
+// are not allowed anymore are disconnected
+func (d *Daemon) setACL(hash, command, entries string, resp *Response) error {
+	if hash == "" {
+		resp.ExitCode = 11
+		resp.Output = "Empty hash specified"
+		return fmt.Errorf("empty hash")
+	}
+	list := []string{}
+	for _, entry := range strings.Split(entries, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	if len(list) == 0 {
+		resp.ExitCode = 13
+		resp.Output = "No peers specified"
+		return fmt.Errorf("empty access list")
+	}
+	instance := d.Instances.getInstance(hash)
+	if instance == nil || instance.PTP == nil {
+		resp.ExitCode = 4
+		resp.Output = "Instance " + hash + " wasn't found"
+		return fmt.Errorf("Instance %s not found", hash)
+	}
+
+	var err error
+	switch command {
+	case "acl-allow":
+		err = instance.PTP.ACL.Allow(list...)
+	case "acl-deny":
+		err = instance.PTP.ACL.Deny(list...)
+	case "acl-remove":
+		err = instance.PTP.ACL.Remove(list...)
+	default:
+		err = fmt.Errorf("unknown access list command %s", command)
+	}
+	if err != nil {
+		resp.ExitCode = 14
+		resp.Output = "Failed to modify access lists: " + err.Error()
+		return err
+	}
+	disconnected := instance.PTP.EnforceACL()
+	ptp.LogWith(ptp.Info, ptp.Fields{Hash: hash, Subsystem: ptp.SubsystemInstance}, "Access lists of %s were modified", hash)
+
+	if d.Restore != nil {
+		allow, deny := instance.PTP.ACL.Lists()
+		d.Restore.setACL(hash, allow, deny)
+		err = d.Restore.save()
+		if err != nil {
+			ptp.LogWith(ptp.Error, ptp.Fields{Hash: hash, Subsystem: ptp.SubsystemInstance}, "Failed to save instance information: %s", err.Error())
+		}
+	}
+	resp.ExitCode = 0
+	resp.Output = fmt.Sprintf("Access lists were modified. %d peer(s) disconnected", disconnected)
+	return nil
+}
+
+// SetLog modifies specific option. Log level is set for the whole daemon
+// unless hash of an instance or a subsystem is specified
+func (d *Daemon) SetLog(args *NameValueArg, hash, subsystem string, resp *Response) error {
 	args.Value = strings.ToLower(args.Value)
 	ptp.Log(ptp.Info, "Setting option %s to %s", args.Name, args.Value)
 	resp.ExitCode = 0
+	if args.Name == "log" && (hash != "" || subsystem != "") {
+		return d.setScopedLog(args.Value, hash, subsystem, resp)
+	}
 	if args.Name == "log" {
 		resp.Output = "Logging level has switched to " + args.Value + " level"
 		err := ptp.SetMinLogLevelString(args.Value)
@@ -131,6 +223,37 @@ func (d *Daemon) SetLog(args *NameValueArg, resp *Response) error {
 	return nil
 }
 
+// setScopedLog modifies log level of an instance, a subsystem or a
+// subsystem of an instance. Level "default" removes modification
+func (d *Daemon) setScopedLog(value, hash, subsystem string, resp *Response) error {
+	if subsystem != "" && !ptp.IsLogSubsystem(subsystem) {
+		resp.ExitCode = 1
+		resp.Output = "Unknown subsystem was specified. Supported subsystems are: " + strings.Join(ptp.LogSubsystems, ", ")
+		return fmt.Errorf("unknown subsystem %s", subsystem)
+	}
+	scope := []string{}
+	if subsystem != "" {
+		scope = append(scope, "subsystem "+subsystem)
+	}
+	if hash != "" {
+		scope = append(scope, "instance "+hash)
+	}
+	if value == "default" {
+		ptp.ResetLogLevel(hash, subsystem)
+		resp.Output = "Logging level of " + strings.Join(scope, " of ") + " was reset"
+		return nil
+	}
+	level, err := ptp.ParseLogLevel(value)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Unknown log level was specified. Supported log levels are: trace, debug, info, warning, error, default"
+		return err
+	}
+	ptp.SetLogLevel(hash, subsystem, level)
+	resp.Output = "Logging level of " + strings.Join(scope, " of ") + " has switched to " + value + " level"
+	return nil
+}
+
 // AddKey adds a new crypto-key
 func (p *Daemon) AddKey(args *RunArgs, resp *Response) error {
 	resp.ExitCode = 0
@@ -148,12 +271,48 @@ func (p *Daemon) AddKey(args *RunArgs, resp *Response) error {
 		resp.Output = "No instances with specified hash were found"
 	}
 	if resp.ExitCode == 0 {
+		newKey, err := inst.PTP.Crypter.EnrichKeyValues(ptp.CryptoKey{}, args.Key, args.TTL)
+		if err != nil {
+			resp.ExitCode = 1
+			resp.Output = err.Error()
+			return nil
+		}
 		resp.Output = "New key added"
-		var newKey ptp.CryptoKey
-
-		newKey = inst.PTP.Crypter.EnrichKeyValues(newKey, args.Key, args.TTL)
-		inst.PTP.Crypter.Keys = append(inst.PTP.Crypter.Keys, newKey)
+		inst.PTP.Crypter.AddKey(newKey)
 		p.Instances.update(args.Hash, inst)
 	}
 	return nil
 }
+
+// reloadKeys will re-read key files of instances. If hash is empty,
+// all instances started with a key file are reloaded. Failure of one
+// key file doesn't stop reloading of others: number of reloaded
+// instances is returned along with errors of every failed one
+func (d *Daemon) reloadKeys(hash string) (int, error) {
+	count := 0
+	failed := []string{}
+	for id, inst := range d.Instances.get() {
+		if hash != "" && id != hash {
+			continue
+		}
+		if inst == nil || inst.PTP == nil || inst.Args.Keyfile == "" {
+			continue
+		}
+		err := inst.PTP.Crypter.ReadKeysFromFile(inst.Args.Keyfile, id)
+		if err != nil {
+			ptp.LogWith(ptp.Error, ptp.Fields{Hash: id, Subsystem: ptp.SubsystemInstance}, "Failed to reload keys for %s: %s", id, err)
+			failed = append(failed, fmt.Sprintf("%s: %s", id, err))
+			continue
+		}
+		ptp.LogWith(ptp.Info, ptp.Fields{Hash: id, Subsystem: ptp.SubsystemInstance}, "Reloaded keys for %s from %s", id, inst.Args.Keyfile)
+		count++
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return count, fmt.Errorf("Failed to reload keys for %d instance(s): %s", len(failed), strings.Join(failed, "; "))
+	}
+	if hash != "" && count == 0 {
+		return 0, fmt.Errorf("Instance %s wasn't found or wasn't started with a key file", hash)
+	}
+	return count, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func TestDaemon_SetLog(t *testing.T) {
+	defer ptp.SetMinLogLevel(ptp.Info)
+	d := new(Daemon)
+	tests := []struct {
+		name      string
+		level     string
+		hash      string
+		subsystem string
+		wantCode  int
+		want      string
+	}{
+		{"daemon", "debug", "", "", 0, "Logging level has switched to debug level"},
+		{"unknown level", "verbose", "", "", 1, ""},
+		{"instance", "trace", "hash", "", 0, "Logging level of instance hash has switched to trace level"},
+		{"subsystem of instance", "ERROR", "hash", "dht", 0, "Logging level of subsystem dht of instance hash has switched to error level"},
+		{"reset", "default", "hash", "dht", 0, "Logging level of subsystem dht of instance hash was reset"},
+		{"unknown subsystem", "debug", "", "kernel", 1, ""},
+		{"unknown scoped level", "verbose", "", "peer", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(Response)
+			d.SetLog(&NameValueArg{Name: "log", Value: tt.level}, tt.hash, tt.subsystem, resp)
+			if resp.ExitCode != tt.wantCode {
+				t.Errorf("Daemon.SetLog() exit code = %d, want %d: %s", resp.ExitCode, tt.wantCode, resp.Output)
+			}
+			if tt.want != "" && resp.Output != tt.want {
+				t.Errorf("Daemon.SetLog() output = %q, want %q", resp.Output, tt.want)
+			}
+		})
+	}
+	ptp.ResetLogLevel("hash", "")
+}
+
+func TestDaemon_reloadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good")
+	ioutil.WriteFile(good, []byte(fmt.Sprintf("key: goodkey000000000\nttl: %d\n", time.Now().Add(time.Hour).Unix())), 0600)
+	broken := filepath.Join(dir, "broken")
+	ioutil.WriteFile(broken, []byte("keys: ["), 0600)
+
+	d := &Daemon{Instances: new(InstanceList)}
+	d.Instances.init()
+	for i, keyfile := range []string{good, broken, good, broken, good} {
+		hash := fmt.Sprintf("hash%d", i)
+		d.Instances.update(hash, &P2PInstance{PTP: new(ptp.PeerToPeer), Args: RunArgs{Keyfile: keyfile}})
+	}
+
+	count, err := d.reloadKeys("")
+	if count != 3 {
+		t.Errorf("Daemon.reloadKeys() reloaded %d instances, want 3", count)
+	}
+	if err == nil || !strings.Contains(err.Error(), "hash1") || !strings.Contains(err.Error(), "hash3") {
+		t.Errorf("Daemon.reloadKeys() error = %v", err)
+	}
+	if _, err := d.reloadKeys("hash0"); err != nil {
+		t.Errorf("Daemon.reloadKeys() error = %v", err)
+	}
+	if _, err := d.reloadKeys("unknown"); err == nil {
+		t.Errorf("Daemon.reloadKeys() didn't fail for unknown instance")
+	}
+}
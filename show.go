@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	ptp "github.com/subutai-io/p2p/lib"
 )
@@ -21,10 +22,15 @@ type ShowOutput struct {
 	InterfaceName   string `json:"interface"`
 	Hash            string `json:"hash"`
 	MTU             string `json:"mtu"`
+	KeyID           string `json:"key_id"`
+	KeyState        string `json:"key_state"`
+	KeyUntil        string `json:"key_until"`
+	Identity        string `json:"identity"` // Public identity key
+	Access          string `json:"access"`   // Whether peer is allowed or denied
 }
 
 // Show outputs information about P2P instances and interfaces
-func CommandShow(queryPort int, hash, ip string, interfaces, all, bind, mtu bool) {
+func CommandShow(queryPort int, hash, ip string, interfaces, all, bind, mtu, keys, acl bool) {
 	req := &request{}
 	if hash != "" {
 		req.Hash = hash
@@ -36,6 +42,8 @@ func CommandShow(queryPort int, hash, ip string, interfaces, all, bind, mtu bool
 	req.All = all
 	req.Bind = bind
 	req.MTU = mtu
+	req.Keys = keys
+	req.ACL = acl
 
 	out, err := sendRequestRaw(queryPort, "show", req)
 	if err != nil {
@@ -68,14 +76,34 @@ func CommandShow(queryPort int, hash, ip string, interfaces, all, bind, mtu bool
 			}
 			fmt.Println("No data available")
 			os.Exit(102)
+		} else if req.Keys {
+			fmt.Println("< Key >\t< State >\t< Valid until >")
+			for _, m := range show {
+				if m.Code != 0 {
+					fmt.Println(m.Error)
+					os.Exit(m.Code)
+				}
+				fmt.Printf("%s\t%s\t%s\n", m.KeyID, m.KeyState, m.KeyUntil)
+			}
+			os.Exit(0)
+		} else if req.ACL {
+			fmt.Println("< Peer ID >\t< Access >")
+			for _, m := range show {
+				if m.Code != 0 {
+					fmt.Println(m.Error)
+					os.Exit(m.Code)
+				}
+				fmt.Printf("%s\t%s\n", m.ID, m.Access)
+			}
+			os.Exit(0)
 		} else {
-			fmt.Println("< Peer ID >\t< IP >\t< Endpoint >\t< HW >")
+			fmt.Println("< Peer ID >\t< IP >\t< Endpoint >\t< HW >\t< Identity >")
 			for _, m := range show {
 				if m.Code != 0 {
 					fmt.Println(m.Error)
 					os.Exit(m.Code)
 				}
-				fmt.Printf("%s\t%s\t%s\t%s\n", m.ID, m.IP, m.Endpoint, m.HardwareAddress)
+				fmt.Printf("%s\t%s\t%s\t%s\t%s\n", m.ID, m.IP, m.Endpoint, m.HardwareAddress, m.Identity)
 			}
 			os.Exit(0)
 		}
@@ -111,7 +139,7 @@ func CommandShow(queryPort int, hash, ip string, interfaces, all, bind, mtu bool
 			fmt.Fprintln(os.Stderr, m.Error)
 			os.Exit(m.Code)
 		}
-		fmt.Printf("%s\t%s\t%s\n", m.HardwareAddress, m.IP, m.Hash)
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", m.HardwareAddress, m.IP, m.Hash, m.ID, m.Identity)
 	}
 	os.Exit(0)
 }
@@ -129,6 +157,8 @@ func (d *Daemon) execRESTShow(w http.ResponseWriter, r *http.Request) {
 		Bind:       args.Bind,
 		MTU:        args.MTU,
 		All:        args.All,
+		Keys:       args.Keys,
+		ACL:        args.ACL,
 	})
 	if err != nil {
 		ptp.Log(ptp.Error, "Internal error: %s", err)
@@ -159,6 +189,12 @@ func (d *Daemon) Show(args *request) ([]byte, error) {
 				out, err := d.showIP(args.IP, inst)
 				return out, err
 			}
+			if args.Keys {
+				return d.showKeys(inst)
+			}
+			if args.ACL {
+				return d.showACL(inst)
+			}
 			out, err := d.showHash(inst)
 			return out, err
 		}
@@ -221,12 +257,47 @@ func (d *Daemon) showHash(instance *P2PInstance) ([]byte, error) {
 			IP:              peer.PeerLocalIP.String(),
 			Endpoint:        peer.Endpoint.String(),
 			HardwareAddress: peer.PeerHW.String(),
+			Identity:        peer.IdentityKey(),
 		}
 		out = append(out, s)
 	}
 	return d.showOutput(out)
 }
 
+func (d *Daemon) showKeys(instance *P2PInstance) ([]byte, error) {
+	if instance.PTP == nil {
+		return d.showOutput([]ShowOutput{{Error: "Instance is not running", Code: 16}})
+	}
+	if !instance.PTP.Crypter.IsActive() {
+		return d.showOutput([]ShowOutput{{Error: "Encryption is disabled for this instance", Code: 17}})
+	}
+	out := []ShowOutput{}
+	for _, key := range instance.PTP.Crypter.KeysInfo() {
+		out = append(out, ShowOutput{
+			KeyID:    key.Fingerprint,
+			KeyState: key.State,
+			KeyUntil: key.Until.Format(time.RFC3339),
+		})
+	}
+	return d.showOutput(out)
+}
+
+// showACL lists peers allowed and denied in the swarm
+func (d *Daemon) showACL(instance *P2PInstance) ([]byte, error) {
+	if instance.PTP == nil {
+		return d.showOutput([]ShowOutput{{Error: "Instance is not running", Code: 16}})
+	}
+	allow, deny := instance.PTP.ACL.Lists()
+	out := []ShowOutput{}
+	for _, id := range allow {
+		out = append(out, ShowOutput{ID: id, Access: "allow"})
+	}
+	for _, id := range deny {
+		out = append(out, ShowOutput{ID: id, Access: "deny"})
+	}
+	return d.showOutput(out)
+}
+
 func (d *Daemon) showInterfaces() ([]byte, error) {
 	instances := d.Instances.get()
 	out := []ShowOutput{}
@@ -270,6 +341,12 @@ func (d *Daemon) showInstances() ([]byte, error) {
 				IP:              inst.PTP.Interface.GetIP().String(),
 				Hash:            key,
 			}
+			if inst.PTP.Dht != nil {
+				s.ID = inst.PTP.Dht.ID
+			}
+			if inst.PTP.Identity != nil {
+				s.Identity = inst.PTP.Identity.PublicKey()
+			}
 			out = append(out, s)
 		} else {
 			s := ShowOutput{
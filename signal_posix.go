@@ -0,0 +1,27 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+// handleReloadSignal will reload key files of running instances
+// every time daemon receives SIGHUP
+func handleReloadSignal(d *Daemon) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			ptp.Log(ptp.Info, "Received SIGHUP. Reloading key files")
+			count, err := d.reloadKeys("")
+			if err != nil {
+				ptp.Log(ptp.Error, "Reloaded keys for %d instance(s). %s", count, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,8 @@
+// +build windows
+
+package main
+
+// handleReloadSignal is not supported on Windows. Key files can be
+// reloaded with `p2p set -reload-keys`
+func handleReloadSignal(d *Daemon) {
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -13,9 +14,27 @@ import (
 )
 
 // CommandStart will create new P2P instance
-func CommandStart(restPort int, ip, hash, mac, dev, keyfile, key, ttl string, fwd bool, port int) {
+func CommandStart(restPort int, ip, ipv6, hash, mac, dev, keyfile, key, ttl string, fwd bool, port, vlan int, trunk, static, invite string) {
 	args := &DaemonArgs{}
 	args.IP = ip
+	if invite != "" {
+		// Hash of the swarm is taken from the invite. Traffic is
+		// encrypted with key derived from the invite
+		inv, err := ptp.DecodeInvite(invite)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid invite: %s\n", err)
+			os.Exit(21)
+		}
+		if hash != "" && hash != inv.Hash {
+			fmt.Fprintln(os.Stderr, "Invite was issued for another swarm")
+			os.Exit(21)
+		}
+		hash = inv.Hash
+		keyfile = ""
+		key = ""
+		ttl = ""
+		args.Invite = invite
+	}
 	if hash == "" {
 		fmt.Fprintln(os.Stderr, "Hash cannot be empty. Please start new instances with -hash VALUE argument")
 		os.Exit(12)
@@ -25,6 +44,22 @@ func CommandStart(restPort int, ip, hash, mac, dev, keyfile, key, ttl string, fw
 		os.Exit(17)
 	}
 	args.Hash = hash
+	if ipv6 != "" {
+		nip := net.ParseIP(ipv6)
+		if nip == nil || nip.To4() != nil {
+			fmt.Fprintln(os.Stderr, "Invalid IPv6 address provided")
+			os.Exit(18)
+		}
+	}
+	args.IPv6 = ipv6
+	if vlan != 0 || trunk != "" {
+		if vlan < 1 || vlan > 4094 || trunk == "" || trunk == hash {
+			fmt.Fprintln(os.Stderr, "VLAN ID in range 1-4094 and hash of a trunk instance should be specified together")
+			os.Exit(19)
+		}
+	}
+	args.VLAN = vlan
+	args.Trunk = trunk
 	if mac != "" {
 		_, err := net.ParseMAC(mac)
 		if err != nil {
@@ -39,6 +74,22 @@ func CommandStart(restPort int, ip, hash, mac, dev, keyfile, key, ttl string, fw
 	args.TTL = ttl
 	args.Fwd = fwd
 	args.Port = port
+	if static != "" {
+		// Daemon reads the file, so path shouldn't depend on our directory
+		path, err := filepath.Abs(static)
+		if err == nil {
+			static = path
+		}
+		swarm, err := ptp.LoadStaticSwarm(static)
+		if err == nil {
+			err = swarm.Validate()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid static peers: %s\n", err)
+			os.Exit(20)
+		}
+	}
+	args.Static = static
 
 	out, err := sendRequest(restPort, "start", args)
 	if err != nil {
@@ -60,26 +111,30 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 		w.Write(resp)
 		return
 	}
-	if !bootstrap.isActive {
-		resp, _ := getResponse(106, "Not connected to DHT nodes")
-		w.Write(resp)
-		return
-	}
-	if bootstrap.ip == "" {
-		resp, _ := getResponse(107, "Didn't received outbound IP yet")
-		w.Write(resp)
-		return
-	}
 	args := new(DaemonArgs)
 	err := getJSON(r.Body, args)
 	if handleMarshalError(err, w) != nil {
 		return
 	}
+	// Instances with static peers don't depend on bootstrap nodes
+	if !isStatic(args.Hash, args.Static) {
+		if !bootstrap.isActive {
+			resp, _ := getResponse(106, "Not connected to DHT nodes")
+			w.Write(resp)
+			return
+		}
+		if bootstrap.ip == "" {
+			resp, _ := getResponse(107, "Didn't received outbound IP yet")
+			w.Write(resp)
+			return
+		}
+	}
 
 	ptp.Log(ptp.Debug, "Executing start command: %+v", args)
 	response := new(Response)
 	err = d.run(&RunArgs{
 		IP:      args.IP,
+		IPv6:    args.IPv6,
 		Mac:     args.Mac,
 		Dev:     args.Dev,
 		Hash:    args.Hash,
@@ -89,6 +144,10 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 		TTL:     args.TTL,
 		Fwd:     args.Fwd,
 		Port:    args.Port,
+		VLAN:    args.VLAN,
+		Trunk:   args.Trunk,
+		Static:  args.Static,
+		Invite:  args.Invite,
 	}, response)
 
 	ls, _ := time.Unix(0, 0).MarshalText()
@@ -97,20 +156,26 @@ func (d *Daemon) execRESTStart(w http.ResponseWriter, r *http.Request) {
 	// hash specified, we will just update it's last success timestamp
 	if d.Restore.addEntry(saveEntry{
 		IP:          args.IP,
+		IPv6:        args.IPv6,
 		Mac:         args.Mac,
 		Dev:         args.Dev,
 		Hash:        args.Hash,
 		Keyfile:     args.Keyfile,
 		Key:         args.Key,
 		TTL:         args.TTL,
+		VLAN:        args.VLAN,
+		Trunk:       args.Trunk,
+		Static:      args.Static,
+		Invite:      args.Invite,
 		LastSuccess: string(ls),
 		Enabled:     true,
 	}) != nil {
 		d.Restore.bumpInstance(args.Hash)
 	}
+	d.saveIdentity(args.Hash)
 	err = d.Restore.save()
 	if err != nil {
-		ptp.Log(ptp.Error, "Failed to save instance information: %s", err.Error())
+		ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to save instance information: %s", err.Error())
 	}
 	resp, err := getResponse(response.ExitCode, response.Output)
 	if err != nil {
@@ -139,34 +204,109 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 		}
 	}
 
+	var ipv6 net.IP
+	if args.IPv6 != "" {
+		ipv6 = net.ParseIP(args.IPv6)
+		if ipv6 == nil || ipv6.To4() != nil {
+			resp.ExitCode = 1
+			resp.Output = "Invalid IPv6 address"
+			return errors.New(resp.Output)
+		}
+	}
+
+	// VLAN instances use interface of the trunk instance
+	var trunk *ptp.PeerToPeer
+	if args.Trunk != "" {
+		if args.VLAN < 1 || args.VLAN > 4094 {
+			resp.ExitCode = 1
+			resp.Output = "Invalid VLAN ID"
+			return errors.New(resp.Output)
+		}
+		trunkInst := d.Instances.getInstance(args.Trunk)
+		if trunkInst == nil || trunkInst.PTP == nil {
+			resp.ExitCode = 1
+			resp.Output = "Trunk instance " + args.Trunk + " is not running"
+			return errors.New(resp.Output)
+		}
+		trunk = trunkInst.PTP
+	}
+
+	static, err := staticSwarm(args.Hash, args.Static)
+	if err != nil {
+		resp.ExitCode = 1
+		resp.Output = "Invalid static peers: " + err.Error()
+		return errors.New(resp.Output)
+	}
+
 	inst := d.Instances.getInstance(args.Hash)
 	if inst == nil {
 		resp.Output = resp.Output + "Lookup finished\n"
 		if args.Key != "" {
-			if len(args.Key) < 16 {
-				args.Key += "0000000000000000"[:16-len(args.Key)]
-			} else if len(args.Key) > 16 && len(args.Key) < 24 {
-				args.Key += "000000000000000000000000"[:24-len(args.Key)]
-			} else if len(args.Key) > 24 && len(args.Key) < 32 {
-				args.Key += "00000000000000000000000000000000"[:32-len(args.Key)]
-			} else if len(args.Key) > 32 {
-				args.Key = args.Key[:32]
+			if err := ptp.ValidateKey(args.Key); err != nil {
+				resp.Output = resp.Output + err.Error()
+				resp.ExitCode = 1
+				return err
 			}
 		}
 
 		newInst := new(P2PInstance)
 		newInst.ID = args.Hash
 		newInst.Args = *args
-		newInst.PTP = ptp.New(args.Mac, args.Hash, args.Keyfile, args.Key, args.TTL, TargetURL, args.Fwd, args.Port, OutboundIP)
+		port := args.Port
+		if port == 0 && args.Peers != nil {
+			// Peers reach us on endpoints they knew before restart.
+			// Instance falls back to a random port if it's taken
+			port = args.Peers.Port
+		}
+		newInst.PTP = ptp.New(args.Mac, args.Hash, args.Keyfile, args.Key, args.TTL, TargetURL, args.Fwd, port, OutboundIP)
 		if newInst.PTP == nil {
 			resp.Output = resp.Output + "Failed to create P2P Instance"
 			resp.ExitCode = 1
 			return errors.New("Failed to create P2P Instance")
 		}
+		if args.Identity != "" {
+			// Peers recognize us by identity of previous session
+			identity, err := ptp.LoadIdentity(args.Identity)
+			if err == nil {
+				err = newInst.PTP.SetIdentity(identity)
+			}
+			if err != nil {
+				ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to restore identity of instance %s: %s", args.Hash, err)
+			}
+		} else if args.Peers != nil && len(args.Peers.ID) == 36 && !newInst.PTP.Crypter.IsActive() {
+			// Instance was saved before identity was introduced. Peers of
+			// encrypted swarms accept only IDs derived from identity keys
+			newInst.PTP.Dht.ID = args.Peers.ID
+		}
+		if args.Invite != "" {
+			// Members accept key of the invite once they validate it
+			invite, err := ptp.DecodeInvite(args.Invite)
+			if err == nil {
+				err = newInst.PTP.SetInvite(invite)
+			}
+			if err != nil {
+				ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to use invite for instance %s: %s", args.Hash, err)
+			}
+		}
+		err := newInst.PTP.ACL.Allow(args.Allow...)
+		if err == nil {
+			err = newInst.PTP.ACL.Deny(args.Deny...)
+		}
+		if err != nil {
+			ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to restore access lists of instance %s: %s", args.Hash, err)
+		}
+		if static != nil && static.ID != "" {
+			if newInst.PTP.Crypter.IsActive() || args.Invite != "" {
+				ptp.LogWith(ptp.Warning, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Instance %s is encrypted and keeps ID %s derived from its identity instead of %s", args.Hash, newInst.PTP.Dht.ID, static.ID)
+			} else {
+				// Static peers recognize us by configured ID
+				newInst.PTP.Dht.ID = static.ID
+			}
+		}
 
-		err := bootstrap.registerInstance(newInst.ID, newInst)
+		err = bootstrap.registerInstance(newInst.ID, newInst)
 		if err != nil {
-			ptp.Log(ptp.Error, "Failed to register instance with bootstrap nodes: %s", err.Error())
+			ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to register instance with bootstrap nodes: %s", err.Error())
 			if newInst.PTP != nil {
 				newInst.PTP.Close()
 				newInst.PTP = nil
@@ -180,6 +320,10 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 		newInst.PTP.Dht.LocalPort = newInst.PTP.UDPSocket.GetPort()
 		newInst.PTP.FindNetworkAddresses()
 		err = newInst.PTP.Dht.Connect(newInst.PTP.LocalIPs, newInst.PTP.ProxyManager.GetList())
+		if err != nil && static != nil {
+			ptp.LogWith(ptp.Warning, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Instance %s is started without bootstrap nodes: %s", args.Hash, err)
+			err = nil
+		}
 		if err != nil {
 			if newInst.PTP != nil {
 				newInst.PTP.Close()
@@ -191,9 +335,27 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 			return err
 		}
 
+		if ipv6 != nil && newInst.PTP.Interface != nil {
+			newInst.PTP.Interface.SetIPv6(ipv6)
+		}
+		if trunk != nil {
+			err = trunk.AttachVLAN(uint16(args.VLAN), newInst.PTP)
+			if err != nil {
+				ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to attach VLAN %d: %s", args.VLAN, err)
+				newInst.PTP.Close()
+				newInst.PTP = nil
+				bootstrap.unregisterInstance(newInst.ID)
+				resp.Output = resp.Output + "Failed to attach VLAN: " + err.Error()
+				resp.ExitCode = 604
+				return err
+			}
+		}
+		if daemonConf != nil {
+			newInst.PTP.SetHooks(daemonConf.GetHooks(args.Hash))
+		}
 		err = newInst.PTP.PrepareInterfaces(args.IP, args.Dev)
 		if err != nil {
-			ptp.Log(ptp.Error, "Failed to configure network interface: %s", err)
+			ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to configure network interface: %s", err)
 			if newInst.PTP != nil {
 				newInst.PTP.Close()
 				newInst.PTP = nil
@@ -203,25 +365,34 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 			resp.ExitCode = 603
 			return errors.New("Failed to configure network interface")
 		}
-		go newInst.PTP.ListenInterface()
+		if trunk == nil {
+			go newInst.PTP.ListenInterface()
 
-		// Saving interface name
-		infFound := false
-		for _, inf := range InterfaceNames {
-			if inf == newInst.PTP.Interface.GetName() {
-				infFound = true
+			// Saving interface name
+			infFound := false
+			for _, inf := range InterfaceNames {
+				if inf == newInst.PTP.Interface.GetName() {
+					infFound = true
+				}
+			}
+			if !infFound && newInst.PTP.Interface.GetName() != "" {
+				InterfaceNames = append(InterfaceNames, newInst.PTP.Interface.GetName())
 			}
-		}
-		if !infFound && newInst.PTP.Interface.GetName() != "" {
-			InterfaceNames = append(InterfaceNames, newInst.PTP.Interface.GetName())
 		}
 
 		usedIPs = append(usedIPs, newInst.PTP.Interface.GetIP().String())
-		ptp.Log(ptp.Info, "Instance created")
+		ptp.LogWith(ptp.Info, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Instance created")
 		newInst.Args.LastSuccess = time.Now()
 		d.Instances.update(args.Hash, newInst)
 
 		go newInst.PTP.Run()
+		if args.Peers != nil {
+			restored := newInst.PTP.RestorePeers(args.Peers)
+			ptp.LogWith(ptp.Info, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Restored %d cached peers of instance %s", restored, args.Hash)
+		}
+		if static != nil {
+			newInst.PTP.SetStaticPeers(static.Peers)
+		}
 		resp.Output = resp.Output + "Instance created: " + args.Hash + "\n"
 	} else {
 		resp.ExitCode = 119
@@ -229,3 +400,45 @@ func (d *Daemon) run(args *RunArgs, resp *Response) error {
 	}
 	return nil
 }
+
+// saveIdentity stores identity of running instance in its save entry
+func (d *Daemon) saveIdentity(hash string) {
+	inst := d.Instances.getInstance(hash)
+	if d.Restore == nil || inst == nil || inst.PTP == nil || inst.PTP.Identity == nil {
+		return
+	}
+	d.Restore.setIdentity(hash, inst.PTP.Identity.Encode())
+}
+
+// staticSwarm returns static peers of a swarm listed in configuration
+// file of the daemon and in file passed with start command. Returns nil
+// if swarm has no static peers
+func staticSwarm(hash, file string) (*ptp.StaticSwarm, error) {
+	swarm := &ptp.StaticSwarm{Hash: hash}
+	if daemonConf != nil {
+		if conf := daemonConf.GetStaticSwarm(hash); conf != nil {
+			swarm.ID = conf.ID
+			swarm.Peers = append(swarm.Peers, conf.Peers...)
+		}
+	}
+	if file != "" {
+		loaded, err := ptp.LoadStaticSwarm(file)
+		if err != nil {
+			return nil, err
+		}
+		if loaded.ID != "" {
+			swarm.ID = loaded.ID
+		}
+		swarm.Peers = append(swarm.Peers, loaded.Peers...)
+	}
+	if len(swarm.Peers) == 0 {
+		return nil, nil
+	}
+	return swarm, swarm.Validate()
+}
+
+// isStatic returns true if swarm has static peers
+func isStatic(hash, file string) bool {
+	swarm, err := staticSwarm(hash, file)
+	return err == nil && swarm != nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func Test_staticSwarm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2p-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "static.yaml")
+	ioutil.WriteFile(file, []byte("id: 00000000-0000-0000-0000-000000000002\npeers:\n  - id: 22222222-2222-2222-2222-222222222222\n    endpoints: [5.6.7.8:6000]\n"), 0600)
+	bad := filepath.Join(dir, "bad.yaml")
+	ioutil.WriteFile(bad, []byte("peers:\n  - id: short\n"), 0600)
+
+	defer func(conf *ptp.Conf) { daemonConf = conf }(daemonConf)
+	daemonConf = &ptp.Conf{Static: []ptp.StaticSwarm{{
+		Hash:  "swarm",
+		ID:    "00000000-0000-0000-0000-000000000001",
+		Peers: []ptp.StaticPeer{{ID: "11111111-1111-1111-1111-111111111111", Endpoints: []string{"1.2.3.4:6000"}}},
+	}}}
+
+	tests := []struct {
+		name      string
+		hash      string
+		file      string
+		wantID    string
+		wantPeers int
+		wantErr   bool
+	}{
+		{"configured swarm", "swarm", "", "00000000-0000-0000-0000-000000000001", 1, false},
+		{"configured swarm and file", "swarm", file, "00000000-0000-0000-0000-000000000002", 2, false},
+		{"file only", "other", file, "00000000-0000-0000-0000-000000000002", 1, false},
+		{"no static peers", "other", "", "", 0, false},
+		{"missing file", "swarm", filepath.Join(dir, "missing"), "", 0, true},
+		{"bad peer", "swarm", bad, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := staticSwarm(tt.hash, tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("staticSwarm() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.wantPeers == 0 {
+				if got != nil || isStatic(tt.hash, tt.file) {
+					t.Errorf("staticSwarm() = %+v, want nil", got)
+				}
+				return
+			}
+			if got.ID != tt.wantID || len(got.Peers) != tt.wantPeers || !isStatic(tt.hash, tt.file) {
+				t.Errorf("staticSwarm() = %+v", got)
+			}
+		})
+	}
+}
@@ -21,10 +21,63 @@ type statusInstance struct {
 }
 
 type statusPeer struct {
-	ID        string `json:"id"`
-	IP        string `json:"ip"`
-	State     string `json:"state"`
-	LastError string `json:"lastError"`
+	ID        string         `json:"id"`
+	IP        string         `json:"ip"`
+	State     string         `json:"state"`
+	LastError string         `json:"lastError"`
+	Traffic   *statusTraffic `json:"traffic,omitempty"`
+}
+
+// statusTraffic is traffic exchanged with peer
+type statusTraffic struct {
+	BytesIn    uint64                          `json:"bytesIn"`
+	BytesOut   uint64                          `json:"bytesOut"`
+	PacketsIn  uint64                          `json:"packetsIn"`
+	PacketsOut uint64                          `json:"packetsOut"`
+	RateIn     float64                         `json:"rateIn"`  // Bytes per second
+	RateOut    float64                         `json:"rateOut"` // Bytes per second
+	Endpoints  map[string]*ptp.TrafficCounters `json:"endpoints,omitempty"`
+}
+
+func newStatusTraffic(traffic *ptp.PeerTraffic) *statusTraffic {
+	total := traffic.Total()
+	s := &statusTraffic{
+		BytesIn:    total.BytesIn,
+		BytesOut:   total.BytesOut,
+		PacketsIn:  total.PacketsIn,
+		PacketsOut: total.PacketsOut,
+		Endpoints:  make(map[string]*ptp.TrafficCounters),
+	}
+	s.RateIn, s.RateOut = traffic.Rates()
+	for _, class := range []ptp.EndpointClass{ptp.EndpointLocal, ptp.EndpointInternet, ptp.EndpointProxy, ptp.EndpointRelay} {
+		counters := traffic.Class(class)
+		if counters != (ptp.TrafficCounters{}) {
+			s.Endpoints[class.String()] = &counters
+		}
+	}
+	return s
+}
+
+// format returns human-readable traffic summary
+func (s *statusTraffic) format() string {
+	out := fmt.Sprintf("Rx:%d|Tx:%d|RxRate:%s|TxRate:%s", s.BytesIn, s.BytesOut, formatRate(s.RateIn), formatRate(s.RateOut))
+	for _, class := range []ptp.EndpointClass{ptp.EndpointLocal, ptp.EndpointInternet, ptp.EndpointProxy, ptp.EndpointRelay} {
+		if c, exists := s.Endpoints[class.String()]; exists {
+			out += fmt.Sprintf("|%s:%d/%d", class.String(), c.BytesIn, c.BytesOut)
+		}
+	}
+	return out
+}
+
+// formatRate returns rate in bytes per second with binary prefix
+func formatRate(rate float64) string {
+	units := []string{"B/s", "KiB/s", "MiB/s", "GiB/s"}
+	i := 0
+	for rate >= 1024 && i < len(units)-1 {
+		rate /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", rate, units[i])
 }
 
 // CommandStatus outputs connectivity status of each peer
@@ -57,6 +110,9 @@ func CommandStatus(restPort int, hash string) {
 					fmt.Printf("%s|", peer.ID)
 				}
 				fmt.Printf("%s|State:%s|", peer.IP, peer.State)
+				if peer.Traffic != nil {
+					fmt.Printf("%s|", peer.Traffic.format())
+				}
 				if peer.LastError != "" {
 					fmt.Printf("LastError:%s", peer.LastError)
 				}
@@ -72,6 +128,10 @@ func CommandStatus(restPort int, hash string) {
 				fmt.Printf("\t{\n")
 				fmt.Printf("\t\t\"ip\": \"%s\",\n", peer.IP)
 				fmt.Printf("\t\t\"state\": \"%s\"", peer.State)
+				if peer.Traffic != nil {
+					fmt.Printf(",\n\t\t\"rx\": %d,\n\t\t\"tx\": %d", peer.Traffic.BytesIn, peer.Traffic.BytesOut)
+					fmt.Printf(",\n\t\t\"rx_rate\": %.0f,\n\t\t\"tx_rate\": %.0f", peer.Traffic.RateIn, peer.Traffic.RateOut)
+				}
 				if peer.LastError != "" {
 					fmt.Printf(",\n")
 					fmt.Printf("\t\t\"last_error\": \"%s\"\n", peer.IP)
@@ -152,6 +212,7 @@ func (d *Daemon) Status(hash string) (*statusResponse, error) {
 				IP:        peer.PeerLocalIP.String(),
 				State:     ptp.StringifyState(peer.State),
 				LastError: peer.LastError,
+				Traffic:   newStatusTraffic(&peer.Traffic),
 			})
 		}
 		response.Instances = append(response.Instances, instance)
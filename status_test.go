@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	ptp "github.com/subutai-io/p2p/lib"
+)
+
+func Test_formatRate(t *testing.T) {
+	tests := []struct {
+		name string
+		rate float64
+		want string
+	}{
+		{"bytes", 512, "512.0B/s"},
+		{"kibibytes", 1536, "1.5KiB/s"},
+		{"mebibytes", 1024 * 1024 * 3, "3.0MiB/s"},
+		{"zero", 0, "0.0B/s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatRate(tt.rate); got != tt.want {
+				t.Errorf("formatRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_statusTraffic_format(t *testing.T) {
+	s := &statusTraffic{
+		BytesIn:  300,
+		BytesOut: 200,
+		RateIn:   2048,
+		Endpoints: map[string]*ptp.TrafficCounters{
+			"proxy": {BytesIn: 100, BytesOut: 50},
+			"local": {BytesIn: 200, BytesOut: 150},
+		},
+	}
+	want := "Rx:300|Tx:200|RxRate:2.0KiB/s|TxRate:0.0B/s|local:200/150|proxy:100/50"
+	if got := s.format(); got != want {
+		t.Errorf("statusTraffic.format() = %q, want %q", got, want)
+	}
+}
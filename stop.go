@@ -86,11 +86,11 @@ func (p *Daemon) Stop(args *DaemonArgs, resp *Response) error {
 			if p.Restore.isActive() {
 				err := p.Restore.removeEntry(args.Hash)
 				if err != nil {
-					ptp.Log(ptp.Error, err.Error())
+					ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "%s", err)
 				} else {
 					err := p.Restore.save()
 					if err != nil {
-						ptp.Log(ptp.Error, "Failed to save dump: %s", err.Error())
+						ptp.LogWith(ptp.Error, ptp.Fields{Hash: args.Hash, Subsystem: ptp.SubsystemInstance}, "Failed to save dump: %s", err.Error())
 					}
 				}
 			}